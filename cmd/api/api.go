@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/couchbase/gocb/v2"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/loyyal/loyyal-be-contract/controllers"
 	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
 	"github.com/loyyal/loyyal-be-contract/nats"
 	"github.com/loyyal/loyyal-be-contract/services"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
@@ -33,18 +35,34 @@ var (
 	server       *gin.Engine
 	queueService *nats.Client
 
-	commonController      controllers.CommonController
-	contractController    controllers.ContractController
-	authController        controllers.AuthController
-	identityController    controllers.IdentityController
-	walletController      controllers.WalletController
-	transactionController controllers.TransactionController
+	commonController         controllers.CommonController
+	contractController       controllers.ContractController
+	authController           controllers.AuthController
+	identityController       controllers.IdentityController
+	walletController         controllers.WalletController
+	transactionController    controllers.TransactionController
+	expiryController         controllers.ExpiryController
+	limitController          controllers.LimitController
+	scheduleController       controllers.ScheduleController
+	bulkController           controllers.BulkController
+	reconciliationController controllers.ReconciliationController
+	fxController             controllers.FxController
 
-	authService        services.AuthService
-	identityService    services.IdentityService
-	walletService      services.WalletService
-	transactionService services.TransactionService
-	contractService    services.ContractService
+	authService           services.AuthService
+	identityService       services.IdentityService
+	walletService         services.WalletService
+	transactionService    services.TransactionService
+	contractService       services.ContractService
+	idempotencyService    services.IdempotencyService
+	expiryService         services.ExpiryService
+	mergeService          services.MergeService
+	limitService          services.LimitService
+	scheduleService       services.ScheduleService
+	bulkService           services.BulkService
+	balanceService        services.BalanceService
+	reconciliationService services.ReconciliationService
+	fxService             services.FxService
+	contractCache         *services.ContractCache
 
 	ctx     context.Context
 	cluster *gocb.Cluster
@@ -102,7 +120,7 @@ func init() {
 	logger.Println("nats connection pending")
 
 	natsUrl := os.Getenv("NATS_CONNECTION_URL")
-	queueService, err := nats.NewClient(natsUrl)
+	queueService, err = nats.NewClient(natsUrl)
 	if err != nil {
 		logger.Fatalf("error initializing NATS connection: %v", err)
 	}
@@ -114,12 +132,38 @@ func init() {
 	walletService = services.NewWallet(cluster, bucket)
 	transactionService = services.NewTransaction(cluster, bucket)
 	contractService = services.NewContract(cluster, bucket)
+	expiryService = services.NewExpiry(cluster, bucket)
+	mergeService = services.NewMerge(cluster, bucket)
+	limitService = services.NewLimit(cluster, bucket)
+	scheduleService = services.NewSchedule(cluster, bucket)
+	bulkService = services.NewBulk(cluster, bucket)
+	balanceService = services.NewBalance(cluster, bucket)
+	reconciliationService = services.NewReconciliation(cluster, bucket)
+	fxService = services.NewFx(cluster, bucket)
+	contractCache = services.NewContractCache(contractService)
+
+	// idempotency keys are retained for the configured hours, defaults to a day
+	idempotencyRetention, _ := strconv.Atoi(os.Getenv("IDEMPOTENCY_KEY_RETENTION"))
+	idempotencyService = services.NewIdempotency(cluster, bucket, time.Duration(idempotencyRetention)*time.Hour)
 
 	authController = controllers.NewAuthController(identityService)
 	identityController = controllers.NewIdentityController(logger, identityService, walletService, queueService)
-	walletController = controllers.NewWallet(walletService, transactionService, queueService)
-	transactionController = controllers.NewTransactionController(logger, transactionService, contractService, walletService, queueService)
-	contractController = controllers.NewContractController(contractService)
+	// minutes without progress after which a merge is resumed, defaults to 10
+	mergeStaleAfter, _ := strconv.Atoi(os.Getenv("MERGE_STALE_AFTER"))
+	walletController = controllers.NewWallet(walletService, transactionService, expiryService, mergeService, identityService, balanceService, idempotencyService, queueService, time.Duration(mergeStaleAfter)*time.Minute)
+	transactionController = controllers.NewTransactionController(logger, transactionService, contractService, contractCache, walletService, identityService, expiryService, limitService, idempotencyService, fxService, queueService)
+	contractController = controllers.NewContractController(contractService, identityService, contractCache, queueService)
+	expiryController = controllers.NewExpiryController(expiryService)
+	limitController = controllers.NewLimitController(limitService)
+	fxController = controllers.NewFxController(fxService)
+	scheduleController = controllers.NewScheduleController(scheduleService, &transactionController)
+
+	// rows of a bulk job posted at the same time, defaults to 8
+	bulkConcurrency, _ := strconv.Atoi(os.Getenv("BULK_CONCURRENCY"))
+	// minutes without progress after which a bulk job is resumed, defaults to 10
+	bulkStaleAfter, _ := strconv.Atoi(os.Getenv("BULK_STALE_AFTER"))
+	bulkController = controllers.NewBulkController(bulkService, &transactionController, bulkConcurrency, time.Duration(bulkStaleAfter)*time.Minute)
+	reconciliationController = controllers.NewReconciliationController(reconciliationService, walletService, &transactionController, queueService)
 
 	// create bootstrap identity
 	err = identityService.CreateBootstrapIdentity(ctx, bootstrap_username, bootstrap_password)
@@ -161,10 +205,42 @@ func JaegerTraceProvider() (*sdktrace.TracerProvider, error) {
 	return tp, nil
 
 }
+
+// runPeriodically runs the job on every tick of the interval, it is used for the
+// background jobs of the api such as the expiry of the points
+func runPeriodically(ctx context.Context, name string, interval time.Duration, job func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job(ctx); err != nil {
+				logger.Printf("%s job failed: %v", name, err)
+			}
+		}
+	}
+}
+
 func main() {
 	logger.Println("starting...")
 	defer cluster.Close(nil)
 
+	// reconciliation repair actions are only proposed when asked to
+	openRepairs := os.Getenv("RECONCILIATION_OPEN_REPAIRS") == "true"
+
+	// `api reconcile` runs a single reconciliation and exits
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		report, err := reconciliationController.Run(ctx, "system", openRepairs)
+		if err != nil {
+			logger.Fatalf("reconciliation %s failed: %v", report.Identifier, err)
+		}
+		logger.Printf("reconciliation %s completed: %d wallets, %d transactions checked, mismatches %v", report.Identifier, report.WalletsChecked, report.TransactionsChecked, report.Counts)
+		return
+	}
+
 	server.Use(middleware.CORSMiddleware())
 	server.Use(otelgin.Middleware("api"))
 
@@ -175,5 +251,93 @@ func main() {
 	walletController.WalletRoutes(basepath)
 	transactionController.TransactionRoutes(basepath)
 	contractController.ContractRoutes(basepath)
+	expiryController.ExpiryRoutes(basepath)
+	limitController.LimitRoutes(basepath)
+	scheduleController.ScheduleRoutes(basepath)
+	bulkController.BulkRoutes(basepath)
+	reconciliationController.ReconciliationRoutes(basepath)
+	fxController.FxRoutes(basepath)
+
+	// chaincode callbacks, committing or rejecting the published transactions
+	for _, topic := range []string{models.TopicIssue, models.TopicBurn, models.TopicTransfer} {
+		if _, err := queueService.Subscribe(models.CallbackSubject(topic), transactionController.HandleTransactionResult); err != nil {
+			logger.Fatalf("nats subscription errors: %v", err)
+		}
+	}
+
+	// contract changes made on any replica are reloaded into the cache, lookups
+	// query the database until the first resync succeeds
+	if _, err := queueService.Subscribe(models.TopicContractChanged+".*", contractCache.HandleChange); err != nil {
+		logger.Fatalf("nats subscription errors: %v", err)
+	}
+	if err := contractCache.Resync(ctx); err != nil {
+		logger.Printf("contract cache resync failed: %v", err)
+	}
+
+	// background jobs, the interval is configured in minutes
+	expiryInterval, _ := strconv.Atoi(os.Getenv("EXPIRY_JOB_INTERVAL"))
+	if expiryInterval > 0 {
+		go runPeriodically(ctx, "expiry", time.Duration(expiryInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := transactionController.ExpireLapsedLots(ctx)
+			return err
+		})
+	}
+
+	schedulerInterval, _ := strconv.Atoi(os.Getenv("SCHEDULER_JOB_INTERVAL"))
+	if schedulerInterval > 0 {
+		go runPeriodically(ctx, "scheduler", time.Duration(schedulerInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := scheduleController.RunDueSchedules(ctx)
+			return err
+		})
+	}
+
+	snapshotInterval, _ := strconv.Atoi(os.Getenv("BALANCE_SNAPSHOT_JOB_INTERVAL"))
+	if snapshotInterval > 0 {
+		go runPeriodically(ctx, "balance snapshot", time.Duration(snapshotInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := balanceService.SnapshotSettledDays(ctx)
+			return err
+		})
+	}
+
+	reconciliationInterval, _ := strconv.Atoi(os.Getenv("RECONCILIATION_JOB_INTERVAL"))
+	if reconciliationInterval > 0 {
+		go runPeriodically(ctx, "reconciliation", time.Duration(reconciliationInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := reconciliationController.Run(ctx, "system", openRepairs)
+			return err
+		})
+	}
+
+	lifecycleInterval, _ := strconv.Atoi(os.Getenv("CONTRACT_LIFECYCLE_JOB_INTERVAL"))
+	if lifecycleInterval > 0 {
+		go runPeriodically(ctx, "contract lifecycle", time.Duration(lifecycleInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := contractController.RunLifecycle(ctx)
+			return err
+		})
+	}
+
+	// bulk jobs left unfinished by a stopped replica are resumed
+	bulkResumeInterval, _ := strconv.Atoi(os.Getenv("BULK_RESUME_JOB_INTERVAL"))
+	if bulkResumeInterval > 0 {
+		go runPeriodically(ctx, "bulk resume", time.Duration(bulkResumeInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := bulkController.ResumeJobs(ctx)
+			return err
+		})
+	}
+
+	// merges and rollbacks left running by a stopped replica are resumed
+	mergeResumeInterval, _ := strconv.Atoi(os.Getenv("MERGE_RESUME_JOB_INTERVAL"))
+	if mergeResumeInterval > 0 {
+		go runPeriodically(ctx, "merge resume", time.Duration(mergeResumeInterval)*time.Minute, func(ctx context.Context) error {
+			_, err := walletController.ResumeMerges(ctx)
+			return err
+		})
+	}
+
+	// a full reload catches the changes whose events were missed
+	cacheResyncInterval, _ := strconv.Atoi(os.Getenv("CONTRACT_CACHE_RESYNC_INTERVAL"))
+	if cacheResyncInterval > 0 {
+		go runPeriodically(ctx, "contract cache resync", time.Duration(cacheResyncInterval)*time.Minute, contractCache.Resync)
+	}
+
 	server.Run()
 }
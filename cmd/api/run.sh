@@ -15,6 +15,30 @@ export JWT_SECRET_KEY=wKe53gwBst34y93
 export JWT_SECRET_ISSUER=auth.loyyal.net
 export JWT_TOKEN_VALIDITY=1
 
+# IDEMPOTENCY (retention of idempotency keys in hours)
+export IDEMPOTENCY_KEY_RETENTION=24
+
+# JOBS (intervals in minutes, 0 disables the job)
+export EXPIRY_JOB_INTERVAL=60
+export SCHEDULER_JOB_INTERVAL=1
+export BALANCE_SNAPSHOT_JOB_INTERVAL=60
+export RECONCILIATION_JOB_INTERVAL=1440
+export CONTRACT_LIFECYCLE_JOB_INTERVAL=5
+export CONTRACT_CACHE_RESYNC_INTERVAL=5
+export BULK_RESUME_JOB_INTERVAL=5
+export MERGE_RESUME_JOB_INTERVAL=5
+
+# RECONCILIATION (propose repair actions for the mismatches found)
+export RECONCILIATION_OPEN_REPAIRS=false
+
+# BULK (rows of a bulk upload posted at the same time, minutes without progress
+# after which a job is resumed)
+export BULK_CONCURRENCY=8
+export BULK_STALE_AFTER=10
+
+# MERGE (minutes without progress after which a merge or its rollback is resumed)
+export MERGE_STALE_AFTER=10
+
 # NATS
 
 
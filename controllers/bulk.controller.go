@@ -0,0 +1,544 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type BulkController struct {
+	BulkService  services.BulkService
+	Transactions *TransactionController
+	// rows of a job processed at the same time
+	Concurrency int
+	// a job whose progress was not stored for this long is resumed by another process
+	StaleAfter time.Duration
+}
+
+// constructor calling
+func NewBulkController(service services.BulkService, transactions *TransactionController, concurrency int, staleAfter time.Duration) BulkController {
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	if staleAfter <= 0 {
+		staleAfter = 10 * time.Minute
+	}
+	return BulkController{
+		BulkService:  service,
+		Transactions: transactions,
+		Concurrency:  concurrency,
+		StaleAfter:   staleAfter,
+	}
+}
+
+// BulkValidation is the outcome of the validation of an uploaded bulk file
+type BulkValidation struct {
+	Total int64 `json:"total"`
+	Valid int64 `json:"valid"`
+	// Duplicates are valid rows whose reference was posted before, they are
+	// skipped when the file is processed
+	Duplicates int64                 `json:"duplicates"`
+	Errors     []models.BulkRowError `json:"errors"`
+}
+
+const (
+	// the job counters are stored after this many rows or this much time
+	bulk_progress_rows     = 50
+	bulk_progress_interval = 2 * time.Second
+)
+
+var (
+	ERR_BULK_NOT_ALLOWED      = errors.New("error: bulk uploads are not available to consumers")
+	ERR_BULK_INVALID_ROWS     = errors.New("error: bulk file has invalid rows, upload it with dryRun for the row errors")
+	ERR_BULK_REFERENCE_REUSED = errors.New("error: reference is already used for a different transaction")
+	ERR_NOT_BULK_JOB_CREATOR  = errors.New("error: only the creator of the bulk job can see it")
+)
+
+func (controller *BulkController) bulkUpload(ctx *gin.Context) {
+	fName := "controller/bulk/upload"
+	tracer := otel.Tracer("bulkUpload")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) == "consumer" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_BULK_NOT_ALLOWED.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_USERNAME)))
+		return
+	}
+
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: bulk file is required", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// the format defaults to the extension of the file
+	format := strings.ToLower(ctx.PostForm("format"))
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(file.Filename)), ".")
+		if format == "ndjson" {
+			format = services.BULK_FORMAT_JSONL
+		}
+	}
+
+	dryRun := false
+	if value := ctx.PostForm("dryRun"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: dryRun must be true or false", fmt.Sprintf("got :%s ", value))
+			return
+		}
+	}
+
+	span.SetAttributes(attribute.String("File", file.Filename))
+	span.SetAttributes(attribute.String("Format", format))
+	span.SetAttributes(attribute.Bool("Dry Run", dryRun))
+
+	reader, err := file.Open()
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: bulk file can not be read", fmt.Sprintf("got :%s ", err))
+		return
+	}
+	defer reader.Close()
+
+	rows, rowErrors, err := services.ParseBulkFile(reader, format)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	rows, walletErrors := controller.validateWallets(ctx.Request.Context(), rows)
+	rowErrors = append(rowErrors, walletErrors...)
+	sort.Slice(rowErrors, func(i, j int) bool { return rowErrors[i].Line < rowErrors[j].Line })
+
+	if dryRun {
+		validation := BulkValidation{
+			Total:  int64(len(rows) + len(rowErrors)),
+			Valid:  int64(len(rows)),
+			Errors: rowErrors,
+		}
+		creator := ctx.GetString(token.SESSION_USERNAME)
+		for _, row := range rows {
+			if _, err := controller.Transactions.TransactionService.Get(ctx.Request.Context(), bulkTransactionId(creator, row.Reference)); err == nil {
+				validation.Duplicates++
+			}
+		}
+		common.PrepareCustomResponse(ctx, "bulk file validated", validation)
+		return
+	}
+
+	// a file is processed only when all of its rows are valid
+	if len(rowErrors) > 0 {
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, ERR_BULK_INVALID_ROWS.Error(), fmt.Sprintf("got :%d invalid rows", len(rowErrors)))
+		return
+	}
+
+	job := models.BulkJob{
+		FileName: file.Filename,
+		Format:   format,
+		Total:    int64(len(rows)),
+	}
+	identifier, err := controller.BulkService.CreateJob(ctx.Request.Context(), &job, rows, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	go controller.processJob(job, rows)
+	common.PrepareCustomResponse(ctx, "bulk job queued", struct {
+		Identifier string `json:"identifier"`
+		Total      int64  `json:"total"`
+	}{Identifier: identifier, Total: job.Total})
+}
+
+// validateWallets checks that the wallets of the rows exist and may send or
+// receive points, each wallet is loaded once per file
+func (controller *BulkController) validateWallets(ctx context.Context, rows []models.BulkRow) ([]models.BulkRow, []models.BulkRowError) {
+	checked := map[string]error{}
+	check := func(walletId string, outbound bool) error {
+		key := walletId + "/in"
+		if outbound {
+			key = walletId + "/out"
+		}
+		if err, ok := checked[key]; ok {
+			return err
+		}
+		_, err := controller.Transactions.transactingWallet(ctx, walletId, outbound)
+		checked[key] = err
+		return err
+	}
+
+	valid := []models.BulkRow{}
+	rowErrors := []models.BulkRowError{}
+	for _, row := range rows {
+		err := check(row.From, true)
+		if err == nil {
+			err = check(row.To, false)
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: row.Line, Reference: row.Reference, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, row)
+	}
+	return valid, rowErrors
+}
+
+// ResumeJobs takes over the jobs left unfinished by a process that stopped, the
+// rows without a stored result are posted again. It returns the resumed jobs.
+func (controller *BulkController) ResumeJobs(ctx context.Context) (int, error) {
+	fName := "controller/bulk/resumeJobs"
+	tracer := otel.Tracer("api")
+	ctx, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	staleBefore := time.Now().UTC().Add(-controller.StaleAfter)
+	jobs, err := controller.BulkService.FilterJobs(ctx, " AND status IN $statuses AND STR_TO_MILLIS(lastUpdatedAt) < STR_TO_MILLIS($before)", map[string]interface{}{
+		"statuses": []string{services.BULK_JOB_QUEUED, services.BULK_JOB_PROCESSING},
+		"before":   staleBefore.Format(time.RFC3339Nano),
+	}, "createdAt", -1)
+	if err != nil {
+		return 0, err
+	}
+
+	resumed := 0
+	for _, stale := range jobs {
+		job, err := controller.BulkService.ClaimJob(ctx, stale.Identifier, staleBefore)
+		if errors.Is(err, services.ERR_BULK_JOB_NOT_STALE) {
+			continue
+		}
+		if err != nil {
+			return resumed, err
+		}
+
+		rows, err := controller.BulkService.Input(ctx, job.Identifier)
+		if err != nil {
+			return resumed, err
+		}
+		results, err := controller.BulkService.Rows(ctx, job.Identifier, "")
+		if err != nil {
+			return resumed, err
+		}
+
+		// the counters are rebuilt from the stored results, the progress saved
+		// last may be behind them
+		done := map[int64]bool{}
+		job.Processed, job.Succeeded, job.Failed, job.Duplicates = 0, 0, 0, 0
+		for _, result := range results {
+			done[result.Line] = true
+			countResult(&job, result.Status)
+		}
+		remaining := []models.BulkRow{}
+		for _, row := range rows {
+			if !done[row.Line] {
+				remaining = append(remaining, row)
+			}
+		}
+
+		go controller.processJob(job, remaining)
+		resumed++
+	}
+
+	span.SetAttributes(attribute.Int("resumed", resumed))
+	return resumed, nil
+}
+
+// processJob posts the rows of the job with a limited number of rows in flight,
+// the results are stored and counted by this goroutine alone
+func (controller *BulkController) processJob(job models.BulkJob, rows []models.BulkRow) {
+	fName := "controller/bulk/processJob"
+	tracer := otel.Tracer("api")
+	ctx, span := tracer.Start(context.Background(), fName)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("Job", job.Identifier))
+
+	job.Status = services.BULK_JOB_PROCESSING
+	if job.StartedAt == nil {
+		startedAt := time.Now().UTC()
+		job.StartedAt = &startedAt
+	}
+	if err := controller.BulkService.SaveProgress(ctx, &job); err != nil {
+		fmt.Printf("failed to start bulk job %s: %v", job.Identifier, err)
+	}
+
+	pending := make(chan models.BulkRow)
+	results := make(chan models.BulkRowResult)
+	jobId, creator := job.Identifier, job.Creator
+	for worker := 0; worker < controller.Concurrency; worker++ {
+		go func() {
+			for row := range pending {
+				results <- controller.processRow(ctx, jobId, creator, row)
+			}
+		}()
+	}
+	go func() {
+		for _, row := range rows {
+			pending <- row
+		}
+		close(pending)
+	}()
+
+	lastSaved := time.Now()
+	for i := 0; i < len(rows); i++ {
+		result := <-results
+		if err := controller.BulkService.SaveRowResult(ctx, &result); err != nil {
+			fmt.Printf("failed to store the result of line %d of bulk job %s: %v", result.Line, job.Identifier, err)
+		}
+
+		countResult(&job, result.Status)
+
+		if job.Processed%bulk_progress_rows == 0 || time.Since(lastSaved) > bulk_progress_interval {
+			if err := controller.BulkService.SaveProgress(ctx, &job); err != nil {
+				fmt.Printf("failed to store the progress of bulk job %s: %v", job.Identifier, err)
+			}
+			lastSaved = time.Now()
+		}
+	}
+
+	completedAt := time.Now().UTC()
+	job.CompletedAt = &completedAt
+	job.Status = services.BULK_JOB_COMPLETED
+	if job.Failed > 0 {
+		job.Status = services.BULK_JOB_COMPLETED_WITH_ERRORS
+	}
+	if err := controller.BulkService.SaveProgress(ctx, &job); err != nil {
+		fmt.Printf("failed to complete bulk job %s: %v", job.Identifier, err)
+		return
+	}
+	if err := controller.BulkService.DeleteInput(ctx, job.Identifier); err != nil {
+		fmt.Printf("failed to delete the rows of bulk job %s: %v", job.Identifier, err)
+	}
+}
+
+// countResult adds the outcome of a row to the counters of the job
+func countResult(job *models.BulkJob, status string) {
+	job.Processed++
+	switch status {
+	case services.BULK_ROW_SUCCEEDED:
+		job.Succeeded++
+	case services.BULK_ROW_DUPLICATE:
+		job.Duplicates++
+	default:
+		job.Failed++
+	}
+}
+
+// processRow posts one row, the transaction id is derived from the reference so
+// that a row uploaded again is recognised and not posted twice
+func (controller *BulkController) processRow(ctx context.Context, jobId string, creator string, row models.BulkRow) models.BulkRowResult {
+	result := models.BulkRowResult{
+		JobId:           jobId,
+		Line:            row.Line,
+		Reference:       row.Reference,
+		TransactionType: row.TransactionType,
+		Amount:          row.Amount,
+		TransactionId:   bulkTransactionId(creator, row.Reference),
+	}
+
+	transactionType := row.TransactionType
+	if transactionType == services.BULK_ROW_EARN {
+		transactionType = services.TRANSACTION_TYPE_ISSUE
+	}
+
+	existing, err := controller.Transactions.TransactionService.Get(ctx, result.TransactionId)
+	if err == nil {
+		result.Status = services.BULK_ROW_DUPLICATE
+		if existing.TransactionType != transactionType || existing.FromExtID != row.From || existing.ToExtID != row.To || existing.OriginalAmount != row.Amount {
+			result.Status = services.BULK_ROW_FAILED
+			result.Error = ERR_BULK_REFERENCE_REUSED.Error()
+		}
+		result.ProcessedAt = time.Now().UTC()
+		return result
+	}
+
+	input := TransactionInput{
+		ExternalId:             result.TransactionId,
+		From:                   row.From,
+		To:                     row.To,
+		Amount:                 row.Amount,
+		Metadata:               row.Metadata,
+		TransactionInitiatedBy: row.TransactionInitiatedBy,
+	}
+	_, err = controller.Transactions.Submit(ctx, transactionType, input, fmt.Sprintf("bulk job %s line %d", jobId, row.Line))
+	result.ProcessedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		result.Status = services.BULK_ROW_SUCCEEDED
+	case errors.Is(err, gocb.ErrDocumentExists):
+		// the same reference was posted by another upload in the meantime
+		result.Status = services.BULK_ROW_DUPLICATE
+	default:
+		result.Status = services.BULK_ROW_FAILED
+		result.TransactionId = ""
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// bulkTransactionId is the id of the transaction of a row, references are
+// unique for the partner uploading the file
+func bulkTransactionId(creator string, reference string) string {
+	sum := sha256.Sum256([]byte(creator + "/" + reference))
+	return "bulk_" + hex.EncodeToString(sum[:20])
+}
+
+// authorizeJob loads the job when the caller created it or is an admin
+func (controller *BulkController) authorizeJob(ctx *gin.Context, jobId string) (models.BulkJob, error) {
+	job, err := controller.BulkService.GetJob(ctx.Request.Context(), jobId)
+	if err != nil {
+		return job, err
+	}
+	if ctx.GetString(token.SESSION_ROLE) != "admin" && job.Creator != ctx.GetString(token.SESSION_USERNAME) {
+		return job, ERR_NOT_BULK_JOB_CREATOR
+	}
+	return job, nil
+}
+
+func (controller *BulkController) bulkJobGet(ctx *gin.Context) {
+	fName := "controller/bulk/jobGet"
+	tracer := otel.Tracer("bulkJobGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	jobId := ctx.Query("jobId")
+	if jobId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: job id is required", fmt.Sprintf("got :%s ", jobId))
+		return
+	}
+
+	job, err := controller.authorizeJob(ctx, jobId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "bulk job fetched", job)
+}
+
+func (controller *BulkController) bulkJobRows(ctx *gin.Context) {
+	fName := "controller/bulk/jobRows"
+	tracer := otel.Tracer("bulkJobRows")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	jobId := ctx.Query("jobId")
+	if jobId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: job id is required", fmt.Sprintf("got :%s ", jobId))
+		return
+	}
+
+	if _, err := controller.authorizeJob(ctx, jobId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	rows, err := controller.BulkService.Rows(ctx.Request.Context(), jobId, ctx.Query("status"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "bulk job rows fetched", rows)
+}
+
+// bulkJobErrors downloads the failed rows of the job as a csv report
+func (controller *BulkController) bulkJobErrors(ctx *gin.Context) {
+	fName := "controller/bulk/jobErrors"
+	tracer := otel.Tracer("bulkJobErrors")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	jobId := ctx.Query("jobId")
+	if jobId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: job id is required", fmt.Sprintf("got :%s ", jobId))
+		return
+	}
+
+	if _, err := controller.authorizeJob(ctx, jobId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	rows, err := controller.BulkService.Rows(ctx.Request.Context(), jobId, services.BULK_ROW_FAILED)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	ctx.Header("Content-Type", "text/csv")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "bulk_"+jobId+"_errors.csv"))
+	ctx.Status(http.StatusOK)
+
+	writer := csv.NewWriter(ctx.Writer)
+	writer.Write([]string{"line", "reference", "type", "amount", "error"})
+	for _, row := range rows {
+		writer.Write([]string{strconv.FormatInt(row.Line, 10), row.Reference, row.TransactionType, strconv.FormatInt(row.Amount, 10), row.Error})
+	}
+	writer.Flush()
+}
+
+func (controller *BulkController) bulkFilter(ctx *gin.Context) {
+	fName := "controller/bulk/filter"
+	tracer := otel.Tracer("bulkFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		Status string `json:"status"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := ""
+	// partners only see the files they have uploaded themselves
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		queryString += " AND creator=$creator"
+	}
+	if input.Status != "" {
+		queryString += " AND status=$status"
+	}
+
+	jobs, err := controller.BulkService.FilterJobs(ctx.Request.Context(), queryString, map[string]interface{}{
+		"creator": ctx.GetString(token.SESSION_USERNAME),
+		"status":  input.Status,
+	}, "createdAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "bulk jobs filtered", jobs)
+}
+
+func (controller *BulkController) BulkRoutes(group *gin.RouterGroup) {
+	bulkRoute := group.Group("/bulk")
+
+	bulkRoute.Use(middleware.JWTAuthMiddleware())
+
+	bulkRoute.POST("/upload", controller.bulkUpload)
+	bulkRoute.POST("/filter", controller.bulkFilter)
+	bulkRoute.GET("/job", controller.bulkJobGet)
+	bulkRoute.GET("/job/rows", controller.bulkJobRows)
+	bulkRoute.GET("/job/errors", controller.bulkJobErrors)
+}
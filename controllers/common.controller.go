@@ -1,8 +1,15 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/export"
 )
 
 type CommonController struct {
@@ -16,6 +23,42 @@ func (controller *CommonController) HealtCheck(ctx *gin.Context) {
 	common.PrepareCustomResponse(ctx, "success", nil)
 }
 
+// newExportWriter reads the export options of the request: the format
+// (ndjson or csv), the comma separated columns and gzip, which is also used
+// when the client accepts it
+func newExportWriter(ctx *gin.Context, available []string, fileName string) (*export.Writer, error) {
+	columns, err := export.Columns(ctx.Query("columns"), available)
+	if err != nil {
+		return nil, err
+	}
+
+	compress := strings.Contains(ctx.GetHeader("Accept-Encoding"), "gzip")
+	if value := ctx.Query("gzip"); value != "" {
+		compress, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("error: gzip must be true or false")
+		}
+	}
+
+	return export.NewWriter(ctx.Writer, strings.ToLower(ctx.Query("format")), columns, fileName, compress)
+}
+
+// finishExport ends the stream of an export, an error before the first row is
+// answered as usual while a later one cuts the stream short and is reported in
+// the X-Export-Error trailer
+func finishExport(ctx *gin.Context, fName string, writer *export.Writer, exportErr error) {
+	if exportErr != nil && !writer.Started() {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, exportErr.Error(), fmt.Sprintf("got :%s ", exportErr))
+		return
+	}
+	if exportErr != nil {
+		fmt.Printf("export %s failed after %d rows: %v", fName, writer.Rows(), exportErr)
+	}
+	if err := writer.Close(exportErr); err != nil {
+		fmt.Printf("export %s could not be completed: %v", fName, err)
+	}
+}
+
 func (controller *CommonController) CommonRoutes(group *gin.RouterGroup) {
 	commonRoute := group.Group("/common")
 
@@ -1,30 +1,76 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/loyyal/loyyal-be-contract/middleware"
 	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/nats"
 	"github.com/loyyal/loyyal-be-contract/services"
 	"github.com/loyyal/loyyal-be-contract/utils/common"
 	"github.com/loyyal/loyyal-be-contract/utils/notification"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
 	"go.opentelemetry.io/otel"
 )
 
 type ContractController struct {
 	ContractService services.ContractService
+	IdentityService services.IdentityService
+	ContractCache   *services.ContractCache
+	Nats            *nats.Client
 }
 
 // constructor calling
-func NewContractController(service services.ContractService) ContractController {
+func NewContractController(service services.ContractService, identityService services.IdentityService, contractCache *services.ContractCache, nats *nats.Client) ContractController {
 	return ContractController{
 		ContractService: service,
+		IdentityService: identityService,
+		ContractCache:   contractCache,
+		Nats:            nats,
 	}
 }
 
+type ContractDecisionInput struct {
+	Identifier string `json:"identifier" binding:"required"`
+	Comment    string `json:"comment"`
+}
+
+var (
+	ERR_CONTRACT_OPERATOR = errors.New("error: contract operator must be an operator identity")
+	ERR_CONTRACT_PARTNER  = errors.New("error: contract partner must be a partner identity")
+)
+
+// validateContract checks the type and the pricing of the contract and that it
+// is made for an operator and a partner known as such
+func (controller *ContractController) validateContract(ctx context.Context, contract *models.Contract) error {
+	if !services.IsContractType(contract.ContractType) {
+		return services.ERR_CONTRACT_TYPE
+	}
+	if err := services.ValidatePricing(contract); err != nil {
+		return err
+	}
+
+	operator, err := controller.IdentityService.Get(ctx, string(contract.OperatorId))
+	if err != nil || operator.IdentityType != "operator" {
+		return ERR_CONTRACT_OPERATOR
+	}
+	if contract.PartnerId != "" {
+		partner, err := controller.IdentityService.Get(ctx, string(contract.PartnerId))
+		if err != nil || partner.IdentityType != "partner" {
+			return ERR_CONTRACT_PARTNER
+		}
+	}
+	return nil
+}
+
 func (controller *ContractController) ContractCreate(ctx *gin.Context) {
 	fName := "controllers/ContractCreate"
 	tracer := otel.Tracer(fName)
@@ -43,14 +89,19 @@ func (controller *ContractController) ContractCreate(ctx *gin.Context) {
 	validUpto, _ := time.Parse(time.RFC1123, contract.ValidUntill.In(location).Format(time.RFC1123))
 
 	if validFrom.Unix() < currenTimestamp.Unix() || validUpto.Unix() < currenTimestamp.Unix() {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: previous date contract can not be created", fmt.Sprintf("previous date contract can not be created. got from: %d and untill :%d ", contract.ValidFrom, contract.ValidUntill))
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: previous date contract can not be created", fmt.Sprintf("previous date contract can not be created. got from: %s and untill :%s ", contract.ValidFrom, contract.ValidUntill))
 		return
 	}
 
 	contract.ValidFrom = validFrom
 	contract.ValidUntill = validUpto
 
-	identifier, err := controller.ContractService.CreateContract(ctx.Request.Context(), &contract, "admin", "loyyalchannel")
+	if err := controller.validateContract(ctx.Request.Context(), &contract); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	identifier, err := controller.ContractService.CreateContract(ctx.Request.Context(), &contract, ctx.GetString(token.SESSION_USERNAME), "loyyalchannel")
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{
 			"message": err.Error(),
@@ -59,6 +110,9 @@ func (controller *ContractController) ContractCreate(ctx *gin.Context) {
 		return
 	}
 
+	controller.publishChange(ctx.Request.Context(), &contract, services.CONTRACT_CHANGE_CREATED)
+
+	// the contract is a draft until its operator and partner approve it
 	common.PrepareCustomResponse(ctx, "contract created successfully", struct {
 		Identifier string `json:"identifier"`
 	}{Identifier: identifier})
@@ -72,7 +126,9 @@ func (controller *ContractController) ContractGet(ctx *gin.Context) {
 		return
 	}
 
-	contract, err := controller.ContractService.GetContract(ctx.Request.Context(), contractId)
+	// a version gives the contract as it was at that version
+	version, _ := strconv.ParseInt(ctx.Query("version"), 10, 64)
+	contract, err := controller.ContractService.GetContractVersion(ctx.Request.Context(), contractId, version)
 	if err != nil {
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err.Error()))
 		return
@@ -85,6 +141,205 @@ func (controller *ContractController) ContractGet(ctx *gin.Context) {
 	common.PrepareCustomResponse(ctx, "contract fetched", nil)
 }
 
+// ContractUpdate changes the fields given in the body, the other fields of the
+// contract are kept. Every update is stored as a new version, the update of an
+// approved contract is staged as its proposal until the parties approve it.
+func (controller *ContractController) ContractUpdate(ctx *gin.Context) {
+	fName := "controllers/ContractUpdate"
+	tracer := otel.Tracer("ContractUpdate")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	body, err := ctx.GetRawData()
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got %s ", err.Error()))
+		return
+	}
+	var input struct {
+		Identifier string `json:"identifier"`
+	}
+	if err := json.Unmarshal(body, &input); err != nil || input.Identifier == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: contract identifier is required", fmt.Sprintf("got %s ", input.Identifier))
+		return
+	}
+
+	location, _ := time.LoadLocation("UTC")
+	currenTimestamp, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+
+	contract, err := controller.ContractService.UpdateContract(ctx.Request.Context(), input.Identifier, ctx.GetString(token.SESSION_USERNAME), func(contract *models.Contract) error {
+		validUntill := contract.ValidUntill
+		if err := json.Unmarshal(body, contract); err != nil {
+			return err
+		}
+		if err := binding.Validator.ValidateStruct(contract); err != nil {
+			return err
+		}
+
+		contract.ValidFrom, _ = time.Parse(time.RFC1123, contract.ValidFrom.In(location).Format(time.RFC1123))
+		contract.ValidUntill, _ = time.Parse(time.RFC1123, contract.ValidUntill.In(location).Format(time.RFC1123))
+		if !contract.ValidUntill.After(contract.ValidFrom) {
+			return errors.New("error: contract validity must end after it starts")
+		}
+		if !contract.ValidUntill.Equal(validUntill) && contract.ValidUntill.Unix() < currenTimestamp.Unix() {
+			return errors.New("error: contract validity can not be moved to a previous date")
+		}
+		return controller.validateContract(ctx.Request.Context(), contract)
+	})
+	if errors.Is(err, services.ERR_CONTRACT_NOT_FOUND) {
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", input.Identifier))
+		return
+	}
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	controller.publishChange(ctx.Request.Context(), &contract, services.CONTRACT_CHANGE_UPDATED)
+	common.PrepareCustomResponse(ctx, "contract updated", contract)
+}
+
+// ContractHistory lists every version of the contract with what changed
+func (controller *ContractController) ContractHistory(ctx *gin.Context) {
+	fName := "controllers/ContractHistory"
+	tracer := otel.Tracer("ContractHistory")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	contractId := ctx.Query("contractId")
+	if contractId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: contract id is required", fmt.Sprintf("got :%s ", contractId))
+		return
+	}
+
+	if _, err := controller.ContractService.GetContract(ctx.Request.Context(), contractId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", err.Error()))
+		return
+	}
+
+	versions, err := controller.ContractService.History(ctx.Request.Context(), contractId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "contract history", versions)
+}
+
+// ContractBudget tells how much of the budget of the contract is consumed, and
+// of the cap of the member when one is given
+func (controller *ContractController) ContractBudget(ctx *gin.Context) {
+	fName := "controllers/ContractBudget"
+	tracer := otel.Tracer("ContractBudget")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	contractId := ctx.Query("contractId")
+	if contractId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: contract id is required", fmt.Sprintf("got :%s ", contractId))
+		return
+	}
+
+	contract, err := controller.ContractService.GetContract(ctx.Request.Context(), contractId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", err.Error()))
+		return
+	}
+
+	usage, err := controller.ContractService.BudgetUsage(ctx.Request.Context(), &contract, ctx.Query("memberId"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "contract budget", usage)
+}
+
+// ContractApprove records the approval of the contract by the operator or the
+// partner signed in
+func (controller *ContractController) ContractApprove(ctx *gin.Context) {
+	controller.decide(ctx, "controllers/ContractApprove", services.CONTRACT_DECISION_APPROVED)
+}
+
+// ContractReject records the rejection of the contract by the operator or the
+// partner signed in
+func (controller *ContractController) ContractReject(ctx *gin.Context) {
+	controller.decide(ctx, "controllers/ContractReject", services.CONTRACT_DECISION_REJECTED)
+}
+
+func (controller *ContractController) decide(ctx *gin.Context, fName string, decision string) {
+	tracer := otel.Tracer(fName)
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input ContractDecisionInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got %s ", err.Error()))
+		return
+	}
+
+	// the party is the identity signed in, as operator or as partner
+	party := ctx.GetString(token.SESSION_ROLE)
+	if party != services.CONTRACT_PARTY_OPERATOR && party != services.CONTRACT_PARTY_PARTNER {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, services.ERR_CONTRACT_PARTY.Error(), fmt.Sprintf("got :%s ", party))
+		return
+	}
+
+	contract, err := controller.ContractService.Decide(ctx.Request.Context(), input.Identifier, models.ContractDecision{
+		Party:      party,
+		IdentityId: ctx.GetString(token.SESSION_USER_IDENTIFIER),
+		Decision:   decision,
+		Comment:    input.Comment,
+		DecidedBy:  ctx.GetString(token.SESSION_USERNAME),
+	})
+	switch {
+	case errors.Is(err, services.ERR_CONTRACT_NOT_FOUND):
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", input.Identifier))
+		return
+	case errors.Is(err, services.ERR_CONTRACT_PARTY):
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", input.Identifier))
+		return
+	case errors.Is(err, services.ERR_CONTRACT_NOT_DRAFT):
+		common.PrepareCustomError(ctx, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got :%s ", input.Identifier))
+		return
+	case err != nil:
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	controller.notifyCounterparty(ctx.Request.Context(), &contract)
+	controller.publishChange(ctx.Request.Context(), &contract, services.CONTRACT_CHANGE_DECIDED)
+	common.PrepareCustomResponse(ctx, "contract "+decision, contract)
+}
+
+// notifyCounterparty tells the other party of the contract about the last
+// decision made on it
+func (controller *ContractController) notifyCounterparty(ctx context.Context, contract *models.Contract) {
+	decision := contract.Decisions[len(contract.Decisions)-1]
+	counterparty := string(contract.PartnerId)
+	if decision.Party == services.CONTRACT_PARTY_PARTNER {
+		counterparty = string(contract.OperatorId)
+	}
+	// a contract for every partner has no partner to notify
+	if counterparty == "" {
+		return
+	}
+
+	err := controller.Nats.Publish(ctx, &models.ContractDecisionEvent{
+		ContractID:     contract.Identifier,
+		Channel:        contract.Channel,
+		Party:          decision.Party,
+		Decision:       decision.Decision,
+		Comment:        decision.Comment,
+		CounterpartyID: counterparty,
+		Status:         contract.Status,
+		DecidedBy:      decision.DecidedBy,
+		DecidedAt:      decision.DecidedAt.Unix(),
+	})
+	if err != nil {
+		fmt.Print("failed to publish the contract decision to NATS: %w", err)
+	}
+}
+
 func (controller *ContractController) ContractDelete(ctx *gin.Context) {
 	fName := "controllers/ContractDelete"
 	tracer := otel.Tracer("ContractDelete")
@@ -109,9 +364,64 @@ func (controller *ContractController) ContractDelete(ctx *gin.Context) {
 		return
 	}
 
+	controller.publishChange(ctx.Request.Context(), &models.Contract{Identifier: contract.Identifier, Channel: "loyyalchannel"}, services.CONTRACT_CHANGE_DELETED)
 	common.PrepareCustomResponse(ctx, "contract deleted", nil)
 }
 
+// ContractCacheMetrics tells how the contract cache of this replica is used
+func (controller *ContractController) ContractCacheMetrics(ctx *gin.Context) {
+	fName := "controllers/ContractCacheMetrics"
+	tracer := otel.Tracer("ContractCacheMetrics")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, "error: only an admin can read the contract cache metrics", fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "contract cache metrics", controller.ContractCache.Metrics())
+}
+
+// RunLifecycle activates the approved contracts that have become valid and
+// expires the ones whose validity has ended, every replica is told so that
+// its cache follows. The number of contracts changed is returned.
+func (controller *ContractController) RunLifecycle(ctx context.Context) (int, error) {
+	fName := "controller/contract/runLifecycle"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	activated, err := controller.ContractService.ActivateApproved(ctx, "system")
+	for _, contract := range activated {
+		controller.publishChange(ctx, contract, services.CONTRACT_CHANGE_ACTIVATED)
+	}
+	if err != nil {
+		return len(activated), err
+	}
+
+	expired, err := controller.ContractService.ExpireLapsed(ctx, "system")
+	for _, contract := range expired {
+		controller.publishChange(ctx, contract, services.CONTRACT_CHANGE_EXPIRED)
+	}
+	return len(activated) + len(expired), err
+}
+
+// publishChange tells every replica that the contract has changed so that it
+// reloads the contract into its cache
+func (controller *ContractController) publishChange(ctx context.Context, contract *models.Contract, change string) {
+	err := controller.Nats.Publish(ctx, &models.ContractChangedEvent{
+		ContractID: contract.Identifier,
+		Channel:    contract.Channel,
+		Change:     change,
+		Version:    contract.Version,
+		ChangedAt:  time.Now().Unix(),
+	})
+	if err != nil {
+		fmt.Print("failed to publish the contract change to NATS: %w", err)
+	}
+}
+
 func (controller *ContractController) ContractFilter(ctx *gin.Context) {
 	fName := "controller/ContractFilter"
 	tracer := otel.Tracer("ContractFilter")
@@ -146,6 +456,12 @@ func (controller *ContractController) ContractRoutes(group *gin.RouterGroup) {
 	contractRoute.GET("/get", controller.ContractGet)
 	contractRoute.POST("/filter", controller.ContractFilter)
 	contractRoute.POST("/create", controller.ContractCreate)
+	contractRoute.PUT("/update", controller.ContractUpdate)
+	contractRoute.GET("/history", controller.ContractHistory)
+	contractRoute.GET("/budget", controller.ContractBudget)
+	contractRoute.POST("/approve", controller.ContractApprove)
+	contractRoute.POST("/reject", controller.ContractReject)
 	contractRoute.DELETE("/delete", controller.ContractDelete)
+	contractRoute.GET("/cache", controller.ContractCacheMetrics)
 	contractRoute.GET("/send-email", controller.SendEmail)
 }
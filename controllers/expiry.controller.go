@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+)
+
+type ExpiryController struct {
+	ExpiryService services.ExpiryService
+}
+
+// constructor calling
+func NewExpiryController(service services.ExpiryService) ExpiryController {
+	return ExpiryController{
+		ExpiryService: service,
+	}
+}
+
+type ExpiryPolicyInput struct {
+	// OperatorId is the operator identity, empty for the default policy
+	OperatorId   string `json:"operatorId"`
+	ExpiryMonths int64  `json:"expiryMonths"`
+	// [fifo, soonest_expiry]
+	ConsumptionOrder string `json:"consumptionOrder"`
+}
+
+func (controller *ExpiryController) policySave(ctx *gin.Context) {
+	fName := "controller/expiry/policySave"
+	tracer := otel.Tracer("expiryPolicySave")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input ExpiryPolicyInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	policy := models.ExpiryPolicy{
+		OperatorId:       input.OperatorId,
+		ExpiryMonths:     input.ExpiryMonths,
+		ConsumptionOrder: input.ConsumptionOrder,
+	}
+
+	identifier, err := controller.ExpiryService.SavePolicy(ctx.Request.Context(), &policy, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "expiry policy saved", struct {
+		Identifier string `json:"identifier"`
+	}{Identifier: identifier})
+}
+
+func (controller *ExpiryController) policyGet(ctx *gin.Context) {
+	fName := "controller/expiry/policyGet"
+	tracer := otel.Tracer("expiryPolicyGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	// falls back to the default policy when the operator has none
+	policy, err := controller.ExpiryService.GetPolicy(ctx.Request.Context(), ctx.Query("operatorId"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "expiry policy fetched", policy)
+}
+
+func (controller *ExpiryController) policyFilter(ctx *gin.Context) {
+	fName := "controller/expiry/policyFilter"
+	tracer := otel.Tracer("expiryPolicyFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	policies, err := controller.ExpiryService.FilterPolicies(ctx.Request.Context(), "AND isDeleted=false", map[string]interface{}{}, "createdAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "expiry policies filtered", policies)
+}
+
+func (controller *ExpiryController) policyDelete(ctx *gin.Context) {
+	fName := "controller/expiry/policyDelete"
+	tracer := otel.Tracer("expiryPolicyDelete")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		OperatorId string `json:"operatorId"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	err := controller.ExpiryService.DeletePolicy(ctx.Request.Context(), input.OperatorId, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "expiry policy deleted", nil)
+}
+
+func (controller *ExpiryController) ExpiryRoutes(group *gin.RouterGroup) {
+	expiryRoute := group.Group("/expiry")
+
+	expiryRoute.Use(middleware.JWTAuthMiddleware())
+
+	expiryRoute.GET("/policy/get", controller.policyGet)
+	expiryRoute.POST("/policy/filter", controller.policyFilter)
+	expiryRoute.POST("/policy/save", controller.policySave)
+	expiryRoute.DELETE("/policy/delete", controller.policyDelete)
+}
@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type FxController struct {
+	FxService services.FxService
+}
+
+// constructor calling
+func NewFxController(service services.FxService) FxController {
+	return FxController{
+		FxService: service,
+	}
+}
+
+var ERR_FX_ADMIN_ONLY = errors.New("error: only admins can manage exchange rates")
+
+type FxRateInput struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+	// Rate is the amount of To for one unit of From, such as 3.6725
+	Rate          models.Ratio `json:"rate" binding:"required"`
+	EffectiveFrom time.Time    `json:"effectiveFrom" binding:"required"`
+}
+
+// FxImportResult tells how many rates of a file were loaded and why the others
+// were not
+type FxImportResult struct {
+	Total    int64                `json:"total"`
+	Imported int64                `json:"imported"`
+	Errors   []models.FxRateError `json:"errors"`
+}
+
+func (controller *FxController) rateSave(ctx *gin.Context) {
+	fName := "controller/fx/rateSave"
+	tracer := otel.Tracer("fxRateSave")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_FX_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_USERNAME)))
+		return
+	}
+
+	var input FxRateInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	rate := models.FxRate{
+		From:          input.From,
+		To:            input.To,
+		Rate:          input.Rate,
+		EffectiveFrom: input.EffectiveFrom,
+		Source:        services.FX_SOURCE_API,
+	}
+	identifier, err := controller.FxService.SaveRate(ctx.Request.Context(), &rate, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "exchange rate saved", struct {
+		Identifier string `json:"identifier"`
+	}{Identifier: identifier})
+}
+
+// rateImport loads the rates of a csv file, the valid lines are loaded and the
+// others reported
+func (controller *FxController) rateImport(ctx *gin.Context) {
+	fName := "controller/fx/rateImport"
+	tracer := otel.Tracer("fxRateImport")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_FX_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_USERNAME)))
+		return
+	}
+
+	file, err := ctx.FormFile("file")
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: rate file is required", fmt.Sprintf("got :%s ", err))
+		return
+	}
+	span.SetAttributes(attribute.String("File", file.Filename))
+
+	reader, err := file.Open()
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: rate file can not be read", fmt.Sprintf("got :%s ", err))
+		return
+	}
+	defer reader.Close()
+
+	rates, rateErrors, err := services.ParseFxFile(reader)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	result := FxImportResult{Total: int64(len(rates) + len(rateErrors)), Errors: rateErrors}
+	for _, rate := range rates {
+		if _, err := controller.FxService.SaveRate(ctx.Request.Context(), rate, ctx.GetString(token.SESSION_USERNAME)); err != nil {
+			common.PrepareCustomError(ctx, http.StatusInternalServerError, fName, "error: rate file was imported partially", fmt.Sprintf("got :%s after %d rates", err, result.Imported))
+			return
+		}
+		result.Imported++
+	}
+
+	common.PrepareCustomResponse(ctx, "exchange rates imported", result)
+}
+
+// rateGet gives the rate of the pair effective at the time, now when no time
+// is given
+func (controller *FxController) rateGet(ctx *gin.Context) {
+	fName := "controller/fx/rateGet"
+	tracer := otel.Tracer("fxRateGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	from, to := strings.ToUpper(ctx.Query("from")), strings.ToUpper(ctx.Query("to"))
+	if !services.IsCurrency(from) || !services.IsCurrency(to) {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, services.ERR_INVALID_CURRENCY.Error(), fmt.Sprintf("got :%s and %s ", from, to))
+		return
+	}
+
+	at := time.Now().UTC()
+	if value := ctx.Query("at"); value != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: at must be an RFC 3339 time", fmt.Sprintf("got :%s ", value))
+			return
+		}
+	}
+
+	rate, err := controller.FxService.Rate(ctx.Request.Context(), from, to, at)
+	if errors.Is(err, services.ERR_FX_RATE_NOT_FOUND) {
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "exchange rate fetched", rate)
+}
+
+func (controller *FxController) rateFilter(ctx *gin.Context) {
+	fName := "controller/fx/rateFilter"
+	tracer := otel.Tracer("fxRateFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := "AND isDeleted=false"
+	if input.From != "" {
+		queryString += " AND `from`=$from"
+	}
+	if input.To != "" {
+		queryString += " AND `to`=$to"
+	}
+
+	rates, err := controller.FxService.FilterRates(ctx.Request.Context(), queryString, map[string]interface{}{
+		"from": strings.ToUpper(input.From),
+		"to":   strings.ToUpper(input.To),
+	}, "`from`, `to`, STR_TO_MILLIS(effectiveFrom) desc", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "exchange rates filtered", rates)
+}
+
+func (controller *FxController) rateDelete(ctx *gin.Context) {
+	fName := "controller/fx/rateDelete"
+	tracer := otel.Tracer("fxRateDelete")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_FX_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_USERNAME)))
+		return
+	}
+
+	var input struct {
+		Identifier string `json:"identifier" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	err := controller.FxService.DeleteRate(ctx.Request.Context(), input.Identifier, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "exchange rate deleted", nil)
+}
+
+func (controller *FxController) FxRoutes(group *gin.RouterGroup) {
+	fxRoute := group.Group("/fx")
+
+	fxRoute.Use(middleware.JWTAuthMiddleware())
+
+	fxRoute.GET("/rate/get", controller.rateGet)
+	fxRoute.POST("/rate/filter", controller.rateFilter)
+	fxRoute.POST("/rate/save", controller.rateSave)
+	fxRoute.POST("/rate/import", controller.rateImport)
+	fxRoute.DELETE("/rate/delete", controller.rateDelete)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/loyyal/loyyal-be-contract/nats"
 	"github.com/loyyal/loyyal-be-contract/services"
 	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
 )
 
 type IdentityController struct {
@@ -97,6 +98,10 @@ func (controller *IdentityController) identityCreate(ctx *gin.Context) {
 			return
 		}
 
+		if err := controller.IdentityService.SetWalletRef(ctx.Request.Context(), identity.Identifier, wallet.Identifier, services.WALLET_ROLE_OWNER); err != nil {
+			fmt.Print("failed to link the wallet to the identity: %w", err)
+		}
+
 		// publishing to nats
 		if err := controller.Nats.Publish(ctx.Request.Context(), &models.CreateRequest{RefID: wallet.Ref, Amount: wallet.Balance, Channel: wallet.Channel}); err != nil {
 			fmt.Print("failed to write wallet to NATS (failing over to retry service): %w", err)
@@ -162,6 +167,38 @@ func (controller *IdentityController) IdentityUpdate(ctx *gin.Context) {
 	common.PrepareCustomResponse(ctx, "identity updated", nil)
 }
 
+// identityTier sets the tier of a member, contracts with tier bands earn at
+// the rate of the tier. Only admins and operators manage tiers.
+func (controller *IdentityController) identityTier(ctx *gin.Context) {
+	fName := "identitycontroller/tier"
+	tracer := otel.Tracer("identityTier")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		Identifier string `json:"identifier" binding:"required"`
+		Tier       string `json:"tier"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	role := ctx.GetString(token.SESSION_ROLE)
+	if role != "admin" && role != "operator" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, "error: only admins and operators can set the tier of a member", fmt.Sprintf("got :%s ", role))
+		return
+	}
+
+	err := controller.IdentityService.SetTier(ctx.Request.Context(), input.Identifier, input.Tier, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "identity tier updated", input)
+}
+
 func (controller *IdentityController) identityDelete(ctx *gin.Context) {
 	fName := "identitycontroller/delete"
 	tracer := otel.Tracer("identityDelete")
@@ -197,8 +234,8 @@ func (controller *IdentityController) identityLinkedWallets(ctx *gin.Context) {
 	defer span.End()
 
 	userId := ctx.Query("userId")
-	wallets, err := controller.WalletService.CustomFilterQuery(ctx.Request.Context(), "identifier, name, balance, walletType, status, createdAt",
-		"and isDeleted=false and any wallet in testbucket.linkedTo SATISFIES wallet == $userId end", map[string]interface{}{
+	wallets, err := controller.WalletService.CustomFilterQuery(ctx.Request.Context(), "identifier, name, balance, walletType, status, members, createdAt",
+		"and isDeleted=false and (any wallet in testbucket.linkedTo SATISFIES wallet == $userId end or any member in testbucket.members SATISFIES member.identityId == $userId end)", map[string]interface{}{
 			"userId": userId,
 		}, "createdAt", -1)
 	if err != nil {
@@ -209,6 +246,38 @@ func (controller *IdentityController) identityLinkedWallets(ctx *gin.Context) {
 	common.PrepareCustomResponse(ctx, "linked wallets fetched", wallets)
 }
 
+func (controller *IdentityController) identityWalletMemberships(ctx *gin.Context) {
+	fName := "identitycontroller/walletmemberships"
+	tracer := otel.Tracer("identityWalletMemberships")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	userId := ctx.Query("userId")
+	if userId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: user id is required", fmt.Sprintf("got :%s ", userId))
+		return
+	}
+
+	identity, err := controller.IdentityService.Get(ctx.Request.Context(), userId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	audit, err := controller.WalletService.MembershipAudit(ctx.Request.Context(), "and identityId=$userId", map[string]interface{}{
+		"userId": userId,
+	})
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet memberships fetched", struct {
+		Wallets []models.WalletRef              `json:"wallets"`
+		Audit   []*models.WalletMembershipAudit `json:"audit"`
+	}{Wallets: identity.Wallets, Audit: audit})
+}
+
 func (controller *IdentityController) identityFilter(ctx *gin.Context) {
 	fName := "identitycontroller/filter"
 	tracer := otel.Tracer("identityFilter")
@@ -250,9 +319,11 @@ func (controller *IdentityController) IdentityRoutes(group *gin.RouterGroup) {
 
 	identityRoute.GET("/get", controller.IdentityGet)
 	identityRoute.GET("/get-linked-wallets", controller.identityLinkedWallets)
+	identityRoute.GET("/wallet-memberships", controller.identityWalletMemberships)
 	identityRoute.POST("/filter", controller.identityFilter)
 	identityRoute.POST("/create", controller.identityCreate)
 	identityRoute.PUT("/update", controller.IdentityUpdate)
+	identityRoute.POST("/tier", controller.identityTier)
 	identityRoute.DELETE("/delete", controller.identityDelete)
 
 }
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+)
+
+type LimitController struct {
+	LimitService services.LimitService
+}
+
+// constructor calling
+func NewLimitController(service services.LimitService) LimitController {
+	return LimitController{
+		LimitService: service,
+	}
+}
+
+type LimitPolicyInput struct {
+	// Identifier of the policy to update, empty to create one
+	Identifier      string           `json:"identifier"`
+	Name            string           `json:"name" binding:"required"`
+	OperatorId      string           `json:"operatorId"`
+	WalletType      string           `json:"walletType"`
+	IdentityType    string           `json:"identityType"`
+	MaxSingleAmount int64            `json:"maxSingleAmount"`
+	Daily           models.LimitCaps `json:"daily"`
+	Weekly          models.LimitCaps `json:"weekly"`
+	Monthly         models.LimitCaps `json:"monthly"`
+}
+
+func (controller *LimitController) policySave(ctx *gin.Context) {
+	fName := "controller/limit/policySave"
+	tracer := otel.Tracer("limitPolicySave")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input LimitPolicyInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	policy := models.LimitPolicy{
+		Identifier:      input.Identifier,
+		Name:            input.Name,
+		OperatorId:      input.OperatorId,
+		WalletType:      input.WalletType,
+		IdentityType:    input.IdentityType,
+		MaxSingleAmount: input.MaxSingleAmount,
+		Daily:           input.Daily,
+		Weekly:          input.Weekly,
+		Monthly:         input.Monthly,
+	}
+
+	identifier, err := controller.LimitService.SavePolicy(ctx.Request.Context(), &policy, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "limit policy saved", struct {
+		Identifier string `json:"identifier"`
+	}{Identifier: identifier})
+}
+
+func (controller *LimitController) policyGet(ctx *gin.Context) {
+	fName := "controller/limit/policyGet"
+	tracer := otel.Tracer("limitPolicyGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	policyId := ctx.Query("policyId")
+	if policyId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: policy id is required", fmt.Sprintf("got :%s ", policyId))
+		return
+	}
+
+	policy, err := controller.LimitService.GetPolicy(ctx.Request.Context(), policyId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "limit policy fetched", policy)
+}
+
+func (controller *LimitController) policyFilter(ctx *gin.Context) {
+	fName := "controller/limit/policyFilter"
+	tracer := otel.Tracer("limitPolicyFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		OperatorId   string `json:"operatorId"`
+		WalletType   string `json:"walletType"`
+		IdentityType string `json:"identityType"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := "AND isDeleted=false"
+	if input.OperatorId != "" {
+		queryString += " AND operatorId=$operatorId"
+	}
+	if input.WalletType != "" {
+		queryString += " AND walletType=$walletType"
+	}
+	if input.IdentityType != "" {
+		queryString += " AND identityType=$identityType"
+	}
+
+	policies, err := controller.LimitService.FilterPolicies(ctx.Request.Context(), queryString, map[string]interface{}{
+		"operatorId":   input.OperatorId,
+		"walletType":   input.WalletType,
+		"identityType": input.IdentityType,
+	}, "createdAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "limit policies filtered", policies)
+}
+
+func (controller *LimitController) policyDelete(ctx *gin.Context) {
+	fName := "controller/limit/policyDelete"
+	tracer := otel.Tracer("limitPolicyDelete")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		Identifier string `json:"identifier" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	err := controller.LimitService.DeletePolicy(ctx.Request.Context(), input.Identifier, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "limit policy deleted", nil)
+}
+
+func (controller *LimitController) LimitRoutes(group *gin.RouterGroup) {
+	limitRoute := group.Group("/limit")
+
+	limitRoute.Use(middleware.JWTAuthMiddleware())
+
+	limitRoute.GET("/policy/get", controller.policyGet)
+	limitRoute.POST("/policy/filter", controller.policyFilter)
+	limitRoute.POST("/policy/save", controller.policySave)
+	limitRoute.DELETE("/policy/delete", controller.policyDelete)
+}
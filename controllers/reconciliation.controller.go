@@ -0,0 +1,514 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/nats"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+type ReconciliationController struct {
+	ReconciliationService services.ReconciliationService
+	WalletService         services.WalletService
+	Transactions          *TransactionController
+	Nats                  *nats.Client
+}
+
+// constructor calling
+func NewReconciliationController(service services.ReconciliationService, walletService services.WalletService, transactions *TransactionController, nats *nats.Client) ReconciliationController {
+	return ReconciliationController{
+		ReconciliationService: service,
+		WalletService:         walletService,
+		Transactions:          transactions,
+		Nats:                  nats,
+	}
+}
+
+type RepairDecisionInput struct {
+	Identifier string `json:"identifier" binding:"required"`
+	Note       string `json:"note"`
+}
+
+const (
+	// wallets and transactions younger than this may still be on their way to
+	// the ledger and are left out of a run
+	reconciliation_grace = 10 * time.Minute
+	// time the ledger has to answer a single balance or lookup request
+	reconciliation_ledger_timeout = 5 * time.Second
+	// entities checked between two saves of a running report
+	reconciliation_save_every = 500
+)
+
+var ERR_RECONCILIATION_ADMIN_ONLY = errors.New("error: only an admin can reconcile the ledger")
+
+// Run reconciles the off-chain state with the ledger and returns the report
+func (controller *ReconciliationController) Run(ctx context.Context, sessionedUser string, openRepairs bool) (models.ReconciliationReport, error) {
+	report, err := controller.ReconciliationService.Start(ctx, sessionedUser)
+	if err != nil {
+		return report, err
+	}
+	err = controller.Reconcile(ctx, &report, openRepairs)
+	return report, err
+}
+
+// Reconcile compares every wallet balance and every transaction with the ledger
+// and records the mismatches on the report. With openRepairs a repair action is
+// proposed for the mismatches that can be fixed, nothing is changed until an
+// operator approves it. The report is saved as completed or failed at the end.
+func (controller *ReconciliationController) Reconcile(ctx context.Context, report *models.ReconciliationReport, openRepairs bool) error {
+	fName := "controller/reconciliation/reconcile"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	cutoff := time.Now().UTC().Add(-reconciliation_grace)
+	checked := int64(0)
+	progress := func() {
+		checked++
+		if checked%reconciliation_save_every == 0 {
+			if err := controller.ReconciliationService.Save(ctx, report); err != nil {
+				fmt.Print("failed to save the reconciliation progress: %w", err)
+			}
+		}
+	}
+
+	err := controller.ReconciliationService.EachWallet(ctx, func(wallet *models.Wallet) error {
+		if wallet.CreatedAt.After(cutoff) {
+			return nil
+		}
+		report.WalletsChecked++
+		defer progress()
+		return controller.reconcileWallet(ctx, report, wallet, openRepairs)
+	})
+	if err == nil {
+		err = controller.ReconciliationService.EachTransaction(ctx, cutoff, func(transaction *models.Transaction) error {
+			report.TransactionsChecked++
+			defer progress()
+			return controller.reconcileTransaction(ctx, report, transaction, openRepairs)
+		})
+	}
+
+	now := time.Now().UTC()
+	report.CompletedAt = &now
+	report.Status = services.RECONCILIATION_COMPLETED
+	if err != nil {
+		report.Status = services.RECONCILIATION_FAILED
+		report.Error = err.Error()
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(
+		attribute.Int64("wallets checked", report.WalletsChecked),
+		attribute.Int64("transactions checked", report.TransactionsChecked),
+		attribute.Int("mismatches", len(report.Mismatches)),
+	)
+
+	if saveErr := controller.ReconciliationService.Save(ctx, report); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func (controller *ReconciliationController) reconcileWallet(ctx context.Context, report *models.ReconciliationReport, wallet *models.Wallet, openRepairs bool) error {
+	mismatch := models.ReconciliationMismatch{
+		EntityType: services.RECONCILIATION_ENTITY_WALLET,
+		EntityId:   wallet.Identifier,
+		OffChain:   wallet.Balance,
+	}
+
+	// the wallet never got its chain id back
+	if wallet.UUID == "" {
+		mismatch.Category = services.MISMATCH_MISSING_ON_CHAIN
+		mismatch.Detail = "wallet has no chain id"
+		return controller.record(ctx, report, mismatch, openRepairs, models.RepairAction{Action: services.REPAIR_REPUBLISH})
+	}
+
+	// the off-chain balance already moved for transactions the ledger has not
+	// booked yet, comparing it now would report a false difference
+	inFlight, err := controller.ReconciliationService.InFlight(ctx, wallet.Identifier)
+	if err != nil {
+		return controller.checkFailed(ctx, report, mismatch, err)
+	}
+	if inFlight {
+		report.WalletsSkipped++
+		return nil
+	}
+
+	data, err := controller.Nats.Request(ctx, &models.BalanceRequest{ID: wallet.UUID, Channel: "loyyalchannel"}, reconciliation_ledger_timeout)
+	if err != nil {
+		return controller.checkFailed(ctx, report, mismatch, err)
+	}
+	var result models.BalanceResult
+	if err := result.Decode(data); err != nil {
+		return controller.checkFailed(ctx, report, mismatch, err)
+	}
+	if result.Error != "" {
+		return controller.checkFailed(ctx, report, mismatch, errors.New(result.Error))
+	}
+
+	if !result.Found {
+		mismatch.Category = services.MISMATCH_MISSING_ON_CHAIN
+		mismatch.Detail = "chain id is unknown to the ledger"
+		return controller.record(ctx, report, mismatch, false, models.RepairAction{})
+	}
+	if result.Balance != wallet.Balance {
+		mismatch.Category = services.MISMATCH_AMOUNT_DIFFERS
+		mismatch.OnChain = result.Balance
+		return controller.record(ctx, report, mismatch, openRepairs, models.RepairAction{
+			Action: services.REPAIR_BALANCE_CORRECTION,
+			From:   wallet.Balance,
+			To:     result.Balance,
+		})
+	}
+	return nil
+}
+
+func (controller *ReconciliationController) reconcileTransaction(ctx context.Context, report *models.ReconciliationReport, transaction *models.Transaction, openRepairs bool) error {
+	mismatch := models.ReconciliationMismatch{
+		EntityType: services.RECONCILIATION_ENTITY_TRANSACTION,
+		EntityId:   transaction.ExtID,
+		OffChain:   transaction.Amount,
+	}
+
+	data, err := controller.Nats.Request(ctx, &models.LookupRequest{RefID: transaction.RefID, Channel: transaction.Channel}, reconciliation_ledger_timeout)
+	if err != nil {
+		return controller.checkFailed(ctx, report, mismatch, err)
+	}
+	var result models.LookupResult
+	if err := result.Decode(data); err != nil {
+		return controller.checkFailed(ctx, report, mismatch, err)
+	}
+	if result.Error != "" {
+		return controller.checkFailed(ctx, report, mismatch, errors.New(result.Error))
+	}
+
+	committed := services.EffectiveStatus(*transaction) == services.TRANSACTION_STATUS_COMMITTED
+	mismatch.OnChain = result.Amount
+
+	switch {
+	case !result.Found && !services.WasPublished(*transaction):
+		// failed before it was priced, there is nothing to publish again and the
+		// operator decides what becomes of it
+		mismatch.Category = services.MISMATCH_MISSING_ON_CHAIN
+		mismatch.OnChain = 0
+		mismatch.Detail = "transaction was never published, it is " + services.EffectiveStatus(*transaction) + " off-chain"
+		return controller.record(ctx, report, mismatch, false, models.RepairAction{})
+	case !result.Found:
+		// written off-chain but never booked, publishing it again with the same
+		// reference can not book it twice
+		mismatch.Category = services.MISMATCH_MISSING_ON_CHAIN
+		mismatch.OnChain = 0
+		mismatch.Detail = "transaction is " + services.EffectiveStatus(*transaction) + " off-chain"
+		return controller.record(ctx, report, mismatch, openRepairs, models.RepairAction{Action: services.REPAIR_REPUBLISH})
+	case !committed:
+		// booked on the ledger but the callback never arrived
+		mismatch.Category = services.MISMATCH_MISSING_OFF_CHAIN
+		mismatch.Detail = "transaction is " + services.EffectiveStatus(*transaction) + " off-chain"
+		return controller.record(ctx, report, mismatch, openRepairs, models.RepairAction{
+			Action:     services.REPAIR_APPLY_RESULT,
+			LedgerUUID: result.UUID,
+		})
+	case result.Amount != transaction.Amount:
+		// there is no safe automatic fix, it is left to the operator
+		mismatch.Category = services.MISMATCH_AMOUNT_DIFFERS
+		return controller.record(ctx, report, mismatch, false, models.RepairAction{})
+	}
+	return nil
+}
+
+// checkFailed records on the report that the entity could not be checked, the
+// run goes on with the next one
+func (controller *ReconciliationController) checkFailed(ctx context.Context, report *models.ReconciliationReport, mismatch models.ReconciliationMismatch, err error) error {
+	mismatch.Category = services.MISMATCH_CHECK_FAILED
+	mismatch.Detail = err.Error()
+	return controller.record(ctx, report, mismatch, false, models.RepairAction{})
+}
+
+// record adds the mismatch to the report, proposing the repair action when asked to
+func (controller *ReconciliationController) record(ctx context.Context, report *models.ReconciliationReport, mismatch models.ReconciliationMismatch, openRepair bool, repair models.RepairAction) error {
+	if openRepair && repair.Action != "" {
+		repair.ReportId = report.Identifier
+		repair.EntityType = mismatch.EntityType
+		repair.EntityId = mismatch.EntityId
+		repair.Category = mismatch.Category
+		if err := controller.ReconciliationService.ProposeRepair(ctx, &repair); err != nil {
+			return err
+		}
+		mismatch.RepairId = repair.Identifier
+	}
+	services.AddMismatch(report, mismatch)
+	return nil
+}
+
+// executeRepair carries out an approved repair action
+func (controller *ReconciliationController) executeRepair(ctx context.Context, repair models.RepairAction, sessionedUser string) error {
+	switch {
+	case repair.Action == services.REPAIR_REPUBLISH && repair.EntityType == services.RECONCILIATION_ENTITY_TRANSACTION:
+		return controller.Transactions.Republish(ctx, repair.EntityId)
+
+	case repair.Action == services.REPAIR_REPUBLISH && repair.EntityType == services.RECONCILIATION_ENTITY_WALLET:
+		wallet, err := controller.WalletService.Get(ctx, repair.EntityId)
+		if err != nil {
+			return err
+		}
+		amount := wallet.Balance
+		if wallet.InitialBalance != nil {
+			amount = *wallet.InitialBalance
+		}
+		return controller.Nats.Publish(ctx, &models.CreateRequest{RefID: wallet.Ref, Amount: amount, Channel: "loyyalchannel"})
+
+	case repair.Action == services.REPAIR_BALANCE_CORRECTION:
+		_, err := controller.WalletService.CorrectBalance(ctx, repair.EntityId, repair.From, repair.To, sessionedUser)
+		return err
+
+	case repair.Action == services.REPAIR_APPLY_RESULT:
+		transaction, err := controller.Transactions.TransactionService.Get(ctx, repair.EntityId)
+		if err != nil {
+			return err
+		}
+		_, err = controller.Transactions.RecordResult(ctx, models.TransactionResult{
+			RefID:   transaction.RefID,
+			UUID:    repair.LedgerUUID,
+			Channel: transaction.Channel,
+		})
+		return err
+	}
+	return fmt.Errorf("error: unknown repair action %s", repair.Action)
+}
+
+func (controller *ReconciliationController) reconciliationRun(ctx *gin.Context) {
+	fName := "controller/reconciliation/run"
+	tracer := otel.Tracer("reconciliationRun")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	var input struct {
+		OpenRepairs bool `json:"openRepairs"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	report, err := controller.ReconciliationService.Start(ctx.Request.Context(), ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// a run goes through every wallet and transaction, it is followed through the report
+	go controller.Reconcile(context.Background(), &report, input.OpenRepairs)
+
+	common.PrepareCustomResponse(ctx, "reconciliation started", struct {
+		Identifier string `json:"identifier"`
+	}{Identifier: report.Identifier})
+}
+
+func (controller *ReconciliationController) reconciliationReport(ctx *gin.Context) {
+	fName := "controller/reconciliation/report"
+	tracer := otel.Tracer("reconciliationReport")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	reportId := ctx.Query("reportId")
+	if reportId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: reportId is required", "got : empty reportId")
+		return
+	}
+
+	report, err := controller.ReconciliationService.Get(ctx.Request.Context(), reportId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusNotFound, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "reconciliation report found", report)
+}
+
+func (controller *ReconciliationController) reconciliationFilter(ctx *gin.Context) {
+	fName := "controller/reconciliation/filter"
+	tracer := otel.Tracer("reconciliationFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := ""
+	if input.Status != "" {
+		queryString += " AND status=$status"
+	}
+
+	reports, err := controller.ReconciliationService.Filter(ctx.Request.Context(), queryString, map[string]interface{}{
+		"status": input.Status,
+	}, "startedAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "reconciliation reports filtered", reports)
+}
+
+func (controller *ReconciliationController) repairFilter(ctx *gin.Context) {
+	fName := "controller/reconciliation/repairFilter"
+	tracer := otel.Tracer("repairFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	var input struct {
+		ReportId string `json:"reportId"`
+		Status   string `json:"status"`
+		Action   string `json:"action"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := ""
+	if input.ReportId != "" {
+		queryString += " AND reportId=$reportId"
+	}
+	if input.Status != "" {
+		queryString += " AND status=$status"
+	}
+	if input.Action != "" {
+		queryString += " AND action=$action"
+	}
+
+	repairs, err := controller.ReconciliationService.FilterRepairs(ctx.Request.Context(), queryString, map[string]interface{}{
+		"reportId": input.ReportId,
+		"status":   input.Status,
+		"action":   input.Action,
+	}, "proposedAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "repair actions filtered", repairs)
+}
+
+// repairApprove approves a proposed repair action and carries it out right away,
+// the outcome is recorded on the action
+func (controller *ReconciliationController) repairApprove(ctx *gin.Context) {
+	fName := "controller/reconciliation/repairApprove"
+	tracer := otel.Tracer("repairApprove")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	var input RepairDecisionInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	sessionedUser := ctx.GetString(token.SESSION_USERNAME)
+	repair, err := controller.ReconciliationService.Decide(ctx.Request.Context(), input.Identifier, true, input.Note, sessionedUser)
+	if errors.Is(err, services.ERR_REPAIR_NOT_PROPOSED) {
+		common.PrepareCustomError(ctx, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got :%s ", repair.Status))
+		return
+	}
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	actionErr := controller.executeRepair(ctx.Request.Context(), repair, sessionedUser)
+	repair, err = controller.ReconciliationService.Complete(ctx.Request.Context(), repair.Identifier, actionErr)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+	if actionErr != nil {
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, actionErr.Error(), fmt.Sprintf("got :%s ", actionErr))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "repair action executed", repair)
+}
+
+func (controller *ReconciliationController) repairReject(ctx *gin.Context) {
+	fName := "controller/reconciliation/repairReject"
+	tracer := otel.Tracer("repairReject")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, ERR_RECONCILIATION_ADMIN_ONLY.Error(), fmt.Sprintf("got :%s ", ctx.GetString(token.SESSION_ROLE)))
+		return
+	}
+
+	var input RepairDecisionInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	repair, err := controller.ReconciliationService.Decide(ctx.Request.Context(), input.Identifier, false, input.Note, ctx.GetString(token.SESSION_USERNAME))
+	if errors.Is(err, services.ERR_REPAIR_NOT_PROPOSED) {
+		common.PrepareCustomError(ctx, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got :%s ", repair.Status))
+		return
+	}
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "repair action rejected", repair)
+}
+
+func (controller *ReconciliationController) ReconciliationRoutes(group *gin.RouterGroup) {
+	reconciliationRoute := group.Group("/reconciliation")
+
+	reconciliationRoute.Use(middleware.JWTAuthMiddleware())
+
+	reconciliationRoute.POST("/run", controller.reconciliationRun)
+	reconciliationRoute.GET("/report", controller.reconciliationReport)
+	reconciliationRoute.POST("/filter", controller.reconciliationFilter)
+	reconciliationRoute.POST("/repair/filter", controller.repairFilter)
+	reconciliationRoute.POST("/repair/approve", controller.repairApprove)
+	reconciliationRoute.POST("/repair/reject", controller.repairReject)
+}
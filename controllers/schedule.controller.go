@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/middleware"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type ScheduleController struct {
+	ScheduleService services.ScheduleService
+	Transactions    *TransactionController
+}
+
+// constructor calling
+func NewScheduleController(service services.ScheduleService, transactions *TransactionController) ScheduleController {
+	return ScheduleController{
+		ScheduleService: service,
+		Transactions:    transactions,
+	}
+}
+
+type ScheduleInput struct {
+	// [issue, transfer]
+	TransactionType        string          `json:"transactionType" binding:"required"`
+	From                   string          `json:"from" binding:"required"`
+	To                     string          `json:"to" binding:"required"`
+	Amount                 int64           `json:"amount" binding:"required"`
+	Metadata               json.RawMessage `json:"metadata"`
+	TransactionInitiatedBy string          `json:"transactionInitiatedBy"`
+	ExecuteAt              time.Time       `json:"executeAt" binding:"required"`
+	// Recurrence is a RRULE such as FREQ=YEARLY or FREQ=MONTHLY;BYMONTHDAY=-1
+	Recurrence string `json:"recurrence"`
+}
+
+type ScheduleUpdateInput struct {
+	Identifier string          `json:"identifier" binding:"required"`
+	Amount     int64           `json:"amount"`
+	Metadata   json.RawMessage `json:"metadata"`
+	ExecuteAt  time.Time       `json:"executeAt"`
+	// Recurrence replaces the recurrence when given, "none" turns the schedule
+	// into a single execution
+	Recurrence string `json:"recurrence"`
+}
+
+// lease of a scheduled transaction while it is executed
+const schedule_execution_lease = 5 * time.Minute
+
+var (
+	ERR_INVALID_SCHEDULE_TYPE = errors.New("error: only issue and transfer transactions can be scheduled")
+	ERR_NOT_SCHEDULE_CREATOR  = errors.New("error: only the creator of the scheduled transaction can change it")
+)
+
+func (controller *ScheduleController) scheduleCreate(ctx *gin.Context) {
+	fName := "controller/schedule/create"
+	tracer := otel.Tracer("scheduleCreate")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input ScheduleInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if input.TransactionType != services.TRANSACTION_TYPE_ISSUE && input.TransactionType != services.TRANSACTION_TYPE_TRANSFER {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_SCHEDULE_TYPE.Error(), fmt.Sprintf("got :%s ", input.TransactionType))
+		return
+	}
+
+	if input.Amount <= 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
+		return
+	}
+
+	if input.From == input.To {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_SAME_FROM_AND_TO.Error(), fmt.Sprintf("got: from %s & to %s", input.From, input.To))
+		return
+	}
+
+	schedule := models.ScheduledTransaction{
+		TransactionType:        input.TransactionType,
+		From:                   input.From,
+		To:                     input.To,
+		Amount:                 input.Amount,
+		Metadata:               input.Metadata,
+		TransactionInitiatedBy: input.TransactionInitiatedBy,
+		ExecuteAt:              input.ExecuteAt.UTC(),
+		Recurrence:             input.Recurrence,
+	}
+
+	identifier, err := controller.ScheduleService.Create(ctx.Request.Context(), &schedule, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "transaction scheduled", struct {
+		Identifier string     `json:"identifier"`
+		NextRunAt  *time.Time `json:"nextRunAt"`
+	}{Identifier: identifier, NextRunAt: schedule.NextRunAt})
+}
+
+func (controller *ScheduleController) scheduleGet(ctx *gin.Context) {
+	fName := "controller/schedule/get"
+	tracer := otel.Tracer("scheduleGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	scheduleId := ctx.Query("scheduleId")
+	if scheduleId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: schedule id is required", fmt.Sprintf("got :%s ", scheduleId))
+		return
+	}
+
+	schedule, err := controller.ScheduleService.Get(ctx.Request.Context(), scheduleId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "scheduled transaction fetched", schedule)
+}
+
+func (controller *ScheduleController) scheduleFilter(ctx *gin.Context) {
+	fName := "controller/schedule/filter"
+	tracer := otel.Tracer("scheduleFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		From            string `json:"from"`
+		To              string `json:"to"`
+		TransactionType string `json:"transactionType"`
+		Status          string `json:"status"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString := ""
+	// partners only see what they have scheduled themselves
+	if ctx.GetString(token.SESSION_ROLE) != "admin" {
+		queryString += " AND creator=$creator"
+	}
+	if input.From != "" {
+		queryString += " AND `from`=$from"
+	}
+	if input.To != "" {
+		queryString += " AND `to`=$to"
+	}
+	if input.TransactionType != "" {
+		queryString += " AND transactionType=$transactionType"
+	}
+	if input.Status != "" {
+		queryString += " AND status=$status"
+	}
+
+	schedules, err := controller.ScheduleService.Filter(ctx.Request.Context(), queryString, map[string]interface{}{
+		"creator":         ctx.GetString(token.SESSION_USERNAME),
+		"from":            input.From,
+		"to":              input.To,
+		"transactionType": input.TransactionType,
+		"status":          input.Status,
+	}, "createdAt", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "scheduled transactions filtered", schedules)
+}
+
+func (controller *ScheduleController) scheduleUpdate(ctx *gin.Context) {
+	fName := "controller/schedule/update"
+	tracer := otel.Tracer("scheduleUpdate")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input ScheduleUpdateInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if input.Amount < 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
+		return
+	}
+
+	schedule, err := controller.authorizeCreator(ctx, input.Identifier)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	recurrence := schedule.Recurrence
+	if input.Recurrence == "none" {
+		recurrence = ""
+	} else if input.Recurrence != "" {
+		recurrence = input.Recurrence
+	}
+
+	var metadata []byte
+	if input.Metadata != nil {
+		metadata = input.Metadata
+	}
+
+	schedule, err = controller.ScheduleService.Update(ctx.Request.Context(), input.Identifier, input.Amount, metadata, input.ExecuteAt.UTC(), recurrence, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "scheduled transaction updated", schedule)
+}
+
+func (controller *ScheduleController) scheduleCancel(ctx *gin.Context) {
+	fName := "controller/schedule/cancel"
+	tracer := otel.Tracer("scheduleCancel")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input struct {
+		Identifier string `json:"identifier" binding:"required"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if _, err := controller.authorizeCreator(ctx, input.Identifier); err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	_, err := controller.ScheduleService.Cancel(ctx.Request.Context(), input.Identifier, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "scheduled transaction cancelled", nil)
+}
+
+// authorizeCreator allows admins and the creator of the scheduled transaction to change it
+func (controller *ScheduleController) authorizeCreator(ctx *gin.Context, scheduleId string) (models.ScheduledTransaction, error) {
+	schedule, err := controller.ScheduleService.Get(ctx.Request.Context(), scheduleId)
+	if err != nil {
+		return schedule, err
+	}
+
+	if ctx.GetString(token.SESSION_ROLE) != "admin" && schedule.Creator != ctx.GetString(token.SESSION_USERNAME) {
+		return schedule, ERR_NOT_SCHEDULE_CREATOR
+	}
+	return schedule, nil
+}
+
+// RunDueSchedules executes the scheduled transactions that are due and records
+// the outcome of every execution. It is safe to run from several replicas, a
+// scheduled transaction is claimed before it is executed.
+func (controller *ScheduleController) RunDueSchedules(ctx context.Context) (int, error) {
+	fName := "controller/schedule/runDueSchedules"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	due, err := controller.ScheduleService.Due(ctx, time.Now().UTC(), 100)
+	if err != nil {
+		return 0, err
+	}
+
+	executed := 0
+	for _, schedule := range due {
+		claimed, err := controller.ScheduleService.Claim(ctx, schedule.Identifier, schedule_execution_lease)
+		if err != nil {
+			continue
+		}
+
+		dueAt := *claimed.NextRunAt
+		// the id is derived from the due time so that a retried execution finds
+		// the transaction booked before
+		transactionId := claimed.Identifier + "_" + dueAt.Format("20060102T150405")
+		run := models.ScheduleRun{DueAt: dueAt, ExecutedAt: time.Now().UTC(), TransactionId: transactionId, Status: services.SCHEDULE_RUN_SUCCEEDED}
+
+		if _, err := controller.Transactions.TransactionService.Get(ctx, transactionId); err != nil {
+			input := TransactionInput{
+				ExternalId:             transactionId,
+				From:                   claimed.From,
+				To:                     claimed.To,
+				Amount:                 claimed.Amount,
+				Metadata:               claimed.Metadata,
+				TransactionInitiatedBy: claimed.TransactionInitiatedBy,
+			}
+			if _, err := controller.Transactions.Submit(ctx, claimed.TransactionType, input, "scheduled transaction "+claimed.Identifier); err != nil {
+				run.TransactionId = ""
+				run.Status = services.SCHEDULE_RUN_FAILED
+				run.Error = err.Error()
+			}
+		}
+
+		if _, err := controller.ScheduleService.RecordRun(ctx, claimed.Identifier, run); err != nil {
+			fmt.Print("failed to record the scheduled transaction run: %w", err)
+			continue
+		}
+		executed++
+	}
+
+	span.SetAttributes(attribute.Int("executed schedules", executed))
+	return executed, nil
+}
+
+func (controller *ScheduleController) ScheduleRoutes(group *gin.RouterGroup) {
+	scheduleRoute := group.Group("/schedule")
+
+	scheduleRoute.Use(middleware.JWTAuthMiddleware())
+
+	scheduleRoute.GET("/get", controller.scheduleGet)
+	scheduleRoute.POST("/filter", controller.scheduleFilter)
+	scheduleRoute.POST("/create", controller.scheduleCreate)
+	scheduleRoute.PUT("/update", controller.scheduleUpdate)
+	scheduleRoute.POST("/cancel", controller.scheduleCancel)
+}
@@ -6,9 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,6 +18,8 @@ import (
 	"github.com/loyyal/loyyal-be-contract/nats"
 	"github.com/loyyal/loyyal-be-contract/services"
 	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/export"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -27,6 +30,12 @@ type TransactionController struct {
 	TransactionService services.TransactionService
 	WalletService      services.WalletService
 	ContractService    services.ContractService
+	ContractCache      *services.ContractCache
+	IdentityService    services.IdentityService
+	ExpiryService      services.ExpiryService
+	LimitService       services.LimitService
+	IdempotencyService services.IdempotencyService
+	FxService          services.FxService
 	Nats               *nats.Client
 }
 
@@ -36,23 +45,100 @@ type TransactionInput struct {
 	Amount                 int64           `json:"amount" binding:"required"`
 	Metadata               json.RawMessage `json:"metadata"`
 	TransactionInitiatedBy string          `json:"transactionInitiatedBy"`
+	// ExternalId is the caller supplied transaction id, also used as idempotency key
+	ExternalId string `json:"externalId"`
+	// QuoteToken prices the transaction as quoted, issue and redeem only
+	QuoteToken string `json:"quoteToken"`
+	// SourceCurrency is the ISO currency of the amount, it is converted into
+	// the currency of the contract. Empty is the currency of the contract.
+	SourceCurrency string `json:"sourceCurrency"`
 }
 
+type QuoteInput struct {
+	// [issue, redeem]
+	TransactionType string `json:"transactionType" binding:"required"`
+	TransactionInput
+}
+
+type DepositInput struct {
+	To     string `json:"to" binding:"required"`
+	Amount int64  `json:"amount" binding:"required"`
+	// [external_program, cash]
+	Source                 string          `json:"source" binding:"required"`
+	SourceReference        string          `json:"sourceReference" binding:"required"`
+	Metadata               json.RawMessage `json:"metadata"`
+	TransactionInitiatedBy string          `json:"transactionInitiatedBy"`
+	ExternalId             string          `json:"externalId"`
+}
+
+type WithdrawInput struct {
+	From   string `json:"from" binding:"required"`
+	Amount int64  `json:"amount" binding:"required"`
+	// [external_program, cash]
+	Destination            string          `json:"destination" binding:"required"`
+	DestinationReference   string          `json:"destinationReference" binding:"required"`
+	Metadata               json.RawMessage `json:"metadata"`
+	TransactionInitiatedBy string          `json:"transactionInitiatedBy"`
+	ExternalId             string          `json:"externalId"`
+}
+
+type WithdrawSettleInput struct {
+	TransactionId string `json:"transactionId" binding:"required"`
+	// [completed, failed]
+	Status              string `json:"status" binding:"required"`
+	SettlementReference string `json:"settlementReference"`
+	Remarks             string `json:"remarks"`
+}
+
+type ReversalInput struct {
+	TransactionId string `json:"transactionId" binding:"required"`
+	// Amount to reverse in the unit of the original transaction, zero reverses the remaining amount
+	Amount     int64           `json:"amount"`
+	Reason     string          `json:"reason" binding:"required"`
+	Metadata   json.RawMessage `json:"metadata"`
+	ExternalId string          `json:"externalId"`
+}
+
+const (
+	TRANSFER_PARTY_EXTERNAL_PROGRAM = "external_program"
+	TRANSFER_PARTY_CASH             = "cash"
+)
+
 var (
 	ERR_INVALID_WALLET                  = errors.New("error: invalid wallet provided")
 	ERR_AMOUNT_NEGATIVE_OR_ZERO         = errors.New("error: amount can not be empty or zero")
 	ERR_SAME_FROM_AND_TO                = errors.New("error: from and to can not be same address")
 	ERR_INSUFICIENT_BALANCE             = errors.New("error: insuffient balance")
 	ERR_INVALID_TRANSACTION_ID_PROVIDED = errors.New("error: invalid transaction id provided")
+	ERR_INVALID_DEPOSIT_SOURCE          = errors.New("error: deposit source must be external_program or cash")
+	ERR_INVALID_WITHDRAW_DESTINATION    = errors.New("error: withdraw destination must be external_program or cash")
+	ERR_INVALID_SETTLEMENT_STATUS       = errors.New("error: settlement status must be completed or failed")
+	ERR_INVALID_STATUS_IDS              = errors.New("error: between 1 and 100 comma separated transaction ids are required")
+	ERR_INVALID_QUOTE_TYPE              = errors.New("error: only issue and redeem transactions can be quoted")
+	ERR_QUOTE_MISMATCH                  = errors.New("error: quote was made for another transaction")
+	ERR_QUOTE_BUDGET_EXHAUSTED          = errors.New("error: budget of a quoted contract is exhausted")
+	ERR_TRANSACTION_NEVER_PUBLISHED     = errors.New("error: transaction was never priced and published, it can not be published again")
+	ERR_REPUBLISH_BUDGET_EXHAUSTED      = errors.New("error: budget of a contract of the transaction is exhausted")
 )
 
+const MAX_STATUS_IDS = 100
+
+// time a quote is honoured for
+const quote_validity = 5 * time.Minute
+
 // constructor calling
-func NewTransactionController(logger *log.Logger, transactionService services.TransactionService, contractService services.ContractService, walletService services.WalletService, nats *nats.Client) TransactionController {
+func NewTransactionController(logger *log.Logger, transactionService services.TransactionService, contractService services.ContractService, contractCache *services.ContractCache, walletService services.WalletService, identityService services.IdentityService, expiryService services.ExpiryService, limitService services.LimitService, idempotencyService services.IdempotencyService, fxService services.FxService, nats *nats.Client) TransactionController {
 	return TransactionController{
 		logger:             logger,
 		TransactionService: transactionService,
 		ContractService:    contractService,
+		ContractCache:      contractCache,
 		WalletService:      walletService,
+		IdentityService:    identityService,
+		ExpiryService:      expiryService,
+		LimitService:       limitService,
+		IdempotencyService: idempotencyService,
+		FxService:          fxService,
 		Nats:               nats,
 	}
 }
@@ -78,6 +164,11 @@ func (controller *TransactionController) issue(ctx *gin.Context) {
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_SAME_FROM_AND_TO.Error(), fmt.Sprintf("got: from %s & to %s", input.From, input.To))
 		return
 	}
+	sourceCurrency, err := parseCurrency(input.SourceCurrency)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.SourceCurrency))
+		return
+	}
 
 	span.SetAttributes(attribute.String("From", input.From))
 	span.SetAttributes(attribute.String("To", input.To))
@@ -85,9 +176,9 @@ func (controller *TransactionController) issue(ctx *gin.Context) {
 	span.SetAttributes(attribute.String("Transaction Type", "issue"))
 
 	// check if From is valid
-	walletFrom, err := controller.WalletService.Get(ctx.Request.Context(), input.From)
-	if common.IsStructEmpty(walletFrom) || walletFrom.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletFrom))
+	walletFrom, err := controller.transactingWallet(ctx.Request.Context(), input.From, true)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.From))
 		return
 	}
 	// check if From has available balance
@@ -97,13 +188,14 @@ func (controller *TransactionController) issue(ctx *gin.Context) {
 	}
 
 	// check if To is valid
-	walletTo, err := controller.WalletService.Get(ctx.Request.Context(), input.To)
-	if common.IsStructEmpty(walletTo) || walletTo.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletTo))
+	walletTo, err := controller.transactingWallet(ctx.Request.Context(), input.To, false)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.To))
 		return
 	}
 
 	var transaction models.Transaction
+	transaction.ExtID = middleware.TransactionId(ctx, input.ExternalId)
 	transaction.FromExtID = input.From
 	transaction.ToExtID = input.To
 	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
@@ -111,11 +203,41 @@ func (controller *TransactionController) issue(ctx *gin.Context) {
 	transaction.ToUUID = walletTo.UUID
 
 	transaction.Amount = input.Amount
+	transaction.SourceCurrency = sourceCurrency
 	transaction.Metadata = input.Metadata
 	transaction.TransactionType = "issue"
 
+	// a quoted transaction is priced as it was quoted
+	var quote *models.Quote
+	if input.QuoteToken != "" {
+		quote, err = controller.readQuote(ctx, &transaction, input.QuoteToken)
+		if err != nil {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
+		}
+	}
+
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &transaction, quotedPoints(&transaction, quote), &walletFrom, &walletTo)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	releaseBudgets := func() {}
+	if quote != nil {
+		releaseBudgets, err = controller.applyQuote(ctx.Request.Context(), &transaction, quote)
+		if err != nil {
+			releaseLimits()
+			common.PrepareCustomError(ctx, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
+		}
+	}
+
 	err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
 	if err != nil {
+		releaseLimits()
+		releaseBudgets()
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
 		return
 	}
@@ -155,11 +277,16 @@ func (controller *TransactionController) redeem(ctx *gin.Context) {
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_SAME_FROM_AND_TO.Error(), fmt.Sprintf("got: from %s & to %s", input.From, input.To))
 		return
 	}
+	sourceCurrency, err := parseCurrency(input.SourceCurrency)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.SourceCurrency))
+		return
+	}
 
 	// check if From is valid
-	walletFrom, err := controller.WalletService.Get(ctx.Request.Context(), input.From)
-	if common.IsStructEmpty(walletFrom) || walletFrom.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletFrom))
+	walletFrom, err := controller.transactingWallet(ctx.Request.Context(), input.From, true)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.From))
 		return
 	}
 	// check if From has available balance
@@ -168,14 +295,23 @@ func (controller *TransactionController) redeem(ctx *gin.Context) {
 		return
 	}
 
+	// check if the caller may spend from the shared wallet
+	spender, release, err := controller.authorizeSpend(ctx, input.From, input.Amount)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
 	// check if To is valid
-	walletTo, err := controller.WalletService.Get(ctx.Request.Context(), input.To)
-	if common.IsStructEmpty(walletTo) || walletTo.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletTo))
+	walletTo, err := controller.transactingWallet(ctx.Request.Context(), input.To, false)
+	if err != nil {
+		release()
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.To))
 		return
 	}
 
 	var transaction models.Transaction
+	transaction.ExtID = middleware.TransactionId(ctx, input.ExternalId)
 	transaction.FromExtID = input.From
 	transaction.ToExtID = input.To
 	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
@@ -183,11 +319,47 @@ func (controller *TransactionController) redeem(ctx *gin.Context) {
 	transaction.ToUUID = walletTo.UUID
 
 	transaction.Amount = input.Amount
+	transaction.SourceCurrency = sourceCurrency
 	transaction.Metadata = input.Metadata
 	transaction.TransactionType = "redeem"
+	if spender != "" {
+		transaction.AllowanceIdentity = spender
+		transaction.AllowanceAmount = input.Amount
+	}
+
+	// a quoted transaction is priced as it was quoted
+	var quote *models.Quote
+	if input.QuoteToken != "" {
+		quote, err = controller.readQuote(ctx, &transaction, input.QuoteToken)
+		if err != nil {
+			release()
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
+		}
+	}
+
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &transaction, quotedPoints(&transaction, quote), &walletFrom, &walletTo)
+	if err != nil {
+		release()
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if quote != nil {
+		// redeemed points are not taken from contract budgets
+		if _, err := controller.applyQuote(ctx.Request.Context(), &transaction, quote); err != nil {
+			releaseLimits()
+			release()
+			common.PrepareCustomError(ctx, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
+		}
+	}
 
 	err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
 	if err != nil {
+		releaseLimits()
+		release()
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
 		return
 	}
@@ -223,9 +395,9 @@ func (controller *TransactionController) transfer(ctx *gin.Context) {
 	}
 
 	// check if From is valid
-	walletFrom, err := controller.WalletService.Get(ctx.Request.Context(), input.From)
-	if common.IsStructEmpty(walletFrom) || walletFrom.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletFrom))
+	walletFrom, err := controller.transactingWallet(ctx.Request.Context(), input.From, true)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.From))
 		return
 	}
 	// check if From has available balance
@@ -234,14 +406,23 @@ func (controller *TransactionController) transfer(ctx *gin.Context) {
 		return
 	}
 
+	// check if the caller may spend from the shared wallet
+	spender, release, err := controller.authorizeSpend(ctx, input.From, input.Amount)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
 	// check if To is valid
-	walletTo, err := controller.WalletService.Get(ctx.Request.Context(), input.To)
-	if common.IsStructEmpty(walletTo) || walletTo.UUID == "" {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WALLET.Error(), fmt.Sprintf("got :%v ", walletTo))
+	walletTo, err := controller.transactingWallet(ctx.Request.Context(), input.To, false)
+	if err != nil {
+		release()
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.To))
 		return
 	}
 
 	var transaction models.Transaction
+	transaction.ExtID = middleware.TransactionId(ctx, input.ExternalId)
 	transaction.FromExtID = input.From
 	transaction.ToExtID = input.To
 	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
@@ -251,9 +432,23 @@ func (controller *TransactionController) transfer(ctx *gin.Context) {
 	transaction.Amount = input.Amount
 	transaction.Metadata = input.Metadata
 	transaction.TransactionType = "transfer"
+	if spender != "" {
+		transaction.AllowanceIdentity = spender
+		transaction.AllowanceAmount = input.Amount
+	}
+
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &transaction, transaction.Amount, &walletFrom, &walletTo)
+	if err != nil {
+		release()
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
 
 	err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
 	if err != nil {
+		releaseLimits()
+		release()
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
 		return
 	}
@@ -266,214 +461,1694 @@ func (controller *TransactionController) transfer(ctx *gin.Context) {
 }
 
 func (controller *TransactionController) deposit(ctx *gin.Context) {
+	fName := "controller/transaction/deposit"
+	tracer := otel.Tracer("deposit")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
 
-}
+	var input DepositInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
 
-func (controller *TransactionController) withdraw(ctx *gin.Context) {
+	if input.Amount <= 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
+		return
+	}
 
-}
+	if input.Source != TRANSFER_PARTY_EXTERNAL_PROGRAM && input.Source != TRANSFER_PARTY_CASH {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_DEPOSIT_SOURCE.Error(), fmt.Sprintf("got :%s ", input.Source))
+		return
+	}
 
-// TODO: to remove all un required filed before returning outdide system
-func (controller *TransactionController) TransactionGet(ctx *gin.Context) {
-	fName := "transactioncontrller/get"
-	tracer := otel.Tracer("TransactionGet")
-	_, span := tracer.Start(ctx.Request.Context(), fName)
-	defer span.End()
+	span.SetAttributes(attribute.String("To", input.To))
+	span.SetAttributes(attribute.Int64("Amount", input.Amount))
+	span.SetAttributes(attribute.String("Source", input.Source))
+	span.SetAttributes(attribute.String("Transaction Type", services.TRANSACTION_TYPE_DEPOSIT))
 
-	transactionId := ctx.Query("transactionId")
-	if transactionId == "" {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": "transaction id is required",
-		})
+	// check if To is valid
+	walletTo, err := controller.transactingWallet(ctx.Request.Context(), input.To, false)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.To))
 		return
 	}
 
-	transaction, err := controller.TransactionService.Get(ctx.Request.Context(), transactionId)
+	var transaction models.Transaction
+	transaction.ExtID = middleware.TransactionId(ctx, input.ExternalId)
+	transaction.ToExtID = input.To
+	transaction.ToUUID = walletTo.UUID
+	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
+	transaction.Source = input.Source
+	transaction.SourceReference = input.SourceReference
+
+	transaction.Amount = input.Amount
+	transaction.Metadata = input.Metadata
+	transaction.TransactionType = services.TRANSACTION_TYPE_DEPOSIT
+
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &transaction, transaction.Amount, nil, &walletTo)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": err.Error(),
-		})
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{
-		"message": "success",
-		"body":    transaction,
-	})
+	err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
+	if err != nil {
+		releaseLimits()
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+	span.AddEvent("transaction created to database")
+
+	// publishing to nats
+	go controller.ApplyBusinessContractAndPublishToNats(ctx.Request.Context(), &transaction)
+	common.PrepareCustomResponse(ctx, "points deposited", struct {
+		Identifier string `json:"identifier"`
+	}{Identifier: transaction.ExtID})
 }
 
-func (controller *TransactionController) TransactionFilter(ctx *gin.Context) {
-	fName := "transactioncontrller/filter"
-	tracer := otel.Tracer("TransactionFilter")
+func (controller *TransactionController) withdraw(ctx *gin.Context) {
+	fName := "controller/transaction/withdraw"
+	tracer := otel.Tracer("withdraw")
 	_, span := tracer.Start(ctx.Request.Context(), fName)
 	defer span.End()
 
-	type Transaction struct {
-		Identifier             string    `json:"identifier"`
-		Amount                 int64     `json:"amount"`
-		From                   string    `json:"from"`
-		To                     string    `json:"to"`
-		Currency               string    `json:"currency"`
-		TransactionType        string    `json:"transactionType"`
-		CreatedOn              time.Time `json:"createdOn"`
-		Creator                string    `json:"creator"`
-		IsCommitedOnBlockchain bool      `json:"isCommited,omitempty"`
+	var input WithdrawInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
 	}
 
-	var transaction Transaction
-	if err := ctx.BindJSON(&transaction); err != nil {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+	if input.Amount <= 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
 		return
 	}
 
-	queryString := ""
-	if transaction.From != "" {
-		queryString += " AND from_extid=$from"
+	if input.Destination != TRANSFER_PARTY_EXTERNAL_PROGRAM && input.Destination != TRANSFER_PARTY_CASH {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_WITHDRAW_DESTINATION.Error(), fmt.Sprintf("got :%s ", input.Destination))
+		return
 	}
 
-	if transaction.To != "" {
-		queryString += " AND to_extid=$to"
-	}
+	span.SetAttributes(attribute.String("From", input.From))
+	span.SetAttributes(attribute.Int64("Amount", input.Amount))
+	span.SetAttributes(attribute.String("Destination", input.Destination))
+	span.SetAttributes(attribute.String("Transaction Type", services.TRANSACTION_TYPE_WITHDRAW))
 
-	if transaction.Amount > 0 {
-		queryString += " AND amount=$amount"
+	// check if From is valid
+	walletFrom, err := controller.transactingWallet(ctx.Request.Context(), input.From, true)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.From))
+		return
+	}
+	// check if From has available balance
+	if walletFrom.Balance <= 0 || walletFrom.Balance < input.Amount {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INSUFICIENT_BALANCE.Error(), fmt.Sprintf("got :%v ", walletFrom))
+		return
 	}
 
-	results, err := controller.TransactionService.Filter(ctx.Request.Context(), queryString, map[string]interface{}{
-		"from":   transaction.From,
-		"to":     transaction.To,
-		"amount": transaction.Amount,
-	}, "createdAt", -1)
-
+	// check if the caller may spend from the shared wallet
+	spender, release, err := controller.authorizeSpend(ctx, input.From, input.Amount)
 	if err != nil {
-		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: no transaction found", fmt.Sprintf("%s", err))
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
 		return
 	}
 
-	transactions := []Transaction{}
+	var transaction models.Transaction
+	transaction.ExtID = middleware.TransactionId(ctx, input.ExternalId)
+	transaction.FromExtID = input.From
+	transaction.FromUUID = walletFrom.UUID
+	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
+	transaction.Destination = input.Destination
+	transaction.DestinationReference = input.DestinationReference
+	transaction.SettlementStatus = services.SETTLEMENT_STATUS_PENDING
 
-	for _, row := range results {
-		var tx Transaction
-		tx.Identifier = row.ExtID
-		tx.Amount = row.Amount
-		tx.From = row.FromExtID
-		tx.To = row.ToExtID
-		tx.TransactionType = row.TransactionType
-		tx.Creator = row.Creator
-		tx.CreatedOn = row.CreatedOn
+	transaction.Amount = input.Amount
+	transaction.Metadata = input.Metadata
+	transaction.TransactionType = services.TRANSACTION_TYPE_WITHDRAW
+	if spender != "" {
+		transaction.AllowanceIdentity = spender
+		transaction.AllowanceAmount = input.Amount
+	}
 
-		if row.UUID != "" {
-			tx.IsCommitedOnBlockchain = true
-		}
-		transactions = append(transactions, tx)
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &transaction, transaction.Amount, &walletFrom, nil)
+	if err != nil {
+		release()
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
 
+	err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
+	if err != nil {
+		releaseLimits()
+		release()
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
 	}
+	span.AddEvent("transaction created to database")
 
-	common.PrepareCustomResponse(ctx, "transaction filtered", transactions)
+	// publishing to nats
+	go controller.ApplyBusinessContractAndPublishToNats(ctx.Request.Context(), &transaction)
+	common.PrepareCustomResponse(ctx, "points withdrawn", struct {
+		Identifier       string `json:"identifier"`
+		SettlementStatus string `json:"settlementStatus"`
+	}{Identifier: transaction.ExtID, SettlementStatus: transaction.SettlementStatus})
 }
 
-func (controller *TransactionController) ApplyBusinessContractAndPublishToNats(ctx context.Context, transaction *models.Transaction) {
-	fName := "controller/transaction/applyBusinessContractAndPublishToNats"
-	tracer := otel.Tracer("api")
-	_, span := tracer.Start(ctx, fName)
+// withdrawSettle records the external settlement confirmation of a withdrawal. A
+// failed settlement gives the withdrawn points back to the wallet.
+func (controller *TransactionController) withdrawSettle(ctx *gin.Context) {
+	fName := "controller/transaction/withdrawSettle"
+	tracer := otel.Tracer("withdrawSettle")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
 	defer span.End()
 
-	contracts, err := controller.ContractService.Filter(ctx, "AND isDeleted=false", map[string]interface{}{}, "createdAt", -1)
-	if err != nil {
-		controller.logger.Println("failed to query the contract for dynamic application: %w", err)
+	var input WithdrawSettleInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
 	}
 
-	span.AddEvent("filtered " + strconv.Itoa(len(contracts)) + "contracts from the database")
+	if input.Status != services.SETTLEMENT_STATUS_COMPLETED && input.Status != services.SETTLEMENT_STATUS_FAILED {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_SETTLEMENT_STATUS.Error(), fmt.Sprintf("got :%s ", input.Status))
+		return
+	}
 
-	location, _ := time.LoadLocation("UTC")
-	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
-	if len(contracts) > 0 {
-		// sorting based on priority
-		sort.Slice(contracts, func(i, j int) bool {
-			return contracts[i].Priorty > contracts[j].Priorty
-		})
+	transaction, err := controller.TransactionService.Get(ctx.Request.Context(), input.TransactionId)
+	if err != nil || transaction.TransactionType != services.TRANSACTION_TYPE_WITHDRAW {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_TRANSACTION_ID_PROVIDED.Error(), fmt.Sprintf("got :%s ", input.TransactionId))
+		return
+	}
 
-		filteredContract := []models.Contract{}
-		for _, row := range contracts {
-			if row.ValidFrom.Before(now) && row.ValidUntill.After(now) {
-				filteredContract = append(filteredContract, *row)
-			}
+	// only the settlement that moves the withdrawal out of pending refunds it
+	transaction, err = controller.TransactionService.Settle(ctx.Request.Context(), transaction.ExtID, input.Status, input.SettlementReference, input.Remarks)
+	if errors.Is(err, services.ERR_WITHDRAW_NOT_PENDING) || errors.Is(err, services.ERR_WITHDRAW_NOT_BOOKED) {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", transaction.SettlementStatus))
+		return
+	}
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+	span.AddEvent("settlement recorded")
+
+	if input.Status == services.SETTLEMENT_STATUS_FAILED {
+		// the withdrawn points are given back by a reversal of the withdrawal: the
+		// contract is not applied again, the points go back into the lots they
+		// came from and, once committed, the withdrawal releases what it held
+		var refund models.Transaction
+		refund.ToExtID = transaction.FromExtID
+		refund.ToUUID = transaction.FromUUID
+		refund.ReversalOf = transaction.ExtID
+		refund.AppliedContract = transaction.AppliedContract
+		refund.AppliedContractVersion = transaction.AppliedContractVersion
+		refund.OriginalAmount = transaction.OriginalAmount
+		refund.Amount = transaction.Amount
+		refund.TransactionType = services.TRANSACTION_TYPE_REVERSAL
+		refund.TransactionInitiatedBy = transaction.TransactionInitiatedBy
+		refund.Remarks = "refund of failed withdrawal " + transaction.ExtID
+
+		err = controller.TransactionService.Create(ctx.Request.Context(), &refund)
+		if err != nil {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+			return
 		}
+		go controller.publishTransactionToNats(ctx.Request.Context(), &refund)
+	}
 
-		if len(filteredContract) > 0 {
-			sort.Slice(filteredContract, func(i, j int) bool {
-				return filteredContract[i].Priorty > filteredContract[j].Priorty
-			})
+	common.PrepareCustomResponse(ctx, "withdrawal settled", struct {
+		Identifier       string `json:"identifier"`
+		SettlementStatus string `json:"settlementStatus"`
+	}{Identifier: transaction.ExtID, SettlementStatus: transaction.SettlementStatus})
+}
 
-			maxPriority := filteredContract[0].Priorty
-			maxPriorityContract := []models.Contract{}
-			for _, row := range filteredContract {
-				if row.Priorty == maxPriority {
-					maxPriorityContract = append(maxPriorityContract, row)
-				}
-			}
+// reverse creates a compensating transaction for a full or partial amount of the
+// original transaction and marks the original as (partially) reversed.
+func (controller *TransactionController) reverse(ctx *gin.Context) {
+	fName := "controller/transaction/reverse"
+	tracer := otel.Tracer("reverse")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
 
-			var applicableContract models.Contract
-			if len(maxPriorityContract) == 1 {
-				applicableContract = filteredContract[0]
-			} else {
-				sort.Slice(maxPriorityContract, func(i, j int) bool {
-					return filteredContract[i].LastUpdatedAt.Unix() > filteredContract[j].LastUpdatedAt.Unix()
-				})
+	var input ReversalInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
 
-				applicableContract = maxPriorityContract[0]
-			}
+	if input.Amount < 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
+		return
+	}
 
-			// apply contract
-			if transaction.TransactionType == "issue" {
-				span.AddEvent("applying " + strconv.Itoa(int(applicableContract.EarnConversionRatio)) + "as earn rate to the transaction")
-				transaction.Amount = transaction.Amount * applicableContract.EarnConversionRatio
-				transaction.AppliedContract = applicableContract.Identifier
-			}
-			if transaction.TransactionType == "redeem" {
-				span.AddEvent("applying " + strconv.Itoa(int(applicableContract.BurnConversionRatio)) + "as burn rate to the transaction")
-				transaction.Amount = transaction.Amount * applicableContract.BurnConversionRatio
-				transaction.AppliedContract = applicableContract.Identifier
-			}
+	span.SetAttributes(attribute.String("Transaction", input.TransactionId))
+	span.SetAttributes(attribute.Int64("Amount", input.Amount))
+	span.SetAttributes(attribute.String("Transaction Type", services.TRANSACTION_TYPE_REVERSAL))
+
+	original, err := controller.TransactionService.Get(ctx.Request.Context(), input.TransactionId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_TRANSACTION_ID_PROVIDED.Error(), fmt.Sprintf("got :%s ", input.TransactionId))
+		return
+	}
+
+	// the reversal moves the points in the opposite direction
+	var reversal models.Transaction
+	reversal.ExtID = middleware.TransactionId(ctx, input.ExternalId)
+	if reversal.ExtID == "" {
+		reversal.ExtID = common.GenerateIdentifier(62)
+	}
+	reversal.FromExtID = original.ToExtID
+	reversal.FromUUID = original.ToUUID
+	reversal.ToExtID = original.FromExtID
+	reversal.ToUUID = original.FromUUID
+	reversal.ReversalOf = original.ExtID
+	reversal.AppliedContract = original.AppliedContract
+	reversal.AppliedContractVersion = original.AppliedContractVersion
+	reversal.TransactionType = services.TRANSACTION_TYPE_REVERSAL
+	reversal.TransactionInitiatedBy = original.TransactionInitiatedBy
+	reversal.Metadata = input.Metadata
+	reversal.Remarks = input.Reason
+
+	original, amount, points, err := controller.TransactionService.ReserveReversal(ctx.Request.Context(), input.TransactionId, input.Amount, reversal.ExtID)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
 
+	// the wallets must still be able to send and receive, and the debited one
+	// must still hold the points
+	var walletFrom, walletTo *models.Wallet
+	if reversal.FromExtID != "" {
+		wallet, err := controller.transactingWallet(ctx.Request.Context(), reversal.FromExtID, true)
+		if err != nil {
+			controller.TransactionService.ReleaseReversal(ctx.Request.Context(), original.ExtID, amount, points, reversal.ExtID)
+			common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
+		}
+		if wallet.Balance < points {
+			controller.TransactionService.ReleaseReversal(ctx.Request.Context(), original.ExtID, amount, points, reversal.ExtID)
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INSUFICIENT_BALANCE.Error(), fmt.Sprintf("got :%v ", wallet))
+			return
+		}
+		walletFrom = &wallet
+	}
+	if reversal.ToExtID != "" {
+		wallet, err := controller.transactingWallet(ctx.Request.Context(), reversal.ToExtID, false)
+		if err != nil {
+			controller.TransactionService.ReleaseReversal(ctx.Request.Context(), original.ExtID, amount, points, reversal.ExtID)
+			common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+			return
 		}
+		walletTo = &wallet
+	}
+
+	reversal.OriginalAmount = amount
+	reversal.Amount = points
 
+	// check the velocity limits of the wallets
+	releaseLimits, err := controller.reserveLimits(ctx.Request.Context(), &reversal, reversal.Amount, walletFrom, walletTo)
+	if err != nil {
+		controller.TransactionService.ReleaseReversal(ctx.Request.Context(), original.ExtID, amount, points, reversal.ExtID)
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
 	}
-	controller.publishTransactionToNats(ctx, transaction)
 
+	err = controller.TransactionService.Create(ctx.Request.Context(), &reversal)
+	if err != nil {
+		releaseLimits()
+		controller.TransactionService.ReleaseReversal(ctx.Request.Context(), original.ExtID, amount, points, reversal.ExtID)
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+	span.AddEvent("reversal created to database")
+
+	// publishing to nats, the contract is not applied again
+	go controller.publishTransactionToNats(ctx.Request.Context(), &reversal)
+	common.PrepareCustomResponse(ctx, "transaction reversed", struct {
+		Identifier     string `json:"identifier"`
+		ReversalOf     string `json:"reversalOf"`
+		Amount         int64  `json:"amount"`
+		Points         int64  `json:"points"`
+		ReversalStatus string `json:"reversalStatus"`
+	}{Identifier: reversal.ExtID, ReversalOf: original.ExtID, Amount: amount, Points: points, ReversalStatus: original.ReversalStatus})
 }
 
-func (controller *TransactionController) publishTransactionToNats(ctx context.Context, transaction *models.Transaction) {
-	fName := "controller/transaction/publishTransactionToNats"
+// Submit creates and publishes a transaction on behalf of a background process
+// (the scheduler or a bulk upload) with the checks of the earn, redeem and
+// transfer endpoints, the contracts valid at that time are applied. The external
+// id of the input is the id of the transaction so that it is never booked twice.
+func (controller *TransactionController) Submit(ctx context.Context, transactionType string, input TransactionInput, remarks string) (models.Transaction, error) {
+	fName := "controller/transaction/submit"
 	tracer := otel.Tracer("api")
 	_, span := tracer.Start(ctx, fName)
 	defer span.End()
 
-	var request nats.TopicEncoder
-	request = &models.TransferRequest{
-		RefID:   transaction.RefID,
-		From:    transaction.FromUUID,
-		To:      transaction.ToUUID,
-		Channel: transaction.Channel,
-		Amount:  transaction.Amount,
-		Update:  !transaction.Spend,
+	if input.Amount <= 0 {
+		return models.Transaction{}, ERR_AMOUNT_NEGATIVE_OR_ZERO
+	}
+	if input.From == input.To {
+		return models.Transaction{}, ERR_SAME_FROM_AND_TO
+	}
+	sourceCurrency, err := parseCurrency(input.SourceCurrency)
+	if err != nil {
+		return models.Transaction{}, err
 	}
 
-	// in case of issue request
-	if transaction.FromExtID == "" {
-		request = &models.IssueRequest{
-			ID:      transaction.ToUUID,
-			RefID:   transaction.RefID,
-			Amount:  transaction.Amount,
-			Channel: transaction.Channel,
-		}
+	walletFrom, err := controller.transactingWallet(ctx, input.From, true)
+	if err != nil {
+		return models.Transaction{}, err
 	}
-	if err := controller.Nats.Publish(ctx, request); err != nil {
-		controller.logger.Println("failed to write wallet to NATS (failing over to retry service): %w", err)
-		span.AddEvent("failed to write wallet to NATS")
-		span.SetStatus(codes.Error, "failed to write wallet to NATS")
+	if walletFrom.Balance <= 0 || walletFrom.Balance < input.Amount {
+		return models.Transaction{}, ERR_INSUFICIENT_BALANCE
+	}
+	walletTo, err := controller.transactingWallet(ctx, input.To, false)
+	if err != nil {
+		return models.Transaction{}, err
+	}
+
+	var transaction models.Transaction
+	transaction.ExtID = input.ExternalId
+	transaction.FromExtID = input.From
+	transaction.ToExtID = input.To
+	transaction.TransactionInitiatedBy = input.TransactionInitiatedBy
+	transaction.FromUUID = walletFrom.UUID
+	transaction.ToUUID = walletTo.UUID
+	transaction.Amount = input.Amount
+	transaction.SourceCurrency = sourceCurrency
+	transaction.Metadata = input.Metadata
+	transaction.TransactionType = transactionType
+	transaction.Remarks = remarks
+
+	releaseLimits, err := controller.reserveLimits(ctx, &transaction, transaction.Amount, &walletFrom, &walletTo)
+	if err != nil {
+		return transaction, err
+	}
+
+	err = controller.TransactionService.Create(ctx, &transaction)
+	if err != nil {
+		releaseLimits()
+		return transaction, err
+	}
+	span.AddEvent("transaction created to database")
+
+	// transfers are published as they are, like the transfer endpoint does
+	if transaction.TransactionType == services.TRANSACTION_TYPE_TRANSFER {
+		controller.publishTransactionToNats(ctx, &transaction)
+	} else {
+		controller.ApplyBusinessContractAndPublishToNats(ctx, &transaction)
+	}
+	return transaction, nil
+}
+
+// transactingWallet loads a wallet taking part in a transaction and checks that
+// its status allows points to leave (outbound) or to come in.
+func (controller *TransactionController) transactingWallet(ctx context.Context, walletId string, outbound bool) (models.Wallet, error) {
+	wallet, err := controller.WalletService.Get(ctx, walletId)
+	if err != nil {
+		return wallet, err
+	}
+	if common.IsStructEmpty(wallet) || wallet.UUID == "" {
+		return wallet, ERR_INVALID_WALLET
+	}
+
+	if outbound {
+		return wallet, services.CanSend(wallet)
+	}
+	return wallet, services.CanReceive(wallet)
+}
+
+// reserveLimits counts the points of the transaction against the velocity
+// limits of the wallet sending (burn) and the wallet receiving (earn) them, the
+// counters are recorded on the transaction. The returned func gives the
+// counters back when the transaction is not accepted.
+func (controller *TransactionController) reserveLimits(ctx context.Context, transaction *models.Transaction, points int64, walletFrom *models.Wallet, walletTo *models.Wallet) (func(), error) {
+	operatorId, _ := controller.resolveParties(ctx, transaction)
+
+	reservations := []*services.LimitReservation{}
+	release := func() {
+		for _, reservation := range reservations {
+			controller.LimitService.Release(context.Background(), reservation)
+		}
+		transaction.LimitCounters = nil
+	}
+
+	for _, party := range []struct {
+		wallet    *models.Wallet
+		direction string
+	}{{walletFrom, services.LIMIT_DIRECTION_BURN}, {walletTo, services.LIMIT_DIRECTION_EARN}} {
+		if party.wallet == nil {
+			continue
+		}
+
+		subject := controller.limitSubject(ctx, *party.wallet, operatorId)
+		reservation, err := controller.LimitService.Reserve(ctx, subject, party.direction, points)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	transaction.LimitCounters = map[string]int64{}
+	for _, reservation := range reservations {
+		for key, delta := range reservation.Counters() {
+			transaction.LimitCounters[key] = delta
+		}
+	}
+	return release, nil
+}
+
+// rechargeLimits counts the transaction against the limits again once the
+// contract has priced it, the limits were charged with the amount submitted
+// and are charged with the points moved instead
+func (controller *TransactionController) rechargeLimits(ctx context.Context, transaction *models.Transaction) error {
+	if len(transaction.LimitCounters) == 0 || transaction.Amount == transaction.OriginalAmount {
+		return nil
+	}
+
+	var walletFrom, walletTo *models.Wallet
+	if transaction.FromExtID != "" {
+		wallet, err := controller.WalletService.Get(ctx, transaction.FromExtID)
+		if err != nil {
+			return err
+		}
+		walletFrom = &wallet
+	}
+	if transaction.ToExtID != "" {
+		wallet, err := controller.WalletService.Get(ctx, transaction.ToExtID)
+		if err != nil {
+			return err
+		}
+		walletTo = &wallet
+	}
+
+	controller.LimitService.ReleaseCounters(ctx, transaction.LimitCounters, transaction.OriginalAmount, transaction.OriginalAmount)
+	transaction.LimitCounters = nil
+	_, err := controller.reserveLimits(ctx, transaction, transaction.Amount, walletFrom, walletTo)
+	return err
+}
+
+// quotedPoints are the points a quoted transaction will move
+func quotedPoints(transaction *models.Transaction, quote *models.Quote) int64 {
+	if quote == nil || len(quote.Lines) == 0 {
+		return transaction.Amount
+	}
+	return services.LinesPoints(quote.Lines)
+}
+
+// limitSubject describes the wallet to the limit policies
+func (controller *TransactionController) limitSubject(ctx context.Context, wallet models.Wallet, operatorId string) models.LimitSubject {
+	subject := models.LimitSubject{WalletId: wallet.Identifier, WalletType: wallet.WalletType, OperatorId: operatorId}
+	for _, identityId := range wallet.LinkedTo {
+		identity, err := controller.IdentityService.Get(ctx, identityId)
+		if err != nil {
+			continue
+		}
+		subject.IdentityTypes = append(subject.IdentityTypes, identity.IdentityType)
+	}
+	return subject
+}
+
+func (controller *TransactionController) limitRemaining(ctx *gin.Context) {
+	fName := "controller/transaction/limitRemaining"
+	tracer := otel.Tracer("limitRemaining")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
+
+	wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// the operator can be given to see the limits of a program, the operator
+	// linked to the wallet is taken otherwise
+	operatorId := ctx.Query("operatorId")
+	if operatorId == "" {
+		operatorId, _ = controller.resolveParties(ctx.Request.Context(), &models.Transaction{ToExtID: walletId})
+	}
+
+	allowances, err := controller.LimitService.Remaining(ctx.Request.Context(), controller.limitSubject(ctx.Request.Context(), wallet, operatorId))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "remaining limits fetched", allowances)
+}
+
+// authorizeSpend checks the role and the remaining allowance of a member on the
+// wallet it spends from. Consumers must be members of the wallet, other roles
+// are held to the allowance when they share the wallet. The member charged is
+// returned with a func giving the allowance back when the spend does not go
+// through.
+func (controller *TransactionController) authorizeSpend(ctx *gin.Context, walletId string, amount int64) (string, func(), error) {
+	identityId := ctx.GetString(token.SESSION_USER_IDENTIFIER)
+	if ctx.GetString(token.SESSION_ROLE) != "consumer" {
+		wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletId)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, found := services.Member(wallet, identityId); !found {
+			return "", func() {}, nil
+		}
+	}
+
+	charged, err := controller.WalletService.ReserveAllowance(ctx.Request.Context(), walletId, identityId, amount)
+	if err != nil {
+		return "", nil, err
+	}
+	if !charged {
+		return "", func() {}, nil
+	}
+
+	return identityId, func() {
+		if err := controller.WalletService.ReleaseAllowance(context.Background(), walletId, identityId, amount); err != nil {
+			fmt.Print("failed to release the spend allowance: %w", err)
+		}
+	}, nil
+}
+
+// TODO: to remove all un required filed before returning outdide system
+func (controller *TransactionController) TransactionGet(ctx *gin.Context) {
+	fName := "transactioncontrller/get"
+	tracer := otel.Tracer("TransactionGet")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	transactionId := ctx.Query("transactionId")
+	if transactionId == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "transaction id is required",
+		})
+		return
+	}
+
+	transaction, err := controller.TransactionService.Get(ctx.Request.Context(), transactionId)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	transaction.Status = services.EffectiveStatus(transaction)
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "success",
+		"body":    transaction,
+	})
+}
+
+// TransactionFilterInput are the criteria of the transaction filter and export
+type TransactionFilterInput struct {
+	Amount          int64  `json:"amount"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	TransactionType string `json:"transactionType"`
+	// [accepted, published, committed, rejected, failed]
+	Status string `json:"status"`
+}
+
+// transactionSummary is a transaction as returned outside of the system
+type transactionSummary struct {
+	Identifier             string    `json:"identifier"`
+	Amount                 int64     `json:"amount"`
+	From                   string    `json:"from"`
+	To                     string    `json:"to"`
+	Currency               string    `json:"currency"`
+	TransactionType        string    `json:"transactionType"`
+	CreatedOn              time.Time `json:"createdOn"`
+	Creator                string    `json:"creator"`
+	IsCommitedOnBlockchain bool      `json:"isCommited,omitempty"`
+	// [accepted, published, committed, rejected, failed]
+	Status        string                           `json:"status"`
+	Error         string                           `json:"errmsg,omitempty"`
+	StatusHistory []models.TransactionStatusChange `json:"statusHistory,omitempty"`
+}
+
+func summarizeTransaction(row *models.Transaction) transactionSummary {
+	var tx transactionSummary
+	tx.Identifier = row.ExtID
+	tx.Amount = row.Amount
+	tx.From = row.FromExtID
+	tx.To = row.ToExtID
+	tx.Currency = row.Currency
+	tx.TransactionType = row.TransactionType
+	tx.Creator = row.Creator
+	tx.CreatedOn = row.CreatedOn
+	tx.Status = services.EffectiveStatus(*row)
+	tx.Error = row.Error
+	tx.StatusHistory = row.StatusHistory
+
+	if row.UUID != "" {
+		tx.IsCommitedOnBlockchain = true
+	}
+	return tx
+}
+
+// transactionFilterQuery builds the conditions of the transaction filter, it is
+// shared by the filter and the export so both select the same transactions
+func transactionFilterQuery(filter TransactionFilterInput) (string, map[string]interface{}) {
+	queryString := ""
+	if filter.From != "" {
+		queryString += " AND from_extid=$from"
+	}
+
+	if filter.To != "" {
+		queryString += " AND to_extid=$to"
+	}
+
+	if filter.Amount > 0 {
+		queryString += " AND amount=$amount"
+	}
+
+	if filter.TransactionType != "" {
+		queryString += " AND transactionType=$transactionType"
+	}
+
+	if filter.Status != "" {
+		queryString += " AND " + services.EffectiveStatusExpression + "=$status"
+	}
+
+	return queryString, map[string]interface{}{
+		"from":            filter.From,
+		"to":              filter.To,
+		"amount":          filter.Amount,
+		"transactionType": filter.TransactionType,
+		"status":          filter.Status,
+	}
+}
+
+func (controller *TransactionController) TransactionFilter(ctx *gin.Context) {
+	fName := "transactioncontrller/filter"
+	tracer := otel.Tracer("TransactionFilter")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var filter TransactionFilterInput
+	if err := ctx.BindJSON(&filter); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString, params := transactionFilterQuery(filter)
+	results, err := controller.TransactionService.Filter(ctx.Request.Context(), queryString, params, "createdOn", -1)
+
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: no transaction found", fmt.Sprintf("%s", err))
+		return
+	}
+
+	transactions := []transactionSummary{}
+
+	for _, row := range results {
+		transactions = append(transactions, summarizeTransaction(row))
+	}
+
+	common.PrepareCustomResponse(ctx, "transaction filtered", transactions)
+}
+
+// columns of the transaction export in their default order
+var transactionExportColumns = []string{"identifier", "amount", "from", "to", "currency", "transactionType", "createdOn", "creator", "isCommited", "status", "errmsg", "statusHistory"}
+
+// TransactionExport streams the transactions matching the filter as NDJSON or
+// CSV, the format, the columns and gzip are chosen with query parameters
+func (controller *TransactionController) TransactionExport(ctx *gin.Context) {
+	fName := "transactioncontrller/export"
+	tracer := otel.Tracer("TransactionExport")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var filter TransactionFilterInput
+	if err := ctx.BindJSON(&filter); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	writer, err := newExportWriter(ctx, transactionExportColumns, "transactions")
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString, params := transactionFilterQuery(filter)
+	err = controller.TransactionService.Export(ctx.Request.Context(), queryString, params, "createdOn", func(row *models.Transaction) error {
+		tx := summarizeTransaction(row)
+		return writer.Write(export.Record{
+			"identifier":      tx.Identifier,
+			"amount":          tx.Amount,
+			"from":            tx.From,
+			"to":              tx.To,
+			"currency":        tx.Currency,
+			"transactionType": tx.TransactionType,
+			"createdOn":       tx.CreatedOn,
+			"creator":         tx.Creator,
+			"isCommited":      tx.IsCommitedOnBlockchain,
+			"status":          tx.Status,
+			"errmsg":          tx.Error,
+			"statusHistory":   tx.StatusHistory,
+		})
+	})
+	finishExport(ctx, fName, writer, err)
+}
+
+func (controller *TransactionController) ApplyBusinessContractAndPublishToNats(ctx context.Context, transaction *models.Transaction) {
+	fName := "controller/transaction/applyBusinessContractAndPublishToNats"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	// a quoted transaction was priced when it was submitted, the budgets it took
+	// are recorded on it
+	releaseBudgets := func() { controller.releaseBudgets(ctx, transaction, transaction.Amount) }
+	if transaction.QuoteId == "" {
+		lines, release, err := controller.priceTransaction(ctx, transaction, true)
+		if err != nil {
+			controller.logger.Println("failed to apply the contract to the transaction: %w", err)
+			span.SetStatus(codes.Error, err.Error())
+			// the transaction never reaches the ledger, what it held when it was
+			// submitted is given back
+			controller.releaseHolds(ctx, transaction, transaction.Amount)
+			if err := controller.TransactionService.Update(ctx, transaction); err != nil {
+				controller.logger.Println("failed to record the released holds on the transaction: %w", err)
+			}
+			controller.setStatus(ctx, transaction, services.TRANSACTION_STATUS_FAILED, err.Error())
+			return
+		}
+
+		// apply contract
+		span.AddEvent("applying " + strconv.Itoa(len(lines)) + " contracts to the transaction")
+		applyContractLines(transaction, lines)
+		releaseBudgets = release
+
+		// the limits are held to the points the contract gives
+		if err := controller.rechargeLimits(ctx, transaction); err != nil {
+			controller.logger.Println("failed to count the priced transaction against the limits: %w", err)
+			span.SetStatus(codes.Error, err.Error())
+			releaseBudgets()
+			controller.releaseHolds(ctx, transaction, transaction.Amount)
+			controller.setStatus(ctx, transaction, services.TRANSACTION_STATUS_REJECTED, err.Error())
+			return
+		}
+	}
+
+	// recording the applied contract, reversals are priced from these amounts
+	if transaction.AppliedContract != "" {
+		if err := controller.TransactionService.Update(ctx, transaction); err != nil {
+			controller.logger.Println("failed to record the applied contract on the transaction: %w", err)
+		}
+	}
+	if err := controller.publishTransactionToNats(ctx, transaction); err != nil {
+		// nothing is held for a transaction that did not reach the ledger
+		releaseBudgets()
+		controller.releaseHolds(ctx, transaction, transaction.Amount)
+		if err := controller.TransactionService.Update(ctx, transaction); err != nil {
+			controller.logger.Println("failed to record the released holds on the transaction: %w", err)
+		}
+	}
+}
+
+// priceTransaction converts the original amount of the transaction into points
+// with the contracts of its operator and partner, one line per contributing
+// contract. No lines are returned when no contract applies. Earned points are
+// taken out of the contract budgets when consuming, the returned func gives
+// them back.
+func (controller *TransactionController) priceTransaction(ctx context.Context, transaction *models.Transaction, consume bool) ([]models.ContractLine, func(), error) {
+	fName := "controller/transaction/priceTransaction"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	earn := false
+	switch transaction.TransactionType {
+	case services.TRANSACTION_TYPE_ISSUE, services.TRANSACTION_TYPE_DEPOSIT:
+		earn = true
+	case services.TRANSACTION_TYPE_REDEEM, services.TRANSACTION_TYPE_WITHDRAW:
+	default:
+		return []models.ContractLine{}, func() {}, nil
+	}
+
+	// only the contracts of the operator and partner of the transaction price it
+	operatorId, partnerId := controller.resolveParties(ctx, transaction)
+	contracts, err := controller.ContractCache.Applicable(ctx, transaction.Channel, operatorId, partnerId)
+	if err != nil {
+		controller.logger.Println("failed to query the contract for dynamic application: %w", err)
+	}
+
+	span.AddEvent("found " + strconv.Itoa(len(contracts)) + " applicable contracts")
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	applicable := services.ApplicableContracts(contracts, operatorId, partnerId, now)
+
+	amount := services.Amount{Value: transaction.OriginalAmount, Currency: transaction.SourceCurrency}
+	if amount.Value == 0 {
+		amount.Value = transaction.Amount
+	}
+	amount.Rates, err = controller.fxRates(ctx, transaction, applicable)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	member, err := controller.bandMember(ctx, transaction, applicable, earn, now)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if !earn {
+		lines, err := services.PriceContracts(applicable, earn, amount, member)
+		return lines, func() {}, err
+	}
+
+	// a contract whose budget does not fit the points is left out and the
+	// transaction priced again with the others
+	for {
+		lines, err := services.PriceContracts(applicable, earn, amount, member)
+		if err != nil {
+			return nil, func() {}, err
+		}
+		exhausted, release, err := controller.consumeBudgets(ctx, transaction, applicable, lines, consume)
+		if err != nil {
+			return nil, func() {}, err
+		}
+		if exhausted == "" {
+			return lines, release, nil
+		}
+
+		span.AddEvent("budget of contract " + exhausted + " is exhausted")
+		remaining := []*models.Contract{}
+		for _, contract := range applicable {
+			if contract.Identifier != exhausted {
+				remaining = append(remaining, contract)
+			}
+		}
+		applicable = remaining
+	}
+}
+
+// fxRates reads the rates converting the amount of the transaction into the
+// currency of each contract, effective when the transaction was made
+func (controller *TransactionController) fxRates(ctx context.Context, transaction *models.Transaction, contracts []*models.Contract) (map[string]models.FxRate, error) {
+	rates := map[string]models.FxRate{}
+	if transaction.SourceCurrency == "" {
+		return rates, nil
+	}
+
+	at := transaction.CreatedOn
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+	for _, contract := range contracts {
+		currency := strings.ToUpper(contract.ConversionCurrency)
+		if _, ok := rates[currency]; ok || currency == "" || currency == transaction.SourceCurrency {
+			continue
+		}
+		// a contract without a rate only fails the pricing when it is used
+		rate, err := controller.FxService.Rate(ctx, transaction.SourceCurrency, currency, at)
+		if errors.Is(err, services.ERR_FX_RATE_NOT_FOUND) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rates[currency] = rate
+	}
+	return rates, nil
+}
+
+// bandMember reads what the bands of the contracts are chosen by: the tier of
+// the member earning or burning the points and what the member spent in the
+// band period of each contract
+func (controller *TransactionController) bandMember(ctx context.Context, transaction *models.Transaction, contracts []*models.Contract, earn bool, now time.Time) (services.BandMember, error) {
+	member := services.BandMember{Spend: map[string]int64{}}
+	walletId := transaction.FromExtID
+	if earn {
+		walletId = transaction.ToExtID
+	}
+
+	tierRead := false
+	spendSince := map[time.Time]int64{}
+	for _, contract := range contracts {
+		switch {
+		case len(contract.Bands) == 0:
+		case contract.BandBasis == services.BAND_BASIS_TIER && !tierRead:
+			tierRead = true
+			wallet, err := controller.WalletService.Get(ctx, walletId)
+			if err != nil {
+				return member, err
+			}
+			for _, identityId := range wallet.LinkedTo {
+				identity, err := controller.IdentityService.Get(ctx, identityId)
+				if err == nil && identity.Tier != "" {
+					member.Tier = identity.Tier
+					break
+				}
+			}
+		case contract.BandBasis == services.BAND_BASIS_SPEND:
+			since := services.BandPeriodStart(contract, now)
+			spend, ok := spendSince[since]
+			if !ok {
+				var err error
+				spend, err = controller.TransactionService.Spend(ctx, walletId, since, transaction.ExtID)
+				if err != nil {
+					return member, err
+				}
+				spendSince[since] = spend
+			}
+			member.Spend[contract.Identifier] = spend
+		}
+	}
+	return member, nil
+}
+
+// consumeBudgets takes the points of the lines out of the budgets of their
+// contracts, or only checks they fit when not consuming. The contract whose
+// budget does not fit is returned, nothing is consumed then. The returned func
+// gives the consumed points back.
+func (controller *TransactionController) consumeBudgets(ctx context.Context, transaction *models.Transaction, contracts []*models.Contract, lines []models.ContractLine, consume bool) (string, func(), error) {
+	byId := map[string]*models.Contract{}
+	for _, contract := range contracts {
+		byId[contract.Identifier] = contract
+	}
+
+	type consumption struct {
+		contract *models.Contract
+		points   int64
+	}
+	consumed := []consumption{}
+	release := func() {
+		for _, taken := range consumed {
+			controller.ContractService.ReleaseBudget(context.Background(), taken.contract, transaction.ToExtID, taken.points)
+		}
+		transaction.BudgetPoints = nil
+	}
+
+	events := []*models.ContractBudgetEvent{}
+	for _, line := range lines {
+		contract, ok := byId[line.ContractId]
+		if !ok || (contract.Budget == 0 && contract.MemberCap == 0) || line.Points <= 0 {
+			continue
+		}
+
+		if !consume {
+			fits, err := controller.ContractService.BudgetFits(ctx, contract, transaction.ToExtID, line.Points)
+			if err != nil {
+				return "", func() {}, err
+			}
+			if !fits {
+				return contract.Identifier, func() {}, nil
+			}
+			continue
+		}
+
+		fits, reached, err := controller.ContractService.ConsumeBudget(ctx, contract, transaction.ToExtID, line.Points)
+		if err != nil || !fits {
+			release()
+			return contract.Identifier, func() {}, err
+		}
+		consumed = append(consumed, consumption{contract: contract, points: line.Points})
+		if transaction.BudgetPoints == nil {
+			transaction.BudgetPoints = map[string]int64{}
+		}
+		transaction.BudgetPoints[contract.Identifier] += line.Points
+		if len(reached) == 0 {
+			continue
+		}
+		usage, err := controller.ContractService.BudgetUsage(ctx, contract, "")
+		if err != nil {
+			controller.logger.Println("failed to read the contract budget usage: %w", err)
+		}
+		for _, threshold := range reached {
+			events = append(events, &models.ContractBudgetEvent{
+				ContractID: contract.Identifier,
+				OperatorID: string(contract.OperatorId),
+				Channel:    contract.Channel,
+				Threshold:  threshold,
+				Budget:     contract.Budget,
+				Consumed:   usage.Consumed,
+				ReachedAt:  time.Now().UTC().Unix(),
+			})
+		}
+	}
+
+	// the operator is told about the thresholds reached once all budgets fit
+	for _, event := range events {
+		if err := controller.Nats.Publish(ctx, event); err != nil {
+			controller.logger.Println("failed to notify the contract budget threshold: %w", err)
+		}
+	}
+	return "", release, nil
+}
+
+// applyContractLines prices the transaction with the contract lines, the first
+// line is recorded as the applied contract
+func applyContractLines(transaction *models.Transaction, lines []models.ContractLine) {
+	if len(lines) == 0 {
+		return
+	}
+	transaction.Amount = services.LinesPoints(lines)
+	transaction.AppliedContract = lines[0].ContractId
+	transaction.AppliedContractVersion = lines[0].ContractVersion
+	transaction.AppliedRatio = lines[0].Pricing.Ratio
+	transaction.AppliedRounding = lines[0].Pricing.RoundingMode
+	transaction.AppliedFxRate = lines[0].Pricing.FxRate
+	transaction.AppliedFxRateId = lines[0].Pricing.FxRateId
+	transaction.ContractCurrency = lines[0].Pricing.ContractCurrency
+	transaction.ContractLines = lines
+}
+
+// parseCurrency checks the currency of the amount of a transaction
+func parseCurrency(currency string) (string, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency != "" && !services.IsCurrency(currency) {
+		return "", services.ERR_INVALID_CURRENCY
+	}
+	return currency, nil
+}
+
+// readQuote checks the quote token was issued to the caller for this very
+// transaction
+func (controller *TransactionController) readQuote(ctx *gin.Context, transaction *models.Transaction, quoteToken string) (*models.Quote, error) {
+	var quote models.Quote
+	if err := token.ParseQuoteToken(quoteToken, ctx.GetString(token.SESSION_USERNAME), &quote); err != nil {
+		return nil, err
+	}
+	if quote.TransactionType != transaction.TransactionType || quote.From != transaction.FromExtID || quote.To != transaction.ToExtID || quote.Amount != transaction.Amount || quote.SourceCurrency != transaction.SourceCurrency {
+		return nil, ERR_QUOTE_MISMATCH
+	}
+	return &quote, nil
+}
+
+// applyQuote uses the quote up and prices the transaction as quoted, the quoted
+// points are taken out of the contract budgets. The returned func gives them back.
+func (controller *TransactionController) applyQuote(ctx context.Context, transaction *models.Transaction, quote *models.Quote) (func(), error) {
+	release := func() {}
+	if quote.TransactionType == services.TRANSACTION_TYPE_ISSUE {
+		// budgets are checked against the contracts as they are now
+		contracts := []*models.Contract{}
+		for _, line := range quote.Lines {
+			contract, err := controller.ContractService.GetContract(ctx, line.ContractId)
+			if err != nil {
+				return func() {}, err
+			}
+			contracts = append(contracts, &contract)
+		}
+
+		exhausted, releaseBudgets, err := controller.consumeBudgets(ctx, transaction, contracts, quote.Lines, true)
+		if err != nil {
+			return func() {}, err
+		}
+		if exhausted != "" {
+			return func() {}, ERR_QUOTE_BUDGET_EXHAUSTED
+		}
+		release = releaseBudgets
+	}
+
+	if err := controller.TransactionService.ClaimQuote(ctx, quote.Identifier, quote.ExpiresAt); err != nil {
+		release()
+		return func() {}, err
+	}
+
+	transaction.QuoteId = quote.Identifier
+	transaction.OriginalAmount = quote.Amount
+	applyContractLines(transaction, quote.Lines)
+	return release, nil
+}
+
+// quote previews the points of an issue or a redeem the way they would be
+// priced now, nothing is written. The returned token prices the transaction the
+// same when it is submitted before the quote expires.
+func (controller *TransactionController) quote(ctx *gin.Context) {
+	fName := "controller/transaction/quote"
+	tracer := otel.Tracer("quote")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var input QuoteInput
+	if err := ctx.ShouldBindJSON(&input); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if input.TransactionType != services.TRANSACTION_TYPE_ISSUE && input.TransactionType != services.TRANSACTION_TYPE_REDEEM {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_QUOTE_TYPE.Error(), fmt.Sprintf("got :%s ", input.TransactionType))
+		return
+	}
+	if input.Amount <= 0 {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_AMOUNT_NEGATIVE_OR_ZERO.Error(), fmt.Sprintf("got :%d ", input.Amount))
+		return
+	}
+	if input.From == input.To {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_SAME_FROM_AND_TO.Error(), fmt.Sprintf("got: from %s & to %s", input.From, input.To))
+		return
+	}
+	sourceCurrency, err := parseCurrency(input.SourceCurrency)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.SourceCurrency))
+		return
+	}
+
+	walletFrom, err := controller.transactingWallet(ctx.Request.Context(), input.From, true)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.From))
+		return
+	}
+	walletTo, err := controller.transactingWallet(ctx.Request.Context(), input.To, false)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", input.To))
+		return
+	}
+
+	transaction := models.Transaction{
+		Channel:                "loyyalchannel",
+		FromExtID:              input.From,
+		FromUUID:               walletFrom.UUID,
+		ToExtID:                input.To,
+		ToUUID:                 walletTo.UUID,
+		Amount:                 input.Amount,
+		OriginalAmount:         input.Amount,
+		SourceCurrency:         sourceCurrency,
+		TransactionType:        input.TransactionType,
+		TransactionInitiatedBy: input.TransactionInitiatedBy,
+	}
+	// budgets are only checked, they are consumed when the quote is used
+	lines, _, err := controller.priceTransaction(ctx.Request.Context(), &transaction, false)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusUnprocessableEntity, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	quote := models.Quote{
+		Identifier:      common.GenerateIdentifier(30),
+		TransactionType: input.TransactionType,
+		From:            input.From,
+		To:              input.To,
+		Amount:          input.Amount,
+		SourceCurrency:  sourceCurrency,
+		// without a contract the amount is taken as points
+		Points:    input.Amount,
+		ExpiresAt: time.Now().UTC().Add(quote_validity).Truncate(time.Second),
+	}
+	if len(lines) > 0 {
+		applyContractLines(&transaction, lines)
+		quote.Points = transaction.Amount
+		quote.AppliedContract = transaction.AppliedContract
+		quote.AppliedContractVersion = transaction.AppliedContractVersion
+		quote.Lines = lines
+	}
+
+	quoteToken, err := token.GenerateQuoteToken(ctx.GetString(token.SESSION_USERNAME), quote, quote.ExpiresAt)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusInternalServerError, fName, "error: quote could not be signed", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	span.SetAttributes(attribute.Int64("points", quote.Points))
+	common.PrepareCustomResponse(ctx, "transaction quoted", struct {
+		models.Quote
+		Token string `json:"token"`
+	}{Quote: quote, Token: quoteToken})
+}
+
+func (controller *TransactionController) publishTransactionToNats(ctx context.Context, transaction *models.Transaction) error {
+	fName := "controller/transaction/publishTransactionToNats"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	// recorded before it is sent so that the callback finds it published
+	controller.setStatus(ctx, transaction, services.TRANSACTION_STATUS_PUBLISHED, "")
+	if err := controller.Nats.Publish(ctx, ledgerRequest(transaction)); err != nil {
+		controller.logger.Println("failed to write wallet to NATS (failing over to retry service): %w", err)
+		span.AddEvent("failed to write wallet to NATS")
+		span.SetStatus(codes.Error, "failed to write wallet to NATS")
+		controller.setStatus(ctx, transaction, services.TRANSACTION_STATUS_FAILED, err.Error())
+		return err
 	}
 	span.AddEvent("published to NATS ")
+	return nil
+}
+
+// ledgerRequest is the request writing the transaction to the ledger: an issue
+// when no points leave a wallet, a burn when the points leave the ledger and a
+// transfer otherwise
+func ledgerRequest(transaction *models.Transaction) nats.TopicEncoder {
+	// in case of issue request
+	if transaction.FromExtID == "" {
+		return &models.IssueRequest{
+			ID:      transaction.ToUUID,
+			RefID:   transaction.RefID,
+			Amount:  transaction.Amount,
+			Channel: transaction.Channel,
+		}
+	}
+
+	// in case of points leaving the ledger
+	if transaction.ToExtID == "" {
+		return &models.BurnRequest{
+			ID:      transaction.FromUUID,
+			RefID:   transaction.RefID,
+			Amount:  transaction.Amount,
+			Channel: transaction.Channel,
+		}
+	}
+
+	return &models.TransferRequest{
+		RefID:   transaction.RefID,
+		From:    transaction.FromUUID,
+		To:      transaction.ToUUID,
+		Channel: transaction.Channel,
+		Amount:  transaction.Amount,
+		Update:  !transaction.Spend,
+	}
+}
+
+// Republish writes a stored transaction to the ledger again, with its original
+// reference so that the ledger can not book it twice. Only a transaction priced
+// and published once can be, the points lots move when the ledger commits it.
+func (controller *TransactionController) Republish(ctx context.Context, transactionId string) error {
+	fName := "controller/transaction/republish"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	transaction, err := controller.TransactionService.Get(ctx, transactionId)
+	if err != nil {
+		return err
+	}
+
+	// a transaction failing before it was published has no price to publish
+	if !services.WasPublished(transaction) {
+		return ERR_TRANSACTION_NEVER_PUBLISHED
+	}
+
+	// a transaction failing to publish gave its budgets back
+	releaseBudgets := func() {}
+	if services.EffectiveStatus(transaction) == services.TRANSACTION_STATUS_FAILED {
+		releaseBudgets, err = controller.retakeBudgets(ctx, &transaction)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a transaction the chain has answered already keeps its status
+	if services.EffectiveStatus(transaction) != services.TRANSACTION_STATUS_COMMITTED {
+		controller.setStatus(ctx, &transaction, services.TRANSACTION_STATUS_PUBLISHED, "")
+	}
+	if err := controller.Nats.Publish(ctx, ledgerRequest(&transaction)); err != nil {
+		releaseBudgets()
+		if err := controller.TransactionService.Update(ctx, &transaction); err != nil {
+			controller.logger.Println("failed to record the released budgets on the transaction: %w", err)
+		}
+		controller.setStatus(ctx, &transaction, services.TRANSACTION_STATUS_FAILED, err.Error())
+		return err
+	}
+	span.AddEvent("republished to NATS")
+	return nil
+}
+
+// retakeBudgets takes the points a priced transaction earns out of the budgets
+// of its contracts again, the returned func gives them back
+func (controller *TransactionController) retakeBudgets(ctx context.Context, transaction *models.Transaction) (func(), error) {
+	earn := transaction.TransactionType == services.TRANSACTION_TYPE_ISSUE || transaction.TransactionType == services.TRANSACTION_TYPE_DEPOSIT
+	if !earn || len(transaction.BudgetPoints) > 0 || len(transaction.ContractLines) == 0 {
+		return func() {}, nil
+	}
+
+	contracts := []*models.Contract{}
+	for _, line := range transaction.ContractLines {
+		contract, err := controller.ContractService.GetContract(ctx, line.ContractId)
+		if err != nil {
+			return func() {}, err
+		}
+		contracts = append(contracts, &contract)
+	}
+
+	exhausted, release, err := controller.consumeBudgets(ctx, transaction, contracts, transaction.ContractLines, true)
+	if err != nil {
+		return func() {}, err
+	}
+	if exhausted != "" {
+		return func() {}, ERR_REPUBLISH_BUDGET_EXHAUSTED
+	}
+	if err := controller.TransactionService.Update(ctx, transaction); err != nil {
+		release()
+		return func() {}, err
+	}
+	return release, nil
+}
+
+// setStatus records the status on the transaction, a failure to do so is only logged
+func (controller *TransactionController) setStatus(ctx context.Context, transaction *models.Transaction, status string, errmsg string) {
+	updated, err := controller.TransactionService.SetStatus(context.Background(), transaction.ExtID, status, errmsg)
+	if err != nil {
+		controller.logger.Println("failed to record the transaction status: %w", err)
+		return
+	}
+	transaction.Status = updated.Status
+	transaction.StatusHistory = updated.StatusHistory
+}
+
+// HandleTransactionResult records the callback of the chaincode for a published
+// transaction as committed or rejected
+func (controller *TransactionController) HandleTransactionResult(ctx context.Context, data []byte) {
+	fName := "controller/transaction/handleTransactionResult"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	var result models.TransactionResult
+	if err := result.Decode(data); err != nil {
+		controller.logger.Println("failed to decode the transaction result: %w", err)
+		return
+	}
+
+	transaction, err := controller.RecordResult(ctx, result)
+	if err != nil {
+		controller.logger.Println("failed to record the transaction result: %w", err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.AddEvent("transaction " + transaction.ExtID + " is " + transaction.Status)
+}
+
+// RecordResult applies the outcome of the chain to the transaction and, when it
+// changed the status, gives back what the transaction held. It serves the chain
+// callbacks and the repairs of the reconciliation alike.
+func (controller *TransactionController) RecordResult(ctx context.Context, result models.TransactionResult) (models.Transaction, error) {
+	transaction, changed, err := controller.TransactionService.ApplyResult(ctx, result)
+	if err != nil || !changed {
+		return transaction, err
+	}
+
+	// the points lots follow the points once the ledger has moved them
+	if transaction.Status == services.TRANSACTION_STATUS_COMMITTED {
+		controller.trackPointsLots(ctx, &transaction)
+	}
+
+	switch {
+	case transaction.Status == services.TRANSACTION_STATUS_REJECTED:
+		// nothing moved, everything the transaction held is given back
+		controller.releaseHolds(ctx, &transaction, transaction.Amount)
+		if transaction.TransactionType == services.TRANSACTION_TYPE_EXPIRY {
+			controller.reopenLots(ctx, &transaction)
+		}
+	case transaction.TransactionType == services.TRANSACTION_TYPE_REVERSAL && transaction.ReversalOf != "":
+		// the reversed points are given back to what the original transaction held
+		original, err := controller.TransactionService.Get(ctx, transaction.ReversalOf)
+		if err != nil {
+			controller.logger.Println("failed to read the reversed transaction: %w", err)
+			return transaction, nil
+		}
+		controller.releaseHolds(ctx, &original, transaction.Amount)
+	}
+	return transaction, nil
+}
+
+// releaseHolds gives back the share of points out of the points of the
+// transaction that it held on the allowance of the spending member, on the
+// velocity limits and on the contract budgets
+func (controller *TransactionController) releaseHolds(ctx context.Context, transaction *models.Transaction, points int64) {
+	controller.releaseBudgets(ctx, transaction, points)
+	if len(transaction.LimitCounters) > 0 {
+		controller.LimitService.ReleaseCounters(ctx, transaction.LimitCounters, points, transaction.Amount)
+		if points >= transaction.Amount {
+			transaction.LimitCounters = nil
+		}
+	}
+	if transaction.AllowanceIdentity != "" {
+		amount := holdShare(transaction.AllowanceAmount, points, transaction.Amount)
+		if err := controller.WalletService.ReleaseAllowance(ctx, transaction.FromExtID, transaction.AllowanceIdentity, amount); err != nil {
+			controller.logger.Println("failed to release the spend allowance: %w", err)
+		}
+		if points >= transaction.Amount {
+			transaction.AllowanceIdentity = ""
+			transaction.AllowanceAmount = 0
+		}
+	}
+}
+
+// releaseBudgets gives back the share of points out of the points of the
+// transaction that it took out of the contract budgets
+func (controller *TransactionController) releaseBudgets(ctx context.Context, transaction *models.Transaction, points int64) {
+	for contractId, taken := range transaction.BudgetPoints {
+		contract, err := controller.ContractService.GetContract(ctx, contractId)
+		if err != nil {
+			controller.logger.Println("failed to release the contract budget: %w", err)
+			continue
+		}
+		controller.ContractService.ReleaseBudget(ctx, &contract, transaction.ToExtID, holdShare(taken, points, transaction.Amount))
+	}
+	if points >= transaction.Amount {
+		transaction.BudgetPoints = nil
+	}
+}
+
+// holdShare is the part of a held amount matching points out of the points of
+// the transaction
+func holdShare(held int64, points int64, total int64) int64 {
+	if points >= total || total <= 0 {
+		return held
+	}
+	return new(big.Int).Div(new(big.Int).Mul(big.NewInt(held), big.NewInt(points)), big.NewInt(total)).Int64()
+}
+
+type TransactionStatus struct {
+	Identifier    string                           `json:"identifier"`
+	Status        string                           `json:"status"`
+	Error         string                           `json:"errmsg,omitempty"`
+	StatusHistory []models.TransactionStatusChange `json:"statusHistory"`
+}
+
+// transactionStatus lets a partner poll the status of a batch of transactions,
+// the ids are given comma separated
+func (controller *TransactionController) transactionStatus(ctx *gin.Context) {
+	fName := "controller/transaction/status"
+	tracer := otel.Tracer("transactionStatus")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	ids := []string{}
+	for _, id := range strings.Split(ctx.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > MAX_STATUS_IDS {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_STATUS_IDS.Error(), fmt.Sprintf("got :%d ids", len(ids)))
+		return
+	}
+
+	results, err := controller.TransactionService.Filter(ctx.Request.Context(), " AND ext IN $ids", map[string]interface{}{
+		"ids": ids,
+	}, "createdOn", -1)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	statuses := []TransactionStatus{}
+	for _, row := range results {
+		statuses = append(statuses, TransactionStatus{
+			Identifier:    row.ExtID,
+			Status:        services.EffectiveStatus(*row),
+			Error:         row.Error,
+			StatusHistory: row.StatusHistory,
+		})
+	}
+
+	common.PrepareCustomResponse(ctx, "transaction status fetched", statuses)
+}
+
+// trackPointsLots keeps the points lots of the wallets in line with the
+// transaction. Accruals open a new lot expiring as per the contract or the
+// operator policy, moves between wallets carry the expiry dates along. It runs
+// once the ledger committed the transaction, a rejected one never moved points.
+func (controller *TransactionController) trackPointsLots(ctx context.Context, transaction *models.Transaction) {
+	// the expiry job closes the lapsed lot itself
+	if transaction.TransactionType == services.TRANSACTION_TYPE_EXPIRY {
+		return
+	}
+
+	operatorId, _ := controller.resolveParties(ctx, transaction)
+	policy, err := controller.ExpiryService.GetPolicy(ctx, operatorId)
+	if err != nil {
+		controller.logger.Println("failed to load the expiry policy: %w", err)
+	}
+
+	expiryMonths := policy.ExpiryMonths
+	if transaction.AppliedContract != "" {
+		contract, err := controller.ContractService.GetContractVersion(ctx, transaction.AppliedContract, transaction.AppliedContractVersion)
+		if err == nil && contract.ExpiryMonths > 0 {
+			expiryMonths = contract.ExpiryMonths
+		}
+	}
+
+	credit := services.LOT_CREDIT_NONE
+	carried := []models.LotConsumption{}
+	switch transaction.TransactionType {
+	case services.TRANSACTION_TYPE_ISSUE, services.TRANSACTION_TYPE_DEPOSIT:
+		credit = services.LOT_CREDIT_ACCRUAL
+	case services.TRANSACTION_TYPE_TRANSFER, services.TRANSACTION_TYPE_MERGE:
+		credit = services.LOT_CREDIT_CARRY
+	case services.TRANSACTION_TYPE_REVERSAL:
+		// points given back to the wallet they were taken from are tracked again,
+		// with the expiry of the lots the original transaction took them from
+		original, err := controller.TransactionService.Get(ctx, transaction.ReversalOf)
+		if err == nil && original.TransactionType != services.TRANSACTION_TYPE_ISSUE && original.TransactionType != services.TRANSACTION_TYPE_DEPOSIT {
+			credit = services.LOT_CREDIT_CARRY
+			carried = original.ConsumedLots
+		}
+	}
+
+	consumed, err := controller.ExpiryService.ApplyToLots(ctx, transaction, policy.ConsumptionOrder, credit, carried, services.ExpiryDate(transaction.CreatedOn, expiryMonths))
+	if err != nil {
+		controller.logger.Println("failed to update the points lots: %w", err)
+	}
+	if len(consumed) > 0 {
+		transaction.ConsumedLots = consumed
+		if err := controller.TransactionService.RecordConsumedLots(ctx, transaction.ExtID, consumed); err != nil {
+			controller.logger.Println("failed to record the consumed points lots: %w", err)
+		}
+	}
+}
+
+// reopenLots gives the lapsed points back to the lots closed by an expiry the
+// ledger rejected, the next run expires them again
+func (controller *TransactionController) reopenLots(ctx context.Context, transaction *models.Transaction) {
+	for _, lot := range transaction.ConsumedLots {
+		if err := controller.ExpiryService.ReopenLot(ctx, lot.LotId, transaction.ExtID, lot.Amount); err != nil {
+			controller.logger.Println("failed to reopen lot: %w", err)
+		}
+	}
+}
+
+// resolveParties finds the operator and the partner of the transaction from the
+// identities linked to its wallets, the initiator is taken as partner otherwise.
+func (controller *TransactionController) resolveParties(ctx context.Context, transaction *models.Transaction) (string, string) {
+	operatorId, partnerId := "", ""
+	for _, walletId := range []string{transaction.FromExtID, transaction.ToExtID} {
+		if walletId == "" {
+			continue
+		}
+		wallet, err := controller.WalletService.Get(ctx, walletId)
+		if err != nil {
+			continue
+		}
+		for _, identityId := range wallet.LinkedTo {
+			identity, err := controller.IdentityService.Get(ctx, identityId)
+			if err != nil {
+				continue
+			}
+			if identity.IdentityType == "operator" && operatorId == "" {
+				operatorId = identity.Identifier
+			}
+			if identity.IdentityType == "partner" && partnerId == "" {
+				partnerId = identity.Identifier
+			}
+		}
+	}
+
+	if partnerId == "" {
+		partnerId = transaction.TransactionInitiatedBy
+	}
+	return operatorId, partnerId
+}
+
+// ExpireLapsedLots takes the points of every lapsed lot out of its wallet with an
+// expiry transaction. It is safe to run from several replicas, a lot is only
+// expired once.
+func (controller *TransactionController) ExpireLapsedLots(ctx context.Context) (int, error) {
+	fName := "controller/transaction/expireLapsedLots"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	lots, err := controller.ExpiryService.LapsedLots(ctx, time.Now().UTC(), 500)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, lot := range lots {
+		transactionId := common.GenerateIdentifier(62)
+		lot, lapsed, err := controller.ExpiryService.MarkExpired(ctx, lot.Identifier, transactionId)
+		if errors.Is(err, services.ERR_LOT_NOT_OPEN) {
+			continue
+		}
+		if err != nil {
+			controller.logger.Println("failed to expire lot: %w", err)
+			continue
+		}
+
+		// the lot is opened again when its points could not be taken out, so
+		// that it is never left expired without a transaction behind it
+		remaining := lapsed
+		reopen := func() {
+			if err := controller.ExpiryService.ReopenLot(ctx, lot.Identifier, transactionId, remaining); err != nil {
+				controller.logger.Println("failed to reopen lot: %w", err)
+			}
+		}
+
+		wallet, err := controller.WalletService.Get(ctx, lot.WalletId)
+		if err != nil || wallet.UUID == "" {
+			reopen()
+			continue
+		}
+		// the lot can not take out more than what the wallet still holds
+		if lapsed > wallet.Balance {
+			lapsed = wallet.Balance
+		}
+		if lapsed <= 0 {
+			reopen()
+			continue
+		}
+
+		var transaction models.Transaction
+		transaction.ExtID = transactionId
+		transaction.FromExtID = wallet.Identifier
+		transaction.FromUUID = wallet.UUID
+		transaction.Amount = lapsed
+		transaction.TransactionType = services.TRANSACTION_TYPE_EXPIRY
+		transaction.Remarks = "expiry of points accrued on " + lot.AccruedAt.Format("2006-01-02")
+		// the lot closed by the expiry, it is reopened when the ledger rejects it
+		transaction.ConsumedLots = []models.LotConsumption{{LotId: lot.Identifier, Amount: remaining, ExpiresAt: lot.ExpiresAt}}
+
+		err = controller.TransactionService.Create(ctx, &transaction)
+		if err != nil {
+			controller.logger.Println("failed to create expiry transaction: %w", err)
+			reopen()
+			continue
+		}
+		// a failed publish is retried with the transaction, the lot stays expired
+		controller.publishTransactionToNats(ctx, &transaction)
+		expired++
+	}
+
+	span.SetAttributes(attribute.Int("expired lots", expired))
+	return expired, nil
+}
+
+func (controller *TransactionController) expireLots(ctx *gin.Context) {
+	fName := "controller/transaction/expireLots"
+	tracer := otel.Tracer("expireLots")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	expired, err := controller.ExpireLapsedLots(ctx.Request.Context())
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "lapsed points expired", struct {
+		Expired int `json:"expired"`
+	}{Expired: expired})
 }
 
 func (controller *TransactionController) TransactionRoutes(group *gin.RouterGroup) {
@@ -482,8 +2157,17 @@ func (controller *TransactionController) TransactionRoutes(group *gin.RouterGrou
 	transactionRoute.Use(middleware.JWTAuthMiddleware())
 
 	transactionRoute.POST("/filter", controller.TransactionFilter)
+	transactionRoute.POST("/export", controller.TransactionExport)
 	transactionRoute.GET("/get", controller.TransactionGet)
-	transactionRoute.POST("/earn", controller.issue)
-	transactionRoute.POST("/redeem", controller.redeem)
-	transactionRoute.POST("/transfer", controller.transfer)
+	transactionRoute.GET("/status", controller.transactionStatus)
+	transactionRoute.POST("/quote", controller.quote)
+	transactionRoute.POST("/earn", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.issue)
+	transactionRoute.POST("/redeem", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.redeem)
+	transactionRoute.POST("/transfer", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.transfer)
+	transactionRoute.POST("/deposit", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.deposit)
+	transactionRoute.POST("/withdraw", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.withdraw)
+	transactionRoute.POST("/withdraw/settle", controller.withdrawSettle)
+	transactionRoute.POST("/reverse", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.reverse)
+	transactionRoute.POST("/expire", controller.expireLots)
+	transactionRoute.GET("/limits", controller.limitRemaining)
 }
@@ -0,0 +1,31 @@
+package controllers
+
+import "testing"
+
+func TestHoldShare(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   int64
+		points int64
+		total  int64
+		share  int64
+	}{
+		{name: "all points", held: 80, points: 100, total: 100, share: 80},
+		{name: "more than the points", held: 80, points: 120, total: 100, share: 80},
+		{name: "half of the points", held: 80, points: 50, total: 100, share: 40},
+		{name: "share rounded down", held: 10, points: 1, total: 3, share: 3},
+		{name: "nothing", held: 80, points: 0, total: 100, share: 0},
+		{name: "no total", held: 80, points: 0, total: 0, share: 80},
+		{name: "negative total", held: 80, points: 10, total: -1, share: 80},
+		{name: "held more than the points", held: 1000, points: 1, total: 10, share: 100},
+		{name: "share past int64 when multiplied", held: 1 << 40, points: 1 << 40, total: 1 << 41, share: 1 << 39},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if share := holdShare(test.held, test.points, test.total); share != test.share {
+				t.Errorf("got %d, want %d", share, test.share)
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/loyyal/loyyal-be-contract/middleware"
@@ -12,21 +18,41 @@ import (
 	"github.com/loyyal/loyyal-be-contract/nats"
 	"github.com/loyyal/loyyal-be-contract/services"
 	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/export"
+	"github.com/loyyal/loyyal-be-contract/utils/pdf"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type WalletController struct {
 	WalletService      services.WalletService
 	TransactionService services.TransactionService
+	ExpiryService      services.ExpiryService
+	MergeService       services.MergeService
+	IdentityService    services.IdentityService
+	BalanceService     services.BalanceService
+	IdempotencyService services.IdempotencyService
 	Nats               *nats.Client
+	// a merge whose progress was not saved for this long is resumed by another process
+	MergeStaleAfter time.Duration
 }
 
 // constructor calling
-func NewWallet(service services.WalletService, transactionService services.TransactionService, nats *nats.Client) WalletController {
+func NewWallet(service services.WalletService, transactionService services.TransactionService, expiryService services.ExpiryService, mergeService services.MergeService, identityService services.IdentityService, balanceService services.BalanceService, idempotencyService services.IdempotencyService, nats *nats.Client, mergeStaleAfter time.Duration) WalletController {
+	if mergeStaleAfter <= 0 {
+		mergeStaleAfter = 10 * time.Minute
+	}
 	return WalletController{
 		WalletService:      service,
 		TransactionService: transactionService,
+		ExpiryService:      expiryService,
+		MergeService:       mergeService,
+		IdentityService:    identityService,
+		BalanceService:     balanceService,
+		IdempotencyService: idempotencyService,
 		Nats:               nats,
+		MergeStaleAfter:    mergeStaleAfter,
 	}
 }
 
@@ -43,6 +69,37 @@ type WalletMergeRequest struct {
 	To   string   `json:"to" binding:"required"`
 }
 
+type WalletMergeActionRequest struct {
+	MergeId string `json:"mergeId" binding:"required"`
+}
+
+type WalletStatusRequest struct {
+	WalletId string `json:"walletId" binding:"required"`
+	Status   string `json:"status" binding:"required"`
+	Reason   string `json:"reason" binding:"required"`
+	Note     string `json:"note"`
+}
+
+type WalletMemberRequest struct {
+	WalletId   string `json:"walletId" binding:"required"`
+	IdentityId string `json:"identityId"`
+	Role       string `json:"role"`
+	SpendLimit int64  `json:"spendLimit"`
+}
+
+var (
+	ERR_NOT_WALLET_OWNER  = errors.New("error: only an owner of the wallet can manage its members")
+	ERR_NOT_WALLET_MEMBER = errors.New("error: only a member of the wallet can see its statement")
+
+	ERR_INVALID_STATEMENT_PERIOD = errors.New("error: from and to must be RFC3339 times or dates with from before to")
+	ERR_INVALID_STATEMENT_FORMAT = errors.New("error: statement format must be json, csv or pdf")
+
+	ERR_MERGE_WALLET_NOT_ACTIVE = errors.New("error: only active wallets can be merged")
+	ERR_MERGE_DUPLICATE_WALLET  = errors.New("error: a wallet can be merged only once and not into itself")
+	ERR_MERGE_CURRENCY_MISMATCH = errors.New("error: merged wallets must hold the same currency")
+	ERR_MERGE_OWNER_MISMATCH    = errors.New("error: merged wallets must belong to the same identity")
+)
+
 func (controller *WalletController) walletCreate(ctx *gin.Context) {
 	fName := "controller/wallet/create"
 	tracer := otel.Tracer("walleCreate")
@@ -66,6 +123,10 @@ func (controller *WalletController) walletCreate(ctx *gin.Context) {
 		return
 	}
 
+	if err := controller.IdentityService.SetWalletRef(ctx.Request.Context(), request.LinkedTo, wallet.Identifier, services.WALLET_ROLE_OWNER); err != nil {
+		fmt.Print("failed to link the wallet to the identity: %w", err)
+	}
+
 	// publishing to nats
 	if err := controller.Nats.Publish(ctx.Request.Context(), &models.CreateRequest{RefID: wallet.Ref, Amount: wallet.Balance, Channel: wallet.Channel}); err != nil {
 		fmt.Print("failed to write wallet to NATS (failing over to retry service): %w", err)
@@ -105,43 +166,902 @@ func (controller *WalletController) walletMerge(ctx *gin.Context) {
 		return
 	}
 
-	// recursively, get all FROM wallet and transfer their balance to TO wallet
+	if toWallet.IsDeleted || toWallet.Status != services.WALLET_STATUS_ACTIVE {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_MERGE_WALLET_NOT_ACTIVE.Error(), fmt.Sprintf("got :%s ", toWallet.Identifier))
+		return
+	}
+
+	// every wallet has to be active, hold the same currency and belong to the same identity
+	owners := toWallet.LinkedTo
+	seen := map[string]bool{toWallet.Identifier: true}
+	merge := models.MergeOperation{To: toWallet.Identifier, Currency: walletCurrency(toWallet)}
 	for _, walletIdentifier := range request.From {
+		if seen[walletIdentifier] {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_MERGE_DUPLICATE_WALLET.Error(), fmt.Sprintf("got :%s ", walletIdentifier))
+			return
+		}
+		seen[walletIdentifier] = true
+
 		wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletIdentifier)
+		if err != nil || common.IsStructEmpty(wallet) {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: no wallet found with "+walletIdentifier, fmt.Sprintf("got :%s ", walletIdentifier))
+			return
+		}
+
+		if wallet.IsDeleted || wallet.Status != services.WALLET_STATUS_ACTIVE {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_MERGE_WALLET_NOT_ACTIVE.Error(), fmt.Sprintf("got :%s ", walletIdentifier))
+			return
+		}
+
+		if walletCurrency(wallet) != merge.Currency {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_MERGE_CURRENCY_MISMATCH.Error(), fmt.Sprintf("got :%s and %s", walletCurrency(wallet), merge.Currency))
+			return
+		}
+
+		owners = commonIdentities(owners, wallet.LinkedTo)
+		if len(owners) == 0 {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_MERGE_OWNER_MISMATCH.Error(), fmt.Sprintf("got :%s ", walletIdentifier))
+			return
+		}
+
+		merge.Steps = append(merge.Steps, models.MergeStep{From: wallet.Identifier})
+	}
+	merge.IdentityId = owners[0]
+
+	err = controller.MergeService.Create(ctx.Request.Context(), &merge, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+	span.AddEvent("merge operation created")
+
+	merge, err = controller.MergeService.Transition(ctx.Request.Context(), merge.Identifier, []string{services.MERGE_STATUS_PENDING}, services.MERGE_STATUS_RUNNING, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+		return
+	}
+
+	// the merge outlives the request, its progress is available on the status endpoint
+	go controller.runMerge(context.Background(), merge, ctx.GetString(token.SESSION_USERNAME))
+
+	common.PrepareCustomResponse(ctx, "wallet merge started", struct {
+		Identifier string `json:"identifier"`
+		Status     string `json:"status"`
+	}{Identifier: merge.Identifier, Status: merge.Status})
+}
+
+func (controller *WalletController) walletMergeStatus(ctx *gin.Context) {
+	fName := "controllers/wallet/mergeStatus"
+	tracer := otel.Tracer("walletMergeStatus")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	mergeId := ctx.Query("mergeId")
+	if mergeId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: merge id is required", fmt.Sprintf("got :%s ", mergeId))
+		return
+	}
+
+	merge, err := controller.MergeService.Get(ctx.Request.Context(), mergeId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet merge fetched", merge)
+}
+
+// walletMergeResume continues a failed merge from the step where it stopped
+func (controller *WalletController) walletMergeResume(ctx *gin.Context) {
+	fName := "controllers/wallet/mergeResume"
+	tracer := otel.Tracer("walletMergeResume")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMergeActionRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	merge, err := controller.MergeService.Transition(ctx.Request.Context(), request.MergeId, []string{services.MERGE_STATUS_FAILED}, services.MERGE_STATUS_RUNNING, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	go controller.runMerge(context.Background(), merge, ctx.GetString(token.SESSION_USERNAME))
+
+	common.PrepareCustomResponse(ctx, "wallet merge resumed", struct {
+		Identifier string `json:"identifier"`
+		Status     string `json:"status"`
+	}{Identifier: merge.Identifier, Status: merge.Status})
+}
+
+// walletMergeRollback moves the merged balances back and re-activates the source wallets
+func (controller *WalletController) walletMergeRollback(ctx *gin.Context) {
+	fName := "controllers/wallet/mergeRollback"
+	tracer := otel.Tracer("walletMergeRollback")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMergeActionRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// the rollback is claimed from a final state, a rollback still running can
+	// not be started twice while one that failed itself can be retried
+	merge, err := controller.MergeService.Transition(ctx.Request.Context(), request.MergeId, []string{services.MERGE_STATUS_FAILED, services.MERGE_STATUS_COMPLETED, services.MERGE_STATUS_ROLLBACK_FAILED}, services.MERGE_STATUS_ROLLING_BACK, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	go controller.rollbackMerge(context.Background(), merge, ctx.GetString(token.SESSION_USERNAME))
+
+	common.PrepareCustomResponse(ctx, "wallet merge rollback started", struct {
+		Identifier string `json:"identifier"`
+		Status     string `json:"status"`
+	}{Identifier: merge.Identifier, Status: merge.Status})
+}
+
+// ResumeMerges picks up the merges and the rollbacks left running by a stopped
+// process, an operation is claimed once its progress was not saved for
+// MergeStaleAfter. It returns the number of operations resumed.
+func (controller *WalletController) ResumeMerges(ctx context.Context) (int, error) {
+	fName := "controller/wallet/resumeMerges"
+	tracer := otel.Tracer("api")
+	ctx, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	staleBefore := time.Now().UTC().Add(-controller.MergeStaleAfter)
+	merges, err := controller.MergeService.Filter(ctx, " AND status IN $statuses AND STR_TO_MILLIS(lastUpdatedAt) < STR_TO_MILLIS($before)", map[string]interface{}{
+		"statuses": []string{services.MERGE_STATUS_RUNNING, services.MERGE_STATUS_ROLLING_BACK},
+		"before":   staleBefore.Format(time.RFC3339Nano),
+	}, "createdAt", -1)
+	if err != nil {
+		return 0, err
+	}
+
+	resumed := 0
+	for _, stale := range merges {
+		merge, err := controller.MergeService.Claim(ctx, stale.Identifier, staleBefore)
+		if errors.Is(err, services.ERR_MERGE_NOT_STALE) {
+			continue
+		}
 		if err != nil {
-			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%d ", err))
+			return resumed, err
+		}
+
+		if merge.Status == services.MERGE_STATUS_ROLLING_BACK {
+			go controller.rollbackMerge(context.Background(), merge, merge.LastUpdatedBy)
+		} else {
+			go controller.runMerge(context.Background(), merge, merge.LastUpdatedBy)
+		}
+		resumed++
+	}
+
+	span.SetAttributes(attribute.Int("resumed", resumed))
+	return resumed, nil
+}
+
+// runMerge executes the pending steps of the merge, the progress of each step is
+// saved so that a failed merge can be resumed from where it stopped.
+func (controller *WalletController) runMerge(ctx context.Context, merge models.MergeOperation, sessionedUser string) {
+	for i := range merge.Steps {
+		step := &merge.Steps[i]
+		if step.Status == services.MERGE_STEP_COMPLETED {
+			continue
+		}
+
+		if err := controller.mergeStep(ctx, &merge, step, sessionedUser); err != nil {
+			step.Error = err.Error()
+			merge.Status = services.MERGE_STATUS_FAILED
+			merge.Error = "error: merge of wallet " + step.From + " failed"
+			controller.saveMerge(ctx, &merge)
 			return
 		}
+	}
 
-		if common.IsStructEmpty(wallet) {
-			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: no wallet found with "+walletIdentifier, fmt.Sprintf("got :%s ", walletIdentifier))
+	merge.Status = services.MERGE_STATUS_COMPLETED
+	controller.saveMerge(ctx, &merge)
+}
+
+func (controller *WalletController) mergeStep(ctx context.Context, merge *models.MergeOperation, step *models.MergeStep, sessionedUser string) error {
+	step.Error = ""
+
+	if step.Status == services.MERGE_STEP_PENDING {
+		if step.TransactionId == "" {
+			step.TransactionId = common.GenerateIdentifier(62)
+			if err := controller.saveMerge(ctx, merge); err != nil {
+				return err
+			}
+		}
+
+		// the transfer may already exist when the step is resumed, its amount is
+		// the one moved whatever was saved with the step
+		if existing, err := controller.TransactionService.Get(ctx, step.TransactionId); err == nil {
+			step.Amount = existing.Amount
+		} else {
+			// the wallet stops sending points before its balance is taken so that
+			// nothing is spent from it between the snapshot and the transfer
+			if err := controller.changeStatus(ctx, step.From, services.WALLET_STATUS_SUBSPENDED, services.WALLET_REASON_MERGED, "being merged into the wallet "+merge.To, sessionedUser); err != nil {
+				return err
+			}
+
+			wallet, err := controller.WalletService.Get(ctx, step.From)
+			if err != nil {
+				return err
+			}
+			toWallet, err := controller.WalletService.Get(ctx, merge.To)
+			if err != nil {
+				return err
+			}
+
+			step.Amount = wallet.Balance
+			if step.Amount > 0 {
+				var transaction models.Transaction
+				transaction.ExtID = step.TransactionId
+				transaction.FromExtID = wallet.Identifier
+				transaction.ToExtID = toWallet.Identifier
+				transaction.FromUUID = wallet.UUID
+				transaction.ToUUID = toWallet.UUID
+				transaction.Amount = step.Amount
+				transaction.TransactionType = services.TRANSACTION_TYPE_MERGE
+				transaction.Remarks = "merged into the wallet " + toWallet.Identifier
+
+				if err := controller.TransactionService.Create(ctx, &transaction); err != nil {
+					return err
+				}
+			}
+		}
+
+		step.Status = services.MERGE_STEP_CREATED
+		if err := controller.saveMerge(ctx, merge); err != nil {
+			return err
+		}
+	}
+
+	if step.Status == services.MERGE_STEP_CREATED {
+		if step.Amount > 0 {
+			transaction, err := controller.TransactionService.Get(ctx, step.TransactionId)
+			if err != nil {
+				return err
+			}
+
+			// a re-published transfer is deduplicated by the ledger on its reference
+			// do not need apply the business contract
+			// the points lots are carried once the ledger commits the transfer
+			if err := controller.publishTxToNats(ctx, &transaction); err != nil {
+				return err
+			}
+		}
+
+		step.Status = services.MERGE_STEP_TRANSFERRED
+		if err := controller.saveMerge(ctx, merge); err != nil {
+			return err
+		}
+	}
+
+	if step.Status == services.MERGE_STEP_TRANSFERRED {
+		if err := controller.changeStatus(ctx, step.From, services.WALLET_STATUS_CLOSED, services.WALLET_REASON_MERGED, "merged into the wallet "+merge.To, sessionedUser); err != nil {
+			return err
+		}
+
+		step.Status = services.MERGE_STEP_COMPLETED
+		if err := controller.saveMerge(ctx, merge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollbackMerge undoes the steps of the merge in reverse order
+func (controller *WalletController) rollbackMerge(ctx context.Context, merge models.MergeOperation, sessionedUser string) {
+	for i := len(merge.Steps) - 1; i >= 0; i-- {
+		step := &merge.Steps[i]
+		if step.Status == services.MERGE_STEP_ROLLED_BACK {
+			continue
+		}
+
+		if err := controller.rollbackStep(ctx, &merge, step, sessionedUser); err != nil {
+			step.Error = err.Error()
+			merge.Error = "error: rollback of wallet " + step.From + " failed"
+			merge.Status = services.MERGE_STATUS_ROLLBACK_FAILED
+			controller.saveMerge(ctx, &merge)
 			return
 		}
+	}
+
+	merge.Status = services.MERGE_STATUS_ROLLED_BACK
+	controller.saveMerge(ctx, &merge)
+}
 
-		var transaction models.Transaction
-		transaction.FromExtID = wallet.Identifier
-		transaction.ToExtID = toWallet.Identifier
-		transaction.FromUUID = wallet.UUID
-		transaction.ToUUID = toWallet.UUID
-		transaction.Amount = wallet.Balance
-		transaction.TransactionType = "merge"
-		transaction.Remarks = "merged into the wallet " + toWallet.Identifier
+func (controller *WalletController) rollbackStep(ctx context.Context, merge *models.MergeOperation, step *models.MergeStep, sessionedUser string) error {
+	step.Error = ""
+
+	if step.Status == services.MERGE_STEP_COMPLETED {
+		if err := controller.changeStatus(ctx, step.From, services.WALLET_STATUS_ACTIVE, services.WALLET_REASON_MERGE_ROLLED_BACK, "merge "+merge.Identifier+" rolled back", sessionedUser); err != nil {
+			return err
+		}
+		step.Status = services.MERGE_STEP_TRANSFERRED
+		if err := controller.saveMerge(ctx, merge); err != nil {
+			return err
+		}
+	}
 
-		err = controller.TransactionService.Create(ctx.Request.Context(), &transaction)
+	transaction, err := controller.TransactionService.Get(ctx, step.TransactionId)
+	if step.TransactionId != "" && err == nil {
+		// the transfer may or may not have reached the ledger, publishing it again
+		// is deduplicated and makes the reversal below always balanced
+		if step.Status != services.MERGE_STEP_TRANSFERRED {
+			if err := controller.publishTxToNats(ctx, &transaction); err != nil {
+				return err
+			}
+		}
+
+		if step.RollbackTransactionId == "" {
+			step.RollbackTransactionId = common.GenerateIdentifier(62)
+			if err := controller.saveMerge(ctx, merge); err != nil {
+				return err
+			}
+		}
+
+		reversal, err := controller.TransactionService.Get(ctx, step.RollbackTransactionId)
 		if err != nil {
-			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%v ", err))
+			_, amount, points, err := controller.TransactionService.ReserveReversal(ctx, transaction.ExtID, 0, step.RollbackTransactionId)
+			if err != nil {
+				return err
+			}
+
+			reversal = models.Transaction{
+				ExtID:           step.RollbackTransactionId,
+				FromExtID:       transaction.ToExtID,
+				FromUUID:        transaction.ToUUID,
+				ToExtID:         transaction.FromExtID,
+				ToUUID:          transaction.FromUUID,
+				OriginalAmount:  amount,
+				Amount:          points,
+				ReversalOf:      transaction.ExtID,
+				TransactionType: services.TRANSACTION_TYPE_REVERSAL,
+				Remarks:         "rollback of the merge " + merge.Identifier,
+			}
+			if err := controller.TransactionService.Create(ctx, &reversal); err != nil {
+				controller.TransactionService.ReleaseReversal(ctx, transaction.ExtID, amount, points, step.RollbackTransactionId)
+				return err
+			}
+		}
+
+		if err := controller.publishTxToNats(ctx, &reversal); err != nil {
+			return err
+		}
+	}
+
+	// a step stopped before closing the wallet left it suspended
+	if step.TransactionId != "" {
+		if err := controller.changeStatus(ctx, step.From, services.WALLET_STATUS_ACTIVE, services.WALLET_REASON_MERGE_ROLLED_BACK, "merge "+merge.Identifier+" rolled back", sessionedUser); err != nil {
+			return err
+		}
+	}
+
+	step.Status = services.MERGE_STEP_ROLLED_BACK
+	return controller.saveMerge(ctx, merge)
+}
+
+func (controller *WalletController) saveMerge(ctx context.Context, merge *models.MergeOperation) error {
+	err := controller.MergeService.Save(ctx, merge)
+	if err != nil {
+		fmt.Print("failed to save the merge operation progress: %w", err)
+	}
+	return err
+}
+
+// walletCurrency returns the currency held by the wallet, points by default
+func walletCurrency(wallet models.Wallet) string {
+	if len(wallet.Assets) > 0 && wallet.Assets[0].Currency != "" {
+		return wallet.Assets[0].Currency
+	}
+	return "points"
+}
+
+// commonIdentities returns the identities present in both lists
+func commonIdentities(left []string, right []string) []string {
+	shared := []string{}
+	for _, l := range left {
+		for _, r := range right {
+			if l == r {
+				shared = append(shared, l)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+func (controller *WalletController) walletMemberInvite(ctx *gin.Context) {
+	fName := "controller/wallet/memberInvite"
+	tracer := otel.Tracer("walletMemberInvite")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMemberRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if request.IdentityId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: identity id is required", fmt.Sprintf("got :%s ", request.IdentityId))
+		return
+	}
+
+	if err := controller.authorizeOwner(ctx, request.WalletId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if _, err := controller.IdentityService.Get(ctx.Request.Context(), request.IdentityId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	wallet, err := controller.WalletService.InviteMember(ctx.Request.Context(), request.WalletId, request.IdentityId, request.Role, request.SpendLimit, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet member invited", services.Members(wallet))
+}
+
+func (controller *WalletController) walletMemberAccept(ctx *gin.Context) {
+	fName := "controller/wallet/memberAccept"
+	tracer := otel.Tracer("walletMemberAccept")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMemberRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// invitations are accepted by the invited identity itself
+	identityId := ctx.GetString(token.SESSION_USER_IDENTIFIER)
+	wallet, err := controller.WalletService.AcceptInvite(ctx.Request.Context(), request.WalletId, identityId, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	member, _ := services.Member(wallet, identityId)
+	if err := controller.IdentityService.SetWalletRef(ctx.Request.Context(), identityId, request.WalletId, member.Role); err != nil {
+		fmt.Print("failed to link the wallet to the identity: %w", err)
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet invitation accepted", member)
+}
+
+func (controller *WalletController) walletMemberUpdate(ctx *gin.Context) {
+	fName := "controller/wallet/memberUpdate"
+	tracer := otel.Tracer("walletMemberUpdate")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMemberRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if err := controller.authorizeOwner(ctx, request.WalletId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	wallet, err := controller.WalletService.UpdateMember(ctx.Request.Context(), request.WalletId, request.IdentityId, request.Role, request.SpendLimit, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	member, _ := services.Member(wallet, request.IdentityId)
+	if member.Status == services.WALLET_MEMBER_ACTIVE {
+		if err := controller.IdentityService.SetWalletRef(ctx.Request.Context(), request.IdentityId, request.WalletId, member.Role); err != nil {
+			fmt.Print("failed to update the wallet role on the identity: %w", err)
+		}
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet member updated", member)
+}
+
+func (controller *WalletController) walletMemberRemove(ctx *gin.Context) {
+	fName := "controller/wallet/memberRemove"
+	tracer := otel.Tracer("walletMemberRemove")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletMemberRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// members may always leave a wallet, removing others is up to the owners
+	if request.IdentityId != ctx.GetString(token.SESSION_USER_IDENTIFIER) {
+		if err := controller.authorizeOwner(ctx, request.WalletId); err != nil {
+			common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
 			return
 		}
+	}
+
+	wallet, err := controller.WalletService.RemoveMember(ctx.Request.Context(), request.WalletId, request.IdentityId, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	if err := controller.IdentityService.SetWalletRef(ctx.Request.Context(), request.IdentityId, request.WalletId, ""); err != nil {
+		fmt.Print("failed to unlink the wallet from the identity: %w", err)
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet member removed", services.Members(wallet))
+}
+
+func (controller *WalletController) walletMembers(ctx *gin.Context) {
+	fName := "controller/wallet/members"
+	tracer := otel.Tracer("walletMembers")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
+
+	wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	audit, err := controller.WalletService.MembershipAudit(ctx.Request.Context(), "and walletId=$walletId", map[string]interface{}{
+		"walletId": walletId,
+	})
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet members fetched", struct {
+		Members []models.WalletMember           `json:"members"`
+		Audit   []*models.WalletMembershipAudit `json:"audit"`
+	}{Members: services.Members(wallet), Audit: audit})
+}
+
+func (controller *WalletController) walletStatus(ctx *gin.Context) {
+	fName := "controller/wallet/status"
+	tracer := otel.Tracer("walletStatus")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var request WalletStatusRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// merges own the closing and the reopening of the merged wallets
+	if request.Reason == services.WALLET_REASON_MERGED || request.Reason == services.WALLET_REASON_MERGE_ROLLED_BACK {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, services.ERR_INVALID_STATUS_REASON.Error(), fmt.Sprintf("got :%s ", request.Reason))
+		return
+	}
+
+	if err := controller.authorizeOwner(ctx, request.WalletId); err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	// owners can only give up their wallet, the other transitions are left to the admins
+	if ctx.GetString(token.SESSION_ROLE) != "admin" && request.Status != services.WALLET_STATUS_CLOSED {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, services.ERR_WALLET_TRANSITION_DENIED.Error(), fmt.Sprintf("got :%s ", request.Status))
+		return
+	}
+
+	err := controller.changeStatus(ctx.Request.Context(), request.WalletId, request.Status, request.Reason, request.Note, ctx.GetString(token.SESSION_USERNAME))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet status changed", struct {
+		Identifier string `json:"identifier"`
+		Status     string `json:"status"`
+	}{Identifier: request.WalletId, Status: request.Status})
+}
+
+// changeStatus moves the wallet to the status and publishes the change, a wallet
+// already in the status is left as is so that merges can be resumed.
+func (controller *WalletController) changeStatus(ctx context.Context, walletId string, status string, reason string, note string, actor string) error {
+	wallet, previous, err := controller.WalletService.ChangeStatus(ctx, walletId, status, reason, note, actor)
+	if errors.Is(err, services.ERR_WALLET_STATUS_UNCHANGED) && (reason == services.WALLET_REASON_MERGED || reason == services.WALLET_REASON_MERGE_ROLLED_BACK) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	event := &models.WalletStatusEvent{
+		WalletID:  wallet.Identifier,
+		Channel:   wallet.Channel,
+		From:      previous,
+		To:        wallet.Status,
+		Reason:    reason,
+		Actor:     actor,
+		ChangedAt: wallet.LastUpdatedAt.Unix(),
+	}
+	if err := controller.Nats.Publish(ctx, event); err != nil {
+		fmt.Print("failed to publish the wallet status change to NATS: %w", err)
+	}
+	return nil
+}
+
+// authorizeOwner allows admins and the owners of the wallet to manage its members
+func (controller *WalletController) authorizeOwner(ctx *gin.Context, walletId string) error {
+	wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletId)
+	if err != nil {
+		return err
+	}
+
+	if ctx.GetString(token.SESSION_ROLE) == "admin" {
+		return nil
+	}
+
+	member, found := services.Member(wallet, ctx.GetString(token.SESSION_USER_IDENTIFIER))
+	if !found || member.Role != services.WALLET_ROLE_OWNER || member.Status != services.WALLET_MEMBER_ACTIVE {
+		return ERR_NOT_WALLET_OWNER
+	}
+	return nil
+}
+
+// authorizeMember loads the wallet when the caller is an active member of it,
+// admins and partners can see any wallet
+func (controller *WalletController) authorizeMember(ctx *gin.Context, walletId string) (models.Wallet, error) {
+	wallet, err := controller.WalletService.Get(ctx.Request.Context(), walletId)
+	if err != nil {
+		return wallet, err
+	}
+
+	if ctx.GetString(token.SESSION_ROLE) != "consumer" {
+		return wallet, nil
+	}
+
+	member, found := services.Member(wallet, ctx.GetString(token.SESSION_USER_IDENTIFIER))
+	if !found || member.Status != services.WALLET_MEMBER_ACTIVE {
+		return wallet, ERR_NOT_WALLET_MEMBER
+	}
+	return wallet, nil
+}
+
+// statementPeriod reads the period of a statement, a date as to includes the
+// whole day
+func statementPeriod(fromValue string, toValue string) (time.Time, time.Time, error) {
+	parse := func(value string, endOfDay bool) (time.Time, error) {
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			return at.UTC(), nil
+		}
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return time.Time{}, ERR_INVALID_STATEMENT_PERIOD
+		}
+		if endOfDay {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day, nil
+	}
+
+	from, err := parse(fromValue, false)
+	if err != nil {
+		return from, from, err
+	}
+	to, err := parse(toValue, true)
+	if err != nil {
+		return from, to, err
+	}
+	if !from.Before(to) {
+		return from, to, ERR_INVALID_STATEMENT_PERIOD
+	}
+	return from, to, nil
+}
+
+func (controller *WalletController) walletStatement(ctx *gin.Context) {
+	fName := "controller/wallet/statement"
+	tracer := otel.Tracer("walletStatement")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
+
+	from, to, err := statementPeriod(ctx.Query("from"), ctx.Query("to"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got: from %s & to %s", ctx.Query("from"), ctx.Query("to")))
+		return
+	}
+
+	format := strings.ToLower(ctx.DefaultQuery("format", "json"))
+	if format != "json" && format != "csv" && format != "pdf" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, ERR_INVALID_STATEMENT_FORMAT.Error(), fmt.Sprintf("got :%s ", format))
+		return
+	}
+
+	wallet, err := controller.authorizeMember(ctx, walletId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	statement, err := controller.BalanceService.Statement(ctx.Request.Context(), wallet, from, to)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	fileName := fmt.Sprintf("statement_%s_%s_%s", wallet.Identifier, from.Format("20060102"), to.Format("20060102"))
+	switch format {
+	case "csv":
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName+".csv"))
+		ctx.Data(http.StatusOK, "text/csv", statementCSV(statement))
+	case "pdf":
+		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName+".pdf"))
+		ctx.Data(http.StatusOK, "application/pdf", statementPDF(statement))
+	default:
+		common.PrepareCustomResponse(ctx, "wallet statement generated", statement)
+	}
+}
+
+// statementCSV writes the statement lines, the opening and closing balances are
+// the first and last rows
+func statementCSV(statement models.Statement) []byte {
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	writer.Write([]string{"date", "transactionId", "type", "counterparty", "credit", "debit", "balance", "remarks"})
+	writer.Write([]string{statement.From.Format(time.RFC3339), "", "opening_balance", "", "", "", strconv.FormatInt(statement.OpeningBalance, 10), ""})
+	for _, line := range statement.Lines {
+		writer.Write([]string{
+			line.CreatedOn.Format(time.RFC3339Nano),
+			line.TransactionId,
+			line.TransactionType,
+			line.Counterparty,
+			strconv.FormatInt(line.Credit, 10),
+			strconv.FormatInt(line.Debit, 10),
+			strconv.FormatInt(line.Balance, 10),
+			line.Remarks,
+		})
+	}
+	writer.Write([]string{statement.To.Format(time.RFC3339), "", "closing_balance", "", "", "", strconv.FormatInt(statement.ClosingBalance, 10), ""})
+	writer.Flush()
+	return out.Bytes()
+}
+
+func statementPDF(statement models.Statement) []byte {
+	document := pdf.New()
+	document.Line("Wallet statement")
+	document.Line("")
+	document.Line("Wallet:  %s %s", statement.WalletId, statement.WalletName)
+	document.Line("Period:  %s to %s", statement.From.Format(time.RFC3339), statement.To.Format(time.RFC3339))
+	if !statement.Closed {
+		document.Line("The period has not ended, the statement is provisional")
+	}
+	document.Line("")
+	document.Line("Opening balance: %d", statement.OpeningBalance)
+	document.Line("")
+	document.Line("%-20s %-14s %-10s %10s %10s %12s", "Date", "Transaction", "Type", "Credit", "Debit", "Balance")
+	for _, line := range statement.Lines {
+		transactionId := line.TransactionId
+		if len(transactionId) > 14 {
+			transactionId = transactionId[:11] + "..."
+		}
+		document.Line("%-20s %-14s %-10s %10d %10d %12d", line.CreatedOn.Format("2006-01-02 15:04:05"), transactionId, line.TransactionType, line.Credit, line.Debit, line.Balance)
+	}
+	document.Line("")
+	document.Line("Totals")
+	for _, total := range statement.Totals {
+		document.Line("%-10s %6d transactions %12d credit %12d debit", total.TransactionType, total.Count, total.Credits, total.Debits)
+	}
+	document.Line("")
+	document.Line("Closing balance: %d", statement.ClosingBalance)
+	return document.Bytes()
+}
+
+func (controller *WalletController) walletBalanceAt(ctx *gin.Context) {
+	fName := "controller/wallet/balanceAt"
+	tracer := otel.Tracer("walletBalanceAt")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
+
+	// a date asks for the balance at the end of that day
+	value := ctx.Query("at")
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		day, dayErr := time.Parse("2006-01-02", value)
+		if dayErr != nil {
+			common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: at must be a RFC3339 time or a date", fmt.Sprintf("got :%s ", value))
+			return
+		}
+		at = day.AddDate(0, 0, 1)
+	}
+
+	wallet, err := controller.authorizeMember(ctx, walletId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	balance, err := controller.BalanceService.BalanceAt(ctx.Request.Context(), wallet, at)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	common.PrepareCustomResponse(ctx, "wallet balance fetched", struct {
+		WalletId string    `json:"walletId"`
+		At       time.Time `json:"at"`
+		Balance  int64     `json:"balance"`
+	}{WalletId: wallet.Identifier, At: at.UTC(), Balance: balance})
+}
+
+// walletBalanceHistory returns the balance at the end of each day of the period
+// for charting, from and to are dates and both included
+func (controller *WalletController) walletBalanceHistory(ctx *gin.Context) {
+	fName := "controller/wallet/balanceHistory"
+	tracer := otel.Tracer("walletBalanceHistory")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
 
-		// publishing to nats
-		// do not need apply the business contract
-		go controller.publishTxToNats(ctx.Request.Context(), &transaction)
+	from, err := time.Parse("2006-01-02", ctx.Query("from"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: from must be a date", fmt.Sprintf("got :%s ", ctx.Query("from")))
+		return
+	}
+	to, err := time.Parse("2006-01-02", ctx.Query("to"))
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: to must be a date", fmt.Sprintf("got :%s ", ctx.Query("to")))
+		return
+	}
 
-		// markging wallet as disabled
-		controller.WalletService.Update(ctx.Request.Context(), wallet.Identifier, "admin", "disabled")
+	wallet, err := controller.authorizeMember(ctx, walletId)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusForbidden, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
 
+	series, err := controller.BalanceService.History(ctx.Request.Context(), wallet, from, to)
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
 	}
-	common.PrepareCustomResponse(ctx, "wallet merged", nil)
+
+	common.PrepareCustomResponse(ctx, "wallet balance history fetched", series)
 }
 
 func (controller *WalletController) walletGet(ctx *gin.Context) {
@@ -199,42 +1119,113 @@ func (controller *WalletController) walletDelete(ctx *gin.Context) {
 	common.PrepareCustomResponse(ctx, "wallet deleted", nil)
 }
 
+// walletFilterQuery builds the conditions of the wallet filter, it is shared by
+// the filter and the export so both select the same wallets
+func walletFilterQuery(wallet models.Wallet) (string, map[string]interface{}) {
+	queryString := "AND isDeleted=false"
+
+	if wallet.Identifier != "" {
+		queryString += " AND identifier=$identifier"
+	}
+
+	if wallet.Name != "" {
+		queryString += " AND name=$name"
+	}
+
+	return queryString, map[string]interface{}{
+		"identifier": wallet.Identifier,
+		"name":       wallet.Name,
+	}
+}
+
 func (controller *WalletController) walletFilter(ctx *gin.Context) {
 	fName := "controller/wallet/filter"
 	tracer := otel.Tracer("walletFilter")
 	_, span := tracer.Start(ctx.Request.Context(), fName)
 	defer span.End()
 
-	queryString := "AND isDeleted=false"
-
 	var wallet models.Wallet
 	if err := ctx.BindJSON(&wallet); err != nil {
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
 		return
 	}
 
-	if wallet.Identifier != "" {
-		queryString += " AND identifier=$identifier"
+	queryString, params := walletFilterQuery(wallet)
+	wallets, err := controller.WalletService.Filter(ctx.Request.Context(), queryString, params, "createdAt", -1)
+
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
 	}
 
-	if wallet.Name != "" {
-		queryString += " AND name=$name"
+	common.PrepareCustomResponse(ctx, "wallets fetched", wallets)
+}
+
+// columns of the wallet export in their default order
+var walletExportColumns = []string{"identifier", "name", "walletType", "status", "statusReason", "balance", "linkedTo", "metadata", "createdAt", "lastUpdatedAt", "lastUpdatedBy", "isCommited"}
+
+// walletExport streams the wallets matching the filter as NDJSON or CSV, the
+// format, the columns and gzip are chosen with query parameters
+func (controller *WalletController) walletExport(ctx *gin.Context) {
+	fName := "controller/wallet/export"
+	tracer := otel.Tracer("walletExport")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
+
+	var wallet models.Wallet
+	if err := ctx.BindJSON(&wallet); err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: invalid request payload provided", fmt.Sprintf("got :%s ", err))
+		return
 	}
 
-	wallets, err := controller.WalletService.Filter(ctx.Request.Context(), queryString, map[string]interface{}{
-		"identifier": wallet.Identifier,
-		"name":       wallet.Name,
-	}, "createdAt", -1)
+	writer, err := newExportWriter(ctx, walletExportColumns, "wallets")
+	if err != nil {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
+		return
+	}
+
+	queryString, params := walletFilterQuery(wallet)
+	err = controller.WalletService.Export(ctx.Request.Context(), queryString, params, "createdAt", func(row *models.Wallet) error {
+		return writer.Write(export.Record{
+			"identifier":    row.Identifier,
+			"name":          row.Name,
+			"walletType":    row.WalletType,
+			"status":        row.Status,
+			"statusReason":  row.StatusReason,
+			"balance":       row.Balance,
+			"linkedTo":      row.LinkedTo,
+			"metadata":      row.Metadata,
+			"createdAt":     row.CreatedAt,
+			"lastUpdatedAt": row.LastUpdatedAt,
+			"lastUpdatedBy": row.LastUpdatedBy,
+			"isCommited":    row.IsCommitedOnBlockchain,
+		})
+	})
+	finishExport(ctx, fName, writer, err)
+}
+
+func (controller *WalletController) walletExpirySchedule(ctx *gin.Context) {
+	fName := "controller/wallet/expirySchedule"
+	tracer := otel.Tracer("walletExpirySchedule")
+	_, span := tracer.Start(ctx.Request.Context(), fName)
+	defer span.End()
 
+	walletId := ctx.Query("walletId")
+	if walletId == "" {
+		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, "error: wallet id is required", fmt.Sprintf("got :%s ", walletId))
+		return
+	}
+
+	schedule, err := controller.ExpiryService.UpcomingExpiry(ctx.Request.Context(), walletId)
 	if err != nil {
 		common.PrepareCustomError(ctx, http.StatusBadRequest, fName, err.Error(), fmt.Sprintf("got :%s ", err))
 		return
 	}
 
-	common.PrepareCustomResponse(ctx, "wallets fetched", wallets)
+	common.PrepareCustomResponse(ctx, "expiry schedule fetched", schedule)
 }
 
-func (controller *WalletController) publishTxToNats(ctx context.Context, transaction *models.Transaction) {
+func (controller *WalletController) publishTxToNats(ctx context.Context, transaction *models.Transaction) error {
 
 	var request nats.TopicEncoder
 	request = &models.TransferRequest{
@@ -246,10 +1237,18 @@ func (controller *WalletController) publishTxToNats(ctx context.Context, transac
 		Update:  !transaction.Spend,
 	}
 
+	// recorded before it is sent so that the callback finds it published, a
+	// transaction already committed by an earlier publish keeps its status
+	if _, err := controller.TransactionService.SetStatus(ctx, transaction.ExtID, services.TRANSACTION_STATUS_PUBLISHED, ""); err != nil && !errors.Is(err, services.ERR_TRANSACTION_STATUS_TRANSITION) {
+		fmt.Print("failed to record the merge transaction status: %w", err)
+	}
+
 	if err := controller.Nats.Publish(ctx, request); err != nil {
-		fmt.Print("failed to write merge transaction to NATS (failing over to retry service): %w", err)
-		// TODO: execute the retry flow from here
+		fmt.Print("failed to write merge transaction to NATS: %w", err)
+		controller.TransactionService.SetStatus(ctx, transaction.ExtID, services.TRANSACTION_STATUS_FAILED, err.Error())
+		return err
 	}
+	return nil
 }
 
 func (controller *WalletController) WalletRoutes(group *gin.RouterGroup) {
@@ -259,7 +1258,21 @@ func (controller *WalletController) WalletRoutes(group *gin.RouterGroup) {
 
 	walletRoute.GET("/get", controller.walletGet)
 	walletRoute.POST("/filter", controller.walletFilter)
+	walletRoute.POST("/export", controller.walletExport)
+	walletRoute.GET("/expiry-schedule", controller.walletExpirySchedule)
+	walletRoute.GET("/statement", controller.walletStatement)
+	walletRoute.GET("/balance-at", controller.walletBalanceAt)
+	walletRoute.GET("/balance-history", controller.walletBalanceHistory)
 	walletRoute.POST("/create", controller.walletCreate)
-	walletRoute.POST("/merge", controller.walletMerge)
+	walletRoute.POST("/merge", middleware.IdempotencyMiddleware(controller.IdempotencyService), controller.walletMerge)
+	walletRoute.GET("/merge/status", controller.walletMergeStatus)
+	walletRoute.POST("/merge/resume", controller.walletMergeResume)
+	walletRoute.POST("/merge/rollback", controller.walletMergeRollback)
+	walletRoute.POST("/status", controller.walletStatus)
+	walletRoute.GET("/members", controller.walletMembers)
+	walletRoute.POST("/member/invite", controller.walletMemberInvite)
+	walletRoute.POST("/member/accept", controller.walletMemberAccept)
+	walletRoute.POST("/member/update", controller.walletMemberUpdate)
+	walletRoute.POST("/member/remove", controller.walletMemberRemove)
 	walletRoute.DELETE("/delete", controller.walletDelete)
 }
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/loyyal/loyyal-be-contract/services"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"github.com/loyyal/loyyal-be-contract/utils/token"
+)
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// IDEMPOTENCY_TRANSACTION_ID holds the transaction id derived from the key of
+// the request, see TransactionId
+const IDEMPOTENCY_TRANSACTION_ID = "idempotency_transaction_id"
+
+// attempts made to store the response of a completed request
+const idempotency_complete_attempts = 3
+
+// responseRecorder keeps a copy of the body written by the handler so it can be
+// replayed for a retried request.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware makes money-moving endpoints safe to retry. The key is
+// read from the Idempotency-Key header or from the externalId of the request body.
+// A retry with the same body gets the original response back, a retry with a
+// different body is rejected with 409 Conflict.
+func IdempotencyMiddleware(service services.IdempotencyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fName := "middleware/idempotency"
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			common.PrepareCustomError(c, http.StatusBadRequest, fName, "error: invalid request body provided", fmt.Sprintf("got :%s ", err))
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := c.GetHeader(IDEMPOTENCY_KEY_HEADER)
+		if key == "" {
+			var reference struct {
+				ExternalId string `json:"externalId"`
+			}
+			json.Unmarshal(body, &reference)
+			key = reference.ExternalId
+		}
+
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		scope := c.GetString(token.SESSION_USERNAME)
+		fingerprint := requestFingerprint(c.Request.Method, c.FullPath(), body)
+
+		record, err := service.Reserve(c.Request.Context(), scope, key, fingerprint)
+		if errors.Is(err, services.ERR_IDEMPOTENCY_KEY_REUSED) || errors.Is(err, services.ERR_IDEMPOTENCY_KEY_IN_PROGRESS) {
+			common.PrepareCustomError(c, http.StatusConflict, fName, err.Error(), fmt.Sprintf("got key :%s ", key))
+			c.Abort()
+			return
+		}
+		if err != nil {
+			common.PrepareCustomError(c, http.StatusInternalServerError, fName, "error: unable to verify idempotency key", fmt.Sprintf("got :%s ", err))
+			c.Abort()
+			return
+		}
+
+		if record != nil {
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(record.ResponseCode, "application/json; charset=utf-8", record.ResponseBody)
+			c.Abort()
+			return
+		}
+
+		c.Set(IDEMPOTENCY_TRANSACTION_ID, idempotentTransactionId(scope, key))
+		recorder := &responseRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = recorder
+
+		c.Next()
+
+		// a failed request is released so that it can be retried
+		if c.Writer.Status() < http.StatusOK || c.Writer.Status() >= http.StatusMultipleChoices {
+			if err := service.Release(c.Request.Context(), scope, key); err != nil {
+				fmt.Printf("failed to release idempotency key %q: %s", key, err)
+			}
+			return
+		}
+
+		// a successful request keeps the key reserved even when its response
+		// can not be stored, a retry gets a conflict until the lease ends and
+		// then collides with the transaction id derived from the key
+		for attempt := 0; attempt < idempotency_complete_attempts; attempt++ {
+			if err = service.Complete(c.Request.Context(), scope, key, c.Writer.Status(), recorder.body.Bytes()); err == nil {
+				return
+			}
+		}
+		fmt.Printf("failed to store idempotency key %q: %s", key, err)
+	}
+}
+
+// TransactionId is the id of the transaction created by the request: the
+// external id when the caller gave one, otherwise the id derived from the
+// idempotency key so that a retry can not book a second transaction. It is
+// empty when the request has neither, an id is generated then.
+func TransactionId(c *gin.Context, externalId string) string {
+	if externalId != "" {
+		return externalId
+	}
+	return c.GetString(IDEMPOTENCY_TRANSACTION_ID)
+}
+
+func idempotentTransactionId(scope string, key string) string {
+	sum := sha256.Sum256([]byte(scope + "/" + key))
+	return "idem_" + hex.EncodeToString(sum[:20])
+}
+
+// requestFingerprint hashes the request with a compacted body so that whitespace
+// differences of a retried request do not count as a different request.
+func requestFingerprint(method string, path string, body []byte) string {
+	compacted := &bytes.Buffer{}
+	if err := json.Compact(compacted, body); err != nil {
+		compacted = bytes.NewBuffer(body)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(compacted.Bytes())
+	return hex.EncodeToString(hash.Sum(nil))
+}
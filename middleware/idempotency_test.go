@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestFingerprint(t *testing.T) {
+	base := requestFingerprint("POST", "/transaction/issue", []byte(`{"to":"w1","amount":10}`))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		same   bool
+	}{
+		{name: "same request", method: "POST", path: "/transaction/issue", body: `{"to":"w1","amount":10}`, same: true},
+		{name: "whitespace", method: "POST", path: "/transaction/issue", body: "{\n  \"to\": \"w1\",\n  \"amount\": 10\n}\n", same: true},
+		{name: "other method", method: "PUT", path: "/transaction/issue", body: `{"to":"w1","amount":10}`},
+		{name: "other path", method: "POST", path: "/transaction/redeem", body: `{"to":"w1","amount":10}`},
+		{name: "other body", method: "POST", path: "/transaction/issue", body: `{"to":"w1","amount":11}`},
+		{name: "keys in another order", method: "POST", path: "/transaction/issue", body: `{"amount":10,"to":"w1"}`},
+		{name: "whitespace within a value", method: "POST", path: "/transaction/issue", body: `{"to":"w1 ","amount":10}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fingerprint := requestFingerprint(test.method, test.path, []byte(test.body))
+			if (fingerprint == base) != test.same {
+				t.Errorf("got same fingerprint %t, want %t", fingerprint == base, test.same)
+			}
+		})
+	}
+}
+
+func TestRequestFingerprintOfInvalidJson(t *testing.T) {
+	tests := []struct {
+		name  string
+		left  string
+		right string
+		same  bool
+	}{
+		{name: "same body", left: "amount=10", right: "amount=10", same: true},
+		{name: "other body", left: "amount=10", right: "amount=11"},
+		{name: "whitespace counts", left: "{amount: 10", right: "{amount:10"},
+		{name: "empty body", left: "", right: "", same: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			left := requestFingerprint("POST", "/bulk", []byte(test.left))
+			right := requestFingerprint("POST", "/bulk", []byte(test.right))
+			if (left == right) != test.same {
+				t.Errorf("got same fingerprint %t, want %t", left == right, test.same)
+			}
+		})
+	}
+}
+
+func TestIdempotentTransactionId(t *testing.T) {
+	id := idempotentTransactionId("partner1", "key1")
+	if !strings.HasPrefix(id, "idem_") || len(id) != len("idem_")+40 {
+		t.Fatalf("got %s, want idem_ and 40 hex characters", id)
+	}
+	if again := idempotentTransactionId("partner1", "key1"); again != id {
+		t.Errorf("got %s for the same key, want %s", again, id)
+	}
+	if other := idempotentTransactionId("partner2", "key1"); other == id {
+		t.Errorf("got the same id for another scope")
+	}
+	if other := idempotentTransactionId("partner1", "key2"); other == id {
+		t.Errorf("got the same id for another key")
+	}
+}
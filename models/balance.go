@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// BalanceSnapshot is the balance of a wallet at the end of a day, historical
+// balances start from the latest snapshot instead of the first transaction
+type BalanceSnapshot struct {
+	DocType  string `json:"type"`
+	WalletId string `json:"walletId"`
+	// Day is the start of the day (UTC), the balance is the one at the end of it
+	Day     time.Time `json:"day"`
+	At      time.Time `json:"at"`
+	Balance int64     `json:"balance"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BalancePoint is the balance of a wallet at the end of a day with the points
+// credited and debited during that day
+type BalancePoint struct {
+	Day     string `json:"day"`
+	Credits int64  `json:"credits"`
+	Debits  int64  `json:"debits"`
+	Balance int64  `json:"balance"`
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// BulkRow is one transaction of an uploaded bulk file
+type BulkRow struct {
+	// Line of the row in the file, the header of a csv file is line 1
+	Line int64 `json:"line"`
+	// Reference is supplied by the partner and unique for the partner, a row
+	// with a reference that was posted before is not posted again
+	Reference string `json:"reference"`
+	// [earn, redeem, transfer]
+	TransactionType        string          `json:"type"`
+	From                   string          `json:"from"`
+	To                     string          `json:"to"`
+	Amount                 int64           `json:"amount"`
+	TransactionInitiatedBy string          `json:"initiatedBy"`
+	Metadata               json.RawMessage `json:"metadata,omitempty"`
+}
+
+// BulkRowError is a validation error of a row of an uploaded bulk file
+type BulkRowError struct {
+	Line      int64  `json:"line"`
+	Reference string `json:"reference,omitempty"`
+	Error     string `json:"errmsg"`
+}
+
+// BulkRowResult is the outcome of the processing of one row of a bulk job
+type BulkRowResult struct {
+	DocType         string `json:"type"`
+	JobId           string `json:"jobId"`
+	Line            int64  `json:"line"`
+	Reference       string `json:"reference"`
+	TransactionType string `json:"transactionType"`
+	Amount          int64  `json:"amount"`
+	// [succeeded, failed, duplicate]
+	Status        string    `json:"status"`
+	TransactionId string    `json:"transactionId,omitempty"`
+	Error         string    `json:"errmsg,omitempty"`
+	ProcessedAt   time.Time `json:"processedAt"`
+}
+
+// BulkInput holds the rows of a bulk job until the job is completed, a job
+// interrupted by a restart is resumed from them
+type BulkInput struct {
+	DocType string    `json:"type"`
+	JobId   string    `json:"jobId"`
+	Rows    []BulkRow `json:"rows"`
+}
+
+// BulkJob is the processing of an uploaded bulk file
+type BulkJob struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	FileName   string `json:"fileName"`
+	// [csv, jsonl]
+	Format string `json:"format"`
+	// [queued, processing, completed, completed_with_errors]
+	Status     string `json:"status"`
+	Total      int64  `json:"total"`
+	Processed  int64  `json:"processed"`
+	Succeeded  int64  `json:"succeeded"`
+	Failed     int64  `json:"failed"`
+	Duplicates int64  `json:"duplicates"`
+
+	Creator       string     `json:"creator"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	CompletedAt   *time.Time `json:"completedAt,omitempty"`
+	LastUpdatedAt time.Time  `json:"lastUpdatedAt"`
+}
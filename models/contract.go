@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
 
 type Contract struct {
 	DocType      string `json:"type"`
@@ -8,11 +12,16 @@ type Contract struct {
 	ContractId   int64  `json:"contractId"`
 	ContractName string `json:"contractName" binding:"required"`
 
-	OperatorId   int64  `json:"operatorId"`
-	OperatorName string `json:"operatorName" binding:"required"`
+	// OperatorId is the identity of the operator whose transactions the
+	// contract prices
+	OperatorId   PartyId `json:"operatorId" binding:"required"`
+	OperatorName string  `json:"operatorName" binding:"required"`
 
-	PartnerId   int64  `json:"partnerId"`
-	PartnerName string `json:"partnerName" binding:"required"`
+	// PartnerId is the identity of the partner, an empty partner prices the
+	// transactions of every partner of the operator and the contract is
+	// approved by the operator alone
+	PartnerId   PartyId `json:"partnerId"`
+	PartnerName string  `json:"partnerName" binding:"required"`
 
 	// [Regular, Promotional]
 	ContractType string `json:"contractType" binding:"required"`
@@ -25,17 +34,180 @@ type Contract struct {
 	ValidFrom   time.Time `json:"validFrom" binding:"required"`
 	ValidUntill time.Time `json:"validUntill" binding:"required"`
 
-	// [1:20, 2x]
-	EarnConversionRatio int64 `json:"earnConversionRatio" binding:"required"`
-	BurnConversionRatio int64 `json:"burnConversionRatio" binding:"required"`
+	// [1:20, 2x, 3/2, 0.05]
+	EarnConversionRatio Ratio `json:"earnConversionRatio" binding:"required"`
+	BurnConversionRatio Ratio `json:"burnConversionRatio" binding:"required"`
+	// RoundingMode of the converted points [floor, ceil, half_even], empty
+	// rounds down
+	RoundingMode string `json:"roundingMode"`
+	// MinPoints and MaxPoints bound the points of a transaction, 0 is no bound
+	MinPoints int64 `json:"minPoints"`
+	MaxPoints int64 `json:"maxPoints"`
+
+	// BandBasis chooses the band of Bands that prices a transaction [amount,
+	// tier, spend]: by the amount of the transaction, by the tier of the member
+	// or by what the member spent in the BandPeriod [month, year, contract]
+	// before it. The conversion ratios of the band replace the ones of the
+	// contract, a contract without bands applies its own.
+	BandBasis  string         `json:"bandBasis,omitempty"`
+	BandPeriod string         `json:"bandPeriod,omitempty"`
+	Bands      []ContractBand `json:"bands,omitempty"`
+
+	// Stackable promotions add their bonus together, a promotion that is not
+	// stackable is applied alone
+	Stackable bool `json:"stackable"`
+	// BonusType is how a promotion adds to the earned points [ratio,
+	// multiplier, fixed]: the earn ratio applied to the amount, the earn ratio
+	// as a multiplier of the regular points, or BonusPoints. Empty is ratio.
+	BonusType   string `json:"bonusType,omitempty"`
+	BonusPoints int64  `json:"bonusPoints,omitempty"`
+	// MaxBonusPoints caps the bonus all promotions add on top of this regular
+	// contract, 0 is no cap
+	MaxBonusPoints int64 `json:"maxBonusPoints,omitempty"`
+
+	// Budget is the points the contract may give out in total and MemberCap
+	// the points per member wallet, 0 is no limit. The contract stops applying
+	// once a transaction does not fit in them.
+	Budget    int64 `json:"budget,omitempty"`
+	MemberCap int64 `json:"memberCap,omitempty"`
+	// BudgetThresholds are the percentages of the budget at which the operator
+	// is notified, 80 and 100 when none are given
+	BudgetThresholds []int64 `json:"budgetThresholds,omitempty"`
+	// ExpiryMonths after accrual the earned points expire, 0 falls back to the
+	// expiry policy of the operator
+	ExpiryMonths int64 `json:"expiryMonths"`
 	// Creator records the user that created the record.
 	Creator string `json:"creator"`
 	// Channel records the channel on which the wallet will be written.
 	Channel string `json:"channel"`
 
+	// Version is increased on every change, contracts created before versions
+	// were kept have none
+	Version int64 `json:"version"`
+
+	// OperatorApproval and PartnerApproval are the decisions of the parties
+	// on the current terms of a draft [approved, rejected], empty when not
+	// decided yet. Decisions keeps every decision made on the contract.
+	OperatorApproval string             `json:"operatorApproval,omitempty"`
+	PartnerApproval  string             `json:"partnerApproval,omitempty"`
+	Decisions        []ContractDecision `json:"decisions,omitempty"`
+	// Proposal is a change of the terms of an approved contract, a draft with
+	// the approvals of the parties on it. The contract prices with its
+	// approved terms until both parties approve the proposal, which then
+	// replaces them.
+	Proposal *Contract `json:"proposal,omitempty"`
+
+	// [draft, rejected, pending, active, expired]
 	Status        string    `json:"status"`
 	CreatedAt     time.Time `json:"createdAt"`
 	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
 	LastUpdatedBy string    `json:"lastUpdatedBy"`
 	IsDeleted     bool      `json:"isDeleted"`
 }
+
+// ContractBand is a band of transactions with its own conversion ratios. An
+// amount or spend band covers From up to To, To excluded, the last band has
+// no To. A tier band applies to the members of the tier, the band without a
+// tier to every other member.
+type ContractBand struct {
+	Name                string `json:"name,omitempty"`
+	From                int64  `json:"from,omitempty"`
+	To                  int64  `json:"to,omitempty"`
+	Tier                string `json:"tier,omitempty"`
+	EarnConversionRatio Ratio  `json:"earnConversionRatio"`
+	BurnConversionRatio Ratio  `json:"burnConversionRatio"`
+}
+
+// ContractVersion is an immutable copy of a contract as it was after a change
+type ContractVersion struct {
+	DocType    string `json:"type"`
+	ContractId string `json:"contractId"`
+	Version    int64  `json:"version"`
+	// Contract is the whole contract at this version
+	Contract Contract         `json:"contract"`
+	Changes  []ContractChange `json:"changes"`
+	Editor   string           `json:"editor"`
+	EditedAt time.Time        `json:"editedAt"`
+}
+
+// ContractChange is a field of the contract changed by a version
+type ContractChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// ContractDecision is the approval or the rejection of a contract by one of
+// its parties
+type ContractDecision struct {
+	// [operator, partner]
+	Party      string `json:"party"`
+	IdentityId string `json:"identityId"`
+	// [approved, rejected]
+	Decision string `json:"decision"`
+	Comment  string `json:"comment"`
+	// Version of the contract the decision was made on
+	Version   int64     `json:"version"`
+	DecidedBy string    `json:"decidedBy"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// PartyId is the identity id of an operator or a partner. Contracts stored
+// before they referenced identities hold a number, zero is read as no party.
+type PartyId string
+
+func (id *PartyId) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) || bytes.Equal(data, []byte("0")) {
+		*id = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] != '"' {
+		var number json.Number
+		if err := json.Unmarshal(data, &number); err != nil {
+			return err
+		}
+		*id = PartyId(number.String())
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*id = PartyId(value)
+	return nil
+}
+
+// ContractBudgetUsage is how much of the budget of a contract has been consumed
+type ContractBudgetUsage struct {
+	ContractId string `json:"contractId"`
+	Budget     int64  `json:"budget"`
+	Consumed   int64  `json:"consumed"`
+	Remaining  int64  `json:"remaining"`
+	// Utilisation is the consumed share of the budget in percent
+	Utilisation float64 `json:"utilisation"`
+	MemberCap   int64   `json:"memberCap,omitempty"`
+	// MemberId and MemberConsumed are given when the usage of a member is asked
+	MemberId       string `json:"memberId,omitempty"`
+	MemberConsumed int64  `json:"memberConsumed,omitempty"`
+	Exhausted      bool   `json:"exhausted"`
+}
+
+// ContractCacheMetrics tells how well the contract cache of a replica serves
+// the pricing of transactions
+type ContractCacheMetrics struct {
+	// Hits are lookups answered from memory, Misses the ones that queried the
+	// database because the cache was not synced
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hitRatio"`
+	// Refreshes are contracts reloaded on a change event, Resyncs full reloads
+	// and Failures reloads that failed and left the cache unsynced
+	Refreshes int64     `json:"refreshes"`
+	Resyncs   int64     `json:"resyncs"`
+	Failures  int64     `json:"failures"`
+	Contracts int       `json:"contracts"`
+	Synced    bool      `json:"synced"`
+	SyncedAt  time.Time `json:"syncedAt"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// FxRate converts amounts of the From currency into the To currency, from the
+// time it is effective until the next rate of the pair takes over
+type FxRate struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	// From and To are ISO 4217 currency codes
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Rate is the amount of To for one unit of From
+	Rate          Ratio     `json:"rate"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	// [api, csv]
+	Source string `json:"source"`
+
+	Creator       string    `json:"creator"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+	IsDeleted     bool      `json:"isDeleted"`
+}
+
+// FxRateError is a line of an imported rate file that could not be loaded
+type FxRateError struct {
+	Line  int64  `json:"line"`
+	Error string `json:"error"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// IdempotencyRecord remembers the outcome of a money-moving request so that a
+// retried request carrying the same key can be answered without creating a
+// second transaction.
+type IdempotencyRecord struct {
+	DocType string `json:"type"`
+	// Key is the caller supplied Idempotency-Key header or external id.
+	Key string `json:"key"`
+	// Scope is the API user the key belongs to, keys of different users never clash.
+	Scope string `json:"scope"`
+	// Fingerprint is the hash of the request method, path and body.
+	Fingerprint string `json:"fingerprint"`
+	// [processing, completed]
+	Status string `json:"status"`
+
+	ResponseCode int             `json:"responseCode,omitempty"`
+	ResponseBody json.RawMessage `json:"responseBody,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// LeaseUntil is when a processing request is assumed to have died, a retry
+	// may take the key over from then on
+	LeaseUntil time.Time `json:"leaseUntil,omitempty"`
+}
@@ -63,6 +63,8 @@ type PersonalDetails struct {
 
 type WalletRef struct {
 	Ref string `json:"ref"`
+	// Role of the identity on the wallet [owner, spender, viewer]
+	Role string `json:"role,omitempty"`
 }
 
 type Identity struct {
@@ -84,4 +86,7 @@ type Identity struct {
 	LastPasswordResetOn time.Time       `json:"lastPasswordResetOn"`
 	Hash                string          `json:"hashed"`
 	IsDeleted           bool            `json:"isDeleted"`
+
+	// Tier of a member, contracts may earn at a different rate by tier
+	Tier string `json:"tier,omitempty"`
 }
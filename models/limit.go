@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// LimitCaps are the caps of a window, 0 leaves the cap out
+type LimitCaps struct {
+	// Earn is the most points the wallet can receive in the window
+	Earn int64 `json:"earn"`
+	// Burn is the most points the wallet can send in the window
+	Burn int64 `json:"burn"`
+	// Count is the most transactions the wallet can take part in during the window
+	Count int64 `json:"count"`
+}
+
+// LimitPolicy caps the activity of the wallets it matches. An empty operator,
+// wallet type or identity type matches any, every matching policy applies.
+type LimitPolicy struct {
+	DocType      string `json:"type"`
+	Identifier   string `json:"identifier"`
+	Name         string `json:"name"`
+	OperatorId   string `json:"operatorId"`
+	WalletType   string `json:"walletType"`
+	IdentityType string `json:"identityType"`
+
+	// MaxSingleAmount is the most points of a single transaction
+	MaxSingleAmount int64     `json:"maxSingleAmount"`
+	Daily           LimitCaps `json:"daily"`
+	Weekly          LimitCaps `json:"weekly"`
+	Monthly         LimitCaps `json:"monthly"`
+
+	Creator       string    `json:"creator"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+	IsDeleted     bool      `json:"isDeleted"`
+}
+
+// LimitSubject is the wallet a transaction is checked for
+type LimitSubject struct {
+	WalletId      string
+	WalletType    string
+	IdentityTypes []string
+	OperatorId    string
+}
+
+// LimitAllowance is what is left of a cap of a policy in the current window
+type LimitAllowance struct {
+	PolicyId string `json:"policyId"`
+	// [earn, burn, count]
+	Metric string `json:"metric"`
+	// [daily, weekly, monthly]
+	Window    string    `json:"window"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// PointsLot tracks the points credited to a wallet by a single transaction so
+// that they can expire on their own date, independent of the rest of the balance.
+type PointsLot struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	WalletId   string `json:"walletId"`
+	// TransactionId is the transaction that credited the points
+	TransactionId string `json:"transactionId"`
+
+	Amount    int64 `json:"amount"`
+	Remaining int64 `json:"remaining"`
+
+	AccruedAt time.Time `json:"accruedAt"`
+	// ExpiresAt is empty for points that never expire
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// [open, consumed, expired]
+	Status string `json:"status"`
+	// ExpiryTransactionId is the transaction that took the lapsed points out of the wallet
+	ExpiryTransactionId string `json:"expiryTransactionId,omitempty"`
+
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// ExpiryPolicy defines how long the points issued under an operator stay valid.
+// The policy without operator is the default for every operator.
+type ExpiryPolicy struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	// OperatorId is the identity of the operator, empty for the default policy
+	OperatorId string `json:"operatorId"`
+	// ExpiryMonths after accrual the points expire, 0 for never
+	ExpiryMonths int64 `json:"expiryMonths"`
+	// [fifo, soonest_expiry]
+	ConsumptionOrder string `json:"consumptionOrder"`
+
+	Creator       string    `json:"creator"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+	IsDeleted     bool      `json:"isDeleted"`
+}
+
+// ExpirySchedule is the amount of points of a wallet lapsing on a given day
+type ExpirySchedule struct {
+	ExpiresOn string `json:"expiresOn"`
+	Amount    int64  `json:"amount"`
+}
+
+// LotConsumption is the part of a lot used up by a debit from the wallet
+type LotConsumption struct {
+	LotId     string     `json:"lotId"`
+	Amount    int64      `json:"amount"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// MergeStep is the merge of one source wallet into the target wallet
+type MergeStep struct {
+	From   string `json:"from"`
+	Amount int64  `json:"amount"`
+	// TransactionId is generated before the transfer is created so that a resumed
+	// step picks up the same transaction
+	TransactionId         string `json:"transactionId,omitempty"`
+	RollbackTransactionId string `json:"rollbackTransactionId,omitempty"`
+	// [pending, created, transferred, completed, rolled_back], a failed step
+	// keeps its status and records the error so that it can be resumed
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// MergeOperation tracks a wallet merge so that it can be resumed or rolled back
+// when it fails halfway.
+type MergeOperation struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	To         string `json:"to"`
+	// IdentityId is the identity owning all the merged wallets
+	IdentityId string      `json:"identityId"`
+	Currency   string      `json:"currency"`
+	Steps      []MergeStep `json:"steps"`
+	// [pending, running, completed, failed, rolling_back, rolled_back, rollback_failed]
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Creator       string    `json:"creator"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+}
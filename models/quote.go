@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// Pricing is the breakdown of the conversion of an amount into points by a
+// contract
+type Pricing struct {
+	Amount       int64  `json:"amount"`
+	Ratio        Ratio  `json:"ratio"`
+	RoundingMode string `json:"roundingMode"`
+	// ExactPoints is the amount times the ratio before rounding, as a fraction
+	ExactPoints   string `json:"exactPoints"`
+	RoundedPoints int64  `json:"roundedPoints"`
+	MinPoints     int64  `json:"minPoints,omitempty"`
+	MaxPoints     int64  `json:"maxPoints,omitempty"`
+	// Points are the rounded points within the bounds of the contract
+	Points int64 `json:"points"`
+
+	// Currency of an amount converted into the ContractCurrency before the
+	// ratio was applied, with the rate used and the converted amount as a
+	// fraction
+	Currency         string `json:"currency,omitempty"`
+	ContractCurrency string `json:"contractCurrency,omitempty"`
+	FxRateId         string `json:"fxRateId,omitempty"`
+	FxRate           Ratio  `json:"fxRate,omitempty"`
+	ConvertedAmount  string `json:"convertedAmount,omitempty"`
+}
+
+// ContractLine is the part of the points of a transaction contributed by a
+// contract
+type ContractLine struct {
+	ContractId      string `json:"contractId"`
+	ContractVersion int64  `json:"contractVersion"`
+	ContractType    string `json:"contractType"`
+	// [base, bonus]
+	Role string `json:"role"`
+	// [ratio, multiplier, fixed]
+	BonusType string  `json:"bonusType,omitempty"`
+	Pricing   Pricing `json:"pricing"`
+	// Points the contract contributes, a bonus can be cut down by the bonus cap
+	Points int64 `json:"points"`
+	Capped bool  `json:"capped,omitempty"`
+	// Band of the contract that priced the line, with what chose it
+	Band *ContractBand `json:"band,omitempty"`
+	// BandValue is the amount, the tier or the spend the band was chosen by
+	BandValue string `json:"bandValue,omitempty"`
+}
+
+// Quote is the preview of the points of an issue or a redeem, it is honoured
+// when the transaction is submitted with its token before it expires
+type Quote struct {
+	Identifier             string         `json:"identifier"`
+	TransactionType        string         `json:"transactionType"`
+	From                   string         `json:"from"`
+	To                     string         `json:"to"`
+	Amount                 int64          `json:"amount"`
+	SourceCurrency         string         `json:"sourceCurrency,omitempty"`
+	Points                 int64          `json:"points"`
+	AppliedContract        string         `json:"appliedContract,omitempty"`
+	AppliedContractVersion int64          `json:"appliedContractVersion,omitempty"`
+	Lines                  []ContractLine `json:"lines,omitempty"`
+	ExpiresAt              time.Time      `json:"expiresAt"`
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var ERR_INVALID_RATIO = errors.New("error: ratio must be a positive number, a fraction such as 3/2, a rate such as 1:20 or a multiplier such as 2x")
+
+// Ratio is an exact conversion ratio of points per unit of amount, kept as the
+// lowest terms fraction such as "1/20" or "2". It is given as a number, a
+// fraction "3/2", a rate "1:20" (one point per twenty) or a multiplier "2x".
+type Ratio string
+
+// ParseRatio reads a ratio in any of its accepted forms
+func ParseRatio(value string) (Ratio, error) {
+	value = strings.TrimSpace(value)
+
+	var rat *big.Rat
+	var ok bool
+	switch {
+	case strings.Contains(value, ":"):
+		parts := strings.SplitN(value, ":", 2)
+		numerator, okNumerator := new(big.Rat).SetString(strings.TrimSpace(parts[0]))
+		denominator, okDenominator := new(big.Rat).SetString(strings.TrimSpace(parts[1]))
+		if okNumerator && okDenominator && denominator.Sign() != 0 {
+			rat, ok = new(big.Rat).Quo(numerator, denominator), true
+		}
+	case strings.HasSuffix(strings.ToLower(value), "x"):
+		rat, ok = new(big.Rat).SetString(strings.TrimSpace(value[:len(value)-1]))
+	default:
+		rat, ok = new(big.Rat).SetString(value)
+	}
+	if !ok || rat.Sign() <= 0 {
+		return "", ERR_INVALID_RATIO
+	}
+	return Ratio(rat.RatString()), nil
+}
+
+// Rat is the ratio as a fraction, nil for an empty or invalid ratio
+func (ratio Ratio) Rat() *big.Rat {
+	rat, ok := new(big.Rat).SetString(string(ratio))
+	if !ok {
+		return nil
+	}
+	return rat
+}
+
+// UnmarshalJSON accepts a ratio as a string or as a plain number, contracts
+// stored before ratios were fractions hold an integer multiplier
+func (ratio *Ratio) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*ratio = ""
+		return nil
+	}
+
+	// numbers are read as they are, a stored ratio is never refused
+	if len(data) > 0 && data[0] != '"' {
+		rat, ok := new(big.Rat).SetString(string(data))
+		if !ok {
+			return ERR_INVALID_RATIO
+		}
+		*ratio = Ratio(rat.RatString())
+		return nil
+	}
+
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if value == "" {
+		*ratio = ""
+		return nil
+	}
+	parsed, err := ParseRatio(value)
+	if err != nil {
+		return err
+	}
+	*ratio = parsed
+	return nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import "time"
+
+// ReconciliationMismatch is a difference found between the off-chain state and
+// the ledger
+type ReconciliationMismatch struct {
+	// [missing_on_chain, missing_off_chain, amount_differs, check_failed]
+	Category string `json:"category"`
+	// [wallet, transaction]
+	EntityType string `json:"entityType"`
+	EntityId   string `json:"entityId"`
+	OffChain   int64  `json:"offChain"`
+	OnChain    int64  `json:"onChain"`
+	Detail     string `json:"detail,omitempty"`
+	// RepairId is the repair action opened for the mismatch, if any
+	RepairId string `json:"repairId,omitempty"`
+}
+
+// ReconciliationReport is the outcome of a comparison of every wallet and
+// transaction with the ledger
+type ReconciliationReport struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	// [running, completed, failed]
+	Status              string `json:"status"`
+	Error               string `json:"errmsg,omitempty"`
+	WalletsChecked      int64  `json:"walletsChecked"`
+	TransactionsChecked int64  `json:"transactionsChecked"`
+	// WalletsSkipped had transactions on their way to the ledger, their balance
+	// is compared by a later run
+	WalletsSkipped int64 `json:"walletsSkipped"`
+	// Counts are the mismatches by category
+	Counts     map[string]int64         `json:"counts"`
+	Mismatches []ReconciliationMismatch `json:"mismatches"`
+	// Truncated is set when there were more mismatches than the report keeps
+	Truncated bool `json:"truncated"`
+
+	Creator     string     `json:"creator"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// RepairAction is a change proposed by the reconciliation to fix a mismatch, it
+// is only carried out once an operator approves it
+type RepairAction struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	ReportId   string `json:"reportId"`
+	// [republish, balance_correction, apply_result]
+	Action     string `json:"action"`
+	EntityType string `json:"entityType"`
+	EntityId   string `json:"entityId"`
+	Category   string `json:"category"`
+	// From and To are the off-chain balance before and after a balance correction
+	From int64 `json:"from,omitempty"`
+	To   int64 `json:"to,omitempty"`
+	// LedgerUUID is the chain id of a transaction found on the ledger only
+	LedgerUUID string `json:"ledgerUuid,omitempty"`
+
+	// [proposed, approved, rejected, executed, failed]
+	Status     string     `json:"status"`
+	Error      string     `json:"errmsg,omitempty"`
+	Note       string     `json:"note,omitempty"`
+	ProposedAt time.Time  `json:"proposedAt"`
+	DecidedBy  string     `json:"decidedBy,omitempty"`
+	DecidedAt  *time.Time `json:"decidedAt,omitempty"`
+}
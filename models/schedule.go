@@ -0,0 +1,51 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ScheduleRun records the outcome of one execution of a scheduled transaction
+type ScheduleRun struct {
+	DueAt         time.Time `json:"dueAt"`
+	ExecutedAt    time.Time `json:"executedAt"`
+	TransactionId string    `json:"transactionId,omitempty"`
+	// [succeeded, failed]
+	Status string `json:"status"`
+	Error  string `json:"errmsg,omitempty"`
+}
+
+// ScheduledTransaction is a transaction executed at a later time, once or on a
+// recurrence, by the scheduler
+type ScheduledTransaction struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	// [issue, transfer]
+	TransactionType        string          `json:"transactionType"`
+	From                   string          `json:"from"`
+	To                     string          `json:"to"`
+	Amount                 int64           `json:"amount"`
+	Metadata               json.RawMessage `json:"metadata,omitempty"`
+	TransactionInitiatedBy string          `json:"transactionInitiatedBy"`
+
+	// ExecuteAt is the first execution, the start of the recurrence
+	ExecuteAt time.Time `json:"executeAt"`
+	// Recurrence is a RRULE, for example FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=12,
+	// empty for a single execution
+	Recurrence string `json:"recurrence,omitempty"`
+	// NextRunAt is empty once there is no execution left
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	RunCount  int64      `json:"runCount"`
+	// Runs keeps the most recent executions
+	Runs []ScheduleRun `json:"runs,omitempty"`
+
+	// [scheduled, completed, cancelled]
+	Status string `json:"status"`
+	// LockedUntil keeps other scheduler replicas off the transaction while it runs
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+
+	Creator       string    `json:"creator"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+	LastUpdatedBy string    `json:"lastUpdatedBy"`
+}
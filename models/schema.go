@@ -5,10 +5,16 @@ import "encoding/json"
 const (
 	TopicCreate   = "create"
 	TopicIssue    = "issue"
+	TopicBurn     = "burn"
 	TopicTransfer = "transfer"
 	TopicBalance  = "balance"
 	TopicUUID     = "uuid"
 
+	TopicWalletStatus     = "wallet_status"
+	TopicContractBudget   = "contract_budget"
+	TopicContractDecision = "contract_decision"
+	TopicContractChanged  = "contract_changed"
+
 	callbackJoiner = "callingback"
 )
 
@@ -60,7 +66,32 @@ func (r IssueRequest) TopicName() string {
 	return TopicIssue + "." + r.Channel
 }
 
+// BurnRequest is a request to take points out of an account, the points leave
+// the ledger (for example a withdrawal to an external program)
+type BurnRequest struct {
+	ID          string `json:"id,omitempty"`
+	RefID       string `json:"reference_id"` // external reference id (must be unique for each transaction)
+	CostBasis   string `json:"cost_basis"`   // cost basis tag of the burn
+	Channel     string `json:"channel"`      // channel to write to
+	Amount      int64  `json:"amount"`
+	SubmittedAt int64  `json:"submitted"`          // when request was submitted
+	Backfill    bool   `json:"backfill,omitempty"` // use submitted time as transaction time
+}
 
+// Encode converts the request into bytes
+func (r BurnRequest) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// Decode converts bytes back to the request
+func (r *BurnRequest) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// TopicName returns the topic associated with the request
+func (r BurnRequest) TopicName() string {
+	return TopicBurn + "." + r.Channel
+}
 
 type TransferRequest struct {
 	Creator     string `json:"creator,omitempty"`
@@ -89,3 +120,194 @@ func (r *TransferRequest) Decode(data []byte) error {
 func (r TransferRequest) TopicName() string {
 	return TopicTransfer + "." + r.Channel
 }
+
+// WalletStatusEvent notifies the change of the status of a wallet
+type WalletStatusEvent struct {
+	WalletID  string `json:"wallet_id"`
+	Channel   string `json:"channel"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Reason    string `json:"reason"`
+	Actor     string `json:"actor"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+// Encode converts the event into bytes
+func (e WalletStatusEvent) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode converts bytes back to the event
+func (e *WalletStatusEvent) Decode(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// TopicName returns the topic associated with the event
+func (e WalletStatusEvent) TopicName() string {
+	return TopicWalletStatus + "." + e.Channel
+}
+
+// ContractBudgetEvent notifies the operator that the consumption of the budget
+// of a contract has reached a threshold
+type ContractBudgetEvent struct {
+	ContractID string `json:"contract_id"`
+	OperatorID string `json:"operator_id"`
+	Channel    string `json:"channel"`
+	Threshold  int64  `json:"threshold"`
+	Budget     int64  `json:"budget"`
+	Consumed   int64  `json:"consumed"`
+	ReachedAt  int64  `json:"reached_at"`
+}
+
+// Encode converts the event into bytes
+func (e ContractBudgetEvent) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode converts bytes back to the event
+func (e *ContractBudgetEvent) Decode(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// TopicName returns the topic associated with the event
+func (e ContractBudgetEvent) TopicName() string {
+	return TopicContractBudget + "." + e.Channel
+}
+
+// ContractDecisionEvent notifies the counterparty of a contract that the other
+// party has approved or rejected it
+type ContractDecisionEvent struct {
+	ContractID     string `json:"contract_id"`
+	Channel        string `json:"channel"`
+	Party          string `json:"party"`
+	Decision       string `json:"decision"`
+	Comment        string `json:"comment"`
+	CounterpartyID string `json:"counterparty_id"`
+	Status         string `json:"status"`
+	DecidedBy      string `json:"decided_by"`
+	DecidedAt      int64  `json:"decided_at"`
+}
+
+// Encode converts the event into bytes
+func (e ContractDecisionEvent) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode converts bytes back to the event
+func (e *ContractDecisionEvent) Decode(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// TopicName returns the topic associated with the event
+func (e ContractDecisionEvent) TopicName() string {
+	return TopicContractDecision + "." + e.Channel
+}
+
+// ContractChangedEvent tells every replica that a contract has changed so that
+// it reloads the contract into its cache
+type ContractChangedEvent struct {
+	ContractID string `json:"contract_id"`
+	Channel    string `json:"channel"`
+	// [created, updated, deleted, decided, activated, expired]
+	Change    string `json:"change"`
+	Version   int64  `json:"version"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+// Encode converts the event into bytes
+func (e ContractChangedEvent) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode converts bytes back to the event
+func (e *ContractChangedEvent) Decode(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+// TopicName returns the topic associated with the event
+func (e ContractChangedEvent) TopicName() string {
+	return TopicContractChanged + "." + e.Channel
+}
+
+// TransactionResult is the callback of the chaincode for an issue, burn or
+// transfer request, an error means the request was rejected
+type TransactionResult struct {
+	RefID     string `json:"reference_id"`
+	UUID      string `json:"tx_uuid,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	Error     string `json:"errmsg,omitempty"`
+	Channel   string `json:"channel"`
+}
+
+// Decode converts bytes back to the result
+func (r *TransactionResult) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// CallbackSubject returns the subject the results of the requests of the topic
+// are sent back on, for every channel
+func CallbackSubject(topic string) string {
+	return topic + "." + callbackJoiner + ".*"
+}
+
+// BalanceRequest asks the ledger for the balance of a wallet, it is sent as a
+// NATS request and answered with a BalanceResult
+type BalanceRequest struct {
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+}
+
+// Encode converts the request into bytes
+func (r BalanceRequest) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// TopicName returns the topic associated with the request
+func (r BalanceRequest) TopicName() string {
+	return TopicBalance + "." + r.Channel
+}
+
+// BalanceResult is the balance of a wallet on the ledger
+type BalanceResult struct {
+	ID      string `json:"id"`
+	Found   bool   `json:"found"`
+	Balance int64  `json:"balance"`
+	Error   string `json:"errmsg,omitempty"`
+}
+
+// Decode converts bytes back to the result
+func (r *BalanceResult) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+// LookupRequest asks the ledger for the transaction written with a reference,
+// it is sent as a NATS request and answered with a LookupResult
+type LookupRequest struct {
+	RefID   string `json:"reference_id"`
+	Channel string `json:"channel"`
+}
+
+// Encode converts the request into bytes
+func (r LookupRequest) Encode() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// TopicName returns the topic associated with the request
+func (r LookupRequest) TopicName() string {
+	return TopicUUID + "." + r.Channel
+}
+
+// LookupResult is the transaction of a reference on the ledger
+type LookupResult struct {
+	RefID     string `json:"reference_id"`
+	Found     bool   `json:"found"`
+	UUID      string `json:"tx_uuid,omitempty"`
+	Amount    int64  `json:"amount"`
+	Timestamp int64  `json:"ts,omitempty"`
+	Error     string `json:"errmsg,omitempty"`
+}
+
+// Decode converts bytes back to the result
+func (r *LookupResult) Decode(data []byte) error {
+	return json.Unmarshal(data, r)
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// StatementLine is a transaction of a wallet statement with the balance of the
+// wallet after it
+type StatementLine struct {
+	TransactionId   string    `json:"transactionId"`
+	TransactionType string    `json:"transactionType"`
+	CreatedOn       time.Time `json:"createdOn"`
+	// CommittedOn places the line in the statement
+	CommittedOn time.Time `json:"committedOn"`
+	// Counterparty is the other wallet of the transaction, empty for deposits,
+	// withdrawals and expiries
+	Counterparty string `json:"counterparty,omitempty"`
+	Credit       int64  `json:"credit"`
+	Debit        int64  `json:"debit"`
+	Balance      int64  `json:"balance"`
+	Remarks      string `json:"remarks,omitempty"`
+}
+
+// StatementTotal sums up the transactions of a type in a statement
+type StatementTotal struct {
+	TransactionType string `json:"transactionType"`
+	Count           int64  `json:"count"`
+	Credits         int64  `json:"credits"`
+	Debits          int64  `json:"debits"`
+}
+
+// Statement lists the committed transactions of a wallet in a period, from is
+// inclusive and to exclusive
+type Statement struct {
+	WalletId       string           `json:"walletId"`
+	WalletName     string           `json:"walletName"`
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	OpeningBalance int64            `json:"openingBalance"`
+	ClosingBalance int64            `json:"closingBalance"`
+	Lines          []StatementLine  `json:"lines"`
+	Totals         []StatementTotal `json:"totals"`
+	// Closed is set when the period has ended, the statement of a closed period
+	// does not change anymore
+	Closed bool `json:"closed"`
+}
@@ -53,6 +53,15 @@ type Transaction struct {
 	// Amount is the amount of the currency to transfer.
 	Amount int64 `json:"amount"`
 
+	// OriginalAmount is the amount as submitted by the caller, before the
+	// business contract was applied to it.
+	OriginalAmount int64 `json:"originalAmount"`
+
+	// SourceCurrency is the ISO currency of the original amount, it is
+	// converted into the currency of the contract before the contract is
+	// applied. Empty is the currency of the contract.
+	SourceCurrency string `json:"sourceCurrency,omitempty"`
+
 	// Spend defers the update of the balance of the To wallet in order to
 	// unblock chain operations.
 	Spend bool `json:"spend"`
@@ -66,12 +75,84 @@ type Transaction struct {
 	// Error is the recorded chaincode error result if any.
 	Error string `json:"errmsg"`
 
+	// Status is where the transaction is in its lifecycle
+	// [accepted, published, committed, rejected, failed]
+	Status        string                    `json:"status"`
+	StatusHistory []TransactionStatusChange `json:"statusHistory,omitempty"`
+
+	// Source and SourceReference record where deposited points come from,
+	// for example an external program or a cash top-up.
+	Source          string `json:"source,omitempty"`
+	SourceReference string `json:"sourceReference,omitempty"`
+
+	// Destination and DestinationReference record where withdrawn points go to.
+	Destination          string `json:"destination,omitempty"`
+	DestinationReference string `json:"destinationReference,omitempty"`
+
+	// SettlementStatus tracks a withdrawal until the external settlement is
+	// confirmed [pending, completed, failed]
+	SettlementStatus    string    `json:"settlementStatus,omitempty"`
+	SettlementReference string    `json:"settlementReference,omitempty"`
+	SettledAt           time.Time `json:"settledAt"`
+
+	// ReversalOf links a compensating transaction to the transaction it reverses.
+	ReversalOf string `json:"reversalOf,omitempty"`
+
+	// ReversedAmount (in original amount) and ReversedPoints (in points) sum up
+	// all reversals made against this transaction so far.
+	ReversedAmount int64    `json:"reversedAmount"`
+	ReversedPoints int64    `json:"reversedPoints"`
+	Reversals      []string `json:"reversals,omitempty"`
+	// [partially_reversed, reversed]
+	ReversalStatus string `json:"reversalStatus,omitempty"`
+
 	TransactionType string `json:"transactionType"`
 	AppliedContract string `json:"appliedContract"`
+	// AppliedContractVersion is the version of the contract the transaction was
+	// priced with
+	AppliedContractVersion int64 `json:"appliedContractVersion,omitempty"`
+	// AppliedRatio and AppliedRounding are how the first contract line computed
+	// its points from OriginalAmount
+	AppliedRatio    Ratio  `json:"appliedRatio,omitempty"`
+	AppliedRounding string `json:"appliedRounding,omitempty"`
+	// AppliedFxRate converted the original amount into the ContractCurrency
+	// of the applied contract, at the rate effective when it was created
+	AppliedFxRate    Ratio  `json:"appliedFxRate,omitempty"`
+	AppliedFxRateId  string `json:"appliedFxRateId,omitempty"`
+	ContractCurrency string `json:"contractCurrency,omitempty"`
+	// ContractLines are the points contributed by each contract, the regular
+	// contract and the promotions stacked on it
+	ContractLines []ContractLine `json:"contractLines,omitempty"`
+	// AllowanceIdentity is the member of a shared wallet whose spend allowance
+	// was charged AllowanceAmount for the transaction, it is given back when
+	// the transaction is rejected or reversed
+	AllowanceIdentity string `json:"allowanceIdentity,omitempty"`
+	AllowanceAmount   int64  `json:"allowanceAmount,omitempty"`
+	// LimitCounters are the velocity limit counters the points of the
+	// transaction were counted against, with the amount counted on each
+	LimitCounters map[string]int64 `json:"limitCounters,omitempty"`
+	// BudgetPoints are the points taken out of the budget of each contract, by
+	// contract id, they are given back when the transaction is rejected or reversed
+	BudgetPoints map[string]int64 `json:"budgetPoints,omitempty"`
+	// ConsumedLots are the points lots the transaction took its points from, a
+	// refund of the transaction puts the points back with the same expiry
+	ConsumedLots []LotConsumption `json:"consumedLots,omitempty"`
+	// QuoteId is the quote the transaction was priced with, if any
+	QuoteId string `json:"quoteId,omitempty"`
 	// capture the details of the actual user who initiates the transaction. F
 	// for example, partner name in case of redeemption where partner initiates the transaction on behalf of the customer
 	TransactionInitiatedBy string    `json:"transactionInitiatedBy"`
 	CreatedOn              time.Time `json:"createdOn"`
+	// CommittedOn is when the chain committed the transaction, balances and
+	// statements count it from then on
+	CommittedOn *time.Time `json:"committedOn,omitempty"`
+}
+
+// TransactionStatusChange records when the transaction reached a status
+type TransactionStatusChange struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"errmsg,omitempty"`
+	ChangedAt time.Time `json:"changedAt"`
 }
 
 // type TransactionReadOnlys struct {
@@ -10,6 +10,47 @@ type Asset struct {
 	Currency string  `json:"currency"`
 }
 
+// WalletMember is an identity sharing the wallet, for example a household or a
+// corporate pool
+type WalletMember struct {
+	IdentityId string `json:"identityId"`
+	// [owner, spender, viewer]
+	Role string `json:"role"`
+	// SpendLimit is the allowance of a spender, Spent what it has used of it so far
+	SpendLimit int64 `json:"spendLimit,omitempty"`
+	Spent      int64 `json:"spent"`
+	// [invited, active]
+	Status        string    `json:"status"`
+	InvitedBy     string    `json:"invitedBy"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// WalletMembershipAudit records a change of the members of a wallet
+type WalletMembershipAudit struct {
+	DocType    string `json:"type"`
+	Identifier string `json:"identifier"`
+	WalletId   string `json:"walletId"`
+	IdentityId string `json:"identityId"`
+	// [invited, accepted, updated, removed]
+	Action       string    `json:"action"`
+	Role         string    `json:"role"`
+	PreviousRole string    `json:"previousRole,omitempty"`
+	SpendLimit   int64     `json:"spendLimit,omitempty"`
+	Actor        string    `json:"actor"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// WalletStatusChange records a transition of the wallet status
+type WalletStatusChange struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	Note      string    `json:"note,omitempty"`
+	Actor     string    `json:"actor"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
 type Wallet struct {
 	DocType    string `json:"type"`
 	Identifier string `json:"identifier"`
@@ -18,10 +59,16 @@ type Wallet struct {
 	Metadata json.RawMessage `json:"metadata,omitempty"`
 	// TODO: add the default token udner balance to open end the possiblities
 	// handling multiple wallets
-	Assets     []Asset  `json:"assets,omitempty"`
-	WalletType string   `json:"walletType"`
-	Status     string   `json:"status"`
-	LinkedTo   []string `json:"linkedTo"`
+	Assets     []Asset `json:"assets,omitempty"`
+	WalletType string  `json:"walletType"`
+	Status     string  `json:"status"`
+	// StatusReason is the reason code of the last status change
+	StatusReason  string               `json:"statusReason,omitempty"`
+	StatusHistory []WalletStatusChange `json:"statusHistory,omitempty"`
+	LinkedTo      []string             `json:"linkedTo"`
+	// Members are the identities sharing the wallet with their role, the active
+	// members are kept in LinkedTo as well
+	Members []WalletMember `json:"members,omitempty"`
 
 	// Creator records the user that created the record.
 	Creator string `json:"-"`
@@ -34,6 +81,10 @@ type Wallet struct {
 	// Balance is the hard balance of the wallet as returned by the chain.
 	Balance int64 `json:"balance"`
 
+	// InitialBalance is the balance the wallet was created with, it is empty
+	// for wallets created before it was recorded.
+	InitialBalance *int64 `json:"initialBalance,omitempty"`
+
 	// SoftBalance (computed on the fly) is the hard balance plus any
 	// pending diff.
 	// TODO: omitting for now: calculate it for all wallet responses
@@ -2,6 +2,7 @@ package nats
 
 import (
 	"context"
+	"time"
 
 	nats "github.com/nats-io/nats.go"
 	"go.opencensus.io/trace"
@@ -45,3 +46,35 @@ func (c *Client) Publish(ctx context.Context, msg TopicEncoder) error {
 
 	return c.nats.Publish(msg.TopicName(), b)
 }
+
+// Subscribe calls the handler with the payload of every message of the subject
+func (c *Client) Subscribe(subject string, handler func(ctx context.Context, data []byte)) (*nats.Subscription, error) {
+	return c.nats.Subscribe(subject, func(msg *nats.Msg) {
+		ctx, sp := trace.StartSpan(context.Background(), "golo/nats/Subscribe")
+		defer sp.End()
+
+		sp.AddAttributes(trace.StringAttribute("topic", msg.Subject))
+		handler(ctx, Unwrap(msg.Data))
+	})
+}
+
+// Request publishes the message and waits for the reply of the responder, the
+// reply payload is returned without the span context
+func (c *Client) Request(ctx context.Context, msg TopicEncoder, timeout time.Duration) ([]byte, error) {
+	ctx, sp := trace.StartSpan(ctx, "golo/nats/Request")
+	defer sp.End()
+
+	b, err := msg.Encode()
+	if err != nil {
+		return nil, err
+	}
+	b = Wrap(ctx, b)
+
+	sp.AddAttributes(trace.StringAttribute("topic", msg.TopicName()))
+
+	reply, err := c.nats.Request(msg.TopicName(), b, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return Unwrap(reply.Data), nil
+}
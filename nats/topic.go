@@ -24,3 +24,15 @@ func Wrap(ctx context.Context, b []byte) []byte {
 	return a
 }
 
+
+// Unwrap strips the span context added by Wrap and returns the payload
+func Unwrap(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	size := int(b[0])
+	if len(b) < size+1 {
+		return nil
+	}
+	return b[size+1:]
+}
@@ -0,0 +1,467 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BalanceService works out the balance of a wallet at a point in time from the
+// balance it was created with and its committed transactions
+type BalanceService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	balance_snapshot_prefix = "balance_snapshot"
+
+	// a day is settled, and its balance recorded, once it has been over for this
+	// long. Transactions count on the day they commit, so a day over takes no
+	// more of them and the wait only covers the commits still being written.
+	balance_snapshot_settlement = 24 * time.Hour
+	// settled days looked at by the snapshot job
+	balance_snapshot_catch_up = 7
+	// days of a balance history
+	balance_history_max_days = 366
+)
+
+var (
+	ERR_BALANCE_DAY_NOT_SETTLED        = errors.New("error: the balance of a day is recorded once the day has settled")
+	ERR_INVALID_BALANCE_HISTORY_PERIOD = errors.New("error: balance history period must be from before to and at most 366 days")
+)
+
+// committedCondition selects the committed transactions, transactions stored
+// before the status was recorded are committed once they have a chain uuid
+const committedCondition = " AND (status='committed' OR (IFMISSINGORNULL(status, '')='' AND IFMISSINGORNULL(tx_uuid, '')!='' AND IFMISSINGORNULL(errmsg, '')=''))"
+
+// committedTime is when a committed transaction was committed in millis,
+// transactions committed before it was recorded fall back to their creation
+const committedTime = "STR_TO_MILLIS(IFMISSINGORNULL(committedOn, createdOn))"
+
+// CommittedTime is when the committed transaction was committed
+func CommittedTime(transaction models.Transaction) time.Time {
+	if transaction.CommittedOn != nil {
+		return transaction.CommittedOn.UTC()
+	}
+	return transaction.CreatedOn.UTC()
+}
+
+func NewBalance(cluster *gocb.Cluster, bucket *gocb.Bucket) BalanceService {
+	return BalanceService{cluster: cluster, bucket: bucket}
+}
+
+// Delta is the change of the balance of the wallet by the transaction
+func Delta(transaction models.Transaction, walletId string) int64 {
+	var delta int64
+	if transaction.ToExtID == walletId {
+		delta += transaction.Amount
+	}
+	if transaction.FromExtID == walletId {
+		delta -= transaction.Amount
+	}
+	return delta
+}
+
+// NetChange sums up the transactions of the wallet committed in the
+// period, since inclusive and before exclusive, a zero time leaves that end open
+func (service *BalanceService) NetChange(ctx context.Context, walletId string, since time.Time, before time.Time) (int64, error) {
+	fName := "service/balance/netChange"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select IFMISSINGORNULL(SUM(CASE WHEN to_extid=$wallet THEN amount ELSE 0 END), 0) - IFMISSINGORNULL(SUM(CASE WHEN from_extid=$wallet THEN amount ELSE 0 END), 0) as net from `testbucket`.`_default`.`_default` data where type='tx' AND (from_extid=$wallet OR to_extid=$wallet)"
+	query += committedCondition
+	if !since.IsZero() {
+		query += " AND " + committedTime + " >= STR_TO_MILLIS($since)"
+	}
+	if !before.IsZero() {
+		query += " AND " + committedTime + " < STR_TO_MILLIS($before)"
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"wallet": walletId,
+			"since":  since.UTC().Format(time.RFC3339Nano),
+			"before": before.UTC().Format(time.RFC3339Nano),
+		}})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var result struct {
+		Net int64 `json:"net"`
+	}
+	if err := rows.One(&result); err != nil {
+		return 0, err
+	}
+	return result.Net, nil
+}
+
+// InitialBalance is the balance the wallet was created with, for wallets created
+// before it was recorded it is derived from the current balance
+func (service *BalanceService) InitialBalance(ctx context.Context, wallet models.Wallet) (int64, error) {
+	if wallet.InitialBalance != nil {
+		return *wallet.InitialBalance, nil
+	}
+
+	net, err := service.NetChange(ctx, wallet.Identifier, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	return wallet.Balance - net, nil
+}
+
+// BalanceAt is the balance of the wallet right before the given time, it starts
+// from the latest snapshot before that time so that only the transactions since
+// then are summed up
+func (service *BalanceService) BalanceAt(ctx context.Context, wallet models.Wallet, at time.Time) (int64, error) {
+	fName := "service/balance/balanceAt"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	snapshot, err := service.latestSnapshot(ctx, wallet.Identifier, at)
+	if err != nil {
+		return 0, err
+	}
+
+	var balance int64
+	var since time.Time
+	if snapshot != nil {
+		balance = snapshot.Balance
+		since = snapshot.At
+	} else {
+		balance, err = service.InitialBalance(ctx, wallet)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	net, err := service.NetChange(ctx, wallet.Identifier, since, at)
+	if err != nil {
+		return 0, err
+	}
+	return balance + net, nil
+}
+
+// latestSnapshot is the latest snapshot of the wallet taken at or before the
+// given time, nil when there is none
+func (service *BalanceService) latestSnapshot(ctx context.Context, walletId string, at time.Time) (*models.BalanceSnapshot, error) {
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='balance_snapshot' AND walletId=$wallet AND STR_TO_MILLIS(`at`) <= STR_TO_MILLIS($at) order by STR_TO_MILLIS(`at`) desc limit 1"
+
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{"wallet": walletId, "at": at.UTC().Format(time.RFC3339Nano)}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var snapshot models.BalanceSnapshot
+		if err := rows.Row(&snapshot); err != nil {
+			return nil, err
+		}
+		return &snapshot, nil
+	}
+	return nil, rows.Err()
+}
+
+// Snapshot records the balance of the wallet at the end of the day from the
+// transactions committed until then, a day is only recorded once it has settled
+func (service *BalanceService) Snapshot(ctx context.Context, wallet models.Wallet, day time.Time) (models.BalanceSnapshot, error) {
+	fName := "service/balance/snapshot"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	day = startOfDay(day)
+	snapshot := models.BalanceSnapshot{
+		DocType:  "balance_snapshot",
+		WalletId: wallet.Identifier,
+		Day:      day,
+		At:       day.AddDate(0, 0, 1),
+	}
+	if snapshot.At.After(time.Now().Add(-balance_snapshot_settlement)) {
+		return snapshot, ERR_BALANCE_DAY_NOT_SETTLED
+	}
+
+	balance, err := service.BalanceAt(ctx, wallet, snapshot.At)
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Balance = balance
+	snapshot.CreatedAt = time.Now().UTC()
+
+	col := service.bucket.DefaultCollection()
+	_, err = col.Upsert(balance_snapshot_prefix+"/"+wallet.Identifier+"/"+day.Format("20060102"), snapshot, nil)
+	return snapshot, err
+}
+
+// SnapshotSettledDays records the balances at the end of the recently settled
+// days for the wallets that had transactions on them, days already recorded are
+// skipped so that the job catches up after a pause
+func (service *BalanceService) SnapshotSettledDays(ctx context.Context) (int, error) {
+	fName := "service/balance/snapshotSettledDays"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	lastSettled := startOfDay(time.Now().Add(-balance_snapshot_settlement)).AddDate(0, 0, -1)
+
+	recorded := 0
+	// the oldest day first, each snapshot starts from the one of the day before
+	for offset := balance_snapshot_catch_up - 1; offset >= 0; offset-- {
+		day := lastSettled.AddDate(0, 0, -offset)
+
+		walletIds, err := service.activeWallets(ctx, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return recorded, err
+		}
+
+		for _, walletId := range walletIds {
+			exists, err := col.Exists(balance_snapshot_prefix+"/"+walletId+"/"+day.Format("20060102"), nil)
+			if err == nil && exists.Exists() {
+				continue
+			}
+
+			doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
+			if err != nil {
+				continue
+			}
+			var wallet models.Wallet
+			if err := doc.Content(&wallet); err != nil {
+				return recorded, err
+			}
+
+			if _, err := service.Snapshot(ctx, wallet, day); err != nil {
+				return recorded, err
+			}
+			recorded++
+		}
+	}
+
+	span.SetAttributes(attribute.Int("Snapshots", recorded))
+	return recorded, nil
+}
+
+// activeWallets lists the wallets with transactions committed in the period
+func (service *BalanceService) activeWallets(ctx context.Context, since time.Time, before time.Time) ([]string, error) {
+	query := "select distinct raw wallet from `testbucket`.`_default`.`_default` data unnest [data.from_extid, data.to_extid] wallet where type='tx' AND wallet IS VALUED AND wallet!=''"
+	query += committedCondition
+	query += " AND " + committedTime + " >= STR_TO_MILLIS($since) AND " + committedTime + " < STR_TO_MILLIS($before)"
+
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"since":  since.UTC().Format(time.RFC3339Nano),
+			"before": before.UTC().Format(time.RFC3339Nano),
+		}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	walletIds := []string{}
+	for rows.Next() {
+		var walletId string
+		if err := rows.Row(&walletId); err != nil {
+			return nil, err
+		}
+		walletIds = append(walletIds, walletId)
+	}
+	return walletIds, rows.Err()
+}
+
+// History is the balance of the wallet at the end of each day (UTC) of the
+// period with the points credited and debited on that day, days are given as
+// their start and to is included
+func (service *BalanceService) History(ctx context.Context, wallet models.Wallet, from time.Time, to time.Time) ([]models.BalancePoint, error) {
+	fName := "service/balance/history"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	from = startOfDay(from)
+	to = startOfDay(to)
+	if to.Before(from) || to.Sub(from) > balance_history_max_days*24*time.Hour {
+		return nil, ERR_INVALID_BALANCE_HISTORY_PERIOD
+	}
+
+	balance, err := service.BalanceAt(ctx, wallet, from)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "select MILLIS_TO_UTC(" + committedTime + ", '1111-11-11') as day, IFMISSINGORNULL(SUM(CASE WHEN to_extid=$wallet THEN amount ELSE 0 END), 0) as credits, IFMISSINGORNULL(SUM(CASE WHEN from_extid=$wallet THEN amount ELSE 0 END), 0) as debits from `testbucket`.`_default`.`_default` data where type='tx' AND (from_extid=$wallet OR to_extid=$wallet)"
+	query += committedCondition
+	query += " AND " + committedTime + " >= STR_TO_MILLIS($from) AND " + committedTime + " < STR_TO_MILLIS($to)"
+	query += " group by MILLIS_TO_UTC(" + committedTime + ", '1111-11-11')"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"wallet": wallet.Identifier,
+			"from":   from.Format(time.RFC3339Nano),
+			"to":     to.AddDate(0, 0, 1).Format(time.RFC3339Nano),
+		}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := map[string]models.BalancePoint{}
+	for rows.Next() {
+		var point models.BalancePoint
+		if err := rows.Row(&point); err != nil {
+			return nil, err
+		}
+		days[point.Day] = point
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// every day of the period is listed, also the ones without transactions
+	series := []models.BalancePoint{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		point := days[key]
+		point.Day = key
+		balance += point.Credits - point.Debits
+		point.Balance = balance
+		series = append(series, point)
+	}
+	return series, nil
+}
+
+func startOfDay(at time.Time) time.Time {
+	at = at.UTC()
+	return time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Movements lists the transactions of the wallet committed in the period, from
+// inclusive and to exclusive, in a stable order
+func (service *BalanceService) Movements(ctx context.Context, walletId string, from time.Time, to time.Time) ([]*models.Transaction, error) {
+	fName := "service/balance/movements"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='tx' AND (from_extid=$wallet OR to_extid=$wallet)"
+	query += committedCondition
+	query += " AND " + committedTime + " >= STR_TO_MILLIS($from) AND " + committedTime + " < STR_TO_MILLIS($to)"
+	query += " order by " + committedTime + ", ext"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"wallet": walletId,
+			"from":   from.UTC().Format(time.RFC3339Nano),
+			"to":     to.UTC().Format(time.RFC3339Nano),
+		}})
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := []*models.Transaction{}
+	for rows.Next() {
+		var obj models.Transaction
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, &obj)
+	}
+	defer rows.Close()
+	return transactions, rows.Err()
+}
+
+// Statement lists the committed transactions of the wallet in the period with a
+// running balance. Only committed transactions count and nothing depends on the
+// time it is generated, so the statement of a closed period does not change.
+func (service *BalanceService) Statement(ctx context.Context, wallet models.Wallet, from time.Time, to time.Time) (models.Statement, error) {
+	fName := "service/balance/statement"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	statement := models.Statement{
+		WalletId:   wallet.Identifier,
+		WalletName: wallet.Name,
+		From:       from.UTC(),
+		To:         to.UTC(),
+		Lines:      []models.StatementLine{},
+		Totals:     []models.StatementTotal{},
+		Closed:     !to.After(time.Now()),
+	}
+
+	opening, err := service.BalanceAt(ctx, wallet, from)
+	if err != nil {
+		return statement, err
+	}
+	statement.OpeningBalance = opening
+
+	transactions, err := service.Movements(ctx, wallet.Identifier, from, to)
+	if err != nil {
+		return statement, err
+	}
+
+	balance := opening
+	totals := map[string]*models.StatementTotal{}
+	for _, transaction := range transactions {
+		delta := Delta(*transaction, wallet.Identifier)
+		balance += delta
+
+		line := models.StatementLine{
+			TransactionId:   transaction.ExtID,
+			TransactionType: transaction.TransactionType,
+			CreatedOn:       transaction.CreatedOn.UTC(),
+			CommittedOn:     CommittedTime(*transaction),
+			Balance:         balance,
+			Remarks:         transaction.Remarks,
+		}
+		if transaction.FromExtID == wallet.Identifier {
+			line.Counterparty = transaction.ToExtID
+		} else {
+			line.Counterparty = transaction.FromExtID
+		}
+		if delta >= 0 {
+			line.Credit = delta
+		} else {
+			line.Debit = -delta
+		}
+		statement.Lines = append(statement.Lines, line)
+
+		total, ok := totals[transaction.TransactionType]
+		if !ok {
+			total = &models.StatementTotal{TransactionType: transaction.TransactionType}
+			totals[transaction.TransactionType] = total
+		}
+		total.Count++
+		total.Credits += line.Credit
+		total.Debits += line.Debit
+	}
+	statement.ClosingBalance = balance
+
+	for _, total := range totals {
+		statement.Totals = append(statement.Totals, *total)
+	}
+	sort.Slice(statement.Totals, func(i, j int) bool {
+		return statement.Totals[i].TransactionType < statement.Totals[j].TransactionType
+	})
+	return statement, nil
+}
@@ -0,0 +1,447 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type BulkService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	bulk_job_prefix   = "bulk_job"
+	bulk_row_prefix   = "bulk_row"
+	bulk_input_prefix = "bulk_input"
+)
+
+const (
+	BULK_FORMAT_CSV   = "csv"
+	BULK_FORMAT_JSONL = "jsonl"
+
+	BULK_ROW_EARN     = "earn"
+	BULK_ROW_REDEEM   = "redeem"
+	BULK_ROW_TRANSFER = "transfer"
+
+	BULK_JOB_QUEUED                = "queued"
+	BULK_JOB_PROCESSING            = "processing"
+	BULK_JOB_COMPLETED             = "completed"
+	BULK_JOB_COMPLETED_WITH_ERRORS = "completed_with_errors"
+
+	BULK_ROW_SUCCEEDED = "succeeded"
+	BULK_ROW_FAILED    = "failed"
+	BULK_ROW_DUPLICATE = "duplicate"
+
+	// rows accepted in one file
+	BULK_MAX_ROWS = 10000
+)
+
+// columns of a csv bulk file, initiatedBy and metadata are optional
+var bulkColumns = []string{"reference", "type", "from", "to", "amount", "initiatedBy", "metadata"}
+
+var (
+	ERR_INVALID_BULK_FORMAT  = errors.New("error: bulk file format must be csv or jsonl")
+	ERR_BULK_FILE_EMPTY      = errors.New("error: bulk file has no rows")
+	ERR_BULK_FILE_TOO_LARGE  = fmt.Errorf("error: bulk file can not have more than %d rows", BULK_MAX_ROWS)
+	ERR_BULK_MISSING_COLUMNS = errors.New("error: bulk csv header must have the reference, type, from, to and amount columns")
+	ERR_BULK_JOB_NOT_STALE   = errors.New("error: bulk job is finished or still being processed")
+)
+
+func NewBulk(cluster *gocb.Cluster, bucket *gocb.Bucket) BulkService {
+	return BulkService{cluster: cluster, bucket: bucket}
+}
+
+// CreateJob stores the job along with its rows, the rows are kept until the job
+// is completed so that another process can resume it
+func (service *BulkService) CreateJob(ctx context.Context, job *models.BulkJob, rows []models.BulkRow, sessionedUser string) (string, error) {
+	fName := "service/bulk/createJob"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	now := time.Now().UTC()
+	job.DocType = "bulk_job"
+	job.Identifier = common.GenerateIdentifier(30)
+	job.Status = BULK_JOB_QUEUED
+	job.Creator = sessionedUser
+	job.CreatedAt = now
+	job.LastUpdatedAt = now
+
+	col := service.bucket.DefaultCollection()
+	input := models.BulkInput{DocType: "bulk_input", JobId: job.Identifier, Rows: rows}
+	if _, err := col.Insert(bulk_input_prefix+"/"+job.Identifier, input, nil); err != nil {
+		return "", err
+	}
+	_, err := col.Insert(bulk_job_prefix+"/"+job.Identifier, job, nil)
+	span.AddEvent("bulk job created")
+	return job.Identifier, err
+}
+
+// Input loads the rows stored with a job that is not completed yet
+func (service *BulkService) Input(ctx context.Context, jobId string) ([]models.BulkRow, error) {
+	fName := "service/bulk/input"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(bulk_input_prefix+"/"+jobId, nil)
+	if err != nil {
+		return nil, errors.New("error: no rows found for the bulk job")
+	}
+
+	var input models.BulkInput
+	err = doc.Content(&input)
+	return input.Rows, err
+}
+
+// DeleteInput removes the rows of a completed job
+func (service *BulkService) DeleteInput(ctx context.Context, jobId string) error {
+	fName := "service/bulk/deleteInput"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Remove(bulk_input_prefix+"/"+jobId, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// ClaimJob takes over a job that is not completed and whose progress was not
+// stored since staleBefore, its process is assumed to have stopped. The claim
+// is a compare and swap so that only one process resumes the job.
+func (service *BulkService) ClaimJob(ctx context.Context, jobId string, staleBefore time.Time) (models.BulkJob, error) {
+	fName := "service/bulk/claimJob"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("Job", jobId))
+
+	col := service.bucket.DefaultCollection()
+	key := bulk_job_prefix + "/" + jobId
+	doc, err := col.Get(key, nil)
+	if err != nil {
+		return models.BulkJob{}, errors.New("error: no bulk job found")
+	}
+
+	var job models.BulkJob
+	if err := doc.Content(&job); err != nil {
+		return job, err
+	}
+	if (job.Status != BULK_JOB_QUEUED && job.Status != BULK_JOB_PROCESSING) || !job.LastUpdatedAt.Before(staleBefore) {
+		return job, ERR_BULK_JOB_NOT_STALE
+	}
+
+	job.Status = BULK_JOB_PROCESSING
+	job.LastUpdatedAt = time.Now().UTC()
+	_, err = col.Replace(key, job, &gocb.ReplaceOptions{Cas: doc.Cas()})
+	if errors.Is(err, gocb.ErrCasMismatch) {
+		// another process claimed the job or stored its progress
+		return job, ERR_BULK_JOB_NOT_STALE
+	}
+	span.AddEvent("bulk job claimed")
+	return job, err
+}
+
+func (service *BulkService) GetJob(ctx context.Context, jobId string) (models.BulkJob, error) {
+	fName := "service/bulk/getJob"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(bulk_job_prefix+"/"+jobId, nil)
+	if err != nil {
+		return models.BulkJob{}, errors.New("error: no bulk job found")
+	}
+
+	var job models.BulkJob
+	err = doc.Content(&job)
+	return job, err
+}
+
+// SaveProgress stores the counters and the status of the job, a job is only
+// written by the process running it
+func (service *BulkService) SaveProgress(ctx context.Context, job *models.BulkJob) error {
+	fName := "service/bulk/saveProgress"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	job.LastUpdatedAt = time.Now().UTC()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Replace(bulk_job_prefix+"/"+job.Identifier, job, nil)
+	return err
+}
+
+// SaveRowResult stores the outcome of a row, processing a row again overwrites it
+func (service *BulkService) SaveRowResult(ctx context.Context, result *models.BulkRowResult) error {
+	fName := "service/bulk/saveRowResult"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	result.DocType = "bulk_row"
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Upsert(fmt.Sprintf("%s/%s/%d", bulk_row_prefix, result.JobId, result.Line), result, nil)
+	return err
+}
+
+// Rows lists the row results of a job in the order of the file, optionally
+// only the ones with the given status
+func (service *BulkService) Rows(ctx context.Context, jobId string, status string) ([]*models.BulkRowResult, error) {
+	fName := "service/bulk/rows"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='bulk_row' AND jobId=$jobId"
+	if status != "" {
+		query += " AND status=$status"
+	}
+	query += " order by line"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{"jobId": jobId, "status": status}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*models.BulkRowResult{}
+	for rows.Next() {
+		var obj models.BulkRowResult
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		results = append(results, &obj)
+	}
+	defer rows.Close()
+	return results, rows.Err()
+}
+
+func (service *BulkService) FilterJobs(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.BulkJob, error) {
+	fName := "service/bulk/filterJobs"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='bulk_job' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*models.BulkJob{}
+	for rows.Next() {
+		var obj models.BulkJob
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &obj)
+	}
+	defer rows.Close()
+	return jobs, rows.Err()
+}
+
+// ParseBulkFile reads the rows of a csv or jsonl bulk file and checks each of
+// them on its own, the rows with errors are left out of the returned rows. An
+// error is returned when the file as a whole can not be read.
+func ParseBulkFile(reader io.Reader, format string) ([]models.BulkRow, []models.BulkRowError, error) {
+	var rows []models.BulkRow
+	var rowErrors []models.BulkRowError
+	var err error
+
+	switch format {
+	case BULK_FORMAT_CSV:
+		rows, rowErrors, err = parseBulkCSV(reader)
+	case BULK_FORMAT_JSONL:
+		rows, rowErrors, err = parseBulkJSONL(reader)
+	default:
+		return nil, nil, ERR_INVALID_BULK_FORMAT
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows)+len(rowErrors) == 0 {
+		return nil, nil, ERR_BULK_FILE_EMPTY
+	}
+
+	// references are unique within the file
+	valid := []models.BulkRow{}
+	seen := map[string]int64{}
+	for _, row := range rows {
+		if line, ok := seen[row.Reference]; ok {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: row.Line, Reference: row.Reference, Error: fmt.Sprintf("error: reference is already used on line %d", line)})
+			continue
+		}
+		seen[row.Reference] = row.Line
+		valid = append(valid, row)
+	}
+	return valid, rowErrors, nil
+}
+
+func parseBulkCSV(reader io.Reader) ([]models.BulkRow, []models.BulkRowError, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, ERR_BULK_FILE_EMPTY
+		}
+		return nil, nil, err
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		for _, column := range bulkColumns {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index[column] = i
+			}
+		}
+	}
+	for _, column := range bulkColumns[:5] {
+		if _, ok := index[column]; !ok {
+			return nil, nil, ERR_BULK_MISSING_COLUMNS
+		}
+	}
+
+	value := func(record []string, column string) string {
+		i, ok := index[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rows := []models.BulkRow{}
+	rowErrors := []models.BulkRowError{}
+	for line := int64(2); ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if len(rows)+len(rowErrors) >= BULK_MAX_ROWS {
+			return nil, nil, ERR_BULK_FILE_TOO_LARGE
+		}
+		if err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: line, Error: "error: " + err.Error()})
+			continue
+		}
+
+		row := models.BulkRow{
+			Line:                   line,
+			Reference:              value(record, "reference"),
+			TransactionType:        strings.ToLower(value(record, "type")),
+			From:                   value(record, "from"),
+			To:                     value(record, "to"),
+			TransactionInitiatedBy: value(record, "initiatedBy"),
+		}
+		if metadata := value(record, "metadata"); metadata != "" {
+			if !json.Valid([]byte(metadata)) {
+				rowErrors = append(rowErrors, models.BulkRowError{Line: line, Reference: row.Reference, Error: "error: metadata must be json"})
+				continue
+			}
+			row.Metadata = json.RawMessage(metadata)
+		}
+		amount, err := strconv.ParseInt(value(record, "amount"), 10, 64)
+		if err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: line, Reference: row.Reference, Error: "error: amount must be a whole number"})
+			continue
+		}
+		row.Amount = amount
+
+		if err := validateBulkRow(row); err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: line, Reference: row.Reference, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+func parseBulkJSONL(reader io.Reader) ([]models.BulkRow, []models.BulkRowError, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	rows := []models.BulkRow{}
+	rowErrors := []models.BulkRowError{}
+	for line := int64(1); scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if len(rows)+len(rowErrors) >= BULK_MAX_ROWS {
+			return nil, nil, ERR_BULK_FILE_TOO_LARGE
+		}
+
+		var row models.BulkRow
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: line, Error: "error: invalid json row"})
+			continue
+		}
+		row.Line = line
+		row.TransactionType = strings.ToLower(row.TransactionType)
+
+		if err := validateBulkRow(row); err != nil {
+			rowErrors = append(rowErrors, models.BulkRowError{Line: line, Reference: row.Reference, Error: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, scanner.Err()
+}
+
+func validateBulkRow(row models.BulkRow) error {
+	if row.Reference == "" {
+		return errors.New("error: reference is required")
+	}
+	if row.TransactionType != BULK_ROW_EARN && row.TransactionType != BULK_ROW_REDEEM && row.TransactionType != BULK_ROW_TRANSFER {
+		return errors.New("error: type must be earn, redeem or transfer")
+	}
+	if row.From == "" || row.To == "" {
+		return errors.New("error: from and to are required")
+	}
+	if row.From == row.To {
+		return errors.New("error: from and to can not be same address")
+	}
+	if row.Amount <= 0 {
+		return errors.New("error: amount can not be empty or zero")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseBulkFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		file   string
+		// lines of the valid rows and of the rows with errors
+		rows   []int64
+		errors []int64
+		err    error
+	}{
+		{
+			name:   "csv",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to,amount\nr1,earn,a,b,10\nr2,REDEEM,b,c,5\n",
+			rows:   []int64{2, 3},
+		},
+		{
+			name:   "csv columns in any order and case",
+			format: BULK_FORMAT_CSV,
+			file:   "Amount,To,From,Type,Reference,initiatedBy\n10,b,a,transfer,r1,partner\n",
+			rows:   []int64{2},
+		},
+		{
+			name:   "csv row errors",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to,amount,metadata\nr1,earn,a,b,ten,\n,earn,a,b,10,\nr3,gift,a,b,10,\nr4,earn,a,a,10,\nr5,earn,a,b,0,\nr6,earn,a,b,10,{bad}\nr7,earn,a,b,10,\"{\"\"k\"\":1}\"\n",
+			rows:   []int64{8},
+			errors: []int64{2, 3, 4, 5, 6, 7},
+		},
+		{
+			name:   "csv duplicate reference",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to,amount\nr1,earn,a,b,10\nr1,earn,a,c,10\n",
+			rows:   []int64{2},
+			errors: []int64{3},
+		},
+		{
+			name:   "csv missing column",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to\nr1,earn,a,b\n",
+			err:    ERR_BULK_MISSING_COLUMNS,
+		},
+		{
+			name:   "csv without rows",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to,amount\n",
+			err:    ERR_BULK_FILE_EMPTY,
+		},
+		{
+			name:   "empty csv",
+			format: BULK_FORMAT_CSV,
+			file:   "",
+			err:    ERR_BULK_FILE_EMPTY,
+		},
+		{
+			name:   "jsonl",
+			format: BULK_FORMAT_JSONL,
+			file:   "{\"reference\":\"r1\",\"type\":\"earn\",\"from\":\"a\",\"to\":\"b\",\"amount\":10}\n\n{\"reference\":\"r2\",\"type\":\"Transfer\",\"from\":\"b\",\"to\":\"c\",\"amount\":5,\"metadata\":{\"k\":1}}\n",
+			rows:   []int64{1, 3},
+		},
+		{
+			name:   "jsonl row errors",
+			format: BULK_FORMAT_JSONL,
+			file:   "{not json}\n{\"reference\":\"r2\",\"type\":\"earn\",\"from\":\"a\",\"to\":\"b\",\"amount\":-1}\n{\"reference\":\"r3\",\"type\":\"earn\",\"from\":\"a\",\"to\":\"b\",\"amount\":1}\n{\"reference\":\"r3\",\"type\":\"earn\",\"from\":\"a\",\"to\":\"b\",\"amount\":1}\n",
+			rows:   []int64{3},
+			errors: []int64{1, 2, 4},
+		},
+		{
+			name:   "empty jsonl",
+			format: BULK_FORMAT_JSONL,
+			file:   "\n\n",
+			err:    ERR_BULK_FILE_EMPTY,
+		},
+		{
+			name:   "csv too large",
+			format: BULK_FORMAT_CSV,
+			file:   "reference,type,from,to,amount\n" + strings.Repeat("r,earn,a,b,1\n", BULK_MAX_ROWS+1),
+			err:    ERR_BULK_FILE_TOO_LARGE,
+		},
+		{
+			name:   "unknown format",
+			format: "xlsx",
+			file:   "reference,type,from,to,amount\nr1,earn,a,b,10\n",
+			err:    ERR_INVALID_BULK_FORMAT,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, rowErrors, err := ParseBulkFile(strings.NewReader(test.file), test.format)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			lines := []int64{}
+			for _, row := range rows {
+				lines = append(lines, row.Line)
+				if row.TransactionType != strings.ToLower(row.TransactionType) {
+					t.Errorf("line %d: got type %s, want it in lower case", row.Line, row.TransactionType)
+				}
+			}
+			errorLines := []int64{}
+			for _, rowError := range rowErrors {
+				errorLines = append(errorLines, rowError.Line)
+			}
+			if !sameLines(lines, test.rows) {
+				t.Errorf("got rows on lines %v, want %v", lines, test.rows)
+			}
+			if !sameLines(errorLines, test.errors) {
+				t.Errorf("got errors on lines %v, want %v", errorLines, test.errors)
+			}
+		})
+	}
+}
+
+func sameLines(got []int64, want []int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := map[int64]bool{}
+	for _, line := range got {
+		seen[line] = true
+	}
+	for _, line := range want {
+		if !seen[line] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,14 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/couchbase/gocb/v2"
@@ -19,15 +25,87 @@ type ContractService struct {
 }
 
 const (
-	contract_prefix = "contract"
+	contract_prefix         = "contract"
+	contract_version_prefix = "contract_version"
+	contract_budget_prefix  = "contract_budget"
+)
+
+// thresholds in percent of the budget notified when a contract has none
+var default_budget_thresholds = []int64{80, 100}
+
+const (
+	// a draft waits for the approval of its parties, an approved contract is
+	// pending until it is valid and then active
+	CONTRACT_STATUS_DRAFT    = "draft"
+	CONTRACT_STATUS_REJECTED = "rejected"
+	CONTRACT_STATUS_ACTIVE   = "active"
+	CONTRACT_STATUS_PENDING  = "pending"
+	CONTRACT_STATUS_EXPIRED  = "expired"
+)
+
+const (
+	CONTRACT_PARTY_OPERATOR = "operator"
+	CONTRACT_PARTY_PARTNER  = "partner"
+
+	CONTRACT_DECISION_APPROVED = "approved"
+	CONTRACT_DECISION_REJECTED = "rejected"
+)
+
+const (
+	CONTRACT_TYPE_REGULAR     = "Regular"
+	CONTRACT_TYPE_PROMOTIONAL = "Promotional"
+)
+
+const (
+	BONUS_TYPE_RATIO      = "ratio"
+	BONUS_TYPE_MULTIPLIER = "multiplier"
+	BONUS_TYPE_FIXED      = "fixed"
+
+	CONTRACT_LINE_BASE  = "base"
+	CONTRACT_LINE_BONUS = "bonus"
 )
 
 const (
-	CONTRACT_STATUS_ACTIVE  = "active"
-	CONTRACT_STATUS_PENDING = "pending"
-	CONTRACT_STATUS_EXPIRED = "expired"
+	BAND_BASIS_AMOUNT = "amount"
+	BAND_BASIS_TIER   = "tier"
+	BAND_BASIS_SPEND  = "spend"
+
+	BAND_PERIOD_MONTH    = "month"
+	BAND_PERIOD_YEAR     = "year"
+	BAND_PERIOD_CONTRACT = "contract"
 )
 
+const (
+	ROUNDING_FLOOR     = "floor"
+	ROUNDING_CEIL      = "ceil"
+	ROUNDING_HALF_EVEN = "half_even"
+)
+
+var (
+	ERR_CONTRACT_NOT_FOUND = errors.New("error: no contract found")
+	ERR_CONTRACT_UNCHANGED = errors.New("error: the update does not change the contract")
+	ERR_CONTRACT_NOT_DRAFT = errors.New("error: only a draft contract or a proposed change can be approved or rejected")
+	ERR_CONTRACT_DECISION  = errors.New("error: decision must be approved or rejected")
+	ERR_CONTRACT_PARTY     = errors.New("error: only the operator or the partner of the contract can decide on it")
+	ERR_CONTRACT_TYPE      = errors.New("error: contract type must be Regular or Promotional")
+	ERR_ROUNDING_MODE      = errors.New("error: rounding mode must be floor, ceil or half_even")
+	ERR_POINTS_BOUNDS      = errors.New("error: minimum points must be positive and not above the maximum points")
+	ERR_POINTS_OVERFLOW    = errors.New("error: converted points are out of range")
+	ERR_BONUS_TYPE         = errors.New("error: bonus type must be ratio, multiplier or fixed")
+	ERR_BUDGET_SETTINGS    = errors.New("error: budget and member cap can not be negative and budget thresholds must be between 1 and 100")
+	ERR_BONUS_SETTINGS     = errors.New("error: a multiplier must be at least 1, fixed bonus points must be positive and the bonus cap can not be negative")
+	ERR_BAND_BASIS         = errors.New("error: bands must be chosen by amount, tier or spend, and spend in a month, year or contract period")
+	ERR_AMOUNT_BANDS       = errors.New("error: bands must start at 0 and follow each other without gap or overlap, only the last band has no upper bound")
+	ERR_TIER_BANDS         = errors.New("error: tier bands must each have another tier and one band must have no tier for the other members")
+	ERR_NO_BAND            = errors.New("error: no band of the contract applies to the transaction")
+)
+
+// fields maintained by the service, they are not part of the changes of a version
+var contract_bookkeeping_fields = map[string]bool{"version": true, "lastUpdatedAt": true, "lastUpdatedBy": true}
+
+// fields recording the decisions of the parties on the terms of a contract
+var contract_decision_fields = map[string]bool{"status": true, "operatorApproval": true, "partnerApproval": true, "decisions": true, "isDeleted": true, "proposal": true}
+
 func NewContract(cluster *gocb.Cluster, bucket *gocb.Bucket) ContractService {
 	return ContractService{cluster: cluster, bucket: bucket}
 }
@@ -47,18 +125,35 @@ func (service *ContractService) CreateContract(ctx context.Context, contract *mo
 
 	contract.Creator = creator
 	contract.Channel = channel
-	contract.Status = "active"
+	contract.Status = CONTRACT_STATUS_DRAFT
+	contract.OperatorApproval = ""
+	contract.PartnerApproval = ""
+	contract.Decisions = []models.ContractDecision{}
 	contract.CreatedAt = now
 	contract.LastUpdatedAt = now
 	contract.LastUpdatedBy = contract.Creator
+	contract.Version = 1
 	_, err := col.Insert(contract_prefix+"/"+contract.Identifier, contract, nil)
+	if err != nil {
+		return contract.Identifier, err
+	}
+
+	_, err = col.Insert(contractVersionKey(contract.Identifier, contract.Version), models.ContractVersion{
+		DocType:    "contract_version",
+		ContractId: contract.Identifier,
+		Version:    contract.Version,
+		Contract:   *contract,
+		Changes:    []models.ContractChange{},
+		Editor:     creator,
+		EditedAt:   now,
+	}, nil)
 
 	span.AddEvent("contract created")
 	return contract.Identifier, err
 
 }
 
-func (service *ContractService) GetContract(ctx context.Context, contractId string) (any, error) {
+func (service *ContractService) GetContract(ctx context.Context, contractId string) (models.Contract, error) {
 	fName := "service/contract/get"
 	tracer := otel.Tracer("api")
 	_, span := tracer.Start(ctx, fName)
@@ -68,10 +163,16 @@ func (service *ContractService) GetContract(ctx context.Context, contractId stri
 	doc, err := col.Get(contract_prefix+"/"+contractId, nil)
 	if doc == nil {
 		if err != nil {
-			return "", errors.New("error: no contract found")
+			return models.Contract{}, ERR_CONTRACT_NOT_FOUND
 		}
 	}
-	return doc, err
+
+	var contract models.Contract
+	err = doc.Content(&contract)
+	if err != nil {
+		return models.Contract{}, err
+	}
+	return contract, err
 
 }
 
@@ -81,64 +182,1165 @@ func (service *ContractService) DeleteContract(ctx context.Context, contractId s
 	_, span := tracer.Start(ctx, fName)
 	defer span.End()
 
-	col := service.bucket.DefaultCollection()
-	doc, err := col.Get(contract_prefix+"/"+contractId, nil)
-	if doc == nil {
+	_, err := service.revise(ctx, contractId, sessionedUser, func(contract *models.Contract) error {
+		contract.IsDeleted = true
+		return nil
+	})
+	if errors.Is(err, ERR_CONTRACT_UNCHANGED) {
+		return nil
+	}
+	return err
+
+}
+
+// UpdateContract applies the change to the contract as a new version, the
+// versions before stay as they were so that transactions priced with them can
+// still be explained. New terms were not approved by the parties: a contract
+// not approved yet goes back to draft and is approved again, while an approved
+// contract keeps pricing with its terms and the change is staged as its
+// proposal until both parties approve it.
+func (service *ContractService) UpdateContract(ctx context.Context, contractId string, sessionedUser string, change func(*models.Contract) error) (models.Contract, error) {
+	fName := "service/contract/update"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	contract, err := service.revise(ctx, contractId, sessionedUser, func(contract *models.Contract) error {
+		if contract.IsDeleted {
+			return ERR_CONTRACT_NOT_FOUND
+		}
+		approved := contract.Status == CONTRACT_STATUS_ACTIVE || contract.Status == CONTRACT_STATUS_PENDING
+
+		// a proposal already staged is changed further
+		terms := *contract
+		if approved && contract.Proposal != nil {
+			terms = *contract.Proposal
+		}
+		edited, err := copyContract(terms)
 		if err != nil {
-			return errors.New("error: no contract found")
+			return err
+		}
+		if err := change(&edited); err != nil {
+			return err
 		}
+		// the status, the decisions and deletion are not changed through an update
+		edited.Status = terms.Status
+		edited.OperatorApproval, edited.PartnerApproval, edited.Decisions = terms.OperatorApproval, terms.PartnerApproval, terms.Decisions
+		edited.IsDeleted = false
+		edited.Proposal = nil
+
+		changed, err := termsChanged(terms, edited)
+		if err != nil || !changed {
+			return err
+		}
+		edited.Status = CONTRACT_STATUS_DRAFT
+		edited.OperatorApproval = ""
+		edited.PartnerApproval = ""
+		if !approved {
+			*contract = edited
+			return nil
+		}
+
+		// a proposal brought back to the approved terms is withdrawn
+		live := *contract
+		live.Proposal = nil
+		if changed, err := termsChanged(live, edited); err != nil || !changed {
+			contract.Proposal = nil
+			return err
+		}
+		edited.Decisions = nil
+		contract.Proposal = &edited
+		return nil
+	})
+	if err != nil {
+		return contract, err
+	}
+
+	span.AddEvent("contract updated to version " + strconv.FormatInt(contract.Version, 10))
+	return contract, nil
+}
+
+// Decide records the approval or the rejection of a draft contract, or of the
+// proposal of an approved one, by one of its parties. A rejection rejects the
+// draft or drops the proposal, the approved terms staying in force. The
+// approval of the operator and of the partner approves the draft, it is pending
+// until it is valid and then active, or replaces the terms of the contract
+// with its proposal. A contract naming no partner prices the transactions of
+// every partner of the operator and no single partner can approve it, it is
+// approved by the operator alone.
+func (service *ContractService) Decide(ctx context.Context, contractId string, decision models.ContractDecision) (models.Contract, error) {
+	fName := "service/contract/decide"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if decision.Decision != CONTRACT_DECISION_APPROVED && decision.Decision != CONTRACT_DECISION_REJECTED {
+		return models.Contract{}, ERR_CONTRACT_DECISION
 	}
 
-	var wallet models.Contract
-	err = doc.Content(&wallet)
+	contract, err := service.revise(ctx, contractId, decision.DecidedBy, func(contract *models.Contract) error {
+		if contract.IsDeleted {
+			return ERR_CONTRACT_NOT_FOUND
+		}
+		terms := contract
+		if contract.Proposal != nil {
+			terms = contract.Proposal
+		}
+		if terms.Status != CONTRACT_STATUS_DRAFT {
+			return ERR_CONTRACT_NOT_DRAFT
+		}
+
+		switch {
+		case decision.Party == CONTRACT_PARTY_OPERATOR && decision.IdentityId == string(terms.OperatorId):
+			terms.OperatorApproval = decision.Decision
+		case decision.Party == CONTRACT_PARTY_PARTNER && terms.PartnerId != "" && decision.IdentityId == string(terms.PartnerId):
+			terms.PartnerApproval = decision.Decision
+		default:
+			return ERR_CONTRACT_PARTY
+		}
+
+		location, _ := time.LoadLocation("UTC")
+		now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+		decision.Version = contract.Version
+		decision.DecidedAt = now
+		contract.Decisions = append(contract.Decisions, decision)
+
+		approved := terms.OperatorApproval == CONTRACT_DECISION_APPROVED && (terms.PartnerId == "" || terms.PartnerApproval == CONTRACT_DECISION_APPROVED)
+		status := CONTRACT_STATUS_ACTIVE
+		if now.Before(terms.ValidFrom) {
+			status = CONTRACT_STATUS_PENDING
+		}
+		switch {
+		case contract.Proposal != nil && decision.Decision == CONTRACT_DECISION_REJECTED:
+			contract.Proposal = nil
+		case contract.Proposal != nil && approved:
+			applied := *contract.Proposal
+			applied.Decisions = contract.Decisions
+			applied.Status = status
+			*contract = applied
+		case contract.Proposal != nil:
+		case decision.Decision == CONTRACT_DECISION_REJECTED:
+			contract.Status = CONTRACT_STATUS_REJECTED
+		case approved:
+			contract.Status = status
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return contract, err
 	}
 
-	wallet.IsDeleted = true
+	span.AddEvent("contract " + decision.Decision + " by the " + decision.Party + ", now " + contract.Status)
+	return contract, nil
+}
+
+// ActivateApproved makes the approved contracts that have become valid active,
+// the contracts activated are returned
+func (service *ContractService) ActivateApproved(ctx context.Context, sessionedUser string) ([]*models.Contract, error) {
+	fName := "service/contract/activateApproved"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
 	location, _ := time.LoadLocation("UTC")
 	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
-	wallet.LastUpdatedAt = now
-	wallet.LastUpdatedBy = sessionedUser
+	contracts, err := service.Filter(ctx, "AND isDeleted=false AND status=$status AND STR_TO_MILLIS(validFrom) <= STR_TO_MILLIS($now)", map[string]interface{}{
+		"status": CONTRACT_STATUS_PENDING,
+		"now":    now.Format(time.RFC3339),
+	}, "validFrom", -1)
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: need to convert it into soft delete
-	_, err = col.Replace(contract_prefix+"/"+contractId, wallet, nil)
-	return err
+	activated := []*models.Contract{}
+	for _, contract := range contracts {
+		updated, err := service.revise(ctx, contract.Identifier, sessionedUser, func(contract *models.Contract) error {
+			if contract.Status != CONTRACT_STATUS_PENDING {
+				return ERR_CONTRACT_UNCHANGED
+			}
+			contract.Status = CONTRACT_STATUS_ACTIVE
+			return nil
+		})
+		if errors.Is(err, ERR_CONTRACT_UNCHANGED) {
+			continue
+		}
+		if err != nil {
+			return activated, err
+		}
+		activated = append(activated, &updated)
+	}
 
+	span.SetAttributes(attribute.Int("activated", len(activated)))
+	return activated, nil
 }
 
-func (service *ContractService) MarkContractAsExpired(ctx context.Context, contractId string, sessionedUser string) error {
-	fName := "service/contract/markContractAsExpired"
+// ExpireLapsed marks the approved contracts whose validity has ended as
+// expired, the contracts expired are returned
+func (service *ContractService) ExpireLapsed(ctx context.Context, sessionedUser string) ([]*models.Contract, error) {
+	fName := "service/contract/expireLapsed"
 	tracer := otel.Tracer("api")
 	_, span := tracer.Start(ctx, fName)
 	defer span.End()
 
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	contracts, err := service.Filter(ctx, "AND isDeleted=false AND status IN $statuses AND STR_TO_MILLIS(validUntill) <= STR_TO_MILLIS($now)", map[string]interface{}{
+		"statuses": []string{CONTRACT_STATUS_ACTIVE, CONTRACT_STATUS_PENDING},
+		"now":      now.Format(time.RFC3339),
+	}, "validUntill", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []*models.Contract{}
+	for _, contract := range contracts {
+		updated, err := service.expire(ctx, contract.Identifier, sessionedUser)
+		if errors.Is(err, ERR_CONTRACT_UNCHANGED) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, &updated)
+	}
+
+	span.SetAttributes(attribute.Int("expired", len(expired)))
+	return expired, nil
+}
+
+// revise stores the changed contract with the next version number next to an
+// immutable copy of it. The version copy is written first so that two editors
+// can not claim the same version, it is removed again when the contract has
+// been changed in the meantime.
+func (service *ContractService) revise(ctx context.Context, contractId string, editor string, change func(*models.Contract) error) (models.Contract, error) {
 	col := service.bucket.DefaultCollection()
-	doc, err := col.Get(contract_prefix+"/"+contractId, nil)
-	if doc == nil {
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(contract_prefix+"/"+contractId, nil)
+		if err != nil {
+			return models.Contract{}, ERR_CONTRACT_NOT_FOUND
+		}
+
+		var current, updated models.Contract
+		if err := doc.Content(&current); err != nil {
+			return models.Contract{}, err
+		}
+		// the change is made on a copy so that the current contract can be diffed
+		if err := doc.Content(&updated); err != nil {
+			return models.Contract{}, err
+		}
+		if err := change(&updated); err != nil {
+			return current, err
+		}
+		updated.DocType = current.DocType
+		updated.Identifier = current.Identifier
+		updated.Creator = current.Creator
+		updated.Channel = current.Channel
+		updated.CreatedAt = current.CreatedAt
+
+		changes, err := contractChanges(current, updated)
+		if err != nil {
+			return current, err
+		}
+		if len(changes) == 0 {
+			return current, ERR_CONTRACT_UNCHANGED
+		}
+
+		// contracts created before versions were kept get their current state
+		// recorded as the first version
+		if current.Version == 0 {
+			current.Version = 1
+			_, err = col.Upsert(contractVersionKey(contractId, current.Version), models.ContractVersion{
+				DocType:    "contract_version",
+				ContractId: contractId,
+				Version:    current.Version,
+				Contract:   current,
+				Changes:    []models.ContractChange{},
+				Editor:     current.LastUpdatedBy,
+				EditedAt:   current.LastUpdatedAt,
+			}, nil)
+			if err != nil {
+				return current, err
+			}
+		}
+
+		location, _ := time.LoadLocation("UTC")
+		now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+		updated.Version = current.Version + 1
+		updated.LastUpdatedAt = now
+		updated.LastUpdatedBy = editor
+
+		versionKey := contractVersionKey(contractId, updated.Version)
+		_, err = col.Insert(versionKey, models.ContractVersion{
+			DocType:    "contract_version",
+			ContractId: contractId,
+			Version:    updated.Version,
+			Contract:   updated,
+			Changes:    changes,
+			Editor:     editor,
+			EditedAt:   now,
+		}, nil)
+		if errors.Is(err, gocb.ErrDocumentExists) {
+			continue
+		}
+		if err != nil {
+			return current, err
+		}
+
+		_, err = col.Replace(contract_prefix+"/"+contractId, updated, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			col.Remove(versionKey, nil)
+			continue
+		}
 		if err != nil {
-			return errors.New("error: no contract found")
+			col.Remove(versionKey, nil)
+			return current, err
 		}
+		return updated, nil
 	}
+	return models.Contract{}, errors.New("error: contract is being modified concurrently, try again")
+}
 
-	var wallet models.Wallet
-	err = doc.Content(&wallet)
+// GetContractVersion returns the contract as it was at the version, a missing
+// version stands for a contract created before versions were kept
+func (service *ContractService) GetContractVersion(ctx context.Context, contractId string, version int64) (models.Contract, error) {
+	fName := "service/contract/getVersion"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if version == 0 {
+		return service.GetContract(ctx, contractId)
+	}
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(contractVersionKey(contractId, version), nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return service.GetContract(ctx, contractId)
+	}
 	if err != nil {
-		return err
+		return models.Contract{}, err
 	}
 
-	wallet.Status = WALLET_STATUS_EXPIRED
-	location, _ := time.LoadLocation("UTC")
-	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
-	wallet.LastUpdatedAt = now
-	wallet.LastUpdatedBy = sessionedUser
+	var contractVersion models.ContractVersion
+	err = doc.Content(&contractVersion)
+	return contractVersion.Contract, err
+}
+
+// History lists the versions of the contract, the oldest first
+func (service *ContractService) History(ctx context.Context, contractId string) ([]*models.ContractVersion, error) {
+	fName := "service/contract/history"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='contract_version' AND contractId=$contractId order by version"
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{NamedParameters: map[string]interface{}{"contractId": contractId}})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*models.ContractVersion{}
+	for rows.Next() {
+		var obj models.ContractVersion
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		versions = append(versions, &obj)
+	}
+	return versions, rows.Err()
+}
+
+// Applicable lists the active contracts of the channel for the operator, the
+// contracts of every partner of the operator are included
+func (service *ContractService) Applicable(ctx context.Context, channel string, operatorId string) ([]*models.Contract, error) {
+	fName := "service/contract/applicable"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if operatorId == "" {
+		return []*models.Contract{}, nil
+	}
+
+	// approved contracts apply from their start even before they are activated
+	return service.Filter(ctx, "AND isDeleted=false AND status IN $statuses AND channel=$channel AND operatorId=$operatorId", map[string]interface{}{
+		"statuses":   []string{CONTRACT_STATUS_ACTIVE, CONTRACT_STATUS_PENDING},
+		"channel":    channel,
+		"operatorId": operatorId,
+	}, "createdAt", -1)
+}
+
+// Approved lists the approved contracts of every operator, the query waits for
+// the index to catch up with the latest changes so that none of them is missed
+func (service *ContractService) Approved(ctx context.Context) ([]*models.Contract, error) {
+	fName := "service/contract/approved"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='contract' AND isDeleted=false AND status IN $statuses order by createdAt"
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{"statuses": []string{CONTRACT_STATUS_ACTIVE, CONTRACT_STATUS_PENDING}},
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseClusterRows(rows), nil
+}
+
+// ApplicableContracts lists the contracts out of the candidates that apply to a
+// transaction of the operator and partner at the given time. A contract applies
+// when it is approved, valid at that time, made for the operator and either for
+// the partner or for every partner. A promotional contract goes before a
+// regular one, then the highest priority, then a contract made for the partner
+// before one for every partner, then the contract changed last.
+func ApplicableContracts(contracts []*models.Contract, operatorId string, partnerId string, at time.Time) []*models.Contract {
+	applicable := []*models.Contract{}
+	for _, contract := range contracts {
+		if contract.IsDeleted || (contract.Status != CONTRACT_STATUS_ACTIVE && contract.Status != CONTRACT_STATUS_PENDING) {
+			continue
+		}
+		if operatorId == "" || string(contract.OperatorId) != operatorId {
+			continue
+		}
+		if contract.PartnerId != "" && string(contract.PartnerId) != partnerId {
+			continue
+		}
+		if at.Before(contract.ValidFrom) || !at.Before(contract.ValidUntill) {
+			continue
+		}
+		if !IsContractType(contract.ContractType) {
+			continue
+		}
+		applicable = append(applicable, contract)
+	}
+
+	sort.SliceStable(applicable, func(i, j int) bool {
+		a, b := applicable[i], applicable[j]
+		if promotional := isPromotional(a); promotional != isPromotional(b) {
+			return promotional
+		}
+		if a.Priorty != b.Priorty {
+			return a.Priorty > b.Priorty
+		}
+		if (a.PartnerId != "") != (b.PartnerId != "") {
+			return a.PartnerId != ""
+		}
+		if !a.LastUpdatedAt.Equal(b.LastUpdatedAt) {
+			return a.LastUpdatedAt.After(b.LastUpdatedAt)
+		}
+		return a.Identifier < b.Identifier
+	})
+	return applicable
+}
+
+// SelectContract picks the first of the applicable contracts, nil when none applies
+func SelectContract(contracts []*models.Contract, operatorId string, partnerId string, at time.Time) *models.Contract {
+	applicable := ApplicableContracts(contracts, operatorId, partnerId, at)
+	if len(applicable) == 0 {
+		return nil
+	}
+	return applicable[0]
+}
+
+// BandMember is what the bands of the contracts are chosen by besides the
+// amount of the transaction: the tier of the member and what the member spent
+// in the band period of each contract, by contract id
+type BandMember struct {
+	Tier  string
+	Spend map[string]int64
+}
+
+// PriceContracts converts the amount of a transaction into points with the
+// applicable contracts, one line per contract contributing points. A contract
+// with bands is priced with the ratios of the band chosen for the transaction,
+// an amount in another currency is converted into the currency of each
+// contract.
+//
+// Earned points are based on the first regular contract, the promotional
+// contracts add bonus points on top of it. When the first promotion is not
+// stackable it is the only one applied, otherwise every stackable promotion is
+// applied. The bonus of all promotions together is capped by the bonus cap of
+// the regular contract. Burned points are priced with the first regular
+// contract alone, promotions never apply to them; without a regular contract
+// no contract prices the burn.
+func PriceContracts(applicable []*models.Contract, earn bool, amount Amount, member BandMember) ([]models.ContractLine, error) {
+	lines := []models.ContractLine{}
+	if len(applicable) == 0 {
+		return lines, nil
+	}
+
+	if !earn {
+		var contract *models.Contract
+		for _, candidate := range applicable {
+			if !isPromotional(candidate) {
+				contract = candidate
+				break
+			}
+		}
+		if contract == nil {
+			return lines, nil
+		}
+		band, value, err := selectAmountBand(contract, amount, member)
+		if err != nil {
+			return nil, err
+		}
+		_, burnRatio := bandRatios(contract, band)
+		pricing, err := priceAmount(contract, amount, burnRatio)
+		if err != nil {
+			return nil, err
+		}
+		return append(lines, bandLine(contractLine(contract, CONTRACT_LINE_BASE, pricing), band, value)), nil
+	}
+
+	var base *models.Contract
+	promotions := []*models.Contract{}
+	for _, contract := range applicable {
+		if !isPromotional(contract) {
+			if base == nil {
+				base = contract
+			}
+			continue
+		}
+		if len(promotions) == 0 || (promotions[0].Stackable && contract.Stackable) {
+			promotions = append(promotions, contract)
+		}
+	}
+
+	basePoints := int64(0)
+	if base != nil {
+		band, value, err := selectAmountBand(base, amount, member)
+		if err != nil {
+			return nil, err
+		}
+		earnRatio, _ := bandRatios(base, band)
+		pricing, err := priceAmount(base, amount, earnRatio)
+		if err != nil {
+			return nil, err
+		}
+		basePoints = pricing.Points
+		lines = append(lines, bandLine(contractLine(base, CONTRACT_LINE_BASE, pricing), band, value))
+	}
+
+	bonusLeft := int64(-1)
+	if base != nil && base.MaxBonusPoints > 0 {
+		bonusLeft = base.MaxBonusPoints
+	}
+	for _, promotion := range promotions {
+		band, value, err := selectAmountBand(promotion, amount, member)
+		if err != nil {
+			return nil, err
+		}
+		earnRatio, _ := bandRatios(promotion, band)
+
+		var pricing models.Pricing
+		switch promotion.BonusType {
+		case BONUS_TYPE_MULTIPLIER:
+			// the base points are multiplied, the bonus is what the
+			// multiplier adds to them
+			extra := new(big.Rat).Sub(earnRatio.Rat(), big.NewRat(1, 1))
+			pricing, err = Price(basePoints, models.Ratio(extra.RatString()), promotion.RoundingMode, promotion.MinPoints, promotion.MaxPoints)
+		case BONUS_TYPE_FIXED:
+			pricing = models.Pricing{Amount: amount.Value, Points: promotion.BonusPoints, RoundedPoints: promotion.BonusPoints}
+		default:
+			pricing, err = priceAmount(promotion, amount, earnRatio)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line := bandLine(contractLine(promotion, CONTRACT_LINE_BONUS, pricing), band, value)
+		if bonusLeft >= 0 && line.Points > bonusLeft {
+			line.Points = bonusLeft
+			line.Capped = true
+		}
+		if bonusLeft >= 0 {
+			bonusLeft -= line.Points
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// LinesPoints sums up the points of the contract lines
+func LinesPoints(lines []models.ContractLine) int64 {
+	points := int64(0)
+	for _, line := range lines {
+		points += line.Points
+	}
+	return points
+}
+
+func contractLine(contract *models.Contract, role string, pricing models.Pricing) models.ContractLine {
+	line := models.ContractLine{
+		ContractId:      contract.Identifier,
+		ContractVersion: contract.Version,
+		ContractType:    contract.ContractType,
+		Role:            role,
+		Pricing:         pricing,
+		Points:          pricing.Points,
+	}
+	if role == CONTRACT_LINE_BONUS {
+		line.BonusType = contract.BonusType
+		if line.BonusType == "" {
+			line.BonusType = BONUS_TYPE_RATIO
+		}
+	}
+	return line
+}
+
+// SelectBand chooses the band of the contract for a transaction of the amount,
+// along with the amount, the tier or the spend that chose it. A contract
+// without bands has no band.
+func SelectBand(contract *models.Contract, amount int64, member BandMember) (*models.ContractBand, string, error) {
+	if len(contract.Bands) == 0 {
+		return nil, "", nil
+	}
+
+	switch contract.BandBasis {
+	case BAND_BASIS_TIER:
+		var fallback *models.ContractBand
+		for i := range contract.Bands {
+			band := &contract.Bands[i]
+			if band.Tier == "" {
+				fallback = band
+			} else if member.Tier != "" && strings.EqualFold(band.Tier, member.Tier) {
+				return band, member.Tier, nil
+			}
+		}
+		if fallback == nil {
+			return nil, "", ERR_NO_BAND
+		}
+		return fallback, member.Tier, nil
+	case BAND_BASIS_SPEND:
+		spend := member.Spend[contract.Identifier]
+		band := rangeBand(contract.Bands, spend)
+		if band == nil {
+			return nil, "", ERR_NO_BAND
+		}
+		return band, strconv.FormatInt(spend, 10), nil
+	default:
+		band := rangeBand(contract.Bands, amount)
+		if band == nil {
+			return nil, "", ERR_NO_BAND
+		}
+		return band, strconv.FormatInt(amount, 10), nil
+	}
+}
+
+// selectAmountBand chooses the band of the contract by the amount in the
+// currency of the contract
+func selectAmountBand(contract *models.Contract, amount Amount, member BandMember) (*models.ContractBand, string, error) {
+	if len(contract.Bands) == 0 {
+		return nil, "", nil
+	}
+	converted, err := amount.in(contract)
+	if err != nil {
+		return nil, "", err
+	}
+	return SelectBand(contract, converted, member)
+}
+
+// BandPeriodStart is when the spend of a member starts counting for the bands
+// of the contract at the time
+func BandPeriodStart(contract *models.Contract, at time.Time) time.Time {
+	at = at.UTC()
+	switch contract.BandPeriod {
+	case BAND_PERIOD_YEAR:
+		return time.Date(at.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	case BAND_PERIOD_CONTRACT:
+		return contract.ValidFrom.UTC()
+	default:
+		return time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func rangeBand(bands []models.ContractBand, value int64) *models.ContractBand {
+	for i := range bands {
+		if value >= bands[i].From && (bands[i].To == 0 || value < bands[i].To) {
+			return &bands[i]
+		}
+	}
+	return nil
+}
+
+// bandRatios are the earn and burn ratios of the band, the ones of the
+// contract without a band
+func bandRatios(contract *models.Contract, band *models.ContractBand) (models.Ratio, models.Ratio) {
+	if band == nil {
+		return contract.EarnConversionRatio, contract.BurnConversionRatio
+	}
+	return band.EarnConversionRatio, band.BurnConversionRatio
+}
+
+func bandLine(line models.ContractLine, band *models.ContractBand, value string) models.ContractLine {
+	if band != nil {
+		copied := *band
+		line.Band = &copied
+		line.BandValue = value
+	}
+	return line
+}
+
+// validateBands checks that the bands of the contract cover every transaction
+// exactly once
+func validateBands(contract *models.Contract) error {
+	if len(contract.Bands) == 0 {
+		if contract.BandBasis != "" || contract.BandPeriod != "" {
+			return ERR_BAND_BASIS
+		}
+		return nil
+	}
+
+	for _, band := range contract.Bands {
+		for _, ratio := range []models.Ratio{band.EarnConversionRatio, band.BurnConversionRatio} {
+			if rat := ratio.Rat(); rat == nil || rat.Sign() <= 0 {
+				return models.ERR_INVALID_RATIO
+			}
+		}
+		if contract.BonusType == BONUS_TYPE_MULTIPLIER && band.EarnConversionRatio.Rat().Cmp(big.NewRat(1, 1)) < 0 {
+			return ERR_BONUS_SETTINGS
+		}
+	}
+
+	switch contract.BandBasis {
+	case BAND_BASIS_TIER:
+		if contract.BandPeriod != "" {
+			return ERR_BAND_BASIS
+		}
+		tiers := map[string]bool{}
+		for _, band := range contract.Bands {
+			tier := strings.ToLower(strings.TrimSpace(band.Tier))
+			if tiers[tier] || band.From != 0 || band.To != 0 {
+				return ERR_TIER_BANDS
+			}
+			tiers[tier] = true
+		}
+		if !tiers[""] {
+			return ERR_TIER_BANDS
+		}
+		return nil
+	case BAND_BASIS_AMOUNT, BAND_BASIS_SPEND:
+		switch contract.BandPeriod {
+		case "":
+		case BAND_PERIOD_MONTH, BAND_PERIOD_YEAR, BAND_PERIOD_CONTRACT:
+			if contract.BandBasis != BAND_BASIS_SPEND {
+				return ERR_BAND_BASIS
+			}
+		default:
+			return ERR_BAND_BASIS
+		}
+	default:
+		return ERR_BAND_BASIS
+	}
+
+	// the bands are given in order, each starting where the one before ends
+	last := len(contract.Bands) - 1
+	for i, band := range contract.Bands {
+		if band.Tier != "" {
+			return ERR_AMOUNT_BANDS
+		}
+		if i == 0 && band.From != 0 {
+			return ERR_AMOUNT_BANDS
+		}
+		if i > 0 && band.From != contract.Bands[i-1].To {
+			return ERR_AMOUNT_BANDS
+		}
+		if i < last && band.To <= band.From {
+			return ERR_AMOUNT_BANDS
+		}
+		if i == last && band.To != 0 {
+			return ERR_AMOUNT_BANDS
+		}
+	}
+	return nil
+}
+
+func isPromotional(contract *models.Contract) bool {
+	return strings.EqualFold(contract.ContractType, CONTRACT_TYPE_PROMOTIONAL)
+}
+
+// IsContractType tells if the type is one of the known contract types
+func IsContractType(contractType string) bool {
+	return strings.EqualFold(contractType, CONTRACT_TYPE_REGULAR) || strings.EqualFold(contractType, CONTRACT_TYPE_PROMOTIONAL)
+}
+
+// ValidatePricing checks the currency, the ratios, the bands, the rounding
+// mode, the points bounds, the bonus and the budget of the contract
+func ValidatePricing(contract *models.Contract) error {
+	contract.ConversionCurrency = strings.ToUpper(strings.TrimSpace(contract.ConversionCurrency))
+	if !IsCurrency(contract.ConversionCurrency) {
+		return ERR_INVALID_CURRENCY
+	}
+	for _, ratio := range []models.Ratio{contract.EarnConversionRatio, contract.BurnConversionRatio} {
+		if rat := ratio.Rat(); rat == nil || rat.Sign() <= 0 {
+			return models.ERR_INVALID_RATIO
+		}
+	}
+	switch contract.RoundingMode {
+	case "", ROUNDING_FLOOR, ROUNDING_CEIL, ROUNDING_HALF_EVEN:
+	default:
+		return ERR_ROUNDING_MODE
+	}
+	if contract.MinPoints < 0 || contract.MaxPoints < 0 || (contract.MaxPoints > 0 && contract.MinPoints > contract.MaxPoints) {
+		return ERR_POINTS_BOUNDS
+	}
+
+	switch contract.BonusType {
+	case "", BONUS_TYPE_RATIO:
+	case BONUS_TYPE_MULTIPLIER:
+		if contract.EarnConversionRatio.Rat().Cmp(big.NewRat(1, 1)) < 0 {
+			return ERR_BONUS_SETTINGS
+		}
+	case BONUS_TYPE_FIXED:
+		if contract.BonusPoints <= 0 {
+			return ERR_BONUS_SETTINGS
+		}
+	default:
+		return ERR_BONUS_TYPE
+	}
+	if contract.MaxBonusPoints < 0 {
+		return ERR_BONUS_SETTINGS
+	}
+
+	if contract.Budget < 0 || contract.MemberCap < 0 {
+		return ERR_BUDGET_SETTINGS
+	}
+	for _, threshold := range contract.BudgetThresholds {
+		if threshold < 1 || threshold > 100 {
+			return ERR_BUDGET_SETTINGS
+		}
+	}
+	return validateBands(contract)
+}
+
+// Price converts the amount into points with the ratio, the exact result is
+// rounded with the rounding mode and kept within the bounds of the contract.
+// Every step of the conversion is returned.
+func Price(amount int64, ratio models.Ratio, roundingMode string, minPoints int64, maxPoints int64) (models.Pricing, error) {
+	rat := ratio.Rat()
+	if rat == nil {
+		return models.Pricing{}, models.ERR_INVALID_RATIO
+	}
+	if roundingMode == "" {
+		roundingMode = ROUNDING_FLOOR
+	}
+
+	exact := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), rat)
+	numerator := new(big.Int).Mul(big.NewInt(amount), rat.Num())
+	denominator := rat.Denom()
+	// Div and Mod are euclidean, the quotient is the floor for a positive denominator
+	quotient, remainder := new(big.Int).DivMod(numerator, denominator, new(big.Int))
+	if remainder.Sign() != 0 {
+		switch roundingMode {
+		case ROUNDING_CEIL:
+			quotient.Add(quotient, big.NewInt(1))
+		case ROUNDING_HALF_EVEN:
+			switch new(big.Int).Lsh(remainder, 1).Cmp(denominator) {
+			case 1:
+				quotient.Add(quotient, big.NewInt(1))
+			case 0:
+				if quotient.Bit(0) == 1 {
+					quotient.Add(quotient, big.NewInt(1))
+				}
+			}
+		}
+	}
+	if !quotient.IsInt64() {
+		return models.Pricing{}, ERR_POINTS_OVERFLOW
+	}
+
+	pricing := models.Pricing{
+		Amount:        amount,
+		Ratio:         ratio,
+		RoundingMode:  roundingMode,
+		ExactPoints:   exact.RatString(),
+		RoundedPoints: quotient.Int64(),
+		MinPoints:     minPoints,
+		MaxPoints:     maxPoints,
+		Points:        quotient.Int64(),
+	}
+	if minPoints > 0 && pricing.Points < minPoints {
+		pricing.Points = minPoints
+	}
+	if maxPoints > 0 && pricing.Points > maxPoints {
+		pricing.Points = maxPoints
+	}
+	return pricing, nil
+}
+
+// ConsumeBudget takes the points out of the budget of the contract and the cap
+// of the member. Nothing is taken and false is returned when they do not fit.
+// The thresholds of the budget reached by the points are returned.
+func (service *ContractService) ConsumeBudget(ctx context.Context, contract *models.Contract, memberId string, points int64) (bool, []int64, error) {
+	fName := "service/contract/consumeBudget"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if points <= 0 {
+		return true, nil, nil
+	}
+
+	col := service.bucket.DefaultCollection()
+	memberKey := budgetMemberKey(contract.Identifier, memberId)
+	if contract.MemberCap > 0 {
+		consumed, err := service.incrementBudget(memberKey, points)
+		if err != nil {
+			return false, nil, err
+		}
+		if consumed > contract.MemberCap {
+			col.Binary().Decrement(memberKey, &gocb.DecrementOptions{Delta: uint64(points)})
+			span.AddEvent("member cap exhausted")
+			return false, nil, nil
+		}
+	}
+
+	if contract.Budget <= 0 {
+		return true, nil, nil
+	}
+	consumed, err := service.incrementBudget(budgetKey(contract.Identifier), points)
+	if err == nil && consumed > contract.Budget {
+		col.Binary().Decrement(budgetKey(contract.Identifier), &gocb.DecrementOptions{Delta: uint64(points)})
+		span.AddEvent("budget exhausted")
+	}
+	if err != nil || consumed > contract.Budget {
+		if contract.MemberCap > 0 {
+			col.Binary().Decrement(memberKey, &gocb.DecrementOptions{Delta: uint64(points)})
+		}
+		return false, nil, err
+	}
+
+	thresholds := contract.BudgetThresholds
+	if len(thresholds) == 0 {
+		thresholds = default_budget_thresholds
+	}
+	reached := []int64{}
+	for _, threshold := range thresholds {
+		// reached by these points when the consumption before them was below it
+		if (consumed-points)*100 < threshold*contract.Budget && threshold*contract.Budget <= consumed*100 {
+			reached = append(reached, threshold)
+		}
+	}
+	return true, reached, nil
+}
+
+// ReleaseBudget gives points taken by ConsumeBudget back
+func (service *ContractService) ReleaseBudget(ctx context.Context, contract *models.Contract, memberId string, points int64) {
+	if points <= 0 {
+		return
+	}
+
+	col := service.bucket.DefaultCollection()
+	if contract.MemberCap > 0 {
+		if _, err := col.Binary().Decrement(budgetMemberKey(contract.Identifier, memberId), &gocb.DecrementOptions{Delta: uint64(points)}); err != nil {
+			fmt.Print("failed to release the contract member cap: %w", err)
+		}
+	}
+	if contract.Budget > 0 {
+		if _, err := col.Binary().Decrement(budgetKey(contract.Identifier), &gocb.DecrementOptions{Delta: uint64(points)}); err != nil {
+			fmt.Print("failed to release the contract budget: %w", err)
+		}
+	}
+}
+
+// BudgetUsage tells how much of the budget of the contract is consumed, and of
+// the cap of the member when one is given
+func (service *ContractService) BudgetUsage(ctx context.Context, contract *models.Contract, memberId string) (models.ContractBudgetUsage, error) {
+	fName := "service/contract/budgetUsage"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	usage := models.ContractBudgetUsage{
+		ContractId: contract.Identifier,
+		Budget:     contract.Budget,
+		MemberCap:  contract.MemberCap,
+		MemberId:   memberId,
+	}
+
+	var err error
+	usage.Consumed, err = service.budgetCounter(budgetKey(contract.Identifier))
+	if err != nil {
+		return usage, err
+	}
+	if contract.Budget > 0 {
+		usage.Remaining = remainingOf(contract.Budget, usage.Consumed)
+		usage.Utilisation = float64(usage.Consumed) * 100 / float64(contract.Budget)
+		usage.Exhausted = usage.Remaining == 0
+	}
+
+	if memberId != "" {
+		usage.MemberConsumed, err = service.budgetCounter(budgetMemberKey(contract.Identifier, memberId))
+		if err != nil {
+			return usage, err
+		}
+		if contract.MemberCap > 0 && usage.MemberConsumed >= contract.MemberCap {
+			usage.Exhausted = true
+		}
+	}
+	return usage, nil
+}
+
+// BudgetFits tells if the points fit in what is left of the budget of the
+// contract and of the cap of the member, without taking them
+func (service *ContractService) BudgetFits(ctx context.Context, contract *models.Contract, memberId string, points int64) (bool, error) {
+	usage, err := service.BudgetUsage(ctx, contract, memberId)
+	if err != nil {
+		return false, err
+	}
+	if contract.Budget > 0 && usage.Consumed+points > contract.Budget {
+		return false, nil
+	}
+	if contract.MemberCap > 0 && usage.MemberConsumed+points > contract.MemberCap {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (service *ContractService) incrementBudget(key string, points int64) (int64, error) {
+	col := service.bucket.DefaultCollection()
+	result, err := col.Binary().Increment(key, &gocb.IncrementOptions{
+		Delta:   uint64(points),
+		Initial: points,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(result.Content()), nil
+}
+
+func (service *ContractService) budgetCounter(key string) (int64, error) {
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(key, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var consumed int64
+	err = doc.Content(&consumed)
+	return consumed, err
+}
+
+func budgetKey(contractId string) string {
+	return contract_budget_prefix + "/" + contractId
+}
+
+func budgetMemberKey(contractId string, memberId string) string {
+	return contract_budget_prefix + "/" + contractId + "/member/" + memberId
+}
+
+func contractVersionKey(contractId string, version int64) string {
+	return contract_version_prefix + "/" + contractId + "/" + strconv.FormatInt(version, 10)
+}
+
+// contractChanges lists the fields that differ between the two contracts by
+// their JSON name, in alphabetical order
+func contractChanges(before models.Contract, after models.Contract) ([]models.ContractChange, error) {
+	from, err := contractFields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := contractFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []string{}
+	for field := range to {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	changes := []models.ContractChange{}
+	for _, field := range fields {
+		if contract_bookkeeping_fields[field] || reflect.DeepEqual(from[field], to[field]) {
+			continue
+		}
+		changes = append(changes, models.ContractChange{Field: field, From: from[field], To: to[field]})
+	}
+	return changes, nil
+}
+
+// termsChanged tells whether the terms of the contracts differ, the bookkeeping
+// fields and the decisions on the terms are not terms
+func termsChanged(before models.Contract, after models.Contract) (bool, error) {
+	from, err := contractFields(before)
+	if err != nil {
+		return false, err
+	}
+	to, err := contractFields(after)
+	if err != nil {
+		return false, err
+	}
+
+	for _, fields := range []map[string]interface{}{from, to} {
+		for field := range fields {
+			if !contract_bookkeeping_fields[field] && !contract_decision_fields[field] && !reflect.DeepEqual(from[field], to[field]) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// copyContract copies the contract without sharing its slices
+func copyContract(contract models.Contract) (models.Contract, error) {
+	encoded, err := json.Marshal(contract)
+	if err != nil {
+		return models.Contract{}, err
+	}
+	var copied models.Contract
+	err = json.Unmarshal(encoded, &copied)
+	return copied, err
+}
+
+func contractFields(contract models.Contract) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(contract)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(encoded, &fields)
+	return fields, err
+}
 
-	// TODO: need to convert it into soft delete
-	_, err = col.Replace(contract_prefix+"/"+contractId, wallet, nil)
+func (service *ContractService) MarkContractAsExpired(ctx context.Context, contractId string, sessionedUser string) error {
+	fName := "service/contract/markContractAsExpired"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	_, err := service.expire(ctx, contractId, sessionedUser)
+	if errors.Is(err, ERR_CONTRACT_UNCHANGED) {
+		return nil
+	}
 	return err
 
 }
 
+func (service *ContractService) expire(ctx context.Context, contractId string, sessionedUser string) (models.Contract, error) {
+	return service.revise(ctx, contractId, sessionedUser, func(contract *models.Contract) error {
+		if contract.IsDeleted {
+			return ERR_CONTRACT_NOT_FOUND
+		}
+		if contract.Status == CONTRACT_STATUS_EXPIRED {
+			return ERR_CONTRACT_UNCHANGED
+		}
+		contract.Status = CONTRACT_STATUS_EXPIRED
+		// the terms of an expired contract are no longer changed by its proposal
+		contract.Proposal = nil
+		return nil
+	})
+}
+
 func (service *ContractService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.Contract, error) {
 	fName := "service/contract/filter"
 	tracer := otel.Tracer("api")
@@ -0,0 +1,325 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/loyyal/loyyal-be-contract/models"
+)
+
+func TestPrice(t *testing.T) {
+	tests := []struct {
+		name         string
+		amount       int64
+		ratio        models.Ratio
+		roundingMode string
+		minPoints    int64
+		maxPoints    int64
+		rounded      int64
+		points       int64
+		err          error
+	}{
+		{name: "whole ratio", amount: 100, ratio: "2", rounded: 200, points: 200},
+		{name: "fraction", amount: 100, ratio: "3/2", rounded: 150, points: 150},
+		{name: "floor by default", amount: 7, ratio: "1/3", rounded: 2, points: 2},
+		{name: "floor", amount: 7, ratio: "1/3", roundingMode: ROUNDING_FLOOR, rounded: 2, points: 2},
+		{name: "ceil", amount: 7, ratio: "1/3", roundingMode: ROUNDING_CEIL, rounded: 3, points: 3},
+		{name: "ceil of a whole result", amount: 9, ratio: "1/3", roundingMode: ROUNDING_CEIL, rounded: 3, points: 3},
+		{name: "half even below half", amount: 7, ratio: "1/3", roundingMode: ROUNDING_HALF_EVEN, rounded: 2, points: 2},
+		{name: "half even above half", amount: 5, ratio: "1/3", roundingMode: ROUNDING_HALF_EVEN, rounded: 2, points: 2},
+		{name: "half even tie to even", amount: 5, ratio: "1/2", roundingMode: ROUNDING_HALF_EVEN, rounded: 2, points: 2},
+		{name: "half even tie to odd", amount: 7, ratio: "1/2", roundingMode: ROUNDING_HALF_EVEN, rounded: 4, points: 4},
+		{name: "raised to the minimum", amount: 1, ratio: "1/10", minPoints: 5, rounded: 0, points: 5},
+		{name: "capped to the maximum", amount: 1000, ratio: "2", maxPoints: 500, rounded: 2000, points: 500},
+		{name: "within the bounds", amount: 10, ratio: "2", minPoints: 5, maxPoints: 500, rounded: 20, points: 20},
+		{name: "zero amount", amount: 0, ratio: "2", rounded: 0, points: 0},
+		{name: "invalid ratio", amount: 10, ratio: "abc", err: models.ERR_INVALID_RATIO},
+		{name: "missing ratio", amount: 10, ratio: "", err: models.ERR_INVALID_RATIO},
+		{name: "overflow", amount: 1 << 62, ratio: "4", err: ERR_POINTS_OVERFLOW},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pricing, err := Price(test.amount, test.ratio, test.roundingMode, test.minPoints, test.maxPoints)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if pricing.RoundedPoints != test.rounded || pricing.Points != test.points {
+				t.Errorf("got %d rounded to %d points, want %d rounded to %d points", pricing.RoundedPoints, pricing.Points, test.rounded, test.points)
+			}
+			if test.roundingMode == "" && pricing.RoundingMode != ROUNDING_FLOOR {
+				t.Errorf("got rounding mode %s, want %s", pricing.RoundingMode, ROUNDING_FLOOR)
+			}
+		})
+	}
+}
+
+func TestPriceContracts(t *testing.T) {
+	regular := func(id string, earn models.Ratio, burn models.Ratio) *models.Contract {
+		return &models.Contract{Identifier: id, ContractType: CONTRACT_TYPE_REGULAR, EarnConversionRatio: earn, BurnConversionRatio: burn}
+	}
+	promotion := func(id string, earn models.Ratio, stackable bool) *models.Contract {
+		return &models.Contract{Identifier: id, ContractType: CONTRACT_TYPE_PROMOTIONAL, EarnConversionRatio: earn, BurnConversionRatio: "1", Stackable: stackable}
+	}
+	capped := regular("base", "2", "1/2")
+	capped.MaxBonusPoints = 60
+	multiplier := promotion("double", "2", true)
+	multiplier.BonusType = BONUS_TYPE_MULTIPLIER
+	fixed := promotion("welcome", "1", true)
+	fixed.BonusType = BONUS_TYPE_FIXED
+	fixed.BonusPoints = 25
+	banded := regular("banded", "1", "1")
+	banded.BandBasis = BAND_BASIS_AMOUNT
+	banded.Bands = []models.ContractBand{
+		{From: 0, To: 100, EarnConversionRatio: "1", BurnConversionRatio: "1"},
+		{From: 100, EarnConversionRatio: "2", BurnConversionRatio: "1"},
+	}
+	tiered := regular("tiered", "1", "1")
+	tiered.BandBasis = BAND_BASIS_TIER
+	tiered.Bands = []models.ContractBand{
+		{Tier: "gold", EarnConversionRatio: "3", BurnConversionRatio: "1"},
+		{EarnConversionRatio: "1", BurnConversionRatio: "1"},
+	}
+
+	type line struct {
+		contractId string
+		role       string
+		points     int64
+		capped     bool
+	}
+	tests := []struct {
+		name       string
+		applicable []*models.Contract
+		earn       bool
+		amount     int64
+		member     BandMember
+		lines      []line
+	}{
+		{name: "no contract", earn: true, amount: 100},
+		{
+			name:       "regular earn",
+			applicable: []*models.Contract{regular("base", "2", "1/2")},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 200, false}},
+		},
+		{
+			name:       "regular burn",
+			applicable: []*models.Contract{regular("base", "2", "1/2")},
+			amount:     100,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 50, false}},
+		},
+		{
+			name:       "promotions never price a burn",
+			applicable: []*models.Contract{promotion("promo", "1", true)},
+			amount:     100,
+		},
+		{
+			name:       "first regular contract is the base",
+			applicable: []*models.Contract{regular("first", "1", "1"), regular("second", "5", "1")},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"first", CONTRACT_LINE_BASE, 100, false}},
+		},
+		{
+			name:       "stackable promotions add up",
+			applicable: []*models.Contract{regular("base", "1", "1"), promotion("a", "1/2", true), promotion("b", "1/4", true)},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 100, false}, {"a", CONTRACT_LINE_BONUS, 50, false}, {"b", CONTRACT_LINE_BONUS, 25, false}},
+		},
+		{
+			name:       "a first promotion not stackable is alone",
+			applicable: []*models.Contract{regular("base", "1", "1"), promotion("a", "1/2", false), promotion("b", "1/4", true)},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 100, false}, {"a", CONTRACT_LINE_BONUS, 50, false}},
+		},
+		{
+			name:       "bonus capped by the regular contract",
+			applicable: []*models.Contract{capped, promotion("a", "1/2", true), promotion("b", "1/2", true)},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 200, false}, {"a", CONTRACT_LINE_BONUS, 50, false}, {"b", CONTRACT_LINE_BONUS, 10, true}},
+		},
+		{
+			name:       "multiplier bonus",
+			applicable: []*models.Contract{regular("base", "3", "1"), multiplier},
+			earn:       true,
+			amount:     10,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 30, false}, {"double", CONTRACT_LINE_BONUS, 30, false}},
+		},
+		{
+			name:       "fixed bonus",
+			applicable: []*models.Contract{regular("base", "1", "1"), fixed},
+			earn:       true,
+			amount:     10,
+			lines:      []line{{"base", CONTRACT_LINE_BASE, 10, false}, {"welcome", CONTRACT_LINE_BONUS, 25, false}},
+		},
+		{
+			name:       "promotion without a regular contract",
+			applicable: []*models.Contract{promotion("a", "1/2", true)},
+			earn:       true,
+			amount:     100,
+			lines:      []line{{"a", CONTRACT_LINE_BONUS, 50, false}},
+		},
+		{
+			name:       "amount band",
+			applicable: []*models.Contract{banded},
+			earn:       true,
+			amount:     150,
+			lines:      []line{{"banded", CONTRACT_LINE_BASE, 300, false}},
+		},
+		{
+			name:       "tier band",
+			applicable: []*models.Contract{tiered},
+			earn:       true,
+			amount:     10,
+			member:     BandMember{Tier: "Gold"},
+			lines:      []line{{"tiered", CONTRACT_LINE_BASE, 30, false}},
+		},
+		{
+			name:       "default tier band",
+			applicable: []*models.Contract{tiered},
+			earn:       true,
+			amount:     10,
+			member:     BandMember{Tier: "silver"},
+			lines:      []line{{"tiered", CONTRACT_LINE_BASE, 10, false}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines, err := PriceContracts(test.applicable, test.earn, Amount{Value: test.amount}, test.member)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if len(lines) != len(test.lines) {
+				t.Fatalf("got %d lines, want %d", len(lines), len(test.lines))
+			}
+			for i, want := range test.lines {
+				got := lines[i]
+				if got.ContractId != want.contractId || got.Role != want.role || got.Points != want.points || got.Capped != want.capped {
+					t.Errorf("line %d: got %s %s %d capped %t, want %s %s %d capped %t", i, got.ContractId, got.Role, got.Points, got.Capped, want.contractId, want.role, want.points, want.capped)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBands(t *testing.T) {
+	band := func(from int64, to int64, tier string) models.ContractBand {
+		return models.ContractBand{From: from, To: to, Tier: tier, EarnConversionRatio: "1", BurnConversionRatio: "1"}
+	}
+
+	tests := []struct {
+		name     string
+		contract models.Contract
+		err      error
+	}{
+		{name: "no bands", contract: models.Contract{}},
+		{name: "basis without bands", contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT}, err: ERR_BAND_BASIS},
+		{name: "period without bands", contract: models.Contract{BandPeriod: BAND_PERIOD_MONTH}, err: ERR_BAND_BASIS},
+		{
+			name:     "amount bands",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 100, ""), band(100, 500, ""), band(500, 0, "")}},
+		},
+		{
+			name:     "single open band",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 0, "")}},
+		},
+		{
+			name:     "first band not starting at zero",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(10, 100, ""), band(100, 0, "")}},
+			err:      ERR_AMOUNT_BANDS,
+		},
+		{
+			name:     "gap between bands",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 100, ""), band(150, 0, "")}},
+			err:      ERR_AMOUNT_BANDS,
+		},
+		{
+			name:     "empty band",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 0, ""), band(0, 0, "")}},
+			err:      ERR_AMOUNT_BANDS,
+		},
+		{
+			name:     "closed last band",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 100, ""), band(100, 200, "")}},
+			err:      ERR_AMOUNT_BANDS,
+		},
+		{
+			name:     "tier on an amount band",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{band(0, 0, "gold")}},
+			err:      ERR_AMOUNT_BANDS,
+		},
+		{
+			name:     "amount bands with a period",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, BandPeriod: BAND_PERIOD_MONTH, Bands: []models.ContractBand{band(0, 0, "")}},
+			err:      ERR_BAND_BASIS,
+		},
+		{
+			name:     "spend bands with a period",
+			contract: models.Contract{BandBasis: BAND_BASIS_SPEND, BandPeriod: BAND_PERIOD_YEAR, Bands: []models.ContractBand{band(0, 1000, ""), band(1000, 0, "")}},
+		},
+		{
+			name:     "unknown period",
+			contract: models.Contract{BandBasis: BAND_BASIS_SPEND, BandPeriod: "week", Bands: []models.ContractBand{band(0, 0, "")}},
+			err:      ERR_BAND_BASIS,
+		},
+		{
+			name:     "unknown basis",
+			contract: models.Contract{BandBasis: "age", Bands: []models.ContractBand{band(0, 0, "")}},
+			err:      ERR_BAND_BASIS,
+		},
+		{
+			name:     "tier bands",
+			contract: models.Contract{BandBasis: BAND_BASIS_TIER, Bands: []models.ContractBand{band(0, 0, "gold"), band(0, 0, "")}},
+		},
+		{
+			name:     "tier bands without a default",
+			contract: models.Contract{BandBasis: BAND_BASIS_TIER, Bands: []models.ContractBand{band(0, 0, "gold"), band(0, 0, "silver")}},
+			err:      ERR_TIER_BANDS,
+		},
+		{
+			name:     "duplicate tier",
+			contract: models.Contract{BandBasis: BAND_BASIS_TIER, Bands: []models.ContractBand{band(0, 0, "gold"), band(0, 0, " Gold "), band(0, 0, "")}},
+			err:      ERR_TIER_BANDS,
+		},
+		{
+			name:     "tier band with a range",
+			contract: models.Contract{BandBasis: BAND_BASIS_TIER, Bands: []models.ContractBand{band(0, 100, "gold"), band(0, 0, "")}},
+			err:      ERR_TIER_BANDS,
+		},
+		{
+			name:     "tier bands with a period",
+			contract: models.Contract{BandBasis: BAND_BASIS_TIER, BandPeriod: BAND_PERIOD_MONTH, Bands: []models.ContractBand{band(0, 0, "")}},
+			err:      ERR_BAND_BASIS,
+		},
+		{
+			name: "invalid band ratio",
+			contract: models.Contract{BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{
+				{EarnConversionRatio: "0", BurnConversionRatio: "1"},
+			}},
+			err: models.ERR_INVALID_RATIO,
+		},
+		{
+			name: "multiplier band below one",
+			contract: models.Contract{BonusType: BONUS_TYPE_MULTIPLIER, BandBasis: BAND_BASIS_AMOUNT, Bands: []models.ContractBand{
+				{EarnConversionRatio: "1/2", BurnConversionRatio: "1"},
+			}},
+			err: ERR_BONUS_SETTINGS,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateBands(&test.contract); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/loyyal/loyyal-be-contract/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// changes told to every replica by a contract changed event
+const (
+	CONTRACT_CHANGE_CREATED   = "created"
+	CONTRACT_CHANGE_UPDATED   = "updated"
+	CONTRACT_CHANGE_DELETED   = "deleted"
+	CONTRACT_CHANGE_DECIDED   = "decided"
+	CONTRACT_CHANGE_ACTIVATED = "activated"
+	CONTRACT_CHANGE_EXPIRED   = "expired"
+)
+
+const (
+	// wait before the cache is resynced again after a failure, doubled after
+	// every failed attempt up to the max
+	contract_cache_retry     = time.Second
+	contract_cache_retry_max = time.Minute
+)
+
+// contractKey indexes the cached contracts, an empty partner holds the
+// contracts made for every partner of the operator
+type contractKey struct {
+	channel    string
+	operatorId string
+	partnerId  string
+}
+
+// ContractCache keeps the approved contracts of every operator in memory so that
+// pricing a transaction does not query the database. A contract is reloaded on
+// its change event and the whole cache on a periodic resync, lookups go to the
+// database while the cache is not synced. A failed reload or resync is followed
+// by resyncs in the background until one succeeds.
+type ContractCache struct {
+	service ContractService
+
+	mutex     sync.RWMutex
+	index     map[contractKey]map[string]*models.Contract
+	keys      map[string]contractKey
+	synced    bool
+	syncedAt  time.Time
+	resyncing bool
+	// a background resync is retrying after a failure
+	recovering bool
+	// contracts changed while a resync was loading, reloaded once it is done
+	touched map[string]bool
+
+	hits      int64
+	misses    int64
+	refreshes int64
+	resyncs   int64
+	failures  int64
+}
+
+func NewContractCache(service ContractService) *ContractCache {
+	return &ContractCache{
+		service: service,
+		index:   map[contractKey]map[string]*models.Contract{},
+		keys:    map[string]contractKey{},
+		touched: map[string]bool{},
+	}
+}
+
+// Applicable lists the approved contracts of the operator on the channel that
+// are made for the partner or for every partner
+func (cache *ContractCache) Applicable(ctx context.Context, channel string, operatorId string, partnerId string) ([]*models.Contract, error) {
+	fName := "service/contractCache/applicable"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if operatorId == "" {
+		return []*models.Contract{}, nil
+	}
+
+	cache.mutex.RLock()
+	if !cache.synced {
+		cache.mutex.RUnlock()
+		atomic.AddInt64(&cache.misses, 1)
+		span.SetAttributes(attribute.Bool("hit", false))
+		return cache.service.Applicable(ctx, channel, operatorId)
+	}
+
+	contracts := []*models.Contract{}
+	partners := []string{""}
+	if partnerId != "" {
+		partners = append(partners, partnerId)
+	}
+	for _, partner := range partners {
+		for _, contract := range cache.index[contractKey{channel: channel, operatorId: operatorId, partnerId: partner}] {
+			// callers get their own copy, the cached one is shared
+			copied := *contract
+			contracts = append(contracts, &copied)
+		}
+	}
+	cache.mutex.RUnlock()
+
+	atomic.AddInt64(&cache.hits, 1)
+	span.SetAttributes(attribute.Bool("hit", true), attribute.Int("contracts", len(contracts)))
+	return contracts, nil
+}
+
+// Resync reloads every approved contract and replaces the cache with them
+func (cache *ContractCache) Resync(ctx context.Context) error {
+	fName := "service/contractCache/resync"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	cache.mutex.Lock()
+	cache.resyncing = true
+	cache.touched = map[string]bool{}
+	cache.mutex.Unlock()
+
+	contracts, err := cache.service.Approved(ctx)
+	if err != nil {
+		cache.mutex.Lock()
+		cache.resyncing = false
+		cache.synced = false
+		cache.mutex.Unlock()
+		atomic.AddInt64(&cache.failures, 1)
+		cache.recover()
+		return err
+	}
+
+	index := map[contractKey]map[string]*models.Contract{}
+	keys := map[string]contractKey{}
+	for _, contract := range contracts {
+		key := cacheKey(contract)
+		if index[key] == nil {
+			index[key] = map[string]*models.Contract{}
+		}
+		index[key][contract.Identifier] = contract
+		keys[contract.Identifier] = key
+	}
+
+	cache.mutex.Lock()
+	cache.index = index
+	cache.keys = keys
+	cache.synced = true
+	cache.syncedAt = time.Now().UTC()
+	cache.resyncing = false
+	touched := cache.touched
+	cache.touched = map[string]bool{}
+	cache.mutex.Unlock()
+	atomic.AddInt64(&cache.resyncs, 1)
+
+	// a change seen while loading may be newer than what the query returned
+	for contractId := range touched {
+		if err := cache.Refresh(ctx, contractId); err != nil {
+			return err
+		}
+	}
+
+	span.SetAttributes(attribute.Int("contracts", len(contracts)))
+	return nil
+}
+
+// Refresh reloads a contract into the cache, it is dropped once it no longer
+// applies. A failed reload leaves the cache unsynced until a background resync
+// succeeds.
+func (cache *ContractCache) Refresh(ctx context.Context, contractId string) error {
+	fName := "service/contractCache/refresh"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	contract, err := cache.service.GetContract(ctx, contractId)
+	if err != nil && !errors.Is(err, ERR_CONTRACT_NOT_FOUND) {
+		cache.mutex.Lock()
+		cache.synced = false
+		cache.mutex.Unlock()
+		atomic.AddInt64(&cache.failures, 1)
+		cache.recover()
+		return err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.resyncing {
+		cache.touched[contractId] = true
+	}
+	if key, ok := cache.keys[contractId]; ok {
+		delete(cache.index[key], contractId)
+		if len(cache.index[key]) == 0 {
+			delete(cache.index, key)
+		}
+		delete(cache.keys, contractId)
+	}
+	if err == nil && !contract.IsDeleted && (contract.Status == CONTRACT_STATUS_ACTIVE || contract.Status == CONTRACT_STATUS_PENDING) {
+		key := cacheKey(&contract)
+		if cache.index[key] == nil {
+			cache.index[key] = map[string]*models.Contract{}
+		}
+		cache.index[key][contractId] = &contract
+		cache.keys[contractId] = key
+	}
+	atomic.AddInt64(&cache.refreshes, 1)
+	return nil
+}
+
+// recover resyncs the cache in the background until a resync succeeds, the
+// periodic resync may be turned off and the cache would stay unsynced otherwise
+func (cache *ContractCache) recover() {
+	cache.mutex.Lock()
+	if cache.recovering {
+		cache.mutex.Unlock()
+		return
+	}
+	cache.recovering = true
+	cache.mutex.Unlock()
+
+	go func() {
+		wait := contract_cache_retry
+		for {
+			time.Sleep(wait)
+			err := cache.Resync(context.Background())
+			if err == nil {
+				break
+			}
+			fmt.Print("failed to resync the contract cache: %w", err)
+			if wait *= 2; wait > contract_cache_retry_max {
+				wait = contract_cache_retry_max
+			}
+		}
+
+		// a reload failing while the resync was finishing found it recovering
+		cache.mutex.Lock()
+		cache.recovering = false
+		synced := cache.synced
+		cache.mutex.Unlock()
+		if !synced {
+			cache.recover()
+		}
+	}()
+}
+
+// HandleChange reloads the contract of a contract changed event
+func (cache *ContractCache) HandleChange(ctx context.Context, data []byte) {
+	var event models.ContractChangedEvent
+	if err := event.Decode(data); err != nil {
+		fmt.Print("failed to decode the contract changed event: %w", err)
+		return
+	}
+	if err := cache.Refresh(ctx, event.ContractID); err != nil {
+		fmt.Print("failed to refresh the cached contract: %w", err)
+	}
+}
+
+// Metrics tells how the cache has been used since the replica started
+func (cache *ContractCache) Metrics() models.ContractCacheMetrics {
+	cache.mutex.RLock()
+	metrics := models.ContractCacheMetrics{
+		Contracts: len(cache.keys),
+		Synced:    cache.synced,
+		SyncedAt:  cache.syncedAt,
+	}
+	cache.mutex.RUnlock()
+
+	metrics.Hits = atomic.LoadInt64(&cache.hits)
+	metrics.Misses = atomic.LoadInt64(&cache.misses)
+	metrics.Refreshes = atomic.LoadInt64(&cache.refreshes)
+	metrics.Resyncs = atomic.LoadInt64(&cache.resyncs)
+	metrics.Failures = atomic.LoadInt64(&cache.failures)
+	if lookups := metrics.Hits + metrics.Misses; lookups > 0 {
+		metrics.HitRatio = float64(metrics.Hits) / float64(lookups)
+	}
+	return metrics
+}
+
+func cacheKey(contract *models.Contract) contractKey {
+	return contractKey{
+		channel:    contract.Channel,
+		operatorId: string(contract.OperatorId),
+		partnerId:  string(contract.PartnerId),
+	}
+}
@@ -0,0 +1,535 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type ExpiryService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	lot_prefix           = "lot"
+	expiry_policy_prefix = "expiry_policy"
+
+	default_expiry_policy = "default"
+)
+
+const (
+	LOT_STATUS_OPEN     = "open"
+	LOT_STATUS_CONSUMED = "consumed"
+	LOT_STATUS_EXPIRED  = "expired"
+)
+
+const (
+	CONSUMPTION_ORDER_FIFO           = "fifo"
+	CONSUMPTION_ORDER_SOONEST_EXPIRY = "soonest_expiry"
+)
+
+// how the credited side of a transaction is tracked in lots
+const (
+	// LOT_CREDIT_NONE credits are not tracked, for example points redeemed to a partner
+	LOT_CREDIT_NONE = "none"
+	// LOT_CREDIT_ACCRUAL credits open a new lot, for example an issue
+	LOT_CREDIT_ACCRUAL = "accrual"
+	// LOT_CREDIT_CARRY credits keep the expiry dates of the debited lots, for example a transfer
+	LOT_CREDIT_CARRY = "carry"
+)
+
+var (
+	ERR_INVALID_CONSUMPTION_ORDER = errors.New("error: consumption order must be fifo or soonest_expiry")
+	ERR_LOT_NOT_OPEN              = errors.New("error: lot is not open anymore")
+)
+
+func NewExpiry(cluster *gocb.Cluster, bucket *gocb.Bucket) ExpiryService {
+	return ExpiryService{cluster: cluster, bucket: bucket}
+}
+
+// SavePolicy creates or replaces the expiry policy of the operator, there is at
+// most one policy per operator.
+func (service *ExpiryService) SavePolicy(ctx context.Context, policy *models.ExpiryPolicy, sessionedUser string) (string, error) {
+	fName := "service/expiry/savePolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if policy.ConsumptionOrder == "" {
+		policy.ConsumptionOrder = CONSUMPTION_ORDER_FIFO
+	}
+	if policy.ConsumptionOrder != CONSUMPTION_ORDER_FIFO && policy.ConsumptionOrder != CONSUMPTION_ORDER_SOONEST_EXPIRY {
+		return "", ERR_INVALID_CONSUMPTION_ORDER
+	}
+	if policy.ExpiryMonths < 0 {
+		return "", errors.New("error: expiry months can not be negative")
+	}
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+
+	col := service.bucket.DefaultCollection()
+	policy.DocType = "expiry_policy"
+	policy.Identifier = policyKey(policy.OperatorId)
+	policy.CreatedAt = now
+	policy.Creator = sessionedUser
+
+	existing, err := col.Get(expiry_policy_prefix+"/"+policy.Identifier, nil)
+	if err == nil {
+		var previous models.ExpiryPolicy
+		if existing.Content(&previous) == nil && !previous.IsDeleted {
+			policy.CreatedAt = previous.CreatedAt
+			policy.Creator = previous.Creator
+		}
+	}
+
+	policy.IsDeleted = false
+	policy.LastUpdatedAt = now
+	policy.LastUpdatedBy = sessionedUser
+
+	_, err = col.Upsert(expiry_policy_prefix+"/"+policy.Identifier, policy, nil)
+	span.AddEvent("expiry policy saved")
+	return policy.Identifier, err
+}
+
+// GetPolicy returns the policy of the operator, falling back to the default
+// policy. Without any policy the points never expire and are consumed FIFO.
+func (service *ExpiryService) GetPolicy(ctx context.Context, operatorId string) (models.ExpiryPolicy, error) {
+	fName := "service/expiry/getPolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for _, key := range []string{policyKey(operatorId), default_expiry_policy} {
+		doc, err := col.Get(expiry_policy_prefix+"/"+key, nil)
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			continue
+		}
+		if err != nil {
+			return models.ExpiryPolicy{}, err
+		}
+
+		var policy models.ExpiryPolicy
+		err = doc.Content(&policy)
+		if err != nil {
+			return models.ExpiryPolicy{}, err
+		}
+		if !policy.IsDeleted {
+			return policy, nil
+		}
+	}
+
+	return models.ExpiryPolicy{ConsumptionOrder: CONSUMPTION_ORDER_FIFO}, nil
+}
+
+func (service *ExpiryService) DeletePolicy(ctx context.Context, operatorId string, sessionedUser string) error {
+	fName := "service/expiry/deletePolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(expiry_policy_prefix+"/"+policyKey(operatorId), nil)
+	if doc == nil {
+		if err != nil {
+			return errors.New("error: no expiry policy found")
+		}
+	}
+
+	var policy models.ExpiryPolicy
+	err = doc.Content(&policy)
+	if err != nil {
+		return err
+	}
+
+	policy.IsDeleted = true
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	policy.LastUpdatedAt = now
+	policy.LastUpdatedBy = sessionedUser
+
+	_, err = col.Replace(expiry_policy_prefix+"/"+policyKey(operatorId), policy, nil)
+	return err
+}
+
+func (service *ExpiryService) FilterPolicies(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.ExpiryPolicy, error) {
+	fName := "service/expiry/filterPolicies"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='expiry_policy' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []*models.ExpiryPolicy
+	for rows.Next() {
+		var obj models.ExpiryPolicy
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		policies = append(policies, &obj)
+	}
+	defer rows.Close()
+	return policies, rows.Err()
+}
+
+// CreateLot records the points credited to a wallet, expiring at the given date
+// (nil for never).
+func (service *ExpiryService) CreateLot(ctx context.Context, walletId string, transactionId string, amount int64, expiresAt *time.Time) (*models.PointsLot, error) {
+	fName := "service/expiry/createLot"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	now := time.Now().UTC()
+	lot := models.PointsLot{
+		DocType:       "lot",
+		Identifier:    common.GenerateIdentifier(30),
+		WalletId:      walletId,
+		TransactionId: transactionId,
+		Amount:        amount,
+		Remaining:     amount,
+		AccruedAt:     now,
+		ExpiresAt:     expiresAt,
+		Status:        LOT_STATUS_OPEN,
+		CreatedAt:     now,
+		LastUpdatedAt: now,
+	}
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Insert(lot_prefix+"/"+lot.Identifier, lot, nil)
+	span.AddEvent("lot created")
+	return &lot, err
+}
+
+// ConsumeLots takes the amount out of the open lots of the wallet, in the given
+// order. Points not backed by lots (for example a preloaded balance) are not
+// tracked, so the consumed amount can be less than the requested amount.
+func (service *ExpiryService) ConsumeLots(ctx context.Context, walletId string, amount int64, order string) ([]models.LotConsumption, error) {
+	fName := "service/expiry/consumeLots"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	sortBy := "STR_TO_MILLIS(accruedAt)"
+	if order == CONSUMPTION_ORDER_SOONEST_EXPIRY {
+		// lots without an expiry date are used last
+		sortBy = "expiresAt IS MISSING, STR_TO_MILLIS(expiresAt), STR_TO_MILLIS(accruedAt)"
+	}
+
+	lots, err := service.FilterLots(ctx, "AND walletId=$walletId AND status=$status", map[string]interface{}{
+		"walletId": walletId,
+		"status":   LOT_STATUS_OPEN,
+	}, sortBy, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	consumed := []models.LotConsumption{}
+	col := service.bucket.DefaultCollection()
+	for _, lot := range lots {
+		if amount <= 0 {
+			break
+		}
+
+		// lots can be touched concurrently (expiry job, parallel debits), so each
+		// one is re-read and replaced with CAS
+		for attempt := 0; attempt < 3; attempt++ {
+			doc, err := col.Get(lot_prefix+"/"+lot.Identifier, nil)
+			if err != nil {
+				return consumed, err
+			}
+
+			var current models.PointsLot
+			err = doc.Content(&current)
+			if err != nil {
+				return consumed, err
+			}
+			if current.Status != LOT_STATUS_OPEN || current.Remaining <= 0 {
+				break
+			}
+
+			taken := current.Remaining
+			if taken > amount {
+				taken = amount
+			}
+			current.Remaining -= taken
+			if current.Remaining == 0 {
+				current.Status = LOT_STATUS_CONSUMED
+			}
+			current.LastUpdatedAt = time.Now().UTC()
+
+			_, err = col.Replace(lot_prefix+"/"+current.Identifier, current, &gocb.ReplaceOptions{Cas: doc.Cas()})
+			if errors.Is(err, gocb.ErrCasMismatch) {
+				continue
+			}
+			if err != nil {
+				return consumed, err
+			}
+
+			amount -= taken
+			consumed = append(consumed, models.LotConsumption{LotId: current.Identifier, Amount: taken, ExpiresAt: current.ExpiresAt})
+			break
+		}
+	}
+
+	span.SetAttributes(attribute.Int("lots consumed", len(consumed)))
+	return consumed, nil
+}
+
+// ApplyToLots reflects the transaction on the lots of both wallets. The debited
+// wallet gives up its lots in the given order, the credited wallet gets lots as
+// per the credit kind. A carry without a debited wallet carries the given lots
+// instead. Points not covered by carried lots are accrued with the given expiry
+// date. The lots taken from the debited wallet are returned.
+func (service *ExpiryService) ApplyToLots(ctx context.Context, transaction *models.Transaction, order string, credit string, carried []models.LotConsumption, accrualExpiry *time.Time) ([]models.LotConsumption, error) {
+	fName := "service/expiry/applyToLots"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	consumed := []models.LotConsumption{}
+	if transaction.FromExtID != "" {
+		lots, err := service.ConsumeLots(ctx, transaction.FromExtID, transaction.Amount, order)
+		if err != nil {
+			return nil, err
+		}
+		consumed = lots
+		carried = lots
+	}
+
+	if transaction.ToExtID == "" || credit == LOT_CREDIT_NONE {
+		return consumed, nil
+	}
+
+	remaining := transaction.Amount
+	if credit == LOT_CREDIT_CARRY {
+		for _, lot := range carried {
+			amount := lot.Amount
+			if amount > remaining {
+				amount = remaining
+			}
+			if amount <= 0 {
+				break
+			}
+			if _, err := service.CreateLot(ctx, transaction.ToExtID, transaction.ExtID, amount, lot.ExpiresAt); err != nil {
+				return consumed, err
+			}
+			remaining -= amount
+		}
+	}
+
+	if remaining > 0 {
+		if _, err := service.CreateLot(ctx, transaction.ToExtID, transaction.ExtID, remaining, accrualExpiry); err != nil {
+			return consumed, err
+		}
+	}
+
+	span.AddEvent("lots updated")
+	return consumed, nil
+}
+
+// LapsedLots returns the open lots whose expiry date has passed
+func (service *ExpiryService) LapsedLots(ctx context.Context, at time.Time, limit int) ([]*models.PointsLot, error) {
+	return service.FilterLots(ctx, "AND status=$status AND expiresAt IS VALUED AND STR_TO_MILLIS(expiresAt) <= $at AND remaining > 0", map[string]interface{}{
+		"status": LOT_STATUS_OPEN,
+		"at":     at.UnixMilli(),
+	}, "STR_TO_MILLIS(expiresAt)", limit)
+}
+
+// MarkExpired closes the lot and returns the points that lapsed. Only one caller
+// can expire a lot, others get ERR_LOT_NOT_OPEN.
+func (service *ExpiryService) MarkExpired(ctx context.Context, lotId string, expiryTransactionId string) (models.PointsLot, int64, error) {
+	fName := "service/expiry/markExpired"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(lot_prefix+"/"+lotId, nil)
+		if err != nil {
+			return models.PointsLot{}, 0, err
+		}
+
+		var lot models.PointsLot
+		err = doc.Content(&lot)
+		if err != nil {
+			return models.PointsLot{}, 0, err
+		}
+		if lot.Status != LOT_STATUS_OPEN {
+			return lot, 0, ERR_LOT_NOT_OPEN
+		}
+
+		lapsed := lot.Remaining
+		lot.Remaining = 0
+		lot.Status = LOT_STATUS_EXPIRED
+		lot.ExpiryTransactionId = expiryTransactionId
+		lot.LastUpdatedAt = time.Now().UTC()
+
+		_, err = col.Replace(lot_prefix+"/"+lotId, lot, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		if err != nil {
+			return lot, 0, err
+		}
+
+		span.AddEvent("lot expired")
+		return lot, lapsed, nil
+	}
+
+	return models.PointsLot{}, 0, errors.New("error: lot is being modified concurrently, try again")
+}
+
+// ReopenLot gives the lapsed points back to a lot whose expiry transaction could
+// not be created, so that the next run expires it again
+func (service *ExpiryService) ReopenLot(ctx context.Context, lotId string, expiryTransactionId string, remaining int64) error {
+	fName := "service/expiry/reopenLot"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(lot_prefix+"/"+lotId, nil)
+		if err != nil {
+			return err
+		}
+
+		var lot models.PointsLot
+		err = doc.Content(&lot)
+		if err != nil {
+			return err
+		}
+		// only the run that expired the lot can reopen it
+		if lot.Status != LOT_STATUS_EXPIRED || lot.ExpiryTransactionId != expiryTransactionId {
+			return nil
+		}
+
+		lot.Remaining = remaining
+		lot.Status = LOT_STATUS_OPEN
+		lot.ExpiryTransactionId = ""
+		lot.LastUpdatedAt = time.Now().UTC()
+
+		_, err = col.Replace(lot_prefix+"/"+lotId, lot, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		span.AddEvent("lot reopened")
+		return nil
+	}
+
+	return errors.New("error: lot is being modified concurrently, try again")
+}
+
+// UpcomingExpiry returns the points of the wallet that will lapse, summed per day
+func (service *ExpiryService) UpcomingExpiry(ctx context.Context, walletId string) ([]models.ExpirySchedule, error) {
+	fName := "service/expiry/upcomingExpiry"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select SUBSTR(expiresAt, 0, 10) as expiresOn, SUM(remaining) as amount from `testbucket`.`_default`.`_default` data " +
+		"where type='lot' AND walletId=$walletId AND status=$status AND expiresAt IS VALUED AND remaining > 0 " +
+		"group by SUBSTR(expiresAt, 0, 10) order by expiresOn"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"walletId": walletId,
+			"status":   LOT_STATUS_OPEN,
+		}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := []models.ExpirySchedule{}
+	for rows.Next() {
+		var obj models.ExpirySchedule
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, obj)
+	}
+	defer rows.Close()
+	return schedule, rows.Err()
+}
+
+func (service *ExpiryService) FilterLots(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.PointsLot, error) {
+	fName := "service/expiry/filterLots"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='lot' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var lots []*models.PointsLot
+	for rows.Next() {
+		var obj models.PointsLot
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		lots = append(lots, &obj)
+	}
+	defer rows.Close()
+	return lots, rows.Err()
+}
+
+// ExpiryDate returns when points accrued at the given time lapse, nil for never
+func ExpiryDate(accruedAt time.Time, expiryMonths int64) *time.Time {
+	if expiryMonths <= 0 {
+		return nil
+	}
+	expiresAt := accruedAt.UTC().AddDate(0, int(expiryMonths), 0)
+	return &expiresAt
+}
+
+func policyKey(operatorId string) string {
+	if operatorId == "" {
+		return default_expiry_policy
+	}
+	return operatorId
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryDate(t *testing.T) {
+	tests := []struct {
+		name      string
+		accruedAt time.Time
+		months    int64
+		expiresAt *time.Time
+	}{
+		{name: "never", accruedAt: time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), months: 0},
+		{name: "negative months", accruedAt: time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), months: -1},
+		{name: "a year", accruedAt: time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), months: 12, expiresAt: ptr(time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC))},
+		{name: "month end overflows", accruedAt: time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC), months: 1, expiresAt: ptr(time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC))},
+		{name: "counted in utc", accruedAt: time.Date(2024, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), months: 1, expiresAt: ptr(time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expiresAt := ExpiryDate(test.accruedAt, test.months)
+			switch {
+			case expiresAt == nil && test.expiresAt == nil:
+			case expiresAt == nil || test.expiresAt == nil:
+				t.Errorf("got %v, want %v", expiresAt, test.expiresAt)
+			case !expiresAt.Equal(*test.expiresAt) || expiresAt.Location() != time.UTC:
+				t.Errorf("got %s, want %s", expiresAt, test.expiresAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type FxService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	fx_rate_prefix = "fx_rate"
+
+	FX_SOURCE_API = "api"
+	FX_SOURCE_CSV = "csv"
+
+	// rates loaded from a single file
+	FX_MAX_ROWS = 10000
+)
+
+// columns of a csv rate file
+var fxColumns = []string{"from", "to", "rate", "effectiveFrom"}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+var (
+	ERR_INVALID_CURRENCY   = errors.New("error: currency must be a three letter ISO 4217 code")
+	ERR_FX_SAME_CURRENCY   = errors.New("error: a rate must convert between two different currencies")
+	ERR_FX_EFFECTIVE_FROM  = errors.New("error: a rate must have the time it is effective from")
+	ERR_FX_RATE_NOT_FOUND  = errors.New("error: no exchange rate is effective for the currencies")
+	ERR_FX_FILE_EMPTY      = errors.New("error: rate file has no rows")
+	ERR_FX_FILE_TOO_LARGE  = fmt.Errorf("error: rate file can not have more than %d rows", FX_MAX_ROWS)
+	ERR_FX_MISSING_COLUMNS = errors.New("error: rate csv header must have the from, to, rate and effectiveFrom columns")
+	ERR_FX_RATE_UNKNOWN    = errors.New("error: no exchange rate found")
+)
+
+func NewFx(cluster *gocb.Cluster, bucket *gocb.Bucket) FxService {
+	return FxService{cluster: cluster, bucket: bucket}
+}
+
+// IsCurrency tells if the code is an ISO 4217 currency code
+func IsCurrency(code string) bool {
+	return currencyPattern.MatchString(code)
+}
+
+// SaveRate stores the rate of the pair effective from its time, a rate of the
+// same pair and time is replaced
+func (service *FxService) SaveRate(ctx context.Context, rate *models.FxRate, sessionedUser string) (string, error) {
+	fName := "service/fx/saveRate"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if err := validateFxRate(rate); err != nil {
+		return "", err
+	}
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+
+	col := service.bucket.DefaultCollection()
+	rate.DocType = "fx_rate"
+	rate.Identifier = fxRateId(rate.From, rate.To, rate.EffectiveFrom)
+	rate.Creator = sessionedUser
+	rate.CreatedAt = now
+	if existing, err := col.Get(fx_rate_prefix+"/"+rate.Identifier, nil); err == nil {
+		var previous models.FxRate
+		if existing.Content(&previous) == nil {
+			rate.Creator = previous.Creator
+			rate.CreatedAt = previous.CreatedAt
+		}
+	}
+	rate.IsDeleted = false
+	rate.LastUpdatedAt = now
+	rate.LastUpdatedBy = sessionedUser
+
+	_, err := col.Upsert(fx_rate_prefix+"/"+rate.Identifier, rate, nil)
+	span.AddEvent("fx rate saved")
+	return rate.Identifier, err
+}
+
+// DeleteRate takes the rate out, the rate before it is effective again
+func (service *FxService) DeleteRate(ctx context.Context, rateId string, sessionedUser string) error {
+	fName := "service/fx/deleteRate"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(fx_rate_prefix+"/"+rateId, nil)
+	if err != nil {
+		return ERR_FX_RATE_UNKNOWN
+	}
+	var rate models.FxRate
+	if err := doc.Content(&rate); err != nil {
+		return err
+	}
+	if rate.IsDeleted {
+		return ERR_FX_RATE_UNKNOWN
+	}
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	rate.IsDeleted = true
+	rate.LastUpdatedAt = now
+	rate.LastUpdatedBy = sessionedUser
+
+	_, err = col.Replace(fx_rate_prefix+"/"+rateId, rate, &gocb.ReplaceOptions{Cas: doc.Cas()})
+	span.AddEvent("fx rate deleted")
+	return err
+}
+
+// Rate is the rate of the pair effective at the time, the last one that became
+// effective before it
+func (service *FxService) Rate(ctx context.Context, from string, to string, at time.Time) (models.FxRate, error) {
+	fName := "service/fx/rate"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	rates, err := service.FilterRates(ctx, "AND isDeleted=false AND `from`=$from AND `to`=$to AND STR_TO_MILLIS(effectiveFrom) <= STR_TO_MILLIS($at)", map[string]interface{}{
+		"from": strings.ToUpper(from),
+		"to":   strings.ToUpper(to),
+		"at":   at.UTC().Format(time.RFC3339Nano),
+	}, "STR_TO_MILLIS(effectiveFrom) desc", 1)
+	if err != nil {
+		return models.FxRate{}, err
+	}
+	if len(rates) == 0 {
+		return models.FxRate{}, fmt.Errorf("%w: %s to %s", ERR_FX_RATE_NOT_FOUND, from, to)
+	}
+
+	span.SetAttributes(attribute.String("rate", rates[0].Identifier))
+	return *rates[0], nil
+}
+
+func (service *FxService) FilterRates(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.FxRate, error) {
+	fName := "service/fx/filterRates"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='fx_rate' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	rates := []*models.FxRate{}
+	for rows.Next() {
+		var obj models.FxRate
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		rates = append(rates, &obj)
+	}
+	defer rows.Close()
+	return rates, rows.Err()
+}
+
+// ParseFxFile reads the rates of a csv file with a from, to, rate and
+// effectiveFrom column, the lines with errors are left out of the returned
+// rates. An error is returned when the file as a whole can not be read.
+func ParseFxFile(reader io.Reader) ([]*models.FxRate, []models.FxRateError, error) {
+	r := csv.NewReader(reader)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, ERR_FX_FILE_EMPTY
+		}
+		return nil, nil, err
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		for _, column := range fxColumns {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index[column] = i
+			}
+		}
+	}
+	for _, column := range fxColumns {
+		if _, ok := index[column]; !ok {
+			return nil, nil, ERR_FX_MISSING_COLUMNS
+		}
+	}
+
+	value := func(record []string, column string) string {
+		i := index[column]
+		if i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rates := []*models.FxRate{}
+	rateErrors := []models.FxRateError{}
+	for line := int64(2); ; line++ {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if len(rates)+len(rateErrors) >= FX_MAX_ROWS {
+			return nil, nil, ERR_FX_FILE_TOO_LARGE
+		}
+		if err != nil {
+			rateErrors = append(rateErrors, models.FxRateError{Line: line, Error: "error: " + err.Error()})
+			continue
+		}
+
+		rate := &models.FxRate{
+			From:   strings.ToUpper(value(record, "from")),
+			To:     strings.ToUpper(value(record, "to")),
+			Source: FX_SOURCE_CSV,
+		}
+		rate.Rate, err = models.ParseRatio(value(record, "rate"))
+		if err != nil {
+			rateErrors = append(rateErrors, models.FxRateError{Line: line, Error: err.Error()})
+			continue
+		}
+		rate.EffectiveFrom, err = time.Parse(time.RFC3339, value(record, "effectiveFrom"))
+		if err != nil {
+			// a date alone is effective from the start of the day
+			rate.EffectiveFrom, err = time.Parse("2006-01-02", value(record, "effectiveFrom"))
+		}
+		if err != nil {
+			rateErrors = append(rateErrors, models.FxRateError{Line: line, Error: "error: effectiveFrom must be a date or an RFC 3339 time"})
+			continue
+		}
+		if err := validateFxRate(rate); err != nil {
+			rateErrors = append(rateErrors, models.FxRateError{Line: line, Error: err.Error()})
+			continue
+		}
+		rates = append(rates, rate)
+	}
+	if len(rates)+len(rateErrors) == 0 {
+		return nil, nil, ERR_FX_FILE_EMPTY
+	}
+	return rates, rateErrors, nil
+}
+
+func validateFxRate(rate *models.FxRate) error {
+	rate.From = strings.ToUpper(strings.TrimSpace(rate.From))
+	rate.To = strings.ToUpper(strings.TrimSpace(rate.To))
+	if !IsCurrency(rate.From) || !IsCurrency(rate.To) {
+		return ERR_INVALID_CURRENCY
+	}
+	if rate.From == rate.To {
+		return ERR_FX_SAME_CURRENCY
+	}
+	if r := rate.Rate.Rat(); r == nil || r.Sign() <= 0 {
+		return models.ERR_INVALID_RATIO
+	}
+	if rate.EffectiveFrom.IsZero() {
+		return ERR_FX_EFFECTIVE_FROM
+	}
+	rate.EffectiveFrom = rate.EffectiveFrom.UTC()
+	return nil
+}
+
+func fxRateId(from string, to string, effectiveFrom time.Time) string {
+	return from + "_" + to + "_" + strconv.FormatInt(effectiveFrom.UTC().Unix(), 10)
+}
+
+// Amount is the amount of a transaction in its currency along with the rates
+// converting it into the currency of the contracts, by contract currency. An
+// amount without a currency is in the currency of every contract.
+type Amount struct {
+	Value    int64
+	Currency string
+	Rates    map[string]models.FxRate
+}
+
+// rate is the rate converting the amount into the currency of the contract,
+// nil when it is already in that currency
+func (amount Amount) rate(contract *models.Contract) (*models.FxRate, error) {
+	if amount.Currency == "" || contract.ConversionCurrency == "" || strings.EqualFold(amount.Currency, contract.ConversionCurrency) {
+		return nil, nil
+	}
+	rate, ok := amount.Rates[strings.ToUpper(contract.ConversionCurrency)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s to %s", ERR_FX_RATE_NOT_FOUND, amount.Currency, contract.ConversionCurrency)
+	}
+	return &rate, nil
+}
+
+// in is the amount in the currency of the contract, rounded down
+func (amount Amount) in(contract *models.Contract) (int64, error) {
+	rate, err := amount.rate(contract)
+	if err != nil || rate == nil {
+		return amount.Value, err
+	}
+	converted := new(big.Rat).Mul(big.NewRat(amount.Value, 1), rate.Rate.Rat())
+	return new(big.Int).Quo(converted.Num(), converted.Denom()).Int64(), nil
+}
+
+// priceAmount prices the amount with the ratio of the contract, an amount in
+// another currency is converted into the currency of the contract first. The
+// conversion and the ratio are applied as one exact fraction so that the points
+// are rounded once.
+func priceAmount(contract *models.Contract, amount Amount, ratio models.Ratio) (models.Pricing, error) {
+	rate, err := amount.rate(contract)
+	if err != nil {
+		return models.Pricing{}, err
+	}
+	if rate == nil || ratio.Rat() == nil {
+		return Price(amount.Value, ratio, contract.RoundingMode, contract.MinPoints, contract.MaxPoints)
+	}
+
+	converted := new(big.Rat).Mul(ratio.Rat(), rate.Rate.Rat())
+	pricing, err := Price(amount.Value, models.Ratio(converted.RatString()), contract.RoundingMode, contract.MinPoints, contract.MaxPoints)
+	if err != nil {
+		return pricing, err
+	}
+	pricing.Ratio = ratio
+	pricing.Currency = strings.ToUpper(amount.Currency)
+	pricing.ContractCurrency = strings.ToUpper(contract.ConversionCurrency)
+	pricing.FxRateId = rate.Identifier
+	pricing.FxRate = rate.Rate
+	pricing.ConvertedAmount = new(big.Rat).Mul(big.NewRat(amount.Value, 1), rate.Rate.Rat()).RatString()
+	return pricing, nil
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"go.opentelemetry.io/otel"
+)
+
+type IdempotencyService struct {
+	cluster   *gocb.Cluster
+	bucket    *gocb.Bucket
+	retention time.Duration
+}
+
+const (
+	idempotency_prefix = "idempotency"
+)
+
+const (
+	IDEMPOTENCY_STATUS_PROCESSING = "processing"
+	IDEMPOTENCY_STATUS_COMPLETED  = "completed"
+
+	// DEFAULT_IDEMPOTENCY_RETENTION is used when no retention period is configured
+	DEFAULT_IDEMPOTENCY_RETENTION = 24 * time.Hour
+
+	// a reservation not completed within the lease belongs to a request that
+	// died, it is taken over by the next retry
+	idempotency_lease = 2 * time.Minute
+)
+
+var (
+	ERR_IDEMPOTENCY_KEY_REUSED      = errors.New("error: idempotency key already used with a different request")
+	ERR_IDEMPOTENCY_KEY_IN_PROGRESS = errors.New("error: a request with this idempotency key is still in progress")
+)
+
+func NewIdempotency(cluster *gocb.Cluster, bucket *gocb.Bucket, retention time.Duration) IdempotencyService {
+	if retention <= 0 {
+		retention = DEFAULT_IDEMPOTENCY_RETENTION
+	}
+	return IdempotencyService{cluster: cluster, bucket: bucket, retention: retention}
+}
+
+// Reserve claims the key for the calling request. It returns nil when the key is
+// new and the request should be processed, or the stored record when the same
+// request was already completed and its response should be replayed.
+func (service *IdempotencyService) Reserve(ctx context.Context, scope string, key string, fingerprint string) (*models.IdempotencyRecord, error) {
+	fName := "service/idempotency/reserve"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	now := time.Now().UTC()
+	record := models.IdempotencyRecord{
+		DocType:     "idempotency",
+		Key:         key,
+		Scope:       scope,
+		Fingerprint: fingerprint,
+		Status:      IDEMPOTENCY_STATUS_PROCESSING,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(service.retention),
+		LeaseUntil:  now.Add(idempotency_lease),
+	}
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Insert(idempotencyDocId(scope, key), record, &gocb.InsertOptions{Expiry: service.retention})
+	if err == nil {
+		span.AddEvent("idempotency key reserved")
+		return nil, nil
+	}
+	if !errors.Is(err, gocb.ErrDocumentExists) {
+		return nil, err
+	}
+
+	doc, err := col.Get(idempotencyDocId(scope, key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing models.IdempotencyRecord
+	err = doc.Content(&existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.Fingerprint != fingerprint {
+		return nil, ERR_IDEMPOTENCY_KEY_REUSED
+	}
+	if existing.Status != IDEMPOTENCY_STATUS_COMPLETED {
+		if existing.LeaseUntil.IsZero() || now.Before(existing.LeaseUntil) {
+			return nil, ERR_IDEMPOTENCY_KEY_IN_PROGRESS
+		}
+		// the request holding the key died, the retry takes it over
+		existing.LeaseUntil = now.Add(idempotency_lease)
+		_, err = col.Replace(idempotencyDocId(scope, key), existing, &gocb.ReplaceOptions{
+			Cas:    doc.Cas(),
+			Expiry: time.Until(existing.ExpiresAt),
+		})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			return nil, ERR_IDEMPOTENCY_KEY_IN_PROGRESS
+		}
+		if err != nil {
+			return nil, err
+		}
+		span.AddEvent("idempotency key taken over")
+		return nil, nil
+	}
+
+	span.AddEvent("idempotency key replayed")
+	return &existing, nil
+}
+
+// Complete stores the response of the request that reserved the key.
+func (service *IdempotencyService) Complete(ctx context.Context, scope string, key string, responseCode int, responseBody []byte) error {
+	fName := "service/idempotency/complete"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(idempotencyDocId(scope, key), nil)
+	if err != nil {
+		return err
+	}
+
+	var record models.IdempotencyRecord
+	err = doc.Content(&record)
+	if err != nil {
+		return err
+	}
+
+	record.Status = IDEMPOTENCY_STATUS_COMPLETED
+	record.ResponseCode = responseCode
+	record.ResponseBody = responseBody
+
+	_, err = col.Replace(idempotencyDocId(scope, key), record, &gocb.ReplaceOptions{
+		Cas:    doc.Cas(),
+		Expiry: time.Until(record.ExpiresAt),
+	})
+	return err
+}
+
+// Release drops the reservation so that a failed request can be retried with the same key.
+func (service *IdempotencyService) Release(ctx context.Context, scope string, key string) error {
+	fName := "service/idempotency/release"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Remove(idempotencyDocId(scope, key), nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	return err
+}
+
+// the key is hashed as it is user supplied and may exceed the document id limits
+func idempotencyDocId(scope string, key string) string {
+	sum := sha256.Sum256([]byte(scope + "/" + key))
+	return idempotency_prefix + "/" + hex.EncodeToString(sum[:])
+}
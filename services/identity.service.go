@@ -136,7 +136,7 @@ func (service *IdentityService) Create(ctx context.Context, identity *models.Ide
 
 }
 
-func (service *IdentityService) Get(ctx context.Context, identityId string) (any, error) {
+func (service *IdentityService) Get(ctx context.Context, identityId string) (models.Identity, error) {
 	fName := "service/identity/get"
 	tracer := otel.Tracer("api")
 	_, span := tracer.Start(ctx, fName)
@@ -146,14 +146,14 @@ func (service *IdentityService) Get(ctx context.Context, identityId string) (any
 	doc, err := col.Get(identity_prefix+"/"+identityId, nil)
 	if doc == nil {
 		if err != nil {
-			return nil, errors.New("error: no user found")
+			return models.Identity{}, errors.New("error: no user found")
 		}
 	}
 
 	var identity models.Identity
 	doc.Content(&identity)
 	if err != nil {
-		return nil, err
+		return models.Identity{}, err
 	}
 
 	identity.Password = ""
@@ -192,6 +192,77 @@ func (service *IdentityService) Update(ctx context.Context, identityId string, p
 	return err
 }
 
+// SetTier sets the tier of the member, an empty tier removes it
+func (service *IdentityService) SetTier(ctx context.Context, identityId string, tier string, sessionedUser string) error {
+	fName := "service/identity/setTier"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(identity_prefix+"/"+identityId, nil)
+	if err != nil {
+		return errors.New("error: no user found")
+	}
+
+	var identity models.Identity
+	if err := doc.Content(&identity); err != nil {
+		return err
+	}
+
+	identity.Tier = tier
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	identity.LastUpdatedAt = now
+	identity.LastUpdatedBy = sessionedUser
+
+	_, err = col.Replace(identity_prefix+"/"+identityId, identity, &gocb.ReplaceOptions{Cas: doc.Cas()})
+	return err
+}
+
+// SetWalletRef records the role of the identity on the wallet, an empty role
+// removes the wallet from the identity
+func (service *IdentityService) SetWalletRef(ctx context.Context, identityId string, walletId string, role string) error {
+	fName := "service/identity/setWalletRef"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(identity_prefix+"/"+identityId, nil)
+		if err != nil {
+			return errors.New("error: no identity found")
+		}
+
+		var identity models.Identity
+		err = doc.Content(&identity)
+		if err != nil {
+			return err
+		}
+
+		wallets := []models.WalletRef{}
+		for _, ref := range identity.Wallets {
+			if ref.Ref != walletId {
+				wallets = append(wallets, ref)
+			}
+		}
+		if role != "" {
+			wallets = append(wallets, models.WalletRef{Ref: walletId, Role: role})
+		}
+		identity.Wallets = wallets
+
+		_, err = col.Replace(identity_prefix+"/"+identityId, identity, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		span.AddEvent("identity wallet reference updated")
+		return err
+	}
+
+	return errors.New("error: identity is being modified concurrently, try again")
+}
+
 func (service *IdentityService) Delete(ctx context.Context, identityId string, sessionedUser string) error {
 	fName := "service/identity/delete"
 	tracer := otel.Tracer("api")
@@ -0,0 +1,446 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type LimitService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	limit_policy_prefix  = "limit_policy"
+	limit_counter_prefix = "limit_counter"
+)
+
+const (
+	LIMIT_DIRECTION_EARN = "earn"
+	LIMIT_DIRECTION_BURN = "burn"
+
+	LIMIT_METRIC_EARN  = "earn"
+	LIMIT_METRIC_BURN  = "burn"
+	LIMIT_METRIC_COUNT = "count"
+
+	LIMIT_WINDOW_DAILY   = "daily"
+	LIMIT_WINDOW_WEEKLY  = "weekly"
+	LIMIT_WINDOW_MONTHLY = "monthly"
+)
+
+var limitWindows = []string{LIMIT_WINDOW_DAILY, LIMIT_WINDOW_WEEKLY, LIMIT_WINDOW_MONTHLY}
+
+// LimitError is returned when a transaction goes over a limit, Code tells which
+// one, for example daily_burn_limit_exceeded
+type LimitError struct {
+	Code      string
+	PolicyId  string
+	Limit     int64
+	Remaining int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("error: %s: limit of %d set by the policy %s, %d remaining", e.Code, e.Limit, e.PolicyId, e.Remaining)
+}
+
+const LIMIT_CODE_SINGLE_AMOUNT = "single_amount_limit_exceeded"
+
+// LimitReservation holds the counters taken by a transaction so that they can
+// be given back when the transaction is not accepted
+type LimitReservation struct {
+	counters map[string]int64
+}
+
+// Counters are the counters taken with the amount taken from each, they are
+// kept with the transaction to give them back once it is rejected or reversed
+func (reservation *LimitReservation) Counters() map[string]int64 {
+	counters := map[string]int64{}
+	if reservation == nil {
+		return counters
+	}
+	for key, delta := range reservation.counters {
+		counters[key] = delta
+	}
+	return counters
+}
+
+func NewLimit(cluster *gocb.Cluster, bucket *gocb.Bucket) LimitService {
+	return LimitService{cluster: cluster, bucket: bucket}
+}
+
+func (service *LimitService) SavePolicy(ctx context.Context, policy *models.LimitPolicy, sessionedUser string) (string, error) {
+	fName := "service/limit/savePolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	for _, caps := range []models.LimitCaps{policy.Daily, policy.Weekly, policy.Monthly} {
+		if caps.Earn < 0 || caps.Burn < 0 || caps.Count < 0 {
+			return "", errors.New("error: limits can not be negative")
+		}
+	}
+	if policy.MaxSingleAmount < 0 {
+		return "", errors.New("error: limits can not be negative")
+	}
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+
+	col := service.bucket.DefaultCollection()
+	policy.DocType = "limit_policy"
+	policy.CreatedAt = now
+	policy.Creator = sessionedUser
+	if policy.Identifier == "" {
+		policy.Identifier = common.GenerateIdentifier(30)
+	} else {
+		existing, err := col.Get(limit_policy_prefix+"/"+policy.Identifier, nil)
+		if err != nil {
+			return "", errors.New("error: no limit policy found")
+		}
+		var previous models.LimitPolicy
+		if existing.Content(&previous) == nil {
+			policy.CreatedAt = previous.CreatedAt
+			policy.Creator = previous.Creator
+		}
+	}
+
+	policy.IsDeleted = false
+	policy.LastUpdatedAt = now
+	policy.LastUpdatedBy = sessionedUser
+
+	_, err := col.Upsert(limit_policy_prefix+"/"+policy.Identifier, policy, nil)
+	span.AddEvent("limit policy saved")
+	return policy.Identifier, err
+}
+
+func (service *LimitService) GetPolicy(ctx context.Context, policyId string) (models.LimitPolicy, error) {
+	fName := "service/limit/getPolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(limit_policy_prefix+"/"+policyId, nil)
+	if err != nil {
+		return models.LimitPolicy{}, errors.New("error: no limit policy found")
+	}
+
+	var policy models.LimitPolicy
+	err = doc.Content(&policy)
+	if err != nil {
+		return models.LimitPolicy{}, err
+	}
+	if policy.IsDeleted {
+		return models.LimitPolicy{}, errors.New("error: no limit policy found")
+	}
+	return policy, nil
+}
+
+func (service *LimitService) DeletePolicy(ctx context.Context, policyId string, sessionedUser string) error {
+	fName := "service/limit/deletePolicy"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	policy, err := service.GetPolicy(ctx, policyId)
+	if err != nil {
+		return err
+	}
+
+	policy.IsDeleted = true
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+	policy.LastUpdatedAt = now
+	policy.LastUpdatedBy = sessionedUser
+
+	col := service.bucket.DefaultCollection()
+	_, err = col.Replace(limit_policy_prefix+"/"+policyId, policy, nil)
+	span.AddEvent("limit policy deleted")
+	return err
+}
+
+func (service *LimitService) FilterPolicies(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.LimitPolicy, error) {
+	fName := "service/limit/filterPolicies"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='limit_policy' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []*models.LimitPolicy{}
+	for rows.Next() {
+		var obj models.LimitPolicy
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		policies = append(policies, &obj)
+	}
+	defer rows.Close()
+	return policies, rows.Err()
+}
+
+// MatchingPolicies returns the policies that apply to the wallet
+func (service *LimitService) MatchingPolicies(ctx context.Context, subject models.LimitSubject) ([]*models.LimitPolicy, error) {
+	policies, err := service.FilterPolicies(ctx, "AND isDeleted=false"+
+		" AND (operatorId='' OR operatorId=$operatorId)"+
+		" AND (walletType='' OR walletType=$walletType)", map[string]interface{}{
+		"operatorId": subject.OperatorId,
+		"walletType": subject.WalletType,
+	}, "createdAt", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []*models.LimitPolicy{}
+	for _, policy := range policies {
+		if policy.IdentityType == "" {
+			matching = append(matching, policy)
+			continue
+		}
+		for _, identityType := range subject.IdentityTypes {
+			if identityType == policy.IdentityType {
+				matching = append(matching, policy)
+				break
+			}
+		}
+	}
+	return matching, nil
+}
+
+// Reserve counts the transaction against the limits of the wallet. The counters
+// are shared by every replica, a transaction that goes over a limit is taken
+// back out of them before the error is returned.
+func (service *LimitService) Reserve(ctx context.Context, subject models.LimitSubject, direction string, amount int64) (*LimitReservation, error) {
+	fName := "service/limit/reserve"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	reservation := &LimitReservation{counters: map[string]int64{}}
+	policies, err := service.MatchingPolicies(ctx, subject)
+	if err != nil || len(policies) == 0 {
+		return reservation, err
+	}
+
+	for _, policy := range policies {
+		if policy.MaxSingleAmount > 0 && amount > policy.MaxSingleAmount {
+			return reservation, &LimitError{Code: LIMIT_CODE_SINGLE_AMOUNT, PolicyId: policy.Identifier, Limit: policy.MaxSingleAmount, Remaining: policy.MaxSingleAmount}
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, window := range limitWindows {
+		for _, metric := range []string{direction, LIMIT_METRIC_COUNT} {
+			delta := amount
+			if metric == LIMIT_METRIC_COUNT {
+				delta = 1
+			}
+
+			key := counterKey(subject.WalletId, metric, window, now)
+			used, err := service.increment(key, delta, window)
+			if err != nil {
+				service.Release(ctx, reservation)
+				return &LimitReservation{}, err
+			}
+			reservation.counters[key] = delta
+
+			for _, policy := range policies {
+				limit := policyCap(policy, metric, window)
+				if limit > 0 && used > limit {
+					service.Release(ctx, reservation)
+					span.AddEvent("limit exceeded by policy " + policy.Identifier)
+					return &LimitReservation{}, &LimitError{
+						Code:      window + "_" + metric + "_limit_exceeded",
+						PolicyId:  policy.Identifier,
+						Limit:     limit,
+						Remaining: remainingOf(limit, used-delta),
+					}
+				}
+			}
+		}
+	}
+
+	return reservation, nil
+}
+
+// Release gives the counters of a transaction that was not accepted back
+func (service *LimitService) Release(ctx context.Context, reservation *LimitReservation) {
+	if reservation == nil {
+		return
+	}
+
+	col := service.bucket.DefaultCollection()
+	for key, delta := range reservation.counters {
+		if _, err := col.Binary().Decrement(key, &gocb.DecrementOptions{Delta: uint64(delta)}); err != nil {
+			fmt.Print("failed to release the limit counter: %w", err)
+		}
+		delete(reservation.counters, key)
+	}
+}
+
+// ReleaseCounters gives back the share of points out of the total points of a
+// transaction that its counters were charged, the count is given back only
+// with the whole transaction
+func (service *LimitService) ReleaseCounters(ctx context.Context, counters map[string]int64, points int64, total int64) {
+	col := service.bucket.DefaultCollection()
+	for key, delta := range counters {
+		delta = releasedDelta(key, delta, points, total)
+		if delta <= 0 {
+			continue
+		}
+		if _, err := col.Binary().Decrement(key, &gocb.DecrementOptions{Delta: uint64(delta)}); err != nil {
+			fmt.Print("failed to release the limit counter: %w", err)
+		}
+	}
+}
+
+// releasedDelta is the part of the delta a transaction added to the counter
+// that is given back for points out of its total points. A transaction counts
+// once, so the count is only given back with all its points.
+func releasedDelta(key string, delta int64, points int64, total int64) int64 {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 {
+		return 0
+	}
+	if parts[len(parts)-3] == LIMIT_METRIC_COUNT {
+		if points < total {
+			return 0
+		}
+		return delta
+	}
+	if points < total && total > 0 {
+		return new(big.Int).Div(new(big.Int).Mul(big.NewInt(delta), big.NewInt(points)), big.NewInt(total)).Int64()
+	}
+	return delta
+}
+
+// Remaining lists what is left of every cap that applies to the wallet
+func (service *LimitService) Remaining(ctx context.Context, subject models.LimitSubject) ([]models.LimitAllowance, error) {
+	fName := "service/limit/remaining"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	policies, err := service.MatchingPolicies(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	col := service.bucket.DefaultCollection()
+	allowances := []models.LimitAllowance{}
+	for _, window := range limitWindows {
+		for _, metric := range []string{LIMIT_METRIC_EARN, LIMIT_METRIC_BURN, LIMIT_METRIC_COUNT} {
+			var used int64
+			if doc, err := col.Get(counterKey(subject.WalletId, metric, window, now), nil); err == nil {
+				doc.Content(&used)
+			}
+
+			for _, policy := range policies {
+				limit := policyCap(policy, metric, window)
+				if limit == 0 {
+					continue
+				}
+				allowances = append(allowances, models.LimitAllowance{
+					PolicyId:  policy.Identifier,
+					Metric:    metric,
+					Window:    window,
+					Limit:     limit,
+					Used:      used,
+					Remaining: remainingOf(limit, used),
+					ResetsAt:  windowEnd(window, now),
+				})
+			}
+		}
+	}
+	return allowances, nil
+}
+
+func (service *LimitService) increment(key string, delta int64, window string) (int64, error) {
+	col := service.bucket.DefaultCollection()
+	// the counter outlives its window a little so that it is never cut short
+	result, err := col.Binary().Increment(key, &gocb.IncrementOptions{
+		Delta:   uint64(delta),
+		Initial: delta,
+		Expiry:  windowEnd(window, time.Now().UTC()).Sub(time.Now().UTC()) + 24*time.Hour,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(result.Content()), nil
+}
+
+func policyCap(policy *models.LimitPolicy, metric string, window string) int64 {
+	caps := policy.Daily
+	switch window {
+	case LIMIT_WINDOW_WEEKLY:
+		caps = policy.Weekly
+	case LIMIT_WINDOW_MONTHLY:
+		caps = policy.Monthly
+	}
+
+	switch metric {
+	case LIMIT_METRIC_EARN:
+		return caps.Earn
+	case LIMIT_METRIC_BURN:
+		return caps.Burn
+	}
+	return caps.Count
+}
+
+func remainingOf(limit int64, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// counterKey names the counter of the wallet for the window the time falls in
+func counterKey(walletId string, metric string, window string, now time.Time) string {
+	period := now.Format("2006-01-02")
+	switch window {
+	case LIMIT_WINDOW_WEEKLY:
+		year, week := now.ISOWeek()
+		period = fmt.Sprintf("%d-W%02d", year, week)
+	case LIMIT_WINDOW_MONTHLY:
+		period = now.Format("2006-01")
+	}
+	return limit_counter_prefix + "/" + walletId + "/" + metric + "/" + window + "/" + period
+}
+
+// windowEnd returns when the window the time falls in ends, weeks start on monday
+func windowEnd(window string, now time.Time) time.Time {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch window {
+	case LIMIT_WINDOW_WEEKLY:
+		return day.AddDate(0, 0, 7-(int(day.Weekday())+6)%7)
+	case LIMIT_WINDOW_MONTHLY:
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day.AddDate(0, 0, 1)
+}
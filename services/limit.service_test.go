@@ -0,0 +1,88 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		window string
+		now    time.Time
+		key    string
+	}{
+		{name: "daily", metric: LIMIT_METRIC_EARN, window: LIMIT_WINDOW_DAILY, now: time.Date(2024, 3, 5, 23, 59, 0, 0, time.UTC), key: "limit_counter/w1/earn/daily/2024-03-05"},
+		{name: "weekly", metric: LIMIT_METRIC_BURN, window: LIMIT_WINDOW_WEEKLY, now: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), key: "limit_counter/w1/burn/weekly/2024-W10"},
+		{name: "weekly in the iso year after", metric: LIMIT_METRIC_COUNT, window: LIMIT_WINDOW_WEEKLY, now: time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC), key: "limit_counter/w1/count/weekly/2025-W01"},
+		{name: "weekly in the iso year before", metric: LIMIT_METRIC_EARN, window: LIMIT_WINDOW_WEEKLY, now: time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC), key: "limit_counter/w1/earn/weekly/2020-W53"},
+		{name: "monthly", metric: LIMIT_METRIC_EARN, window: LIMIT_WINDOW_MONTHLY, now: time.Date(2024, 11, 30, 12, 0, 0, 0, time.UTC), key: "limit_counter/w1/earn/monthly/2024-11"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key := counterKey("w1", test.metric, test.window, test.now); key != test.key {
+				t.Errorf("got %s, want %s", key, test.key)
+			}
+		})
+	}
+}
+
+func TestWindowEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		window string
+		now    time.Time
+		end    time.Time
+	}{
+		{name: "daily", window: LIMIT_WINDOW_DAILY, now: time.Date(2024, 2, 28, 23, 59, 0, 0, time.UTC), end: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "daily at midnight", window: LIMIT_WINDOW_DAILY, now: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), end: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "weekly on monday", window: LIMIT_WINDOW_WEEKLY, now: time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC), end: time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{name: "weekly on wednesday", window: LIMIT_WINDOW_WEEKLY, now: time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC), end: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{name: "weekly on sunday", window: LIMIT_WINDOW_WEEKLY, now: time.Date(2024, 1, 7, 23, 0, 0, 0, time.UTC), end: time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{name: "monthly", window: LIMIT_WINDOW_MONTHLY, now: time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC), end: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "monthly in december", window: LIMIT_WINDOW_MONTHLY, now: time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC), end: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if end := windowEnd(test.window, test.now); !end.Equal(test.end) {
+				t.Errorf("got %s, want %s", end, test.end)
+			}
+		})
+	}
+}
+
+func TestReleasedDelta(t *testing.T) {
+	earn := "limit_counter/w1/earn/daily/2024-03-05"
+	count := "limit_counter/w1/count/daily/2024-03-05"
+
+	tests := []struct {
+		name     string
+		key      string
+		delta    int64
+		points   int64
+		total    int64
+		released int64
+	}{
+		{name: "all points", key: earn, delta: 100, points: 100, total: 100, released: 100},
+		{name: "more than the points", key: earn, delta: 100, points: 150, total: 100, released: 100},
+		{name: "half of the points", key: earn, delta: 100, points: 50, total: 100, released: 50},
+		{name: "share rounded down", key: earn, delta: 10, points: 1, total: 3, released: 3},
+		{name: "share of a repriced counter", key: earn, delta: 300, points: 20, total: 200, released: 30},
+		{name: "share past int64 when multiplied", key: earn, delta: 1 << 40, points: 1 << 40, total: 1 << 41, released: 1 << 39},
+		{name: "no total", key: earn, delta: 100, points: 0, total: 0, released: 100},
+		{name: "count with all points", key: count, delta: 1, points: 100, total: 100, released: 1},
+		{name: "count with part of the points", key: count, delta: 1, points: 99, total: 100, released: 0},
+		{name: "malformed key", key: "w1/earn", delta: 100, points: 100, total: 100, released: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if released := releasedDelta(test.key, test.delta, test.points, test.total); released != test.released {
+				t.Errorf("got %d, want %d", released, test.released)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type MergeService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	merge_prefix = "merge"
+)
+
+const (
+	MERGE_STATUS_PENDING      = "pending"
+	MERGE_STATUS_RUNNING      = "running"
+	MERGE_STATUS_COMPLETED    = "completed"
+	MERGE_STATUS_FAILED       = "failed"
+	MERGE_STATUS_ROLLING_BACK = "rolling_back"
+	MERGE_STATUS_ROLLED_BACK  = "rolled_back"
+	// a rollback that failed stops here so that it can be claimed again
+	MERGE_STATUS_ROLLBACK_FAILED = "rollback_failed"
+)
+
+const (
+	MERGE_STEP_PENDING     = "pending"
+	MERGE_STEP_CREATED     = "created"
+	MERGE_STEP_TRANSFERRED = "transferred"
+	MERGE_STEP_COMPLETED   = "completed"
+	MERGE_STEP_ROLLED_BACK = "rolled_back"
+)
+
+var (
+	ERR_MERGE_NOT_FOUND        = errors.New("error: no merge operation found")
+	ERR_MERGE_INVALID_STATE    = errors.New("error: merge operation is not in a state allowing this action")
+	ERR_MERGE_CONCURRENT_WRITE = errors.New("error: merge operation is being modified concurrently, try again")
+	ERR_MERGE_NOT_STALE        = errors.New("error: merge operation is still making progress")
+)
+
+func NewMerge(cluster *gocb.Cluster, bucket *gocb.Bucket) MergeService {
+	return MergeService{cluster: cluster, bucket: bucket}
+}
+
+func (service *MergeService) Create(ctx context.Context, merge *models.MergeOperation, creator string) error {
+	fName := "service/merge/create"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	location, _ := time.LoadLocation("UTC")
+	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
+
+	merge.DocType = "merge"
+	merge.Identifier = common.GenerateIdentifier(30)
+	merge.Status = MERGE_STATUS_PENDING
+	merge.Creator = creator
+	merge.CreatedAt = now
+	merge.LastUpdatedAt = now
+	merge.LastUpdatedBy = creator
+	for i := range merge.Steps {
+		merge.Steps[i].Status = MERGE_STEP_PENDING
+		merge.Steps[i].LastUpdatedAt = now
+	}
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Insert(merge_prefix+"/"+merge.Identifier, merge, nil)
+	span.AddEvent("merge operation created")
+	return err
+}
+
+func (service *MergeService) Get(ctx context.Context, mergeId string) (models.MergeOperation, error) {
+	fName := "service/merge/get"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(merge_prefix+"/"+mergeId, nil)
+	if err != nil {
+		return models.MergeOperation{}, ERR_MERGE_NOT_FOUND
+	}
+
+	var merge models.MergeOperation
+	err = doc.Content(&merge)
+	return merge, err
+}
+
+// Transition moves the operation to the given status when it is currently in one
+// of the allowed statuses. It is the guard that lets a single runner work on a
+// merge at a time.
+func (service *MergeService) Transition(ctx context.Context, mergeId string, allowed []string, status string, sessionedUser string) (models.MergeOperation, error) {
+	fName := "service/merge/transition"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(merge_prefix+"/"+mergeId, nil)
+	if err != nil {
+		return models.MergeOperation{}, ERR_MERGE_NOT_FOUND
+	}
+
+	var merge models.MergeOperation
+	err = doc.Content(&merge)
+	if err != nil {
+		return models.MergeOperation{}, err
+	}
+
+	permitted := false
+	for _, current := range allowed {
+		if merge.Status == current {
+			permitted = true
+		}
+	}
+	if !permitted {
+		return merge, ERR_MERGE_INVALID_STATE
+	}
+
+	merge.Status = status
+	merge.Error = ""
+	merge.LastUpdatedAt = time.Now().UTC()
+	merge.LastUpdatedBy = sessionedUser
+
+	_, err = col.Replace(merge_prefix+"/"+mergeId, merge, &gocb.ReplaceOptions{Cas: doc.Cas()})
+	if errors.Is(err, gocb.ErrCasMismatch) {
+		return merge, ERR_MERGE_CONCURRENT_WRITE
+	}
+	return merge, err
+}
+
+// Save persists the progress of the operation, it is called after every step change.
+func (service *MergeService) Save(ctx context.Context, merge *models.MergeOperation) error {
+	fName := "service/merge/save"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	merge.LastUpdatedAt = time.Now().UTC()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Replace(merge_prefix+"/"+merge.Identifier, merge, nil)
+	return err
+}
+
+// Claim takes over a running or rolling back operation whose progress was not
+// saved since staleBefore, the process that ran it is assumed to have stopped.
+func (service *MergeService) Claim(ctx context.Context, mergeId string, staleBefore time.Time) (models.MergeOperation, error) {
+	fName := "service/merge/claim"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("Merge", mergeId))
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(merge_prefix+"/"+mergeId, nil)
+	if err != nil {
+		return models.MergeOperation{}, ERR_MERGE_NOT_FOUND
+	}
+
+	var merge models.MergeOperation
+	if err := doc.Content(&merge); err != nil {
+		return merge, err
+	}
+	if (merge.Status != MERGE_STATUS_RUNNING && merge.Status != MERGE_STATUS_ROLLING_BACK) || !merge.LastUpdatedAt.Before(staleBefore) {
+		return merge, ERR_MERGE_NOT_STALE
+	}
+
+	merge.LastUpdatedAt = time.Now().UTC()
+	_, err = col.Replace(merge_prefix+"/"+mergeId, merge, &gocb.ReplaceOptions{Cas: doc.Cas()})
+	if errors.Is(err, gocb.ErrCasMismatch) {
+		// another process claimed the operation or saved its progress
+		return merge, ERR_MERGE_NOT_STALE
+	}
+	span.AddEvent("merge operation claimed")
+	return merge, err
+}
+
+func (service *MergeService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.MergeOperation, error) {
+	fName := "service/merge/filter"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='merge' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	merges := []*models.MergeOperation{}
+	for rows.Next() {
+		var obj models.MergeOperation
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		merges = append(merges, &obj)
+	}
+	defer rows.Close()
+	return merges, rows.Err()
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type ReconciliationService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	reconciliation_prefix = "reconciliation"
+	repair_prefix         = "reconciliation_repair"
+)
+
+const (
+	RECONCILIATION_RUNNING   = "running"
+	RECONCILIATION_COMPLETED = "completed"
+	RECONCILIATION_FAILED    = "failed"
+
+	MISMATCH_MISSING_ON_CHAIN  = "missing_on_chain"
+	MISMATCH_MISSING_OFF_CHAIN = "missing_off_chain"
+	MISMATCH_AMOUNT_DIFFERS    = "amount_differs"
+	// the ledger could not be asked about the entity, it is checked again by the next run
+	MISMATCH_CHECK_FAILED = "check_failed"
+
+	RECONCILIATION_ENTITY_WALLET      = "wallet"
+	RECONCILIATION_ENTITY_TRANSACTION = "transaction"
+
+	REPAIR_REPUBLISH          = "republish"
+	REPAIR_BALANCE_CORRECTION = "balance_correction"
+	REPAIR_APPLY_RESULT       = "apply_result"
+
+	REPAIR_PROPOSED = "proposed"
+	REPAIR_APPROVED = "approved"
+	REPAIR_REJECTED = "rejected"
+	REPAIR_EXECUTED = "executed"
+	REPAIR_FAILED   = "failed"
+
+	// mismatches kept on a report, the counts cover all of them
+	reconciliation_max_mismatches = 5000
+)
+
+var (
+	ERR_REPAIR_NOT_PROPOSED = errors.New("error: only proposed repair actions can be approved or rejected")
+	ERR_REPAIR_NOT_APPROVED = errors.New("error: only approved repair actions can be carried out")
+)
+
+func NewReconciliation(cluster *gocb.Cluster, bucket *gocb.Bucket) ReconciliationService {
+	return ReconciliationService{cluster: cluster, bucket: bucket}
+}
+
+// Start records a new running reconciliation
+func (service *ReconciliationService) Start(ctx context.Context, sessionedUser string) (models.ReconciliationReport, error) {
+	fName := "service/reconciliation/start"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	report := models.ReconciliationReport{
+		DocType:    "reconciliation",
+		Identifier: common.GenerateIdentifier(30),
+		Status:     RECONCILIATION_RUNNING,
+		Counts:     map[string]int64{},
+		Mismatches: []models.ReconciliationMismatch{},
+		Creator:    sessionedUser,
+		StartedAt:  time.Now().UTC(),
+	}
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Insert(reconciliation_prefix+"/"+report.Identifier, report, nil)
+	return report, err
+}
+
+// AddMismatch counts the mismatch on the report and keeps it while there is room
+func AddMismatch(report *models.ReconciliationReport, mismatch models.ReconciliationMismatch) {
+	report.Counts[mismatch.Category]++
+	if len(report.Mismatches) >= reconciliation_max_mismatches {
+		report.Truncated = true
+		return
+	}
+	report.Mismatches = append(report.Mismatches, mismatch)
+}
+
+// Save stores the report, a report is only written by the run producing it
+func (service *ReconciliationService) Save(ctx context.Context, report *models.ReconciliationReport) error {
+	fName := "service/reconciliation/save"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Replace(reconciliation_prefix+"/"+report.Identifier, report, nil)
+	return err
+}
+
+func (service *ReconciliationService) Get(ctx context.Context, reportId string) (models.ReconciliationReport, error) {
+	fName := "service/reconciliation/get"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(reconciliation_prefix+"/"+reportId, nil)
+	if err != nil {
+		return models.ReconciliationReport{}, errors.New("error: no reconciliation report found")
+	}
+
+	var report models.ReconciliationReport
+	err = doc.Content(&report)
+	return report, err
+}
+
+// Filter lists the reports without their mismatches
+func (service *ReconciliationService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.ReconciliationReport, error) {
+	fName := "service/reconciliation/filter"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select OBJECT_REMOVE(data, 'mismatches').* from `testbucket`.`_default`.`_default` data where type='reconciliation' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*models.ReconciliationReport{}
+	for rows.Next() {
+		var obj models.ReconciliationReport
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		reports = append(reports, &obj)
+	}
+	defer rows.Close()
+	return reports, rows.Err()
+}
+
+// EachWallet hands every wallet that is not deleted to each, with its chain ids
+func (service *ReconciliationService) EachWallet(ctx context.Context, each func(*models.Wallet) error) error {
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='wallet' AND isDeleted=false order by createdAt"
+
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{Context: ctx})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj models.Wallet
+		if err := rows.Row(&obj); err != nil {
+			return err
+		}
+		if err := each(&obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// InFlight tells whether the wallet has transactions the ledger has not
+// settled yet, its balance can not be compared with the ledger until they are
+func (service *ReconciliationService) InFlight(ctx context.Context, walletId string) (bool, error) {
+	query := "select raw count(*) from `testbucket`.`_default`.`_default` data where type='tx' AND (from_extid=$wallet OR to_extid=$wallet) AND (status IN $statuses OR (IFMISSINGORNULL(status, '')='' AND IFMISSINGORNULL(tx_uuid, '')='' AND IFMISSINGORNULL(errmsg, '')=''))"
+
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{
+			"wallet":   walletId,
+			"statuses": []string{TRANSACTION_STATUS_ACCEPTED, TRANSACTION_STATUS_PUBLISHED, TRANSACTION_STATUS_FAILED},
+		},
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+		Context:         ctx,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var count int64
+	if err := rows.One(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// EachTransaction hands every transaction created before the given time and not
+// rejected to each
+func (service *ReconciliationService) EachTransaction(ctx context.Context, before time.Time, each func(*models.Transaction) error) error {
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='tx' AND IFMISSINGORNULL(status, '')!='rejected' AND STR_TO_MILLIS(createdOn) < STR_TO_MILLIS($before) order by STR_TO_MILLIS(createdOn)"
+
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{"before": before.UTC().Format(time.RFC3339Nano)},
+		Context:         ctx,
+	})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj models.Transaction
+		if err := rows.Row(&obj); err != nil {
+			return err
+		}
+		if err := each(&obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ProposeRepair opens a repair action, there is at most one open action per
+// entity and action so that repeated runs do not pile them up. The open action
+// is returned when there is one already.
+func (service *ReconciliationService) ProposeRepair(ctx context.Context, repair *models.RepairAction) error {
+	fName := "service/reconciliation/proposeRepair"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	repair.DocType = "reconciliation_repair"
+	repair.Identifier = repair.Action + "_" + repair.EntityId
+	repair.Status = REPAIR_PROPOSED
+	repair.ProposedAt = time.Now().UTC()
+
+	col := service.bucket.DefaultCollection()
+	key := repair_prefix + "/" + repair.Identifier
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(key, nil)
+		if errors.Is(err, gocb.ErrDocumentNotFound) {
+			_, err = col.Insert(key, repair, nil)
+			if errors.Is(err, gocb.ErrDocumentExists) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		var existing models.RepairAction
+		if err := doc.Content(&existing); err != nil {
+			return err
+		}
+		if existing.Status == REPAIR_PROPOSED || existing.Status == REPAIR_APPROVED {
+			*repair = existing
+			return nil
+		}
+
+		// a decided action is replaced by the new proposal
+		_, err = col.Replace(key, repair, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return err
+	}
+	return errors.New("error: repair action is being modified concurrently, try again")
+}
+
+func (service *ReconciliationService) GetRepair(ctx context.Context, repairId string) (models.RepairAction, error) {
+	fName := "service/reconciliation/getRepair"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(repair_prefix+"/"+repairId, nil)
+	if err != nil {
+		return models.RepairAction{}, errors.New("error: no repair action found")
+	}
+
+	var repair models.RepairAction
+	err = doc.Content(&repair)
+	return repair, err
+}
+
+// Decide approves or rejects a proposed repair action, it fails when another
+// operator has decided on the action in the meantime so that an action is never
+// carried out twice
+func (service *ReconciliationService) Decide(ctx context.Context, repairId string, approve bool, note string, sessionedUser string) (models.RepairAction, error) {
+	fName := "service/reconciliation/decide"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutateRepair(ctx, repairId, func(repair *models.RepairAction) error {
+		if repair.Status != REPAIR_PROPOSED {
+			return ERR_REPAIR_NOT_PROPOSED
+		}
+
+		now := time.Now().UTC()
+		repair.Status = REPAIR_REJECTED
+		if approve {
+			repair.Status = REPAIR_APPROVED
+		}
+		repair.Note = note
+		repair.DecidedBy = sessionedUser
+		repair.DecidedAt = &now
+		return nil
+	})
+}
+
+// Complete records the outcome of an approved repair action
+func (service *ReconciliationService) Complete(ctx context.Context, repairId string, actionErr error) (models.RepairAction, error) {
+	fName := "service/reconciliation/complete"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutateRepair(ctx, repairId, func(repair *models.RepairAction) error {
+		if repair.Status != REPAIR_APPROVED {
+			return ERR_REPAIR_NOT_APPROVED
+		}
+
+		repair.Status = REPAIR_EXECUTED
+		if actionErr != nil {
+			repair.Status = REPAIR_FAILED
+			repair.Error = actionErr.Error()
+		}
+		return nil
+	})
+}
+
+// mutateRepair applies the change to the stored repair action, retrying on
+// concurrent updates
+func (service *ReconciliationService) mutateRepair(ctx context.Context, repairId string, change func(*models.RepairAction) error) (models.RepairAction, error) {
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(repair_prefix+"/"+repairId, nil)
+		if err != nil {
+			return models.RepairAction{}, errors.New("error: no repair action found")
+		}
+
+		var repair models.RepairAction
+		if err := doc.Content(&repair); err != nil {
+			return repair, err
+		}
+		if err := change(&repair); err != nil {
+			return repair, err
+		}
+
+		_, err = col.Replace(repair_prefix+"/"+repairId, repair, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return repair, err
+	}
+	return models.RepairAction{}, errors.New("error: repair action is being modified concurrently, try again")
+}
+
+func (service *ReconciliationService) FilterRepairs(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.RepairAction, error) {
+	fName := "service/reconciliation/filterRepairs"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='reconciliation_repair' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []*models.RepairAction{}
+	for rows.Next() {
+		var obj models.RepairAction
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		repairs = append(repairs, &obj)
+	}
+	defer rows.Close()
+	return repairs, rows.Err()
+}
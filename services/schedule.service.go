@@ -0,0 +1,407 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/loyyal/loyyal-be-contract/models"
+	"github.com/loyyal/loyyal-be-contract/utils/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type ScheduleService struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+}
+
+const (
+	schedule_prefix = "schedule"
+)
+
+const (
+	SCHEDULE_STATUS_SCHEDULED = "scheduled"
+	SCHEDULE_STATUS_COMPLETED = "completed"
+	SCHEDULE_STATUS_CANCELLED = "cancelled"
+
+	SCHEDULE_RUN_SUCCEEDED = "succeeded"
+	SCHEDULE_RUN_FAILED    = "failed"
+
+	// runs kept on the scheduled transaction
+	schedule_run_history = 50
+)
+
+var (
+	ERR_INVALID_RECURRENCE      = errors.New("error: recurrence must be a RRULE with FREQ=DAILY, WEEKLY, MONTHLY or YEARLY and optional INTERVAL, COUNT, UNTIL and BYMONTHDAY")
+	ERR_SCHEDULE_IN_PAST        = errors.New("error: execute at must be in the future")
+	ERR_SCHEDULE_NOT_ACTIVE     = errors.New("error: only scheduled transactions can be changed")
+	ERR_SCHEDULE_NO_OCCURRENCE  = errors.New("error: the recurrence has no execution after execute at")
+	ERR_SCHEDULE_ALREADY_LOCKED = errors.New("error: scheduled transaction is being executed")
+)
+
+func NewSchedule(cluster *gocb.Cluster, bucket *gocb.Bucket) ScheduleService {
+	return ScheduleService{cluster: cluster, bucket: bucket}
+}
+
+func (service *ScheduleService) Create(ctx context.Context, schedule *models.ScheduledTransaction, sessionedUser string) (string, error) {
+	fName := "service/schedule/create"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	now := time.Now().UTC()
+	if !schedule.ExecuteAt.After(now) {
+		return "", ERR_SCHEDULE_IN_PAST
+	}
+
+	next, err := NextOccurrence(schedule.ExecuteAt, schedule.Recurrence, schedule.ExecuteAt.Add(-time.Nanosecond))
+	if err != nil {
+		return "", err
+	}
+	if next == nil {
+		return "", ERR_SCHEDULE_NO_OCCURRENCE
+	}
+
+	schedule.DocType = "schedule"
+	schedule.Identifier = common.GenerateIdentifier(30)
+	schedule.NextRunAt = next
+	schedule.Status = SCHEDULE_STATUS_SCHEDULED
+	schedule.Creator = sessionedUser
+	schedule.CreatedAt = now
+	schedule.LastUpdatedAt = now
+	schedule.LastUpdatedBy = sessionedUser
+
+	col := service.bucket.DefaultCollection()
+	_, err = col.Insert(schedule_prefix+"/"+schedule.Identifier, schedule, nil)
+	span.AddEvent("scheduled transaction created")
+	return schedule.Identifier, err
+}
+
+func (service *ScheduleService) Get(ctx context.Context, scheduleId string) (models.ScheduledTransaction, error) {
+	fName := "service/schedule/get"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	doc, err := col.Get(schedule_prefix+"/"+scheduleId, nil)
+	if err != nil {
+		return models.ScheduledTransaction{}, errors.New("error: no scheduled transaction found")
+	}
+
+	var schedule models.ScheduledTransaction
+	err = doc.Content(&schedule)
+	return schedule, err
+}
+
+// Update changes the amount, the metadata or the timing of a scheduled
+// transaction, the next execution is worked out again
+func (service *ScheduleService) Update(ctx context.Context, scheduleId string, amount int64, metadata []byte, executeAt time.Time, recurrence string, sessionedUser string) (models.ScheduledTransaction, error) {
+	fName := "service/schedule/update"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutate(ctx, scheduleId, func(schedule *models.ScheduledTransaction, now time.Time) error {
+		if schedule.Status != SCHEDULE_STATUS_SCHEDULED {
+			return ERR_SCHEDULE_NOT_ACTIVE
+		}
+
+		if amount > 0 {
+			schedule.Amount = amount
+		}
+		if metadata != nil {
+			schedule.Metadata = metadata
+		}
+		if !executeAt.IsZero() && !executeAt.Equal(schedule.ExecuteAt) {
+			if !executeAt.After(now) {
+				return ERR_SCHEDULE_IN_PAST
+			}
+			schedule.ExecuteAt = executeAt
+		}
+		schedule.Recurrence = recurrence
+
+		// executions already made count towards the COUNT of the recurrence
+		after := schedule.ExecuteAt.Add(-time.Nanosecond)
+		if now.After(after) {
+			after = now
+		}
+		next, err := NextOccurrence(schedule.ExecuteAt, schedule.Recurrence, after)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return ERR_SCHEDULE_NO_OCCURRENCE
+		}
+		schedule.NextRunAt = next
+		schedule.LastUpdatedBy = sessionedUser
+		return nil
+	})
+}
+
+func (service *ScheduleService) Cancel(ctx context.Context, scheduleId string, sessionedUser string) (models.ScheduledTransaction, error) {
+	fName := "service/schedule/cancel"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutate(ctx, scheduleId, func(schedule *models.ScheduledTransaction, now time.Time) error {
+		if schedule.Status != SCHEDULE_STATUS_SCHEDULED {
+			return ERR_SCHEDULE_NOT_ACTIVE
+		}
+		schedule.Status = SCHEDULE_STATUS_CANCELLED
+		schedule.NextRunAt = nil
+		schedule.LastUpdatedBy = sessionedUser
+		return nil
+	})
+}
+
+// Due returns the scheduled transactions whose next execution has come
+func (service *ScheduleService) Due(ctx context.Context, now time.Time, limit int) ([]*models.ScheduledTransaction, error) {
+	return service.Filter(ctx, "AND status=$status AND STR_TO_MILLIS(nextRunAt) <= STR_TO_MILLIS($now)"+
+		" AND (lockedUntil IS MISSING OR lockedUntil IS NULL OR STR_TO_MILLIS(lockedUntil) < STR_TO_MILLIS($now))", map[string]interface{}{
+		"status": SCHEDULE_STATUS_SCHEDULED,
+		"now":    now.Format(time.RFC3339),
+	}, "nextRunAt", limit)
+}
+
+// Claim locks the scheduled transaction for the lease so that a single
+// scheduler replica executes it
+func (service *ScheduleService) Claim(ctx context.Context, scheduleId string, lease time.Duration) (models.ScheduledTransaction, error) {
+	return service.mutate(ctx, scheduleId, func(schedule *models.ScheduledTransaction, now time.Time) error {
+		if schedule.Status != SCHEDULE_STATUS_SCHEDULED || schedule.NextRunAt == nil || schedule.NextRunAt.After(now) {
+			return ERR_SCHEDULE_NOT_ACTIVE
+		}
+		if schedule.LockedUntil != nil && schedule.LockedUntil.After(now) {
+			return ERR_SCHEDULE_ALREADY_LOCKED
+		}
+		lockedUntil := now.Add(lease)
+		schedule.LockedUntil = &lockedUntil
+		return nil
+	})
+}
+
+// RecordRun stores the outcome of the execution and moves the schedule to its
+// next execution. Executions missed while the scheduler was down are skipped.
+func (service *ScheduleService) RecordRun(ctx context.Context, scheduleId string, run models.ScheduleRun) (models.ScheduledTransaction, error) {
+	fName := "service/schedule/recordRun"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutate(ctx, scheduleId, func(schedule *models.ScheduledTransaction, now time.Time) error {
+		schedule.RunCount++
+		schedule.Runs = append(schedule.Runs, run)
+		if len(schedule.Runs) > schedule_run_history {
+			schedule.Runs = schedule.Runs[len(schedule.Runs)-schedule_run_history:]
+		}
+		schedule.LockedUntil = nil
+
+		next, err := NextOccurrence(schedule.ExecuteAt, schedule.Recurrence, now)
+		if err != nil {
+			return err
+		}
+		schedule.NextRunAt = next
+		if next == nil && schedule.Status == SCHEDULE_STATUS_SCHEDULED {
+			schedule.Status = SCHEDULE_STATUS_COMPLETED
+		}
+		schedule.LastUpdatedBy = "scheduler"
+		return nil
+	})
+}
+
+func (service *ScheduleService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.ScheduledTransaction, error) {
+	fName := "service/schedule/filter"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='schedule' "
+	query += queryString
+	query += " order by " + sortBy
+	if limit != -1 {
+		query += " limit " + strconv.Itoa(limit)
+	}
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []*models.ScheduledTransaction{}
+	for rows.Next() {
+		var obj models.ScheduledTransaction
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, &obj)
+	}
+	defer rows.Close()
+	return schedules, rows.Err()
+}
+
+// mutate applies the change to the stored schedule, retrying on concurrent updates
+func (service *ScheduleService) mutate(ctx context.Context, scheduleId string, change func(*models.ScheduledTransaction, time.Time) error) (models.ScheduledTransaction, error) {
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(schedule_prefix+"/"+scheduleId, nil)
+		if err != nil {
+			return models.ScheduledTransaction{}, errors.New("error: no scheduled transaction found")
+		}
+
+		var schedule models.ScheduledTransaction
+		err = doc.Content(&schedule)
+		if err != nil {
+			return models.ScheduledTransaction{}, err
+		}
+
+		now := time.Now().UTC()
+		if err := change(&schedule, now); err != nil {
+			return schedule, err
+		}
+		schedule.LastUpdatedAt = now
+
+		_, err = col.Replace(schedule_prefix+"/"+scheduleId, schedule, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return schedule, err
+	}
+
+	return models.ScheduledTransaction{}, errors.New("error: scheduled transaction is being modified concurrently, try again")
+}
+
+// recurrence is the supported subset of a RRULE
+type recurrence struct {
+	freq       string
+	interval   int
+	count      int
+	until      *time.Time
+	byMonthDay int
+}
+
+func parseRecurrence(rule string) (*recurrence, error) {
+	if rule == "" {
+		return nil, nil
+	}
+
+	rec := &recurrence{interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(rule), "RRULE:"), ";") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, ERR_INVALID_RECURRENCE
+		}
+
+		var err error
+		switch key {
+		case "FREQ":
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" && value != "YEARLY" {
+				return nil, ERR_INVALID_RECURRENCE
+			}
+			rec.freq = value
+		case "INTERVAL":
+			rec.interval, err = strconv.Atoi(value)
+			if rec.interval < 1 {
+				err = ERR_INVALID_RECURRENCE
+			}
+		case "COUNT":
+			rec.count, err = strconv.Atoi(value)
+			if rec.count < 1 {
+				err = ERR_INVALID_RECURRENCE
+			}
+		case "UNTIL":
+			var until time.Time
+			until, err = time.Parse("20060102T150405Z", value)
+			if err != nil {
+				until, err = time.Parse("20060102", value)
+				until = until.Add(24*time.Hour - time.Nanosecond)
+			}
+			rec.until = &until
+		case "BYMONTHDAY":
+			// -1 is the last day of the month
+			rec.byMonthDay, err = strconv.Atoi(value)
+			if rec.byMonthDay == 0 || rec.byMonthDay < -1 || rec.byMonthDay > 31 {
+				err = ERR_INVALID_RECURRENCE
+			}
+		default:
+			err = ERR_INVALID_RECURRENCE
+		}
+		if err != nil {
+			return nil, ERR_INVALID_RECURRENCE
+		}
+	}
+
+	if rec.freq == "" || (rec.byMonthDay != 0 && rec.freq != "MONTHLY") {
+		return nil, ERR_INVALID_RECURRENCE
+	}
+	return rec, nil
+}
+
+// NextOccurrence returns the first execution of the recurrence starting at start
+// that comes after the time, nil when there is none left. An empty rule runs once.
+func NextOccurrence(start time.Time, rule string, after time.Time) (*time.Time, error) {
+	rec, err := parseRecurrence(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec == nil {
+		if start.After(after) {
+			return &start, nil
+		}
+		return nil, nil
+	}
+
+	// occurrences before the start (a BYMONTHDAY earlier in the first month)
+	// are not executed but still count
+	for k := 0; k < 100000; k++ {
+		if rec.count > 0 && k >= rec.count {
+			return nil, nil
+		}
+
+		occurrence := rec.occurrence(start, k)
+		if rec.until != nil && occurrence.After(*rec.until) {
+			return nil, nil
+		}
+		if occurrence.After(after) && !occurrence.Before(start) {
+			return &occurrence, nil
+		}
+	}
+	return nil, nil
+}
+
+func (rec *recurrence) occurrence(start time.Time, k int) time.Time {
+	step := k * rec.interval
+	switch rec.freq {
+	case "DAILY":
+		return start.AddDate(0, 0, step)
+	case "WEEKLY":
+		return start.AddDate(0, 0, 7*step)
+	case "MONTHLY":
+		day := start.Day()
+		if rec.byMonthDay != 0 {
+			day = rec.byMonthDay
+		}
+		return onDay(start, start.Year(), start.Month()+time.Month(step), day)
+	}
+	return onDay(start, start.Year()+step, start.Month(), start.Day())
+}
+
+// onDay returns the time of start on the day of the month, a day past the end of
+// the month (or -1) is the last day of the month
+func onDay(start time.Time, year int, month time.Month, day int) time.Time {
+	first := time.Date(year, month, 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	if day == -1 || day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
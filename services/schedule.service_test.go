@@ -0,0 +1,69 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextOccurrence(t *testing.T) {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 10, 0, 0, 0, time.UTC)
+	}
+	jan31 := at(2024, time.January, 31)
+
+	tests := []struct {
+		name  string
+		start time.Time
+		rule  string
+		after time.Time
+		next  *time.Time
+		err   error
+	}{
+		{name: "once ahead", start: jan31, after: jan31.Add(-time.Minute), next: &jan31},
+		{name: "once done", start: jan31, after: jan31},
+		{name: "daily", start: jan31, rule: "FREQ=DAILY", after: jan31, next: ptr(at(2024, time.February, 1))},
+		{name: "daily not started", start: jan31, rule: "FREQ=DAILY", after: at(2024, time.January, 1), next: &jan31},
+		{name: "rrule prefix in lower case", start: jan31, rule: "rrule:freq=daily", after: jan31, next: ptr(at(2024, time.February, 1))},
+		{name: "weekly every other week", start: jan31, rule: "FREQ=WEEKLY;INTERVAL=2", after: jan31, next: ptr(at(2024, time.February, 14))},
+		{name: "monthly on a day missing from the month", start: jan31, rule: "FREQ=MONTHLY", after: jan31, next: ptr(at(2024, time.February, 29))},
+		{name: "monthly back on the day", start: jan31, rule: "FREQ=MONTHLY", after: at(2024, time.February, 29), next: ptr(at(2024, time.March, 31))},
+		{name: "monthly on the last day", start: at(2024, time.February, 10), rule: "FREQ=MONTHLY;BYMONTHDAY=-1", after: at(2024, time.February, 10), next: ptr(at(2024, time.February, 29))},
+		{name: "monthly on a day before the start", start: at(2024, time.January, 10), rule: "FREQ=MONTHLY;BYMONTHDAY=5", after: at(2024, time.January, 10), next: ptr(at(2024, time.February, 5))},
+		{name: "monthly skipped day counts", start: at(2024, time.January, 10), rule: "FREQ=MONTHLY;BYMONTHDAY=5;COUNT=1", after: at(2024, time.January, 1)},
+		{name: "yearly from a leap day", start: at(2024, time.February, 29), rule: "FREQ=YEARLY", after: at(2024, time.February, 29), next: ptr(at(2025, time.February, 28))},
+		{name: "count left", start: jan31, rule: "FREQ=DAILY;COUNT=2", after: jan31, next: ptr(at(2024, time.February, 1))},
+		{name: "count reached", start: jan31, rule: "FREQ=DAILY;COUNT=2", after: at(2024, time.February, 1)},
+		{name: "until date includes the day", start: jan31, rule: "FREQ=DAILY;UNTIL=20240202", after: at(2024, time.February, 1), next: ptr(at(2024, time.February, 2))},
+		{name: "until date passed", start: jan31, rule: "FREQ=DAILY;UNTIL=20240202", after: at(2024, time.February, 2)},
+		{name: "until time", start: jan31, rule: "FREQ=DAILY;UNTIL=20240201T095959Z", after: jan31},
+		{name: "unknown frequency", start: jan31, rule: "FREQ=HOURLY", err: ERR_INVALID_RECURRENCE},
+		{name: "missing frequency", start: jan31, rule: "INTERVAL=2", err: ERR_INVALID_RECURRENCE},
+		{name: "zero interval", start: jan31, rule: "FREQ=DAILY;INTERVAL=0", err: ERR_INVALID_RECURRENCE},
+		{name: "zero count", start: jan31, rule: "FREQ=DAILY;COUNT=0", err: ERR_INVALID_RECURRENCE},
+		{name: "invalid until", start: jan31, rule: "FREQ=DAILY;UNTIL=tomorrow", err: ERR_INVALID_RECURRENCE},
+		{name: "month day on a daily rule", start: jan31, rule: "FREQ=DAILY;BYMONTHDAY=5", err: ERR_INVALID_RECURRENCE},
+		{name: "month day out of range", start: jan31, rule: "FREQ=MONTHLY;BYMONTHDAY=32", err: ERR_INVALID_RECURRENCE},
+		{name: "part without value", start: jan31, rule: "FREQ", err: ERR_INVALID_RECURRENCE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next, err := NextOccurrence(test.start, test.rule, test.after)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			switch {
+			case next == nil && test.next == nil:
+			case next == nil || test.next == nil:
+				t.Errorf("got %v, want %v", next, test.next)
+			case !next.Equal(*test.next):
+				t.Errorf("got %s, want %s", next, test.next)
+			}
+		})
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"errors"
+	"math/big"
 	"strconv"
 	"time"
 
@@ -20,12 +21,89 @@ type TransactionService struct {
 
 const (
 	transaction_prefix = "tx"
+	quote_prefix       = "quote"
 )
 
+const (
+	TRANSACTION_TYPE_ISSUE    = "issue"
+	TRANSACTION_TYPE_REDEEM   = "redeem"
+	TRANSACTION_TYPE_TRANSFER = "transfer"
+	TRANSACTION_TYPE_MERGE    = "merge"
+	TRANSACTION_TYPE_DEPOSIT  = "deposit"
+	TRANSACTION_TYPE_WITHDRAW = "withdraw"
+	TRANSACTION_TYPE_REVERSAL = "reversal"
+	TRANSACTION_TYPE_EXPIRY   = "expiry"
+)
+
+const (
+	REVERSAL_STATUS_PARTIAL = "partially_reversed"
+	REVERSAL_STATUS_FULL    = "reversed"
+)
+
+var (
+	ERR_REVERSAL_EXCEEDS_REMAINING = errors.New("error: amount exceeds the remaining reversible amount")
+	ERR_TRANSACTION_NOT_REVERSIBLE = errors.New("error: transaction can not be reversed")
+	ERR_TRANSACTION_NOT_COMMITTED  = errors.New("error: only a transaction committed by the ledger can be reversed")
+)
+
+const (
+	SETTLEMENT_STATUS_PENDING   = "pending"
+	SETTLEMENT_STATUS_COMPLETED = "completed"
+	SETTLEMENT_STATUS_FAILED    = "failed"
+)
+
+var (
+	ERR_WITHDRAW_NOT_PENDING = errors.New("error: only pending withdrawals can be settled")
+	ERR_WITHDRAW_NOT_SETTLED = errors.New("error: a withdrawal can be reversed only once its settlement has completed")
+	ERR_WITHDRAW_REVERSED    = errors.New("error: a reversed withdrawal can not be settled")
+	ERR_WITHDRAW_NOT_BOOKED  = errors.New("error: a withdrawal can be settled only once the ledger has committed it")
+)
+
+const (
+	TRANSACTION_STATUS_ACCEPTED  = "accepted"
+	TRANSACTION_STATUS_PUBLISHED = "published"
+	TRANSACTION_STATUS_COMMITTED = "committed"
+	TRANSACTION_STATUS_REJECTED  = "rejected"
+	TRANSACTION_STATUS_FAILED    = "failed"
+)
+
+// transactionTransitions lists the statuses a transaction can move to, a failed
+// transaction can be published again. The chain may answer before a
+// transaction is recorded as published, so an accepted one can be committed.
+var transactionTransitions = map[string][]string{
+	TRANSACTION_STATUS_ACCEPTED:  {TRANSACTION_STATUS_PUBLISHED, TRANSACTION_STATUS_COMMITTED, TRANSACTION_STATUS_REJECTED, TRANSACTION_STATUS_FAILED},
+	TRANSACTION_STATUS_PUBLISHED: {TRANSACTION_STATUS_COMMITTED, TRANSACTION_STATUS_REJECTED, TRANSACTION_STATUS_FAILED},
+	TRANSACTION_STATUS_FAILED:    {TRANSACTION_STATUS_PUBLISHED, TRANSACTION_STATUS_COMMITTED, TRANSACTION_STATUS_REJECTED},
+}
+
+var ERR_TRANSACTION_STATUS_TRANSITION = errors.New("error: transaction status transition is not allowed")
+
+var ERR_QUOTE_USED = errors.New("error: quote has been used already")
+
 func NewTransaction(cluster *gocb.Cluster, bucket *gocb.Bucket) TransactionService {
 	return TransactionService{cluster: cluster, bucket: bucket}
 }
 
+// ClaimQuote marks the quote as used so that it prices a single transaction,
+// the mark is kept until the quote has expired
+func (service *TransactionService) ClaimQuote(ctx context.Context, quoteId string, expiresAt time.Time) error {
+	fName := "service/transaction/claimQuote"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Insert(quote_prefix+"/"+quoteId, map[string]interface{}{
+		"type":    "quote",
+		"quoteId": quoteId,
+		"usedAt":  time.Now().UTC(),
+	}, &gocb.InsertOptions{Expiry: time.Until(expiresAt) + time.Minute})
+	if errors.Is(err, gocb.ErrDocumentExists) {
+		return ERR_QUOTE_USED
+	}
+	return err
+}
+
 func (service *TransactionService) Create(ctx context.Context, transaction *models.Transaction) error {
 	fName := "service/transaction/create"
 	tracer := otel.Tracer("api")
@@ -37,8 +115,14 @@ func (service *TransactionService) Create(ctx context.Context, transaction *mode
 	transaction.DocType = "tx"
 	transaction.Channel = "loyyalchannel"
 	transaction.Creator = "admin"
-	transaction.ExtID = common.GenerateIdentifier(62)
+	// external id is generated only when the caller has not supplied one
+	if transaction.ExtID == "" {
+		transaction.ExtID = common.GenerateIdentifier(62)
+	}
 	transaction.CreatedOn = time.Now()
+	if transaction.OriginalAmount == 0 {
+		transaction.OriginalAmount = transaction.Amount
+	}
 
 	// adding this reference that will be send to blockchain
 	// and used in callback to update the same document in database
@@ -47,6 +131,8 @@ func (service *TransactionService) Create(ctx context.Context, transaction *mode
 		return err
 	}
 	transaction.RefID = ref
+	transaction.Status = TRANSACTION_STATUS_ACCEPTED
+	transaction.StatusHistory = []models.TransactionStatusChange{{Status: TRANSACTION_STATUS_ACCEPTED, ChangedAt: transaction.CreatedOn.UTC()}}
 
 	col := service.bucket.DefaultCollection()
 	_, err = col.Insert(transaction_prefix+"/"+transaction.ExtID, transaction, nil)
@@ -56,7 +142,7 @@ func (service *TransactionService) Create(ctx context.Context, transaction *mode
 
 }
 
-func (service *TransactionService) Get(ctx context.Context, transactionId string) (any, error) {
+func (service *TransactionService) Get(ctx context.Context, transactionId string) (models.Transaction, error) {
 	fName := "service/transaction/get"
 	tracer := otel.Tracer("api")
 	_, span := tracer.Start(ctx, fName)
@@ -66,19 +152,447 @@ func (service *TransactionService) Get(ctx context.Context, transactionId string
 	doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
 	if doc == nil {
 		if err != nil {
-			return "", errors.New("error: no transaction found")
+			return models.Transaction{}, errors.New("error: no transaction found")
 		}
 	}
 
 	var transaction models.Transaction
 	err = doc.Content(&transaction)
 	if err != nil {
-		return nil, err
+		return models.Transaction{}, err
 	}
 	return transaction, err
 
 }
 
+func (service *TransactionService) Update(ctx context.Context, transaction *models.Transaction) error {
+	fName := "service/transaction/update"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	_, err := col.Replace(transaction_prefix+"/"+transaction.ExtID, transaction, nil)
+	span.AddEvent("updated transaction to couchbase")
+
+	return err
+}
+
+// Settle records the external settlement of a pending withdrawal. The change is
+// made only while the withdrawal is still pending, so of two concurrent
+// settlements a single one wins and the other gets ERR_WITHDRAW_NOT_PENDING.
+func (service *TransactionService) Settle(ctx context.Context, transactionId string, status string, reference string, remarks string) (models.Transaction, error) {
+	fName := "service/transaction/settle"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
+		if err != nil {
+			return models.Transaction{}, errors.New("error: no transaction found")
+		}
+
+		var transaction models.Transaction
+		err = doc.Content(&transaction)
+		if err != nil {
+			return models.Transaction{}, err
+		}
+
+		if transaction.SettlementStatus != SETTLEMENT_STATUS_PENDING {
+			return transaction, ERR_WITHDRAW_NOT_PENDING
+		}
+		if transaction.ReversalStatus != "" {
+			return transaction, ERR_WITHDRAW_REVERSED
+		}
+		if EffectiveStatus(transaction) != TRANSACTION_STATUS_COMMITTED {
+			return transaction, ERR_WITHDRAW_NOT_BOOKED
+		}
+
+		transaction.SettlementStatus = status
+		transaction.SettlementReference = reference
+		transaction.SettledAt = time.Now().UTC()
+		if remarks != "" {
+			transaction.Remarks = remarks
+		}
+
+		_, err = col.Replace(transaction_prefix+"/"+transactionId, transaction, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			// re-checking that the withdrawal is still pending
+			continue
+		}
+		if err != nil {
+			return transaction, err
+		}
+
+		span.AddEvent("settlement recorded")
+		return transaction, nil
+	}
+
+	return models.Transaction{}, errors.New("error: transaction is being modified concurrently, try again")
+}
+
+// RecordConsumedLots keeps the lots the transaction took its points from
+func (service *TransactionService) RecordConsumedLots(ctx context.Context, transactionId string, consumed []models.LotConsumption) error {
+	fName := "service/transaction/recordConsumedLots"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
+		if err != nil {
+			return errors.New("error: no transaction found")
+		}
+
+		var transaction models.Transaction
+		if err := doc.Content(&transaction); err != nil {
+			return err
+		}
+		transaction.ConsumedLots = consumed
+
+		_, err = col.Replace(transaction_prefix+"/"+transactionId, transaction, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return err
+	}
+
+	return errors.New("error: transaction is being modified concurrently, try again")
+}
+
+// SetStatus moves the transaction to the status and records the transition,
+// errmsg keeps the reason of a rejection or a failure. Setting the status the
+// transaction already has is a no-op.
+func (service *TransactionService) SetStatus(ctx context.Context, transactionId string, status string, errmsg string) (models.Transaction, error) {
+	fName := "service/transaction/setStatus"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	return service.mutate(ctx, transactionId, func(transaction *models.Transaction) error {
+		return applyStatus(transaction, status, errmsg)
+	})
+}
+
+// ApplyResult records the callback of the chaincode on the transaction it is for,
+// it tells whether the status changed so that a redelivered callback is not
+// acted upon twice
+func (service *TransactionService) ApplyResult(ctx context.Context, result models.TransactionResult) (models.Transaction, bool, error) {
+	fName := "service/transaction/applyResult"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	// the callback can follow the insert of the transaction closely, the index
+	// is read once it has caught up with it
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='tx' AND ref=$ref limit 1"
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(query, &gocb.QueryOptions{
+		NamedParameters: map[string]interface{}{"ref": result.RefID},
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return models.Transaction{}, false, err
+	}
+	transactions := parseTransactionRows(rows)
+	if len(transactions) == 0 {
+		return models.Transaction{}, false, errors.New("error: no transaction found for the reference " + result.RefID)
+	}
+
+	changed := false
+	transaction, err := service.mutate(ctx, transactions[0].ExtID, func(transaction *models.Transaction) error {
+		status := TRANSACTION_STATUS_COMMITTED
+		if result.Error != "" {
+			status = TRANSACTION_STATUS_REJECTED
+		}
+		changed = EffectiveStatus(*transaction) != status
+		if result.Error != "" {
+			// a withdrawal the ledger rejected never left the wallet, there is
+			// nothing to settle or to refund
+			if changed && transaction.SettlementStatus == SETTLEMENT_STATUS_PENDING {
+				transaction.SettlementStatus = SETTLEMENT_STATUS_FAILED
+				transaction.SettledAt = time.Now().UTC()
+			}
+			return applyStatus(transaction, status, result.Error)
+		}
+
+		transaction.UUID = result.UUID
+		transaction.RawTimestamp = result.Timestamp
+		return applyStatus(transaction, status, "")
+	})
+	return transaction, changed && err == nil, err
+}
+
+// mutate applies the change to the stored transaction, retrying on concurrent updates
+func (service *TransactionService) mutate(ctx context.Context, transactionId string, change func(*models.Transaction) error) (models.Transaction, error) {
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
+		if err != nil {
+			return models.Transaction{}, errors.New("error: no transaction found")
+		}
+
+		var transaction models.Transaction
+		err = doc.Content(&transaction)
+		if err != nil {
+			return models.Transaction{}, err
+		}
+
+		previous := transaction.Status
+		if err := change(&transaction); err != nil {
+			return transaction, err
+		}
+		if previous == transaction.Status && len(transaction.StatusHistory) > 0 {
+			return transaction, nil
+		}
+
+		_, err = col.Replace(transaction_prefix+"/"+transactionId, transaction, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return transaction, err
+	}
+
+	return models.Transaction{}, errors.New("error: transaction is being modified concurrently, try again")
+}
+
+func applyStatus(transaction *models.Transaction, status string, errmsg string) error {
+	current := EffectiveStatus(*transaction)
+	if current == status {
+		return nil
+	}
+
+	allowed := false
+	for _, next := range transactionTransitions[current] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return ERR_TRANSACTION_STATUS_TRANSITION
+	}
+
+	now := time.Now().UTC()
+	transaction.Status = status
+	transaction.Error = errmsg
+	transaction.StatusHistory = append(transaction.StatusHistory, models.TransactionStatusChange{
+		Status:    status,
+		Error:     errmsg,
+		ChangedAt: now,
+	})
+	if status == TRANSACTION_STATUS_COMMITTED {
+		transaction.CommittedOn = &now
+	}
+	return nil
+}
+
+// EffectiveStatusExpression is EffectiveStatus as a N1QL expression, it lets
+// the queries filter the transactions stored before the status was recorded
+const EffectiveStatusExpression = "CASE WHEN IFMISSINGORNULL(status, '') != '' THEN status" +
+	" WHEN IFMISSINGORNULL(tx_uuid, '') != '' THEN '" + TRANSACTION_STATUS_COMMITTED + "'" +
+	" WHEN IFMISSINGORNULL(errmsg, '') != '' THEN '" + TRANSACTION_STATUS_REJECTED + "'" +
+	" ELSE '" + TRANSACTION_STATUS_PUBLISHED + "' END"
+
+// EffectiveStatus returns the status of the transaction, transactions stored
+// before the status was recorded get it from their chain fields
+func EffectiveStatus(transaction models.Transaction) string {
+	if transaction.Status != "" {
+		return transaction.Status
+	}
+	if transaction.UUID != "" {
+		return TRANSACTION_STATUS_COMMITTED
+	}
+	if transaction.Error != "" {
+		return TRANSACTION_STATUS_REJECTED
+	}
+	return TRANSACTION_STATUS_PUBLISHED
+}
+
+// WasPublished tells whether the transaction was sent to the ledger once, a
+// transaction failing while it was priced never was. Transactions stored before
+// the status was recorded were all published.
+func WasPublished(transaction models.Transaction) bool {
+	if transaction.Status == "" {
+		return true
+	}
+	for _, change := range transaction.StatusHistory {
+		switch change.Status {
+		case TRANSACTION_STATUS_PUBLISHED, TRANSACTION_STATUS_COMMITTED, TRANSACTION_STATUS_REJECTED:
+			return true
+		}
+	}
+	return false
+}
+
+// ReserveReversal marks the transaction as (partially) reversed by the given
+// amount and returns the reserved amount and the points to reverse. An amount of zero reverses whatever is
+// remaining. The points are derived from the amounts recorded on the transaction,
+// so the contract rate applied at the time is honoured and not today's rate.
+func (service *TransactionService) ReserveReversal(ctx context.Context, transactionId string, amount int64, reversalId string) (models.Transaction, int64, int64, error) {
+	fName := "service/transaction/reserveReversal"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
+		if err != nil {
+			return models.Transaction{}, 0, 0, errors.New("error: no transaction found")
+		}
+
+		var transaction models.Transaction
+		err = doc.Content(&transaction)
+		if err != nil {
+			return models.Transaction{}, 0, 0, err
+		}
+
+		if transaction.TransactionType == TRANSACTION_TYPE_REVERSAL {
+			return transaction, 0, 0, ERR_TRANSACTION_NOT_REVERSIBLE
+		}
+		// the ledger never booked the points of a transaction it has not committed
+		if EffectiveStatus(transaction) != TRANSACTION_STATUS_COMMITTED {
+			return transaction, 0, 0, ERR_TRANSACTION_NOT_COMMITTED
+		}
+		// a withdrawal still pending may yet be refunded by a failed settlement
+		if transaction.SettlementStatus != "" && transaction.SettlementStatus != SETTLEMENT_STATUS_COMPLETED {
+			return transaction, 0, 0, ERR_WITHDRAW_NOT_SETTLED
+		}
+
+		originalAmount := transaction.OriginalAmount
+		if originalAmount == 0 {
+			originalAmount = transaction.Amount
+		}
+
+		remaining := originalAmount - transaction.ReversedAmount
+		reversed := amount
+		if reversed == 0 {
+			reversed = remaining
+		}
+		if reversed <= 0 || reversed > remaining {
+			return transaction, 0, 0, ERR_REVERSAL_EXCEEDS_REMAINING
+		}
+
+		var points int64
+		if reversed == remaining {
+			points = transaction.Amount - transaction.ReversedPoints
+		} else {
+			points = new(big.Int).Div(
+				new(big.Int).Mul(big.NewInt(transaction.Amount), big.NewInt(reversed)),
+				big.NewInt(originalAmount),
+			).Int64()
+		}
+
+		transaction.ReversedAmount += reversed
+		transaction.ReversedPoints += points
+		transaction.Reversals = append(transaction.Reversals, reversalId)
+		transaction.ReversalStatus = REVERSAL_STATUS_PARTIAL
+		if transaction.ReversedAmount == originalAmount {
+			transaction.ReversalStatus = REVERSAL_STATUS_FULL
+		}
+
+		_, err = col.Replace(transaction_prefix+"/"+transactionId, transaction, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			// another reversal got in first, re-evaluating the remaining amount
+			continue
+		}
+		if err != nil {
+			return transaction, 0, 0, err
+		}
+
+		span.AddEvent("reversal reserved")
+		return transaction, reversed, points, nil
+	}
+
+	return models.Transaction{}, 0, 0, errors.New("error: transaction is being modified concurrently, try again")
+}
+
+// ReleaseReversal undoes a reservation made by ReserveReversal when the
+// compensating transaction could not be created.
+func (service *TransactionService) ReleaseReversal(ctx context.Context, transactionId string, amount int64, points int64, reversalId string) error {
+	fName := "service/transaction/releaseReversal"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(transaction_prefix+"/"+transactionId, nil)
+		if err != nil {
+			return err
+		}
+
+		var transaction models.Transaction
+		err = doc.Content(&transaction)
+		if err != nil {
+			return err
+		}
+
+		transaction.ReversedAmount -= amount
+		transaction.ReversedPoints -= points
+		reversals := []string{}
+		for _, id := range transaction.Reversals {
+			if id != reversalId {
+				reversals = append(reversals, id)
+			}
+		}
+		transaction.Reversals = reversals
+		transaction.ReversalStatus = REVERSAL_STATUS_PARTIAL
+		if transaction.ReversedAmount == 0 {
+			transaction.ReversalStatus = ""
+		}
+
+		_, err = col.Replace(transaction_prefix+"/"+transactionId, transaction, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return err
+	}
+
+	return errors.New("error: transaction is being modified concurrently, try again")
+}
+
+// Spend sums up what the member earned points on since the time, the amounts
+// as submitted less what has been reversed. Rejected transactions and the
+// transaction being priced are left out.
+func (service *TransactionService) Spend(ctx context.Context, walletId string, since time.Time, except string) (int64, error) {
+	fName := "service/transaction/spend"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	// transactions priced before the original amount was kept only have an amount
+	query := "select IFMISSINGORNULL(SUM(CASE WHEN IFMISSINGORNULL(originalAmount, 0) > 0 THEN originalAmount ELSE amount END - IFMISSINGORNULL(reversedAmount, 0)), 0) as spend" +
+		" from `testbucket`.`_default`.`_default` data where type='tx' AND to_extid=$wallet AND transactionType IN $types" +
+		" AND IFMISSINGORNULL(status, '')!=$rejected AND ext!=$except AND STR_TO_MILLIS(createdOn) >= STR_TO_MILLIS($since)"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: map[string]interface{}{
+			"wallet":   walletId,
+			"types":    []string{TRANSACTION_TYPE_ISSUE, TRANSACTION_TYPE_DEPOSIT},
+			"rejected": TRANSACTION_STATUS_REJECTED,
+			"except":   except,
+			"since":    since.UTC().Format(time.RFC3339Nano),
+		}})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var result struct {
+		Spend int64 `json:"spend"`
+	}
+	if err := rows.One(&result); err != nil {
+		return 0, err
+	}
+	return result.Spend, nil
+}
+
 func (service *TransactionService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.Transaction, error) {
 	fName := "service/transaction/create"
 	tracer := otel.Tracer("api")
@@ -105,6 +619,39 @@ func (service *TransactionService) Filter(ctx context.Context, queryString strin
 	return parseTransactionRows(rows), nil
 }
 
+// Export runs the filter and hands the transactions to each one by one as they
+// are read from the query, so that no result set is held in memory
+func (service *TransactionService) Export(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, each func(*models.Transaction) error) error {
+	fName := "service/transaction/export"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='tx' "
+	query += queryString
+	query += " order by " + sortBy
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params, Context: ctx})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj models.Transaction
+		if err := rows.Row(&obj); err != nil {
+			return err
+		}
+		if err := each(&obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func parseTransactionRows(rows *gocb.QueryResult) []*models.Transaction {
 	var transactions []*models.Transaction
 	for rows.Next() {
@@ -29,6 +29,93 @@ const (
 	WALLET_STATUS_SUBSPENDED = "suspended"
 	WALLET_STATUS_DISABLED   = "disabled"
 	WALLET_STATUS_EXPIRED    = "expired"
+	WALLET_STATUS_CLOSED     = "closed"
+)
+
+// reason codes of a wallet status change
+const (
+	WALLET_REASON_CUSTOMER_REQUEST  = "customer_request"
+	WALLET_REASON_OPERATOR_REQUEST  = "operator_request"
+	WALLET_REASON_FRAUD_SUSPECTED   = "fraud_suspected"
+	WALLET_REASON_COMPLIANCE_HOLD   = "compliance_hold"
+	WALLET_REASON_INACTIVITY        = "inactivity"
+	WALLET_REASON_REINSTATED        = "reinstated"
+	WALLET_REASON_MERGED            = "merged"
+	WALLET_REASON_MERGE_ROLLED_BACK = "merge_rolled_back"
+)
+
+// walletTransitions lists the statuses a wallet can move to from its current
+// status. A closed wallet is final, it only reopens when the merge that closed
+// it is rolled back.
+var walletTransitions = map[string][]string{
+	WALLET_STATUS_ACTIVE:     {WALLET_STATUS_SUBSPENDED, WALLET_STATUS_DISABLED, WALLET_STATUS_EXPIRED, WALLET_STATUS_CLOSED},
+	WALLET_STATUS_SUBSPENDED: {WALLET_STATUS_ACTIVE, WALLET_STATUS_DISABLED, WALLET_STATUS_CLOSED},
+	WALLET_STATUS_DISABLED:   {WALLET_STATUS_ACTIVE, WALLET_STATUS_CLOSED},
+	WALLET_STATUS_EXPIRED:    {WALLET_STATUS_ACTIVE, WALLET_STATUS_CLOSED},
+	WALLET_STATUS_CLOSED:     {WALLET_STATUS_ACTIVE},
+}
+
+var walletReasons = map[string]bool{
+	WALLET_REASON_CUSTOMER_REQUEST:  true,
+	WALLET_REASON_OPERATOR_REQUEST:  true,
+	WALLET_REASON_FRAUD_SUSPECTED:   true,
+	WALLET_REASON_COMPLIANCE_HOLD:   true,
+	WALLET_REASON_INACTIVITY:        true,
+	WALLET_REASON_REINSTATED:        true,
+	WALLET_REASON_MERGED:            true,
+	WALLET_REASON_MERGE_ROLLED_BACK: true,
+}
+
+// walletFlow tells whether a wallet in the status can receive (inbound) and
+// send (outbound) points
+var walletFlow = map[string]struct{ inbound, outbound bool }{
+	WALLET_STATUS_ACTIVE:     {inbound: true, outbound: true},
+	WALLET_STATUS_SUBSPENDED: {inbound: true, outbound: false},
+	WALLET_STATUS_DISABLED:   {inbound: false, outbound: false},
+	WALLET_STATUS_EXPIRED:    {inbound: false, outbound: false},
+	WALLET_STATUS_CLOSED:     {inbound: false, outbound: false},
+}
+
+var (
+	ERR_WALLET_DELETED            = errors.New("error: wallet is deleted")
+	ERR_INVALID_WALLET_STATUS     = errors.New("error: wallet status must be active, suspended, disabled, expired or closed")
+	ERR_INVALID_STATUS_REASON     = errors.New("error: a valid reason code is required to change the wallet status")
+	ERR_WALLET_TRANSITION_DENIED  = errors.New("error: wallet status transition is not allowed")
+	ERR_WALLET_INBOUND_BLOCKED    = errors.New("error: wallet can not receive points in its current status")
+	ERR_WALLET_OUTBOUND_BLOCKED   = errors.New("error: wallet can not send points in its current status")
+	ERR_WALLET_STATUS_UNCHANGED   = errors.New("error: wallet is already in the requested status")
+	ERR_WALLET_REOPEN_NOT_ALLOWED = errors.New("error: a closed wallet only reopens when its merge is rolled back")
+	ERR_WALLET_NOT_EMPTY          = errors.New("error: a wallet can only be closed once its balance is transferred out")
+)
+
+const (
+	wallet_membership_prefix = "wallet_membership"
+)
+
+const (
+	WALLET_ROLE_OWNER   = "owner"
+	WALLET_ROLE_SPENDER = "spender"
+	WALLET_ROLE_VIEWER  = "viewer"
+
+	WALLET_MEMBER_INVITED = "invited"
+	WALLET_MEMBER_ACTIVE  = "active"
+
+	MEMBERSHIP_ACTION_INVITED  = "invited"
+	MEMBERSHIP_ACTION_ACCEPTED = "accepted"
+	MEMBERSHIP_ACTION_UPDATED  = "updated"
+	MEMBERSHIP_ACTION_REMOVED  = "removed"
+)
+
+var (
+	ERR_INVALID_WALLET_ROLE     = errors.New("error: role must be owner, spender or viewer")
+	ERR_SPEND_LIMIT_REQUIRED    = errors.New("error: spender requires a positive spend limit")
+	ERR_ALREADY_WALLET_MEMBER   = errors.New("error: identity is already a member of the wallet")
+	ERR_NOT_WALLET_MEMBER       = errors.New("error: identity is not a member of the wallet")
+	ERR_NOT_WALLET_INVITEE      = errors.New("error: identity has no pending invitation to the wallet")
+	ERR_LAST_WALLET_OWNER       = errors.New("error: the last owner of a wallet can not be removed or downgraded")
+	ERR_MEMBER_CANNOT_SPEND     = errors.New("error: member is not allowed to spend from the wallet")
+	ERR_SPEND_ALLOWANCE_EXCEEDS = errors.New("error: amount exceeds the remaining spend allowance")
+	ERR_BALANCE_CHANGED         = errors.New("error: wallet balance has changed since the mismatch was found")
 )
 
 func NewWallet(cluster *gocb.Cluster, bucket *gocb.Bucket) WalletService {
@@ -41,6 +128,7 @@ func (service *WalletService) Create(ctx context.Context, wallet *models.Wallet,
 	wallet.DocType = "wallet"
 	wallet.LinkedTo = []string{linkedTo}
 	wallet.Balance = preLoadAmount
+	wallet.InitialBalance = &preLoadAmount
 
 	wallet.WalletType = "regular"
 	wallet.Creator = "admin"
@@ -51,6 +139,14 @@ func (service *WalletService) Create(ctx context.Context, wallet *models.Wallet,
 	wallet.CreatedAt = now
 	wallet.LastUpdatedAt = now
 	wallet.LastUpdatedBy = wallet.Creator
+	wallet.Members = []models.WalletMember{{
+		IdentityId:    linkedTo,
+		Role:          WALLET_ROLE_OWNER,
+		Status:        WALLET_MEMBER_ACTIVE,
+		InvitedBy:     wallet.Creator,
+		CreatedAt:     now,
+		LastUpdatedAt: now,
+	}}
 
 	// adding this reference that will be send to blockchain
 	// and used in callback to update the same document in database
@@ -86,35 +182,159 @@ func (service *WalletService) Get(ctx context.Context, walletId string) (models.
 		return models.Wallet{}, err
 	}
 
+	if wallet.IsDeleted {
+		return models.Wallet{}, ERR_WALLET_DELETED
+	}
+
 	return wallet, err
 
 }
 
-func (service *WalletService) Update(ctx context.Context, walletId string, sessionedUser string, updatedStatus string) error {
+// ChangeStatus moves the wallet to the status when the state machine allows it
+// and records the transition. The previous status is returned.
+func (service *WalletService) ChangeStatus(ctx context.Context, walletId string, status string, reason string, note string, actor string) (models.Wallet, string, error) {
+	fName := "service/wallet/changeStatus"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	if _, found := walletTransitions[status]; !found {
+		return models.Wallet{}, "", ERR_INVALID_WALLET_STATUS
+	}
+	if !walletReasons[reason] {
+		return models.Wallet{}, "", ERR_INVALID_STATUS_REASON
+	}
+
 	col := service.bucket.DefaultCollection()
-	doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
-	if doc == nil {
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
 		if err != nil {
-			return errors.New("error: no wallet found")
+			return models.Wallet{}, "", errors.New("error: no wallet found")
+		}
+
+		var wallet models.Wallet
+		err = doc.Content(&wallet)
+		if err != nil {
+			return models.Wallet{}, "", err
+		}
+
+		if wallet.IsDeleted {
+			return wallet, "", ERR_WALLET_DELETED
+		}
+
+		previous := wallet.Status
+		if err := CanTransition(previous, status, reason); err != nil {
+			return wallet, previous, err
+		}
+		// points left in a closed wallet could never be spent, merges close the
+		// wallet once they have moved its balance
+		if status == WALLET_STATUS_CLOSED && reason != WALLET_REASON_MERGED && wallet.Balance != 0 {
+			return wallet, previous, ERR_WALLET_NOT_EMPTY
 		}
+
+		now := time.Now().UTC()
+		// the channel is not stored with the wallet
+		wallet.Channel = "loyyalchannel"
+		wallet.Status = status
+		wallet.StatusReason = reason
+		wallet.StatusHistory = append(wallet.StatusHistory, models.WalletStatusChange{
+			From:      previous,
+			To:        status,
+			Reason:    reason,
+			Note:      note,
+			Actor:     actor,
+			ChangedAt: now,
+		})
+		wallet.LastUpdatedAt = now
+		wallet.LastUpdatedBy = actor
+
+		_, err = col.Replace(wallet_prefix+"/"+walletId, wallet, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		span.AddEvent("wallet status changed from " + previous + " to " + status)
+		return wallet, previous, err
 	}
 
-	var wallet models.Wallet
-	err = doc.Content(&wallet)
-	if err != nil {
-		return err
+	return models.Wallet{}, "", errors.New("error: wallet is being modified concurrently, try again")
+}
+
+// CorrectBalance sets the off-chain balance of the wallet to the one of the
+// ledger, it fails when the balance has changed since the mismatch was found
+func (service *WalletService) CorrectBalance(ctx context.Context, walletId string, from int64, to int64, actor string) (models.Wallet, error) {
+	fName := "service/wallet/correctBalance"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
+		if err != nil {
+			return models.Wallet{}, errors.New("error: no wallet found")
+		}
+
+		var wallet models.Wallet
+		err = doc.Content(&wallet)
+		if err != nil {
+			return models.Wallet{}, err
+		}
+
+		if wallet.Balance != from {
+			return wallet, ERR_BALANCE_CHANGED
+		}
+
+		wallet.Balance = to
+		wallet.LastUpdatedAt = time.Now().UTC()
+		wallet.LastUpdatedBy = actor
+
+		_, err = col.Replace(wallet_prefix+"/"+walletId, wallet, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		span.AddEvent("wallet balance corrected")
+		return wallet, err
 	}
 
-	wallet.Status = updatedStatus
-	location, _ := time.LoadLocation("UTC")
-	now, _ := time.Parse(time.RFC1123, time.Now().In(location).Format(time.RFC1123))
-	wallet.LastUpdatedAt = now
-	wallet.LastUpdatedBy = sessionedUser
+	return models.Wallet{}, errors.New("error: wallet is being modified concurrently, try again")
+}
 
-	// TODO: need to convert it into soft delete
-	_, err = col.Replace(wallet_prefix+"/"+walletId, wallet, nil)
-	return err
+// CanTransition checks the move of a wallet between the statuses
+func CanTransition(from string, to string, reason string) error {
+	if from == to {
+		return ERR_WALLET_STATUS_UNCHANGED
+	}
+	if from == WALLET_STATUS_CLOSED && reason != WALLET_REASON_MERGE_ROLLED_BACK {
+		return ERR_WALLET_REOPEN_NOT_ALLOWED
+	}
+	for _, allowed := range walletTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return ERR_WALLET_TRANSITION_DENIED
+}
+
+// CanReceive checks that the wallet accepts inbound points
+func CanReceive(wallet models.Wallet) error {
+	if wallet.IsDeleted {
+		return ERR_WALLET_DELETED
+	}
+	if !walletFlow[wallet.Status].inbound {
+		return ERR_WALLET_INBOUND_BLOCKED
+	}
+	return nil
+}
 
+// CanSend checks that the wallet allows outbound points
+func CanSend(wallet models.Wallet) error {
+	if wallet.IsDeleted {
+		return ERR_WALLET_DELETED
+	}
+	if !walletFlow[wallet.Status].outbound {
+		return ERR_WALLET_OUTBOUND_BLOCKED
+	}
+	return nil
 }
 
 func (service *WalletService) Delete(ctx context.Context, walletId string, sessionedUser string) error {
@@ -144,6 +364,288 @@ func (service *WalletService) Delete(ctx context.Context, walletId string, sessi
 
 }
 
+// Members returns the members of the wallet, wallets created before sharing was
+// introduced have their linked identities as owners.
+func Members(wallet models.Wallet) []models.WalletMember {
+	if len(wallet.Members) > 0 {
+		return wallet.Members
+	}
+
+	members := []models.WalletMember{}
+	for _, identityId := range wallet.LinkedTo {
+		members = append(members, models.WalletMember{IdentityId: identityId, Role: WALLET_ROLE_OWNER, Status: WALLET_MEMBER_ACTIVE})
+	}
+	return members
+}
+
+// Member returns the membership of the identity on the wallet
+func Member(wallet models.Wallet, identityId string) (models.WalletMember, bool) {
+	for _, member := range Members(wallet) {
+		if member.IdentityId == identityId {
+			return member, true
+		}
+	}
+	return models.WalletMember{}, false
+}
+
+// InviteMember adds the identity to the wallet, it becomes active once accepted
+func (service *WalletService) InviteMember(ctx context.Context, walletId string, identityId string, role string, spendLimit int64, actor string) (models.Wallet, error) {
+	if err := validateMemberRole(role, spendLimit); err != nil {
+		return models.Wallet{}, err
+	}
+
+	return service.updateMembers(ctx, walletId, actor, func(members []models.WalletMember, now time.Time) ([]models.WalletMember, *models.WalletMembershipAudit, error) {
+		for _, member := range members {
+			if member.IdentityId == identityId {
+				return nil, nil, ERR_ALREADY_WALLET_MEMBER
+			}
+		}
+
+		members = append(members, models.WalletMember{
+			IdentityId:    identityId,
+			Role:          role,
+			SpendLimit:    spendLimit,
+			Status:        WALLET_MEMBER_INVITED,
+			InvitedBy:     actor,
+			CreatedAt:     now,
+			LastUpdatedAt: now,
+		})
+		return members, &models.WalletMembershipAudit{IdentityId: identityId, Action: MEMBERSHIP_ACTION_INVITED, Role: role, SpendLimit: spendLimit}, nil
+	})
+}
+
+func (service *WalletService) AcceptInvite(ctx context.Context, walletId string, identityId string, actor string) (models.Wallet, error) {
+	return service.updateMembers(ctx, walletId, actor, func(members []models.WalletMember, now time.Time) ([]models.WalletMember, *models.WalletMembershipAudit, error) {
+		for i, member := range members {
+			if member.IdentityId == identityId && member.Status == WALLET_MEMBER_INVITED {
+				members[i].Status = WALLET_MEMBER_ACTIVE
+				members[i].LastUpdatedAt = now
+				return members, &models.WalletMembershipAudit{IdentityId: identityId, Action: MEMBERSHIP_ACTION_ACCEPTED, Role: member.Role, SpendLimit: member.SpendLimit}, nil
+			}
+		}
+		return nil, nil, ERR_NOT_WALLET_INVITEE
+	})
+}
+
+// UpdateMember changes the role or the spend limit of a member, a new limit
+// starts a fresh allowance
+func (service *WalletService) UpdateMember(ctx context.Context, walletId string, identityId string, role string, spendLimit int64, actor string) (models.Wallet, error) {
+	if err := validateMemberRole(role, spendLimit); err != nil {
+		return models.Wallet{}, err
+	}
+
+	return service.updateMembers(ctx, walletId, actor, func(members []models.WalletMember, now time.Time) ([]models.WalletMember, *models.WalletMembershipAudit, error) {
+		for i, member := range members {
+			if member.IdentityId != identityId {
+				continue
+			}
+			if member.Role == WALLET_ROLE_OWNER && role != WALLET_ROLE_OWNER && countOwners(members) == 1 {
+				return nil, nil, ERR_LAST_WALLET_OWNER
+			}
+
+			members[i].Role = role
+			if members[i].SpendLimit != spendLimit {
+				members[i].Spent = 0
+			}
+			members[i].SpendLimit = spendLimit
+			members[i].LastUpdatedAt = now
+			return members, &models.WalletMembershipAudit{IdentityId: identityId, Action: MEMBERSHIP_ACTION_UPDATED, Role: role, PreviousRole: member.Role, SpendLimit: spendLimit}, nil
+		}
+		return nil, nil, ERR_NOT_WALLET_MEMBER
+	})
+}
+
+func (service *WalletService) RemoveMember(ctx context.Context, walletId string, identityId string, actor string) (models.Wallet, error) {
+	return service.updateMembers(ctx, walletId, actor, func(members []models.WalletMember, now time.Time) ([]models.WalletMember, *models.WalletMembershipAudit, error) {
+		for i, member := range members {
+			if member.IdentityId != identityId {
+				continue
+			}
+			if member.Role == WALLET_ROLE_OWNER && member.Status == WALLET_MEMBER_ACTIVE && countOwners(members) == 1 {
+				return nil, nil, ERR_LAST_WALLET_OWNER
+			}
+
+			members = append(members[:i], members[i+1:]...)
+			return members, &models.WalletMembershipAudit{IdentityId: identityId, Action: MEMBERSHIP_ACTION_REMOVED, PreviousRole: member.Role}, nil
+		}
+		return nil, nil, ERR_NOT_WALLET_MEMBER
+	})
+}
+
+// ReserveAllowance checks that the member may spend the amount from the wallet
+// and takes it from the allowance of a spender. It tells whether an allowance
+// was charged, owners spend without one.
+func (service *WalletService) ReserveAllowance(ctx context.Context, walletId string, identityId string, amount int64) (bool, error) {
+	return service.adjustAllowance(ctx, walletId, identityId, amount)
+}
+
+// ReleaseAllowance gives back an allowance reserved for a spend that did not happen
+func (service *WalletService) ReleaseAllowance(ctx context.Context, walletId string, identityId string, amount int64) error {
+	_, err := service.adjustAllowance(ctx, walletId, identityId, -amount)
+	return err
+}
+
+func (service *WalletService) adjustAllowance(ctx context.Context, walletId string, identityId string, amount int64) (bool, error) {
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
+		if err != nil {
+			return false, errors.New("error: no wallet found")
+		}
+
+		var wallet models.Wallet
+		err = doc.Content(&wallet)
+		if err != nil {
+			return false, err
+		}
+
+		member, found := Member(wallet, identityId)
+		if !found || member.Status != WALLET_MEMBER_ACTIVE {
+			return false, ERR_NOT_WALLET_MEMBER
+		}
+		switch member.Role {
+		case WALLET_ROLE_OWNER:
+			return false, nil
+		case WALLET_ROLE_VIEWER:
+			return false, ERR_MEMBER_CANNOT_SPEND
+		}
+
+		for i := range wallet.Members {
+			if wallet.Members[i].IdentityId != identityId {
+				continue
+			}
+			if amount > 0 && wallet.Members[i].Spent+amount > wallet.Members[i].SpendLimit {
+				return false, ERR_SPEND_ALLOWANCE_EXCEEDS
+			}
+			wallet.Members[i].Spent += amount
+			if wallet.Members[i].Spent < 0 {
+				wallet.Members[i].Spent = 0
+			}
+		}
+
+		_, err = col.Replace(wallet_prefix+"/"+walletId, wallet, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		return err == nil, err
+	}
+
+	return false, errors.New("error: wallet is being modified concurrently, try again")
+}
+
+// updateMembers applies the change to the members of the wallet, keeps the
+// linked identities in sync and records the change in the membership audit.
+func (service *WalletService) updateMembers(ctx context.Context, walletId string, actor string, change func([]models.WalletMember, time.Time) ([]models.WalletMember, *models.WalletMembershipAudit, error)) (models.Wallet, error) {
+	fName := "service/wallet/updateMembers"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	col := service.bucket.DefaultCollection()
+	for attempt := 0; attempt < 3; attempt++ {
+		doc, err := col.Get(wallet_prefix+"/"+walletId, nil)
+		if err != nil {
+			return models.Wallet{}, errors.New("error: no wallet found")
+		}
+
+		var wallet models.Wallet
+		err = doc.Content(&wallet)
+		if err != nil {
+			return models.Wallet{}, err
+		}
+
+		now := time.Now().UTC()
+		members, audit, err := change(append([]models.WalletMember{}, Members(wallet)...), now)
+		if err != nil {
+			return wallet, err
+		}
+
+		wallet.Members = members
+		wallet.LinkedTo = []string{}
+		for _, member := range members {
+			if member.Status == WALLET_MEMBER_ACTIVE {
+				wallet.LinkedTo = append(wallet.LinkedTo, member.IdentityId)
+			}
+		}
+		wallet.LastUpdatedAt = now
+		wallet.LastUpdatedBy = actor
+
+		_, err = col.Replace(wallet_prefix+"/"+walletId, wallet, &gocb.ReplaceOptions{Cas: doc.Cas()})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			continue
+		}
+		if err != nil {
+			return wallet, err
+		}
+
+		audit.DocType = "wallet_membership"
+		audit.Identifier = common.GenerateIdentifier(30)
+		audit.WalletId = walletId
+		audit.Actor = actor
+		audit.CreatedAt = now
+		_, err = col.Insert(wallet_membership_prefix+"/"+audit.Identifier, audit, nil)
+		span.AddEvent("wallet membership " + audit.Action)
+		return wallet, err
+	}
+
+	return models.Wallet{}, errors.New("error: wallet is being modified concurrently, try again")
+}
+
+// MembershipAudit returns the membership changes matching the query, for a wallet or an identity
+func (service *WalletService) MembershipAudit(ctx context.Context, queryString string, params map[string]interface{}) ([]*models.WalletMembershipAudit, error) {
+	fName := "service/wallet/membershipAudit"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket`.`_default`.`_default` data where type='wallet_membership' "
+	query += queryString
+	query += " order by createdAt"
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params})
+
+	if err != nil {
+		return nil, err
+	}
+
+	audits := []*models.WalletMembershipAudit{}
+	for rows.Next() {
+		var obj models.WalletMembershipAudit
+		if err := rows.Row(&obj); err != nil {
+			return nil, err
+		}
+		audits = append(audits, &obj)
+	}
+	defer rows.Close()
+	return audits, rows.Err()
+}
+
+func validateMemberRole(role string, spendLimit int64) error {
+	switch role {
+	case WALLET_ROLE_OWNER, WALLET_ROLE_VIEWER:
+		return nil
+	case WALLET_ROLE_SPENDER:
+		if spendLimit <= 0 {
+			return ERR_SPEND_LIMIT_REQUIRED
+		}
+		return nil
+	}
+	return ERR_INVALID_WALLET_ROLE
+}
+
+func countOwners(members []models.WalletMember) int {
+	owners := 0
+	for _, member := range members {
+		if member.Role == WALLET_ROLE_OWNER && member.Status == WALLET_MEMBER_ACTIVE {
+			owners++
+		}
+	}
+	return owners
+}
+
 func (service *WalletService) Filter(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, limit int) ([]*models.Wallet, error) {
 	fName := "service/wallet/filter"
 	tracer := otel.Tracer("walletFilter")
@@ -199,6 +701,44 @@ func (service *WalletService) CustomFilterQuery(ctx context.Context, selector st
 	return parseWalletRows(rows), nil
 }
 
+// Export runs the filter and hands the wallets to each one by one as they are
+// read from the query, so that no result set is held in memory
+func (service *WalletService) Export(ctx context.Context, queryString string, params map[string]interface{}, sortBy string, each func(*models.Wallet) error) error {
+	fName := "service/wallet/export"
+	tracer := otel.Tracer("api")
+	_, span := tracer.Start(ctx, fName)
+	defer span.End()
+
+	query := "select data.* from `testbucket` data where type='wallet' "
+	query += queryString
+	query += " order by " + sortBy
+
+	span.SetAttributes(attribute.String("query", query))
+	rows, err := service.cluster.Query(
+		query,
+		&gocb.QueryOptions{NamedParameters: params, Context: ctx})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var obj models.Wallet
+		if err := rows.Row(&obj); err != nil {
+			return err
+		}
+		if obj.UUID != "" {
+			obj.IsCommitedOnBlockchain = true
+		}
+		obj.UUID = ""
+		obj.Ref = ""
+		if err := each(&obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
 func parseWalletRows(rows *gocb.QueryResult) []*models.Wallet {
 	var wallets []*models.Wallet
 	for rows.Next() {
@@ -0,0 +1,248 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_NDJSON = "ndjson"
+	FORMAT_CSV    = "csv"
+
+	// rows written between two flushes of the response
+	flushEvery = 500
+)
+
+var (
+	ERR_INVALID_EXPORT_FORMAT = errors.New("error: export format must be ndjson or csv")
+	ERR_INVALID_EXPORT_COLUMN = errors.New("error: unknown export column")
+)
+
+// Record is an exported row, the value of each column by name
+type Record map[string]interface{}
+
+// Writer streams records to the response as NDJSON or CSV with a fixed set of
+// columns. Nothing is written until the first record so that an error before it
+// can still be answered with an error response.
+type Writer struct {
+	response http.ResponseWriter
+	format   string
+	columns  []string
+	fileName string
+	compress bool
+
+	started bool
+	out     io.Writer
+	gzip    *gzip.Writer
+	csv     *csv.Writer
+	rows    int64
+}
+
+// Columns picks the requested comma separated columns out of the ones available,
+// all of them are exported when none are requested
+func Columns(requested string, available []string) ([]string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return available, nil
+	}
+
+	known := map[string]bool{}
+	for _, column := range available {
+		known[column] = true
+	}
+
+	columns := []string{}
+	for _, column := range strings.Split(requested, ",") {
+		column = strings.TrimSpace(column)
+		if !known[column] {
+			return nil, fmt.Errorf("%w: %s", ERR_INVALID_EXPORT_COLUMN, column)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func NewWriter(response http.ResponseWriter, format string, columns []string, fileName string, compress bool) (*Writer, error) {
+	if format == "" {
+		format = FORMAT_NDJSON
+	}
+	if format != FORMAT_NDJSON && format != FORMAT_CSV {
+		return nil, ERR_INVALID_EXPORT_FORMAT
+	}
+	return &Writer{response: response, format: format, columns: columns, fileName: fileName, compress: compress}, nil
+}
+
+// Started tells if the response has been started, errors after that can only
+// be reported by closing the stream early
+func (writer *Writer) Started() bool {
+	return writer.started
+}
+
+// Rows is the number of records written so far
+func (writer *Writer) Rows() int64 {
+	return writer.rows
+}
+
+func (writer *Writer) start() error {
+	writer.started = true
+
+	contentType := "application/x-ndjson"
+	if writer.format == FORMAT_CSV {
+		contentType = "text/csv"
+	}
+	header := writer.response.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", writer.fileName+"."+writer.format))
+	header.Set("Trailer", "X-Export-Rows, X-Export-Error")
+	writer.out = writer.response
+	if writer.compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		writer.gzip = gzip.NewWriter(writer.response)
+		writer.out = writer.gzip
+	}
+	writer.response.WriteHeader(http.StatusOK)
+
+	if writer.format == FORMAT_CSV {
+		writer.csv = csv.NewWriter(writer.out)
+		return writer.csv.Write(writer.columns)
+	}
+	return nil
+}
+
+// Write adds a record, the response is flushed every few hundred records so that
+// memory stays flat whatever the size of the export
+func (writer *Writer) Write(record Record) error {
+	if !writer.started {
+		if err := writer.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if writer.format == FORMAT_CSV {
+		err = writer.writeCSV(record)
+	} else {
+		err = writer.writeJSON(record)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer.rows++
+	if writer.rows%flushEvery == 0 {
+		return writer.flush()
+	}
+	return nil
+}
+
+// Close ends the stream, the error of a failed export is sent as a trailer
+func (writer *Writer) Close(exportErr error) error {
+	if !writer.started {
+		if err := writer.start(); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.flush(); err != nil {
+		return err
+	}
+	if writer.gzip != nil {
+		if err := writer.gzip.Close(); err != nil {
+			return err
+		}
+	}
+
+	header := writer.response.Header()
+	header.Set("X-Export-Rows", strconv.FormatInt(writer.rows, 10))
+	if exportErr != nil {
+		header.Set("X-Export-Error", exportErr.Error())
+	}
+	return nil
+}
+
+func (writer *Writer) flush() error {
+	if writer.csv != nil {
+		writer.csv.Flush()
+		if err := writer.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if writer.gzip != nil {
+		if err := writer.gzip.Flush(); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := writer.response.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// writeJSON writes the record as a JSON object with the keys in column order
+func (writer *Writer) writeJSON(record Record) error {
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, column := range writer.columns {
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		key, _ := json.Marshal(column)
+		value, err := json.Marshal(record[column])
+		if err != nil {
+			return err
+		}
+		line.Write(key)
+		line.WriteByte(':')
+		line.Write(value)
+	}
+	line.WriteString("}\n")
+
+	_, err := writer.out.Write(line.Bytes())
+	return err
+}
+
+func (writer *Writer) writeCSV(record Record) error {
+	values := make([]string, len(writer.columns))
+	for i, column := range writer.columns {
+		values[i] = csvValue(record[column])
+	}
+	return writer.csv.Write(values)
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339Nano)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case []string:
+		return strings.Join(v, ";")
+	case json.RawMessage:
+		return string(v)
+	default:
+		// nested values are kept as JSON
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+}
@@ -0,0 +1,101 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// page layout of an A4 page in points, the text is set in Courier so that
+// columns line up
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	margin       = 40
+	fontSize     = 9
+	lineHeight   = 12
+	linesPerPage = (pageHeight - 2*margin) / lineHeight
+)
+
+// Document is a plain text document rendered as a PDF, one line of text per
+// line of the page. It writes no creation date so the same lines always give
+// the same file.
+type Document struct {
+	lines []string
+}
+
+func New() *Document {
+	return &Document{}
+}
+
+// Line adds a line of text, characters outside of printable ASCII are replaced
+func (document *Document) Line(format string, args ...interface{}) {
+	document.lines = append(document.lines, fmt.Sprintf(format, args...))
+}
+
+// Bytes renders the document
+func (document *Document) Bytes() []byte {
+	pages := [][]string{}
+	for start := 0; start < len(document.lines) || start == 0; start += linesPerPage {
+		end := start + linesPerPage
+		if end > len(document.lines) {
+			end = len(document.lines)
+		}
+		pages = append(pages, document.lines[start:end])
+	}
+
+	// objects: 1 catalog, 2 pages, 3 font, then a page and its content per page
+	objects := []string{"", "", "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>"}
+	kids := []string{}
+	for _, lines := range pages {
+		pageId := len(objects) + 1
+		contentId := pageId + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageId))
+
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", fontSize, lineHeight, margin, pageHeight-margin)
+		for _, line := range lines {
+			fmt.Fprintf(&content, "(%s) '\n", escape(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, contentId),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// escape makes the text safe for a PDF string literal
+func escape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
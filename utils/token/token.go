@@ -1,6 +1,8 @@
 package token
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -12,6 +14,12 @@ import (
 	"go.opencensus.io/trace"
 )
 
+const (
+	SESSION_USERNAME        = "sessionUsername"
+	SESSION_ROLE            = "sessionRole"
+	SESSION_USER_IDENTIFIER = "sessionUserIdentifier"
+)
+
 func GenerateToken(email string, role string, name string, userIdentifier string) (string, error) {
 	token_expiry, err := strconv.Atoi(os.Getenv("JWT_TOKEN_VALIDITY"))
 
@@ -34,6 +42,55 @@ func GenerateToken(email string, role string, name string, userIdentifier string
 
 }
 
+// audience of the quote tokens, they can not be used as session tokens
+const quoteAudience = "quote"
+
+var (
+	ERR_QUOTE_TOKEN_INVALID = errors.New("error: invalid quote token")
+	ERR_QUOTE_TOKEN_EXPIRED = errors.New("error: quote token has expired")
+)
+
+// GenerateQuoteToken signs the quote for the user until the expiry
+func GenerateQuoteToken(username string, quote interface{}, expiresAt time.Time) (string, error) {
+	claims := jwt.MapClaims{}
+	claims["sub"] = username
+	claims["aud"] = quoteAudience
+	claims["quote"] = quote
+	claims["exp"] = expiresAt.Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+}
+
+// ParseQuoteToken checks the quote token was issued to the user and has not
+// expired, and reads the quote it carries
+func ParseQuoteToken(tokenString string, username string, quote interface{}) error {
+	parser := jwt.Parser{UseJSONNumber: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv("JWT_SECRET_KEY")), nil
+	})
+	if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+		return ERR_QUOTE_TOKEN_EXPIRED
+	}
+	if err != nil || !token.Valid {
+		return ERR_QUOTE_TOKEN_INVALID
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["aud"] != quoteAudience || claims["sub"] != username {
+		return ERR_QUOTE_TOKEN_INVALID
+	}
+
+	encoded, err := json.Marshal(claims["quote"])
+	if err != nil {
+		return ERR_QUOTE_TOKEN_INVALID
+	}
+	return json.Unmarshal(encoded, quote)
+}
+
 func TokenValid(c *gin.Context) error {
 	_, sp := trace.StartSpan(c, "api/v4/userSession")
 	defer sp.End()
@@ -50,9 +107,14 @@ func TokenValid(c *gin.Context) error {
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
+	// a quote token is signed with the same key but opens no session
+	if ok && claims["aud"] == quoteAudience {
+		return ERR_QUOTE_TOKEN_INVALID
+	}
 	if ok && token.Valid {
 		username := fmt.Sprintf("%s", claims["sub"])
 		role := fmt.Sprintf("%s", claims["aud"])
+		userIdentifier := fmt.Sprintf("%s", claims["userIdentifier"])
 
 		sp.AddAttributes(
 			trace.StringAttribute("token.username", username),
@@ -64,6 +126,11 @@ func TokenValid(c *gin.Context) error {
 		// TODO: need to make channel dynamic from the token
 		c.Header("X-API-CHANNEL", "loyyalchannel")
 
+		// keeping the session on the context for the handlers down the chain
+		c.Set(SESSION_USERNAME, username)
+		c.Set(SESSION_ROLE, role)
+		c.Set(SESSION_USER_IDENTIFIER, userIdentifier)
+
 		return nil
 	}
 	return nil